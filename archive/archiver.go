@@ -1,21 +1,735 @@
 package archive
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Archiver writes archives of files, directories and content. It writes one
+// archive at a time: a call made while another is still writing fails, so an
+// Archiver can't be shared by goroutines, other than to call the Add methods
+// on the archive started by Open.
 type Archiver interface {
 	ArchiveContent(content []byte, infilename string) error
+	ArchiveReader(r io.Reader, infilename string) error
+	ArchiveContentMode(content []byte, infilename string, mode os.FileMode) error
 	ArchiveFile(infilename string) error
+	ArchiveFileAs(infilename, archivePath string) error
+	ArchiveFileFrom(infilename, root string) error
+	ArchiveFiles(files []string, base string) error
 	ArchiveDir(indirname string) error
+	ArchiveDirWithOptions(indirname string, opts ArchiveDirOptions) error
+	ArchiveDirContext(ctx context.Context, indirname string, opts ArchiveDirOptions) error
+	ArchiveDirsContext(ctx context.Context, sources []ArchiveDirSource, opts ArchiveDirOptions) error
 	ArchiveMultiple(content map[string][]byte) error
+	ArchiveMultipleOrdered(content []ContentEntry) error
+	ArchiveExistingZip(path, prefix string) error
+	Open() error
+	AddContent(content []byte, infilename string) error
+	AddFile(infilename, archivePath string) error
+	AddDir(ctx context.Context, indirname string, opts ArchiveDirOptions) error
+	Close() error
+	SetOptions(opts ArchiveOptions)
+	Entries() []ArchiveEntry
+	Skipped() []SkippedFile
+}
+
+// ArchiveOptions controls how an Archiver writes entries. The zero value
+// preserves the default behavior. Options for zip entries are ignored when
+// writing other formats.
+type ArchiveOptions struct {
+	// NormalizeTimestamps stores normalizedModTime as the modification
+	// time of every entry instead of the source file's time, so that
+	// identical inputs produce identical archives.
+	NormalizeTimestamps bool
+
+	// ModTime, when set, is stored as the modification time of every entry
+	// found on disk instead of the source file's time, such as the time of
+	// a build. It can't be used with NormalizeTimestamps, and must be
+	// representable in a zip header, from 1980 to 2107.
+	ModTime time.Time
+
+	// DirMode is the permission bits stored for the directory entries
+	// written while walking a directory, which extraction tools create
+	// the directories with, such as 0775 for a group writable cache
+	// directory. The default, when zero, is defaultDirMode, whatever the
+	// modes of the directories on disk. Directories copied from
+	// BaseArchive keep their modes.
+	DirMode os.FileMode
+
+	// FileMode, when set, is the permission bits stored for every file
+	// entry instead of the mode of its source, such as 0644, so that
+	// archives don't depend on the umask of whoever checked the files out.
+	// It replaces executable bits too. Files given their mode, by
+	// ArchiveContentMode, symlinks, and entries copied from BaseArchive
+	// keep their modes. Gzip files store no mode.
+	FileMode os.FileMode
+
+	// FileModes maps the names files are stored under, after Prefix, such
+	// as "bin/handler", to the permission bits stored for them instead of
+	// their own mode or FileMode, such as to keep the executable bits of
+	// an archive built on Windows, whose file systems have none. Files not
+	// in the map keep their mode, or FileMode when it is set. It applies to
+	// the same entries as FileMode.
+	FileModes map[string]os.FileMode
+
+	// Transforms replaces the content of files with the given extensions,
+	// such as ".json" or "js", matched regardless of case like
+	// StoreExtensions, with what their FileTransformer returns for it
+	// before they are stored, such as minified scripts. Files with other
+	// extensions are stored as they are. A transformed file is read into
+	// memory, and its entry records the size and checksums of the content
+	// returned. Entries copied from BaseArchive or by ArchiveExistingZip
+	// aren't transformed. Two extensions that differ only in case are an
+	// error. Files compressed in parallel, by ArchiveDirOptions.Parallelism,
+	// are transformed concurrently, so the FileTransformers must be safe
+	// for concurrent use.
+	Transforms map[string]FileTransformer
+
+	// CompressionLevel is the level, from 1 (fastest) to 9 (smallest), used
+	// to compress entries. Zero selects DefaultCompression.
+	CompressionLevel int
+
+	// Compression is the method zip entries are compressed with:
+	// CompressionDeflate (the default when empty) or CompressionZstd.
+	Compression string
+
+	// StoreExtensions lists file extensions, such as ".png" or "gz", whose
+	// zip entries are stored without compression, as compressing files
+	// that are already compressed wastes time and can make them bigger.
+	// They are matched regardless of case. CompressedExtensions lists
+	// common ones.
+	StoreExtensions []string
+
+	// ExtensionCompression compresses the zip entries of files with the
+	// given extensions, such as ".js" or "json", matched regardless of case
+	// like StoreExtensions, with a method and level of their own, such as
+	// storing images while deflating scripts at level 9. It wins over
+	// StoreExtensions, and files with other extensions use Compression and
+	// CompressionLevel.
+	ExtensionCompression map[string]EntryCompression
+
+	// MinCompressSize, when set, stores the zip entries of files smaller
+	// than this many bytes without compression, as compressing tiny files
+	// saves little and can make them bigger. Other files use Compression,
+	// files matching ExtensionCompression or StoreExtensions follow those,
+	// and entries read from an io.Reader, whose size isn't known up front,
+	// are always compressed.
+	MinCompressSize int64
+
+	// ZipCreator, when set, is stored as the "version made by" of every zip
+	// entry, such as ZipCreatorInfoZipUnix, with headers written as zip
+	// writes them, for validators that compare archives with one made by
+	// another tool. With NoCompression and ModTime it matches zip -X.
+	ZipCreator uint16
+
+	// UTF8Names sets the UTF-8 flag of every zip entry whose name and
+	// comment are valid UTF-8, not only of those with non-ASCII names, for
+	// extractors that otherwise read names in the local code page.
+	UTF8Names bool
+
+	// ZipDataDescriptors writes every zip file entry with a data descriptor
+	// after its content, for streaming extractors that expect one. Those
+	// can't find the end of a stored entry without its sizes, so entries
+	// are then best compressed.
+	ZipDataDescriptors bool
+
+	// Comment is stored as the archive comment of zip files and in the
+	// gzip header of tar.gz files. Other tar files have nowhere to store
+	// it. Nothing is stored when it is empty.
+	Comment string
+
+	// Prefix, when set, is a directory every entry is stored under, such as
+	// "python" for an AWS Lambda layer. Entries copied from BaseArchive
+	// keep their names.
+	Prefix string
+
+	// BaseArchive is the path of an existing archive, of the same type,
+	// whose entries are copied into the archive before any others. It may
+	// be the archive being written, to append to it. Adding an entry with
+	// the same name as one from the base archive is an error, unless
+	// Duplicates is DuplicatesOverwrite.
+	BaseArchive string
+
+	// Duplicates selects what happens when a file is added with the same
+	// name as an entry already in the archive: DuplicatesError (the default
+	// when empty) or DuplicatesOverwrite. The same directory found in
+	// several sources is only ever stored once.
+	Duplicates string
+
+	// CaseInsensitiveCheck selects what happens when a file is added whose
+	// name differs only in case from an entry already in the archive, as
+	// extracting both to a case insensitive file system, such as those of
+	// Windows and macOS, overwrites one with the other: CaseCheckNone (the
+	// default when empty), CaseCheckWarn or CaseCheckError.
+	CaseInsensitiveCheck string
+
+	// MaxSize, when positive, is the most uncompressed bytes the entries of
+	// the archive may add up to. Archiving stops with an error naming the
+	// entry that crossed the limit.
+	MaxSize int64
+
+	// MaxFiles, when positive, is the most files, counting symlinks but not
+	// directories, the archive may hold, for deployment targets that limit
+	// the number of files. Archiving stops with an error naming the limit
+	// and the file that crossed it.
+	MaxFiles int
+
+	// MaxNameLength, when positive, is the most bytes the name of an entry
+	// may have, and MaxNameComponentLength the most bytes each of the
+	// slash separated directory and file names in it may have, such as 255
+	// for the file names of most file systems. Extraction tools on targets
+	// with such limits can fail on entries the archive formats allow, such
+	// as those deep inside a node_modules directory, so archiving stops
+	// with an error naming the entry instead. The trailing slash of
+	// directory entries isn't counted. Entries copied from BaseArchive or
+	// by ArchiveExistingZip are checked too.
+	MaxNameLength          int
+	MaxNameComponentLength int
+
+	// CreateOutputDir creates the directory the archive is written to, and
+	// any missing parents, if it doesn't exist yet. Otherwise a missing
+	// output directory is an error.
+	CreateOutputDir bool
+
+	// Owner, when set, is stored as the owner of every new tar entry
+	// instead of the source file's, such as 0:0 for root owned layers. The
+	// owner's user and group names are left out. Zip archives don't store
+	// owners.
+	Owner *FileOwner
+
+	// SortEntries writes every entry of the archive in the byte order of
+	// the names it is stored under, wherever it came from: a base archive,
+	// a directory, content, or any of the calls made while the archive is
+	// open. The same entries then give the same archive however, and in
+	// whatever order, they are added. Entries are written as they are
+	// added, so an archive whose entries are out of order is rewritten, in
+	// order, once it is finished, which can't be done to one written to
+	// Output.
+	SortEntries bool
+
+	// Order, when set, lists the names of entries to write first, in the
+	// order given, for consumers that give meaning to the position of an
+	// entry, such as the init order of a boot archive. The entries it
+	// doesn't list follow in the byte order of their names, as SortEntries
+	// writes them, which it implies. Directory names may leave out the
+	// trailing slash. Listing a name that isn't in the archive is an
+	// error.
+	Order []string
+
+	// Verify reads the archive back once it is written, checking that every
+	// entry decompresses, to the CRC-32 stored for it where the format has
+	// one, and is the content that was written, which catches corruption
+	// on disk and errors lost while writing. Archives written to Output
+	// aren't verified.
+	Verify bool
+
+	// Output, when set, receives the archive instead of the file at the
+	// archiver's path, which is then neither created nor changed. Writing
+	// to a hash, for example, gives the checksum the archive would have
+	// without writing it. Duplicates can't be DuplicatesOverwrite, nor can
+	// SortEntries reorder the entries, as both reread the finished archive.
+	Output io.Writer
+
+	// Tee, when set, receives a copy of everything written to the archive's
+	// file, such as a hash that checksums the archive as it is written
+	// instead of reading it back. When the archive is rewritten, for
+	// SortEntries or DuplicatesOverwrite, Tee receives the rewritten
+	// archive instead, after being reset if it has a Reset method, as
+	// hashes do; otherwise it receives both. Archives written to Output
+	// aren't copied.
+	Tee io.Writer
+
+	// Progress, when set, is called as each file found while walking
+	// directories is added to the archive, with the number of files added so
+	// far, the number there are to add, and the name the file is stored
+	// under. The total comes from counting the files before they are
+	// archived, so it is an estimate when the directories change while
+	// they are walked, and files that turn out to be duplicates or
+	// unreadable aren't added. Directory entries aren't counted.
+	Progress func(filesDone, filesTotal int, currentPath string)
+}
+
+// FileTransformer returns the content to store for the file called name, the
+// slash separated name it is stored under, in place of content, for
+// ArchiveOptions.Transforms. It should return the same content for the same
+// input, or identical inputs no longer give identical archives, and it must
+// not keep or modify content.
+type FileTransformer func(name string, content []byte) ([]byte, error)
+
+// SubstituteTransformer returns a FileTransformer that replaces every
+// ${NAME} placeholder in a file with the value of NAME in vars, for config
+// files templated as they are archived. Placeholders for names that aren't in
+// vars are left as they are, and substituted values aren't searched for
+// placeholders again, so the content only depends on the file and vars.
+func SubstituteTransformer(vars map[string]string) FileTransformer {
+	// The names are sorted so that a placeholder that starts with another,
+	// such as ${A}B} with ${A}, is always replaced the same way.
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	oldnew := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		oldnew = append(oldnew, "${"+name+"}", vars[name])
+	}
+	replacer := strings.NewReplacer(oldnew...)
+	return func(name string, content []byte) ([]byte, error) {
+		return []byte(replacer.Replace(string(content))), nil
+	}
+}
+
+// EntryCompression is how the zip entries of files with an extension of
+// ArchiveOptions.ExtensionCompression are compressed.
+type EntryCompression struct {
+	// Method is CompressionDeflate or CompressionZstd, or, when empty, the
+	// archive's Compression.
+	Method string
+
+	// Level is the compression level, from 1 to 9, zero for
+	// DefaultCompression, or NoCompression to store the entries.
+	Level int
+}
+
+// ZipCreatorInfoZipUnix is the "version made by" of zip entries written by
+// Info-ZIP's zip 3.0 on Unix, for ArchiveOptions.ZipCreator.
+const ZipCreatorInfoZipUnix uint16 = 3<<8 | 30
+
+// FileOwner is the numeric user and group ID a tar entry is owned by.
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// CompressedExtensions are the extensions of common file formats that are
+// already compressed, for ArchiveOptions.StoreExtensions.
+var CompressedExtensions = []string{
+	".7z", ".br", ".bz2", ".gif", ".gz", ".jar", ".jpeg", ".jpg", ".mp3",
+	".mp4", ".png", ".webm", ".webp", ".whl", ".xz", ".zip", ".zst",
+}
+
+// Duplicate name policies for ArchiveOptions.
+const (
+	// DuplicatesError fails the archive, naming the duplicate.
+	DuplicatesError = "error"
+
+	// DuplicatesOverwrite keeps only the file added last under a name.
+	// Archives are written as entries are added, so once they are
+	// finished they are rewritten without the files that were replaced.
+	// Replaced files still count towards MaxSize and MaxFiles.
+	DuplicatesOverwrite = "overwrite"
+)
+
+// Case insensitive name checks for ArchiveOptions.
+const (
+	// CaseCheckNone allows names that differ only in case.
+	CaseCheckNone = "none"
+
+	// CaseCheckWarn logs a warning naming both entries.
+	CaseCheckWarn = "warn"
+
+	// CaseCheckError fails the archive, naming both entries.
+	CaseCheckError = "error"
+)
+
+// Compression levels with special meaning for ArchiveOptions.
+const (
+	// DefaultCompression compresses entries at the standard flate level.
+	DefaultCompression = 0
+
+	// NoCompression stores entries without compressing them.
+	NoCompression = -1
+)
+
+// Compression methods for ArchiveOptions.
+const (
+	// CompressionDeflate compresses zip entries with deflate, which every
+	// zip tool can read.
+	CompressionDeflate = "deflate"
+
+	// CompressionZstd compresses zip entries with Zstandard, zip method 93.
+	// Many zip tools can't extract these entries.
+	CompressionZstd = "zstd"
+)
+
+// ArchiveDirOptions controls which files ArchiveDirWithOptions picks up
+// while walking a directory.
+type ArchiveDirOptions struct {
+	// Excludes lists patterns, matched against each path relative to the
+	// directory being archived, of files and directories to leave out.
+	// Patterns use path.Match syntax for each path segment, and a "**"
+	// segment matches any number of segments.
+	Excludes []string
+
+	// ExcludeRegexes lists regular expressions, in RE2 syntax, matched
+	// against each path relative to the directory being archived, with
+	// slashes as separators, of files and directories to leave out, for
+	// filters globs can't express, such as `\.(test|spec)\.js$`. Directory
+	// paths end with a slash, so `(^|/)vendor/$` only matches directories.
+	// The expressions match anywhere in the path unless anchored. They are
+	// checked after Excludes and, like them, win over Includes.
+	ExcludeRegexes []string
+
+	// excludeRegexps holds ExcludeRegexes compiled by prepareDirOptions.
+	excludeRegexps []*regexp.Regexp
+
+	// Includes, when set, limits the archive to the files whose path
+	// relative to the directory matches at least one of these patterns,
+	// using the same syntax as Excludes. Excludes win over includes.
+	// Directories are not matched against includes: they are still walked
+	// unless excluded, and their entries still follow DirEntries.
+	Includes []string
+
+	// DenyPatterns lists patterns, using the same syntax as Excludes, of
+	// files and directories that must never be archived, such as "*.pem"
+	// or "**/.aws/credentials". Finding one that would be archived fails
+	// the archive with an error naming it, rather than leaving it out as
+	// Excludes do, so that a credential in the wrong place breaks the build
+	// instead of shipping. A pattern without a slash, such as "id_rsa",
+	// matches the base name at any depth. Entries left out by Excludes,
+	// IgnoreFile or the other options don't fail the archive.
+	DenyPatterns []string
+
+	// IgnoreFile, when set, is the name of ignore files, such as
+	// ".gitignore", whose rules leave files and directories out like
+	// Excludes. The file is read from the directory being archived and
+	// from each of its subdirectories, and uses the .gitignore syntax:
+	// comments, negation with "!", directory only patterns ending with a
+	// slash, and patterns containing a slash anchored to the directory of
+	// the ignore file.
+	IgnoreFile string
+
+	// SkipHidden leaves out the files and directories whose names start
+	// with a dot, such as .git and .DS_Store, without walking hidden
+	// directories. Include patterns win: a hidden file is kept when an
+	// include pattern names it with a segment starting with a dot, such as
+	// ".env" or "**/.htaccess", and a hidden directory is walked when such
+	// a pattern, like ".well-known/**", could match inside it. Excludes and
+	// IgnoreFile still leave entries out.
+	SkipHidden bool
+
+	// Symlinks selects how symbolic links found in the directory are
+	// archived: SymlinkFollow (the default when empty), SymlinkStore or
+	// SymlinkSkip.
+	Symlinks string
+
+	// FollowDirSymlinks walks into the directories that symlinks point to,
+	// archiving their contents under the link's path, instead of failing
+	// on them. It requires the SymlinkFollow policy. A symlink to a
+	// directory that contains the link, which would be walked forever, is
+	// an error.
+	FollowDirSymlinks bool
+
+	// ExcludeSymlinkDirs leaves out the symlinks that point to
+	// directories, without walking them, such as a vendor directory linked
+	// to a large shared cache, whatever the Symlinks policy does with links
+	// to files. It can't be used with FollowDirSymlinks.
+	ExcludeSymlinkDirs bool
+
+	// SortEntries reads the whole directory before archiving it, then
+	// writes the entries in the byte order of their names, as
+	// ArchiveMultiple does, rather than in the order the directory is
+	// walked. The order then only depends on the names of the files, so the
+	// same files give the same archive on every platform.
+	SortEntries bool
+
+	// RequireFiles fails the archive when no files are found in the
+	// directory, which would otherwise give an archive with no files in
+	// it. Directory entries don't count as files.
+	RequireFiles bool
+
+	// DirEntries selects which directories get an explicit entry in the
+	// archive: DirEntriesNone (the default when empty), DirEntriesEmpty or
+	// DirEntriesAll. Directories are otherwise only implied by the paths of
+	// the files inside them.
+	DirEntries string
+
+	// Parallelism is how many files of a zip archive are read and
+	// compressed at once, with zero or one compressing a file at a time.
+	// Files are still written in the order they are found, so the archive is
+	// the same on every run, though not byte for byte the same as one
+	// compressed a file at a time.
+	Parallelism int
+
+	// SpecialFiles selects what happens to files that are neither regular
+	// files, directories nor symlinks, such as named pipes, sockets and
+	// devices: SpecialFilesError (the default when empty) or
+	// SpecialFilesSkip. Reading them could block forever or never end.
+	SpecialFiles string
+
+	// SkipMissing skips files that are removed between being found and
+	// being read, logging a warning for each, instead of failing the
+	// archive. The archive then depends on when it was written.
+	SkipMissing bool
+
+	// ContinueOnError skips files that can't be read, such as for lacking
+	// permission, logging a warning for each and recording its error in
+	// Skipped, instead of failing the archive. Errors reading a file after
+	// its entry has been started still fail the archive, as the entry
+	// can't be taken back.
+	ContinueOnError bool
+
+	// MaxFileSize, when set, leaves out the files larger than this many
+	// bytes, logging a warning for each, such as stray test fixtures that
+	// were committed by mistake. Unlike ArchiveOptions.MaxSize, which fails
+	// the archive, it only prunes the files it finds.
+	MaxFileSize int64
+
+	// Flatten stores every file at the root of the archive, or of the
+	// source's Prefix, under its base name, without the directories
+	// between, such as for a flat Lambda package built from a nested
+	// directory. No directory entries are written. Files with the same
+	// name in different directories then collide, which follows
+	// ArchiveOptions.Duplicates: an error naming the file by default, or
+	// keeping the file found last with DuplicatesOverwrite.
+	Flatten bool
+
+	// StripComponents drops this many leading directories from the path of
+	// each entry, relative to the directory being walked, before it is
+	// stored, as tar's --strip-components does. With one, a/b/c.txt is
+	// stored as b/c.txt. Directories with no path left get no entry, and a
+	// file with no name left is an error. It can't be used with Flatten.
+	StripComponents int
+
+	// IncludeSourceDir stores the entries of each directory walked under
+	// its base name, after the source's Prefix, so that archiving dist
+	// stores dist/index.html rather than index.html. Like a Prefix, the
+	// directory itself gets no entry. StripComponents and Flatten apply to
+	// the path relative to the directory as before.
+	IncludeSourceDir bool
+}
+
+// Special file policies for ArchiveDirOptions.
+const (
+	// SpecialFilesError fails the archive when a special file is found.
+	SpecialFilesError = "error"
+
+	// SpecialFilesSkip leaves special files out of the archive, logging a
+	// warning for each.
+	SpecialFilesSkip = "skip"
+)
+
+// ArchiveEntry describes an entry written to an archive, as returned by
+// Entries after archiving.
+type ArchiveEntry struct {
+	// Name is the name the entry is stored under. Directory names end
+	// with a slash.
+	Name string
+
+	// Size is the uncompressed size of the entry's content in bytes.
+	Size int64
+
+	// Mode is the mode stored for the entry.
+	Mode os.FileMode
+
+	// Modified is the modification time stored for the entry, in UTC.
+	Modified time.Time
+
+	// CRC32 is the IEEE CRC-32 checksum of the entry's content, which zip
+	// files also store for each entry.
+	CRC32 uint32
+
+	// MD5 is the MD5 checksum of the entry's content. It is nil for
+	// directories.
+	MD5 []byte
+
+	// SHA256 is the SHA-256 checksum of the entry's content. It is nil for
+	// directories.
+	SHA256 []byte
+}
+
+// SkippedFile is a file or directory found while walking a directory that
+// was left out of the archive, as returned by Skipped.
+type SkippedFile struct {
+	// Name is the name the entry would have been stored under. Directory
+	// names end with a slash. The contents of a skipped directory aren't
+	// walked, so they aren't listed.
+	Name string
+
+	// Reason is why the entry was left out, one of the Skipped reasons.
+	Reason string
+
+	// Pattern is the exclude pattern or regular expression that matched
+	// the entry, for SkippedExcluded, ArchiveDirOptions.Excludes and then
+	// ExcludeRegexes being checked in order. It is empty for other reasons.
+	Pattern string
+
+	// Err is the error reading the entry, for SkippedUnreadable. It is nil
+	// for other reasons.
+	Err error
+}
+
+// Reasons for leaving out a SkippedFile.
+const (
+	// SkippedExcluded is for entries matching ArchiveDirOptions.Excludes.
+	SkippedExcluded = "excluded"
+
+	// SkippedIgnored is for entries ignored by an ArchiveDirOptions.IgnoreFile.
+	SkippedIgnored = "ignored"
+
+	// SkippedHidden is for hidden entries left out by SkipHidden.
+	SkippedHidden = "hidden"
+
+	// SkippedNotIncluded is for files matching none of the
+	// ArchiveDirOptions.Includes.
+	SkippedNotIncluded = "not included"
+
+	// SkippedSymlink is for symlinks left out by SymlinkSkip.
+	SkippedSymlink = "symlink"
+
+	// SkippedSymlinkDir is for symlinks to directories left out by
+	// ExcludeSymlinkDirs.
+	SkippedSymlinkDir = "symlinked directory"
+
+	// SkippedSpecialFile is for special files left out by SpecialFilesSkip.
+	SkippedSpecialFile = "special file"
+
+	// SkippedTooLarge is for files larger than MaxFileSize.
+	SkippedTooLarge = "too large"
+
+	// SkippedMissing is for files removed while archiving, left out by
+	// SkipMissing.
+	SkippedMissing = "missing"
+
+	// SkippedUnreadable is for files that couldn't be read, left out by
+	// ContinueOnError.
+	SkippedUnreadable = "unreadable"
+)
+
+// ContentEntry is a file given by its content, for ArchiveMultipleOrdered.
+type ContentEntry struct {
+	// Name is the path the content is stored under.
+	Name string
+
+	// Content is the content of the file.
+	Content []byte
+}
+
+// ArchiveDirSource is one of the directories merged into an archive by
+// ArchiveDirsContext.
+type ArchiveDirSource struct {
+	// Path is the directory to walk.
+	Path string
+
+	// Prefix, when set, is prepended to the name of every entry found in
+	// Path so that several directories can be kept apart in one archive.
+	Prefix string
+}
+
+// Symlink policies for ArchiveDirOptions.
+const (
+	// SymlinkFollow archives the file a symlink points to in place of the
+	// link. Symlinks to directories are not followed and cause an error.
+	SymlinkFollow = "follow"
+
+	// SymlinkStore archives the link itself, with the link target as its
+	// content. Zip entries keep the mode of the link, including
+	// os.ModeSymlink, as zip --symlinks and ditto store links, so that
+	// extracting them gives links again, as macOS bundles need.
+	SymlinkStore = "store"
+
+	// SymlinkSkip leaves symlinks out of the archive.
+	SymlinkSkip = "skip"
+)
+
+// normalizedModTime is the earliest timestamp representable in a zip
+// header.
+var normalizedModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxModTime is the first timestamp after those representable in a zip
+// header.
+var maxModTime = time.Date(2108, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// defaultDirMode is the mode of directory entries when ArchiveOptions.DirMode
+// isn't set.
+const defaultDirMode os.FileMode = 0755
+
+// dirMode returns the permission bits to store for a directory entry.
+func (o ArchiveOptions) dirMode() os.FileMode {
+	if o.DirMode == 0 {
+		return defaultDirMode
+	}
+	return o.DirMode.Perm()
+}
+
+// fileMode returns the permission bits to store for the file entry called
+// name instead of its own, from FileModes or else FileMode, if any.
+func (o ArchiveOptions) fileMode(name string) (os.FileMode, bool) {
+	if mode, ok := o.FileModes[name]; ok {
+		return mode.Perm(), true
+	}
+	if o.FileMode != 0 {
+		return o.FileMode.Perm(), true
+	}
+	return 0, false
+}
+
+// teeOutput returns w, copying everything written to it to o.Tee when that is
+// set, which is reset first if it can be.
+func (o ArchiveOptions) teeOutput(w io.Writer) io.Writer {
+	if o.Tee == nil {
+		return w
+	}
+	if r, ok := o.Tee.(interface{ Reset() }); ok {
+		r.Reset()
+	}
+	return io.MultiWriter(w, o.Tee)
+}
+
+// entryModTime returns the modification time to store for an entry whose
+// source was modified at modTime.
+func (o ArchiveOptions) entryModTime(modTime time.Time) time.Time {
+	switch {
+	case !o.ModTime.IsZero():
+		return o.ModTime
+	case o.NormalizeTimestamps:
+		return normalizedModTime
+	}
+	return modTime
 }
 
 type ArchiverBuilder func(filepath string) Archiver
 
 var archiverBuilders = map[string]ArchiverBuilder{
-	"zip": NewZipArchiver,
+	"zip":     NewZipArchiver,
+	"tar":     NewTarArchiver,
+	"tar.gz":  NewTarGzArchiver,
+	"tar.bz2": NewTarBz2Archiver,
+	"tar.xz":  NewTarXzArchiver,
+	"gz":      NewGzipArchiver,
+}
+
+// absOutputPath returns path, the file an archiver writes to, made absolute
+// against the process working directory, so that a relative path always
+// names the same file and errors name it in full. path is returned as it is
+// when it is empty, as for getDiscardArchiver, or the working directory
+// can't be found.
+func absOutputPath(path string) string {
+	if path == "" {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
 }
 
 func getArchiver(archiveType string, filepath string) Archiver {
@@ -25,6 +739,1420 @@ func getArchiver(archiveType string, filepath string) Archiver {
 	return nil
 }
 
+// getDiscardArchiver returns an archiver of archiveType that only records
+// the entries it would write, for Entries, without compressing or writing
+// anything. It returns nil if the type isn't supported.
+func getDiscardArchiver(archiveType string) Archiver {
+	archiver := getArchiver(archiveType, "")
+	switch a := archiver.(type) {
+	case *ZipArchiver:
+		a.discard = true
+	case *TarArchiver:
+		a.discard = true
+	case *GzipArchiver:
+		a.discard = true
+	}
+	return archiver
+}
+
+// Directory entry policies for ArchiveDirOptions.
+const (
+	// DirEntriesNone writes no directory entries.
+	DirEntriesNone = "none"
+
+	// DirEntriesEmpty writes entries for directories that contain nothing,
+	// so they still exist once the archive is extracted.
+	DirEntriesEmpty = "empty"
+
+	// DirEntriesAll writes an entry for every directory.
+	DirEntriesAll = "all"
+)
+
+// prepareDirOptions checks opts, returning them with ExcludeRegexes compiled
+// for the walk.
+func prepareDirOptions(opts ArchiveDirOptions) (ArchiveDirOptions, error) {
+	if err := validateDirOptions(opts); err != nil {
+		return opts, err
+	}
+	opts.excludeRegexps = make([]*regexp.Regexp, len(opts.ExcludeRegexes))
+	for i, expr := range opts.ExcludeRegexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return opts, fmt.Errorf("error validating exclude regexes: %w", err)
+		}
+		opts.excludeRegexps[i] = re
+	}
+	return opts, nil
+}
+
+func validateDirOptions(opts ArchiveDirOptions) error {
+	if err := validatePatterns(opts.Excludes); err != nil {
+		return fmt.Errorf("error validating excludes: %w", err)
+	}
+	if err := validatePatterns(opts.Includes); err != nil {
+		return fmt.Errorf("error validating includes: %w", err)
+	}
+	if err := validatePatterns(opts.DenyPatterns); err != nil {
+		return fmt.Errorf("error validating deny patterns: %w", err)
+	}
+	switch opts.Symlinks {
+	case "", SymlinkFollow, SymlinkStore, SymlinkSkip:
+	default:
+		return fmt.Errorf("invalid symlink policy: %s", opts.Symlinks)
+	}
+	if opts.FollowDirSymlinks && opts.Symlinks != "" && opts.Symlinks != SymlinkFollow {
+		return fmt.Errorf("following directory symlinks requires the %q symlink policy, got %q", SymlinkFollow, opts.Symlinks)
+	}
+	if opts.FollowDirSymlinks && opts.ExcludeSymlinkDirs {
+		return fmt.Errorf("directory symlinks can't be both followed and excluded")
+	}
+	switch opts.DirEntries {
+	case "", DirEntriesNone, DirEntriesEmpty, DirEntriesAll:
+	default:
+		return fmt.Errorf("invalid directory entry policy: %s", opts.DirEntries)
+	}
+	switch opts.SpecialFiles {
+	case "", SpecialFilesError, SpecialFilesSkip:
+	default:
+		return fmt.Errorf("invalid special file policy: %s", opts.SpecialFiles)
+	}
+	if opts.Parallelism < 0 {
+		return fmt.Errorf("invalid parallelism: %d", opts.Parallelism)
+	}
+	if opts.StripComponents < 0 {
+		return fmt.Errorf("invalid number of components to strip: %d", opts.StripComponents)
+	}
+	if opts.Flatten && opts.StripComponents > 0 {
+		return fmt.Errorf("components can't be stripped from flattened entries")
+	}
+	return nil
+}
+
+// prepareDirSources checks that every source is a directory, appends its base
+// name to its prefix if opts.IncludeSourceDir is set, and sanitizes
+// its prefix, placing it under the archive wide prefix. The sources are
+// returned sorted by prefix and then path so that they are always walked in
+// the same order and hashes don't change.
+func prepareDirSources(sources []ArchiveDirSource, archivePrefix string, opts ArchiveDirOptions) ([]ArchiveDirSource, error) {
+	archivePrefix, err := sanitizePrefix(archivePrefix)
+	if err != nil {
+		return nil, err
+	}
+	prepared := make([]ArchiveDirSource, len(sources))
+	for i, src := range sources {
+		if _, err := assertValidDir(src.Path); err != nil {
+			return nil, err
+		}
+		prefix, err := sanitizePrefix(src.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		if opts.IncludeSourceDir {
+			abs, err := filepath.Abs(src.Path)
+			if err != nil {
+				return nil, fmt.Errorf("error resolving source directory %s: %w", src.Path, err)
+			}
+			dirname, err := sanitizePrefix(filepath.Base(abs))
+			if err != nil {
+				return nil, err
+			}
+			prefix = joinArchivePath(prefix, dirname)
+		}
+		prepared[i] = ArchiveDirSource{
+			Path:   src.Path,
+			Prefix: joinArchivePath(archivePrefix, prefix),
+		}
+	}
+	sort.SliceStable(prepared, func(i, j int) bool {
+		if prepared[i].Prefix != prepared[j].Prefix {
+			return prepared[i].Prefix < prepared[j].Prefix
+		}
+		return prepared[i].Path < prepared[j].Path
+	})
+	return prepared, nil
+}
+
+// checkOutputOutside errors if the archive at outputPath would be written
+// inside one of the source directories, where walking the directory could
+// archive a partial copy of the archive itself.
+func checkOutputOutside(sources []ArchiveDirSource, outputPath string) error {
+	output, err := resolveOutputPath(outputPath)
+	if err != nil {
+		return fmt.Errorf("error resolving output path: %w", err)
+	}
+	for _, src := range sources {
+		dir, err := resolvePath(src.Path)
+		if err != nil {
+			return fmt.Errorf("error resolving source directory: %w", err)
+		}
+		if isWithin(dir, output) {
+			return fmt.Errorf("output path %s is inside source directory %s, so the archive would include itself", outputPath, src.Path)
+		}
+	}
+	return nil
+}
+
+// resolveOutputPath resolves path like resolvePath, although it, and some of
+// its parent directories, may not exist yet.
+func resolveOutputPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var missing []string
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{resolved}, missing...)...), nil
+}
+
+// sanitizePrefix sanitizes a directory prefix for entry names like
+// sanitizeArchivePath, normalizing backslashes and dropping any leading or
+// trailing slashes. A prefix is always relative to the archive root, so a
+// leading slash isn't an error.
+func sanitizePrefix(prefix string) (string, error) {
+	prefix = strings.TrimLeft(strings.Replace(prefix, `\`, "/", -1), "/")
+	prefix, err := sanitizeArchivePath(prefix)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(prefix, "/"), nil
+}
+
+// joinPrefixes sanitizes prefix and places it under archivePrefix, both as
+// with sanitizePrefix.
+func joinPrefixes(archivePrefix, prefix string) (string, error) {
+	archivePrefix, err := sanitizePrefix(archivePrefix)
+	if err != nil {
+		return "", err
+	}
+	prefix, err = sanitizePrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	return joinArchivePath(archivePrefix, prefix), nil
+}
+
+// joinArchivePath returns the slash separated name prefixed with prefix.
+func joinArchivePath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	if name == "" {
+		return prefix
+	}
+	return prefix + "/" + name
+}
+
+// walkedEntryName returns the name an entry found at relname, relative to the
+// directory being walked, is stored under, with prefix. It reports false,
+// along with the name without any components stripped, when stripping
+// opts.StripComponents leaves no name.
+func walkedEntryName(prefix, relname string, opts ArchiveDirOptions) (string, bool) {
+	name := filepath.ToSlash(relname)
+	if opts.Flatten {
+		name = filepath.Base(relname)
+	}
+	if opts.StripComponents > 0 {
+		segments := strings.Split(name, "/")
+		if name == "." || len(segments) <= opts.StripComponents {
+			return joinArchivePath(prefix, name), false
+		}
+		name = strings.Join(segments[opts.StripComponents:], "/")
+	}
+	return joinArchivePath(prefix, name), true
+}
+
+// prefixedArchivePath sanitizes name and prefix, returning the name an
+// entry is stored at.
+func prefixedArchivePath(prefix, name string) (string, error) {
+	name, err := sanitizeArchivePath(name)
+	if err != nil {
+		return "", err
+	}
+	prefix, err = sanitizePrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	return joinArchivePath(prefix, name), nil
+}
+
+// archivePathFrom returns the path infilename is stored at when archived
+// from root: its path relative to root, or its base name when root is empty.
+// A file outside of root is an error.
+func archivePathFrom(root, infilename string) (string, error) {
+	if root == "" {
+		return filepath.Base(infilename), nil
+	}
+	relname, err := filepath.Rel(root, infilename)
+	if err != nil {
+		return "", archiveError("relativizing file for archival", infilename, err)
+	}
+	if relname == ".." || strings.HasPrefix(relname, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %q is not inside root %q", infilename, root)
+	}
+	return relname, nil
+}
+
+// listedFile is a file given to ArchiveFiles, with the name it is stored
+// under.
+type listedFile struct {
+	path string
+	name string
+	info os.FileInfo
+}
+
+// listFiles returns the files given to ArchiveFiles with the names they are
+// stored under, their paths relative to base under prefix, in the byte order
+// of those names. An empty base is the current directory. A file outside of
+// base, or a directory, is an error.
+func listFiles(files []string, base, prefix string) ([]listedFile, error) {
+	if base == "" {
+		base = "."
+	}
+	listed := make([]listedFile, len(files))
+	for i, file := range files {
+		fi, err := assertValidFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return nil, fmt.Errorf("could not archive directory as a file: %s", file)
+		}
+		relname, err := archivePathFrom(base, file)
+		if err != nil {
+			return nil, err
+		}
+		name, err := prefixedArchivePath(prefix, filepath.ToSlash(relname))
+		if err != nil {
+			return nil, err
+		}
+		listed[i] = listedFile{path: file, name: name, info: fi}
+	}
+	sort.SliceStable(listed, func(i, j int) bool {
+		return listed[i].name < listed[j].name
+	})
+	return listed, nil
+}
+
+// archiveNames records the names already written to an archive.
+type archiveNames struct {
+	policy    string
+	caseCheck string
+	isDir     map[string]bool
+
+	// folded maps the lower case form of each name to the first name
+	// added with it, for caseCheck.
+	folded map[string]string
+
+	// replaced counts how many of the entries written under a name were
+	// replaced by a later one.
+	replaced map[string]int
+}
+
+func newArchiveNames(policy, caseCheck string) archiveNames {
+	return archiveNames{
+		policy:    policy,
+		caseCheck: caseCheck,
+		isDir:     map[string]bool{},
+		folded:    map[string]string{},
+		replaced:  map[string]int{},
+	}
+}
+
+// add records name, reporting whether it still needs writing. The same
+// directory may be found in several sources and is only written once. Any
+// other repeated name is an error, unless the policy is to overwrite files,
+// in which case the earlier entry is recorded as replaced.
+func (n archiveNames) add(name string, isDir bool) (bool, error) {
+	if wasDir, ok := n.isDir[name]; ok {
+		switch {
+		case isDir && wasDir:
+			return false, nil
+		case !isDir && !wasDir && n.policy == DuplicatesOverwrite:
+			n.replaced[name]++
+			return true, nil
+		}
+		return false, fmt.Errorf("duplicate file path in archive: %s", name)
+	}
+	if err := n.checkCase(name, isDir); err != nil {
+		return false, err
+	}
+	n.isDir[name] = isDir
+	return true, nil
+}
+
+// checkCase applies caseCheck to a new name. Directories whose names differ
+// only in case are merged on extraction rather than overwritten, so only
+// names involving a file are reported.
+func (n archiveNames) checkCase(name string, isDir bool) error {
+	if n.caseCheck == "" || n.caseCheck == CaseCheckNone {
+		return nil
+	}
+	key := strings.ToLower(name)
+	other, ok := n.folded[key]
+	if !ok {
+		n.folded[key] = name
+		return nil
+	}
+	if isDir && n.isDir[other] {
+		return nil
+	}
+	if n.caseCheck == CaseCheckError {
+		return fmt.Errorf("file paths in archive differ only in case: %s and %s", other, name)
+	}
+	log.Printf("[WARN] file paths in archive differ only in case, so one overwrites the other on case insensitive file systems: %s and %s", other, name)
+	return nil
+}
+
+// keep returns a function reporting, for each entry of the archive in turn,
+// whether it was not replaced by a later entry with the same name.
+func (n archiveNames) keep() func(name string) bool {
+	seen := map[string]int{}
+	return func(name string) bool {
+		name = strings.TrimSuffix(name, "/")
+		seen[name]++
+		return seen[name] > n.replaced[name]
+	}
+}
+
+// manifestEntry is an entry of an archiveManifest. The entry's content is
+// written to it as it is archived, to count and checksum it.
+type manifestEntry struct {
+	ArchiveEntry
+	crc32  hash.Hash32
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newManifestEntry(name string, mode os.FileMode, modified time.Time) *manifestEntry {
+	return &manifestEntry{
+		ArchiveEntry: ArchiveEntry{Name: name, Mode: mode, Modified: modified.UTC()},
+		crc32:        crc32.NewIEEE(),
+		md5:          md5.New(),
+		sha256:       sha256.New(),
+	}
+}
+
+func (e *manifestEntry) Write(p []byte) (int, error) {
+	e.Size += int64(len(p))
+	e.crc32.Write(p)
+	e.md5.Write(p)
+	e.sha256.Write(p)
+	return len(p), nil
+}
+
+// archiveManifest records the entries written to an archive, in the order
+// they were written.
+type archiveManifest []*manifestEntry
+
+// add records a new entry, returning it so that its content can be written
+// to it.
+func (m *archiveManifest) add(name string, mode os.FileMode, modified time.Time) *manifestEntry {
+	entry := newManifestEntry(name, mode, modified)
+	*m = append(*m, entry)
+	return entry
+}
+
+// removeReplaced drops the entries that names records as replaced.
+func (m *archiveManifest) removeReplaced(names archiveNames) {
+	keep := names.keep()
+	kept := (*m)[:0]
+	for _, entry := range *m {
+		if keep(entry.Name) {
+			kept = append(kept, entry)
+		}
+	}
+	*m = kept
+}
+
+// sorted reports whether the entries are in the order of their names given
+// by less.
+func (m archiveManifest) sorted(less func(a, b string) bool) bool {
+	return sort.SliceIsSorted(m, func(i, j int) bool {
+		return less(m[i].Name, m[j].Name)
+	})
+}
+
+// sort puts the entries in the order of their names given by less, as
+// SortEntries and Order write them, keeping entries with the same name in
+// the order they were added.
+func (m archiveManifest) sort(less func(a, b string) bool) {
+	sort.SliceStable(m, func(i, j int) bool {
+		return less(m[i].Name, m[j].Name)
+	})
+}
+
+// sortsEntries reports whether the entries of the archive are written in
+// order, as SortEntries or Order ask.
+func (o ArchiveOptions) sortsEntries() bool {
+	return o.SortEntries || len(o.Order) > 0
+}
+
+// entryLess returns the order entries are written in when they are sorted:
+// those listed in Order first, in the order given, then the rest in the byte
+// order of their names.
+func (o ArchiveOptions) entryLess() func(a, b string) bool {
+	rank := make(map[string]int, len(o.Order))
+	for i, name := range o.Order {
+		if _, ok := rank[strings.TrimSuffix(name, "/")]; !ok {
+			rank[strings.TrimSuffix(name, "/")] = i
+		}
+	}
+	position := func(name string) int {
+		if i, ok := rank[strings.TrimSuffix(name, "/")]; ok {
+			return i
+		}
+		return len(o.Order)
+	}
+	return func(a, b string) bool {
+		if pa, pb := position(a), position(b); pa != pb {
+			return pa < pb
+		}
+		return a < b
+	}
+}
+
+// checkOrder returns an error if Order lists a name that isn't one of the
+// entries of the finished archive, which is most likely a mistake.
+func (o ArchiveOptions) checkOrder(m archiveManifest) error {
+	if len(o.Order) == 0 {
+		return nil
+	}
+	names := make(map[string]bool, len(m))
+	for _, entry := range m {
+		names[strings.TrimSuffix(entry.Name, "/")] = true
+	}
+	for _, name := range o.Order {
+		if !names[strings.TrimSuffix(name, "/")] {
+			return fmt.Errorf("the entry order lists %s, which isn't in the archive", name)
+		}
+	}
+	return nil
+}
+
+// needsRewrite reports whether a finished archive has to be rewritten,
+// without the entries that names records as replaced or with its entries
+// sorted as opts.SortEntries or opts.Order ask.
+func needsRewrite(names archiveNames, m archiveManifest, opts ArchiveOptions) bool {
+	return len(names.replaced) > 0 || opts.sortsEntries() && !m.sorted(opts.entryLess())
+}
+
+// fileCount returns how many of the entries aren't directories.
+func (m archiveManifest) fileCount() int {
+	n := 0
+	for _, entry := range m {
+		if !strings.HasSuffix(entry.Name, "/") {
+			n++
+		}
+	}
+	return n
+}
+
+func (m archiveManifest) entries() []ArchiveEntry {
+	entries := make([]ArchiveEntry, len(m))
+	for i, entry := range m {
+		entries[i] = entry.ArchiveEntry
+		entries[i].CRC32 = entry.crc32.Sum32()
+		if !strings.HasSuffix(entry.Name, "/") {
+			entries[i].MD5 = entry.md5.Sum(nil)
+			entries[i].SHA256 = entry.sha256.Sum(nil)
+		}
+	}
+	return entries
+}
+
+// wantDirEntry reports whether the directory at path, found while walking
+// indirname, should get an explicit entry under the given policy.
+func wantDirEntry(indirname, path string, policy string) (bool, error) {
+	if path == indirname {
+		return false, nil
+	}
+	switch policy {
+	case DirEntriesAll:
+		return true, nil
+	case DirEntriesEmpty:
+		f, err := os.Open(path)
+		if err != nil {
+			return false, archiveError("reading directory for archival", path, err)
+		}
+		defer f.Close()
+		if _, err := f.Readdirnames(1); err != io.EOF {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// transformReader returns the content to store for the file called name,
+// read from r, with its size, which is size unless the file is transformed
+// by the Transforms for its extension, reading r into memory. Other files are
+// returned as they are, without reading them.
+func (o ArchiveOptions) transformReader(r io.Reader, size int64, name string) (io.Reader, int64, error) {
+	ext := path.Ext(name)
+	if ext == "" {
+		return r, size, nil
+	}
+	for e, transform := range o.Transforms {
+		if !isExtension(ext, e) {
+			continue
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, 0, archiveError("reading file for archival", name, err)
+		}
+		content, err = transform(name, content)
+		if err != nil {
+			return nil, 0, archiveError("transforming file for archival", name, err)
+		}
+		return bytes.NewReader(content), int64(len(content)), nil
+	}
+	return r, size, nil
+}
+
+// hasExtension reports whether the slash separated name ends with one of
+// extensions, ignoring case. The extensions may leave out the leading dot.
+func hasExtension(name string, extensions []string) bool {
+	ext := path.Ext(name)
+	if ext == "" {
+		return false
+	}
+	for _, e := range extensions {
+		if isExtension(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExtension reports whether ext, which starts with a dot, is the extension
+// e, which may leave out the leading dot, ignoring case.
+func isExtension(ext, e string) bool {
+	if !strings.HasPrefix(e, ".") {
+		e = "." + e
+	}
+	return strings.EqualFold(e, ext)
+}
+
+// skipReadError returns the reason the file at path is skipped for err, from
+// walking or reading it: SkippedMissing when it no longer exists and
+// opts.SkipMissing is set, or SkippedUnreadable when opts.ContinueOnError is.
+// It returns "" when the error should fail the archive, and logs a warning
+// otherwise.
+func skipReadError(path string, err error, opts ArchiveDirOptions) string {
+	switch {
+	case opts.SkipMissing && os.IsNotExist(err):
+		log.Printf("[WARN] skipping %s, which was removed while archiving", path)
+		return SkippedMissing
+	case opts.ContinueOnError:
+		log.Printf("[WARN] skipping %s, which couldn't be read: %s", path, err)
+		return SkippedUnreadable
+	}
+	return ""
+}
+
+// skipReason returns why the entry at path, found while walking dir, is left
+// out of the archive by the excludes, includes, ignore files and hidden file
+// rules of opts, or "" if it isn't, along with the exclude pattern or regular
+// expression it matched when it is excluded.
+func skipReason(dir string, ignores *ignoreMatcher, path string, info os.FileInfo, opts ArchiveDirOptions) (string, string, error) {
+	ignored, err := ignores.ignored(path, info.IsDir())
+	if err != nil {
+		return "", "", err
+	}
+	if ignored {
+		return SkippedIgnored, "", nil
+	}
+	if pattern := excludingPattern(dir, path, opts.Excludes); pattern != "" {
+		return SkippedExcluded, pattern, nil
+	}
+	if expr := excludingRegexp(dir, path, info.IsDir(), opts.excludeRegexps); expr != "" {
+		return SkippedExcluded, expr, nil
+	}
+	switch {
+	case isHidden(dir, path, info.IsDir(), opts):
+		return SkippedHidden, "", nil
+	case !info.IsDir() && !isIncluded(dir, path, opts.Includes):
+		return SkippedNotIncluded, "", nil
+	}
+	return "", "", nil
+}
+
+// skippedFiles records the entries left out while walking directories, in
+// the order they were found.
+type skippedFiles []SkippedFile
+
+func (s *skippedFiles) add(name string, isDir bool, reason string) {
+	s.addMatched(name, isDir, reason, "")
+}
+
+// addMatched records an entry left out because it matched pattern.
+func (s *skippedFiles) addMatched(name string, isDir bool, reason, pattern string) {
+	if isDir {
+		name += "/"
+	}
+	*s = append(*s, SkippedFile{Name: name, Reason: reason, Pattern: pattern})
+}
+
+// addReadError records an entry left out for reason, as returned by
+// skipReadError, keeping err when the entry couldn't be read.
+func (s *skippedFiles) addReadError(name string, isDir bool, reason string, err error) {
+	s.add(name, isDir, reason)
+	if reason == SkippedUnreadable {
+		(*s)[len(*s)-1].Err = err
+	}
+}
+
+// tooLarge reports whether the file at path, with info, is larger than
+// opts.MaxFileSize and should be skipped, logging a warning if so.
+func tooLarge(path string, info os.FileInfo, opts ArchiveDirOptions) bool {
+	if opts.MaxFileSize <= 0 || info.Size() <= opts.MaxFileSize {
+		return false
+	}
+	log.Printf("[WARN] skipping %s, which is %d bytes, larger than the maximum file size of %d bytes", path, info.Size(), opts.MaxFileSize)
+	return true
+}
+
+// isDirSymlink reports whether the symlink at path points to a directory.
+// Broken links don't.
+func isDirSymlink(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// followSymlink returns the FileInfo of the file the symlink at path points
+// to.
+func followSymlink(path string) (os.FileInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, archiveError("following symlink for archival", path, err)
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("could not archive symlink to directory: %s", path)
+	}
+	return fi, nil
+}
+
+// unreadableSymlink returns the error reading the target of the symlink at
+// path, when err from followSymlink is for a target that can't be read and
+// should be skipped as opts.ContinueOnError is set, logging a warning if so.
+// It returns nil otherwise, including for a link to a directory, which is
+// still an error.
+func unreadableSymlink(path string, err error, opts ArchiveDirOptions) error {
+	archiveErr, ok := err.(*ArchiveError)
+	if !opts.ContinueOnError || !ok {
+		return nil
+	}
+	log.Printf("[WARN] skipping %s, whose target couldn't be read: %s", path, archiveErr.Err)
+	return archiveErr.Err
+}
+
+// checkFilesFound returns an error if opts requires files but walking
+// sources added none.
+func checkFilesFound(sources []ArchiveDirSource, opts ArchiveDirOptions, added int) error {
+	if !opts.RequireFiles || added > 0 {
+		return nil
+	}
+	paths := make([]string, len(sources))
+	for i, source := range sources {
+		paths[i] = source.Path
+	}
+	return fmt.Errorf("no files found to archive in %s", strings.Join(paths, ", "))
+}
+
+// archiveProgress reports the files added while walking directories to
+// ArchiveOptions.Progress. The zero value reports nothing.
+type archiveProgress struct {
+	fn    func(filesDone, filesTotal int, currentPath string)
+	done  int
+	total int
+}
+
+// newArchiveProgress returns the progress reporter for walking sources,
+// counting their files first when fn is set.
+func newArchiveProgress(fn func(filesDone, filesTotal int, currentPath string), sources []ArchiveDirSource, opts ArchiveDirOptions) archiveProgress {
+	if fn == nil {
+		return archiveProgress{}
+	}
+	return archiveProgress{fn: fn, total: countFiles(sources, opts)}
+}
+
+// add reports the file stored as name.
+func (p *archiveProgress) add(name string) {
+	if p.fn == nil {
+		return
+	}
+	p.done++
+	p.fn(p.done, p.total, name)
+}
+
+// countFiles returns the number of files walking sources with opts would
+// archive, skipping what the walk would skip. Errors are left for the walk
+// itself to return, so anything that can't be read isn't counted.
+func countFiles(sources []ArchiveDirSource, opts ArchiveDirOptions) int {
+	count := 0
+	for _, dir := range sources {
+		ignores := newIgnoreMatcher(dir.Path, opts.IgnoreFile)
+		walkTree(dir.Path, opts.FollowDirSymlinks, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			reason, _, err := skipReason(dir.Path, ignores, path, info, opts)
+			switch {
+			case err != nil:
+				return nil
+			case reason != "" && info.IsDir():
+				return filepath.SkipDir
+			case reason != "" || info.IsDir():
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if opts.Symlinks == SymlinkSkip || (opts.ExcludeSymlinkDirs && isDirSymlink(path)) {
+					return nil
+				}
+				if opts.Symlinks == SymlinkStore {
+					count++
+					return nil
+				}
+				if info, err = os.Stat(path); err != nil {
+					return nil
+				}
+			}
+			if info.Mode().IsRegular() && (opts.MaxFileSize <= 0 || info.Size() <= opts.MaxFileSize) {
+				count++
+			}
+			return nil
+		})
+	}
+	return count
+}
+
+// walkSource walks the directory root with fn, first reading the whole tree
+// and sorting its entries when opts.SortEntries is set. Excluded and ignored
+// directories are not read while sorting, but are still passed to fn, which is
+// expected to skip excluded and ignored entries itself.
+func walkSource(root string, opts ArchiveDirOptions, fn filepath.WalkFunc) error {
+	if !opts.SortEntries {
+		return walkTree(root, opts.FollowDirSymlinks, fn)
+	}
+
+	type walkEntry struct {
+		path string
+		name string
+		info os.FileInfo
+		err  error
+	}
+	var entries []walkEntry
+	ignores := newIgnoreMatcher(root, opts.IgnoreFile)
+	err := walkTree(root, opts.FollowDirSymlinks, func(path string, info os.FileInfo, err error) error {
+		relname, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return archiveError("relativizing file for archival", path, relErr)
+		}
+		// Entries are ordered by the names they are stored under, where
+		// directories end with a slash.
+		name := filepath.ToSlash(relname)
+		switch {
+		case relname == ".":
+			name = ""
+		case info != nil && info.IsDir():
+			name += "/"
+		}
+		if err != nil {
+			// The error is passed on to fn, which either skips the
+			// entry or fails the archive.
+			entries = append(entries, walkEntry{path: path, name: name, info: info, err: err})
+			return nil
+		}
+		reason, _, err := skipReason(root, ignores, path, info, opts)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, walkEntry{path: path, name: name, info: info})
+		// Skipped directories are still passed to fn, which records
+		// them, but aren't read.
+		if reason != "" && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	for _, entry := range entries {
+		// The contents of directories have already been read, so there
+		// is nothing left for SkipDir to skip.
+		if err := fn(entry.path, entry.info, entry.err); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTree walks the directory root like filepath.Walk. When followDirs is
+// set, a symlink to a directory is walked into as though it were the
+// directory, with the paths of its contents under the link's path.
+func walkTree(root string, followDirs bool, fn filepath.WalkFunc) error {
+	if !followDirs {
+		return filepath.Walk(root, fn)
+	}
+	w := &treeWalker{fn: fn}
+	return w.walk(root, root, nil)
+}
+
+type treeWalker struct {
+	fn filepath.WalkFunc
+}
+
+// walk walks dir, calling fn with the path of each entry moved from dir to
+// name. parents holds the resolved directories of the links followed to
+// reach dir.
+func (w *treeWalker) walk(dir, name string, parents []string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(dir, path)
+		if relErr != nil {
+			return archiveError("relativizing file for archival", path, relErr)
+		}
+		linkpath := name
+		if rel != "." {
+			linkpath = filepath.Join(name, rel)
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return w.fn(linkpath, info, err)
+		}
+
+		// Anything that isn't a readable directory is left to fn, which
+		// reports broken links itself.
+		target, err := resolvePath(path)
+		if err != nil {
+			return w.fn(linkpath, info, nil)
+		}
+		if ti, err := os.Stat(target); err != nil || !ti.IsDir() {
+			return w.fn(linkpath, info, nil)
+		}
+		from, err := resolvePath(filepath.Dir(path))
+		if err != nil {
+			return archiveError("following symlink for archival", path, err)
+		}
+		// The directories being walked are all inside the resolved
+		// directories the links were found in, so a target containing
+		// any of those would eventually lead back to this link.
+		chain := append(parents[:len(parents):len(parents)], from)
+		for _, parent := range chain {
+			if isWithin(target, parent) {
+				return fmt.Errorf("symlink cycle found while archiving: %s -> %s", linkpath, target)
+			}
+		}
+		return w.walk(target, linkpath, chain)
+	})
+}
+
+// resolvePath returns the absolute path of path with every symlink resolved.
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
+
+// isWithin reports whether path is dir or inside it.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// specialFileError returns the error for finding the special file at path,
+// or nil if the policy is to skip it.
+func specialFileError(path string, info os.FileInfo, policy string) error {
+	kind := "special file"
+	switch mode := info.Mode(); {
+	case mode&os.ModeNamedPipe != 0:
+		kind = "named pipe"
+	case mode&os.ModeSocket != 0:
+		kind = "socket"
+	case mode&os.ModeDevice != 0:
+		kind = "device"
+	}
+	if policy == SpecialFilesSkip {
+		log.Printf("[WARN] skipping %s %s", kind, path)
+		return nil
+	}
+	return fmt.Errorf("could not archive %s: %s", kind, path)
+}
+
+// sanitizeArchivePath returns name without any leading "./", or an error if
+// name is absolute or has a ".." component that could place the entry
+// outside of the directory the archive is extracted into. Both slashes and
+// backslashes are treated as separators since extractors differ on the
+// latter.
+func sanitizeArchivePath(name string) (string, error) {
+	for strings.HasPrefix(name, "./") {
+		name = strings.TrimLeft(name[2:], "/")
+	}
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || hasDriveLetter(name) {
+		return "", fmt.Errorf("illegal file path in archive: %s", name)
+	}
+	isSeparator := func(r rune) bool { return r == '/' || r == '\\' }
+	for _, segment := range strings.FieldsFunc(name, isSeparator) {
+		if segment == ".." {
+			return "", fmt.Errorf("illegal file path in archive: %s", name)
+		}
+	}
+	return name, nil
+}
+
+// hasDriveLetter reports whether name starts with a Windows drive letter
+// such as "C:", regardless of the platform the provider runs on.
+func hasDriveLetter(name string) bool {
+	return len(name) >= 2 && name[1] == ':' &&
+		('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z')
+}
+
+// sanitizeContentName sanitizes a caller supplied name for an entry of
+// content, as with sanitizeArchivePath, and also normalizes backslashes to
+// slashes and cleans the name of "." components and repeated slashes. An
+// empty name, or one naming a directory, is an error.
+func sanitizeContentName(name string) (string, error) {
+	original := name
+	name = strings.Replace(name, `\`, "/", -1)
+	if name == "" || strings.HasSuffix(name, "/") {
+		return "", fmt.Errorf("illegal file path in archive: %q", original)
+	}
+	name, err := sanitizeArchivePath(name)
+	if err != nil {
+		return "", err
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", fmt.Errorf("illegal file path in archive: %q", original)
+	}
+	return name, nil
+}
+
+// sanitizeArchivePaths sanitizes the names of content and places them under
+// prefix, returning the entries sorted by name so that files are always
+// processed in the same order and hashes don't change. Names are sanitized
+// with sanitizeContentName, and names that sanitize to the same path are an
+// error unless duplicates is DuplicatesOverwrite.
+func sanitizeArchivePaths(content map[string][]byte, prefix string, duplicates string) ([]ContentEntry, error) {
+	names := make([]string, 0, len(content))
+	originals := make(map[string]string, len(content))
+	for k := range content {
+		name, err := sanitizeContentName(k)
+		if err != nil {
+			return nil, err
+		}
+		name, err = prefixedArchivePath(prefix, name)
+		if err != nil {
+			return nil, err
+		}
+		if original, ok := originals[name]; ok {
+			if duplicates != DuplicatesOverwrite {
+				return nil, fmt.Errorf("duplicate file path in archive: %s", name)
+			}
+			// Map order is random, so the original name sorting last
+			// wins to keep the archive the same on every run.
+			if original > k {
+				continue
+			}
+		} else {
+			names = append(names, name)
+		}
+		originals[name] = k
+	}
+	sort.Strings(names)
+	entries := make([]ContentEntry, len(names))
+	for i, name := range names {
+		entries[i] = ContentEntry{Name: name, Content: content[originals[name]]}
+	}
+	return entries, nil
+}
+
+// sanitizeContentEntries sanitizes the names of content like
+// sanitizeArchivePaths, but keeps the entries in the order given. With
+// DuplicatesOverwrite, a later entry with the same path replaces the content
+// of the earlier one, which keeps its place.
+func sanitizeContentEntries(content []ContentEntry, prefix string, duplicates string) ([]ContentEntry, error) {
+	entries := make([]ContentEntry, 0, len(content))
+	index := make(map[string]int, len(content))
+	for _, entry := range content {
+		name, err := sanitizeContentName(entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		name, err = prefixedArchivePath(prefix, name)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[name]; ok {
+			if duplicates != DuplicatesOverwrite {
+				return nil, fmt.Errorf("duplicate file path in archive: %s", name)
+			}
+			entries[i].Content = entry.Content
+			continue
+		}
+		index[name] = len(entries)
+		entries = append(entries, ContentEntry{Name: name, Content: entry.Content})
+	}
+	return entries, nil
+}
+
+// archiveVerifier compares the entries read back from a finished archive with
+// those written to it, in order.
+type archiveVerifier struct {
+	entries []ArchiveEntry
+	next    int
+}
+
+func newArchiveVerifier(entries []ArchiveEntry) *archiveVerifier {
+	return &archiveVerifier{entries: entries}
+}
+
+// check reads the content r of the next entry, called name, erroring if it
+// can't be read or differs from the next entry written.
+func (v *archiveVerifier) check(name string, r io.Reader) error {
+	if v.next == len(v.entries) {
+		return fmt.Errorf("error verifying archive: unexpected entry %s", name)
+	}
+	want := v.entries[v.next]
+	v.next++
+	if name != want.Name {
+		return fmt.Errorf("error verifying archive: found entry %s instead of %s", name, want.Name)
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("error verifying archive: could not read %s: %w", name, err)
+	}
+	if want.MD5 != nil && !bytes.Equal(h.Sum(nil), want.MD5) {
+		return fmt.Errorf("error verifying archive: %s differs from the content written", name)
+	}
+	return nil
+}
+
+// finish errors if any entry written wasn't read back.
+func (v *archiveVerifier) finish() error {
+	if v.next < len(v.entries) {
+		return fmt.Errorf("error verifying archive: entry %s is missing", v.entries[v.next].Name)
+	}
+	return nil
+}
+
+// sizeLimit accumulates the uncompressed size of the entries written to an
+// archive, erroring once it crosses ArchiveOptions.MaxSize.
+type sizeLimit struct {
+	max   int64
+	total int64
+}
+
+// add counts n more bytes of the entry called name.
+func (l *sizeLimit) add(name string, n int64) error {
+	if l.max <= 0 {
+		return nil
+	}
+	l.total += n
+	if l.total > l.max {
+		return fmt.Errorf("archive exceeds the maximum size of %d bytes while adding %s", l.max, name)
+	}
+	return nil
+}
+
+// fileLimit counts the files written to an archive, erroring once there are
+// more than ArchiveOptions.MaxFiles.
+type fileLimit struct {
+	max   int
+	count int
+}
+
+// add counts the entry called name, unless it is a directory.
+func (l *fileLimit) add(name string, isDir bool) error {
+	if l.max <= 0 || isDir {
+		return nil
+	}
+	l.count++
+	if l.count > l.max {
+		return fmt.Errorf("archive exceeds the maximum of %d files while adding %s", l.max, name)
+	}
+	return nil
+}
+
+// checkNameLength errors if the archive entry called name is longer than
+// MaxNameLength, or any of its components longer than MaxNameComponentLength.
+func (o ArchiveOptions) checkNameLength(name string) error {
+	name = strings.TrimSuffix(name, "/")
+	if o.MaxNameLength > 0 && len(name) > o.MaxNameLength {
+		return fmt.Errorf("archive entry %s is %d bytes long, more than the maximum of %d", name, len(name), o.MaxNameLength)
+	}
+	if o.MaxNameComponentLength <= 0 {
+		return nil
+	}
+	for _, component := range strings.Split(name, "/") {
+		if len(component) > o.MaxNameComponentLength {
+			return fmt.Errorf("archive entry %s has a component, %s, that is %d bytes long, more than the maximum of %d", name, component, len(component), o.MaxNameComponentLength)
+		}
+	}
+	return nil
+}
+
+// prepareOutputDir checks that the directory the archive at path is written
+// to exists, creating it when create is set.
+func prepareOutputDir(path string, create bool) error {
+	dir := filepath.Dir(path)
+	_, err := os.Stat(dir)
+	if err == nil || !os.IsNotExist(err) {
+		// Any other problem with the directory is reported when the
+		// archive is created in it.
+		return nil
+	}
+	if !create {
+		return fmt.Errorf("output directory %s does not exist", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create output directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// archiveSession is the state of an archive kept open by Open. Every call
+// writing to the archive while it is open locks it, so that the Add and
+// Archive methods take turns adding their entries.
+type archiveSession struct {
+	mu   sync.Mutex
+	open bool
+}
+
+// lock locks the session for a call about to write to the archive at path,
+// reporting whether the archive is open, in which case the call holds mu
+// until it passes what lock reported to unlock. Otherwise the call writes an
+// archive of its own, or, when add is set as for the Add methods, errors.
+func (s *archiveSession) lock(path string, add bool) (bool, error) {
+	s.mu.Lock()
+	if s.open {
+		return true, nil
+	}
+	s.mu.Unlock()
+	if add {
+		return false, fmt.Errorf("archive %s is not open", path)
+	}
+	return false, nil
+}
+
+// unlock releases the session when held, as reported by lock, returning
+// held.
+func (s *archiveSession) unlock(held bool) bool {
+	if held {
+		s.mu.Unlock()
+	}
+	return held
+}
+
+// archiveGuard stops an archiver from writing two archives at once, such as
+// when it is shared by goroutines, which would corrupt both. An archiver
+// writes one archive at a time: a second call made while the first is
+// still writing fails rather than waiting, except while the archive is kept
+// open by Open, when calls take turns adding to it.
+type archiveGuard struct {
+	mu   sync.Mutex
+	busy bool
+}
+
+// acquire marks the archiver writing the archive at path as busy, erroring
+// if it already is.
+func (g *archiveGuard) acquire(path string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.busy {
+		return fmt.Errorf("archive %s is already being written by another call, and an archiver can only write one archive at a time", path)
+	}
+	g.busy = true
+	return nil
+}
+
+// release marks the archiver as no longer busy.
+func (g *archiveGuard) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.busy = false
+}
+
+// createArchiveFile creates the temporary file, alongside path, that an
+// archive is written to before commitArchiveFile moves it into place. Until
+// then path is left as it was, so that it can still be read, such as when it
+// is the base archive, and a failed or interrupted write never leaves a
+// partial archive there. Paths that aren't regular files, such as devices
+// and named pipes, can't be replaced, so they are written to directly.
+func createArchiveFile(path string) (*os.File, error) {
+	if fi, err := os.Stat(path); err == nil && !fi.Mode().IsRegular() {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("error creating archive %s: %w", path, err)
+		}
+		return f, nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive %s: %w", path, err)
+	}
+	// Temporary files are only readable by their owner.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("error creating archive %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// closeArchiveFile closes f, returning err or the error closing f.
+func closeArchiveFile(f *os.File, err error) error {
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// commitArchiveFile moves the temporary file tmp, created by
+// createArchiveFile, to path if there was no error, and removes it otherwise.
+// The rename is atomic as both are in the same directory.
+func commitArchiveFile(tmp, path string, err error) error {
+	if tmp == path {
+		return err
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// contextReader stops reading with ctx's error once ctx is done, so that
+// copying a large file can be interrupted.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func assertValidCompressionLevel(level int) error {
+	if level < NoCompression || level > 9 {
+		return fmt.Errorf("invalid compression level: %d", level)
+	}
+	return nil
+}
+
+func assertValidModTime(opts ArchiveOptions) error {
+	if opts.ModTime.IsZero() {
+		return nil
+	}
+	if opts.NormalizeTimestamps {
+		return fmt.Errorf("a modification time can't be set when normalizing timestamps")
+	}
+	if opts.ModTime.Before(normalizedModTime) || !opts.ModTime.Before(maxModTime) {
+		return fmt.Errorf("modification time %s is outside the range zip files can store, from 1980 to 2107", opts.ModTime.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func assertValidOwner(owner *FileOwner) error {
+	if owner != nil && (owner.UID < 0 || owner.GID < 0) {
+		return fmt.Errorf("invalid owner %d:%d, IDs can't be negative", owner.UID, owner.GID)
+	}
+	return nil
+}
+
+func assertValidOutput(output io.Writer, duplicates string) error {
+	if output != nil && duplicates == DuplicatesOverwrite {
+		return fmt.Errorf("duplicates can only be overwritten when the archive is written to a file")
+	}
+	return nil
+}
+
+func assertValidCaseCheck(check string) error {
+	switch check {
+	case "", CaseCheckNone, CaseCheckWarn, CaseCheckError:
+		return nil
+	}
+	return fmt.Errorf("invalid case insensitive check: %s", check)
+}
+
+func assertValidDuplicates(duplicates string) error {
+	switch duplicates {
+	case "", DuplicatesError, DuplicatesOverwrite:
+		return nil
+	}
+	return fmt.Errorf("invalid duplicate name policy: %s", duplicates)
+}
+
+func assertValidCompression(compression string) error {
+	switch compression {
+	case "", CompressionDeflate, CompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("invalid compression method: %s", compression)
+}
+
+func assertValidExtensionCompression(compression map[string]EntryCompression) error {
+	seen := map[string]string{}
+	for ext, c := range compression {
+		if strings.TrimPrefix(ext, ".") == "" {
+			return fmt.Errorf("invalid extension for compression: %q", ext)
+		}
+		normalized := strings.ToLower("." + strings.TrimPrefix(ext, "."))
+		if prev, ok := seen[normalized]; ok {
+			return fmt.Errorf("extensions %s and %s are the same extension, so only one of them can set its compression", prev, ext)
+		}
+		seen[normalized] = ext
+		if err := assertValidCompression(c.Method); err != nil {
+			return fmt.Errorf("%w for extension %s", err, ext)
+		}
+		if err := assertValidCompressionLevel(c.Level); err != nil {
+			return fmt.Errorf("%w for extension %s", err, ext)
+		}
+	}
+	return nil
+}
+
+// assertValidTransforms checks that no two of transforms are for the same
+// extension, which would leave it to the order of the map which one applies.
+func assertValidTransforms(transforms map[string]FileTransformer) error {
+	seen := map[string]string{}
+	for ext := range transforms {
+		if strings.TrimPrefix(ext, ".") == "" {
+			return fmt.Errorf("invalid extension for transform: %q", ext)
+		}
+		normalized := strings.ToLower("." + strings.TrimPrefix(ext, "."))
+		if prev, ok := seen[normalized]; ok {
+			return fmt.Errorf("extensions %s and %s are the same extension, so only one of them can set its transform", prev, ext)
+		}
+		seen[normalized] = ext
+	}
+	return nil
+}
+
 func assertValidFile(infilename string) (os.FileInfo, error) {
 	fi, err := os.Stat(infilename)
 	if err != nil && os.IsNotExist(err) {
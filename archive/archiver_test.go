@@ -0,0 +1,970 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSanitizeArchivePath(t *testing.T) {
+	cases := []struct {
+		name  string
+		want  string
+		valid bool
+	}{
+		{"content.txt", "content.txt", true},
+		{"./content.txt", "content.txt", true},
+		{".//./sub/content.txt", "sub/content.txt", true},
+		{"sub/content.txt", "sub/content.txt", true},
+		{"..data/content.txt", "..data/content.txt", true},
+		{"../content.txt", "", false},
+		{"../../etc/passwd", "", false},
+		{"sub/../../content.txt", "", false},
+		{`sub\..\..\content.txt`, "", false},
+		{"/etc/passwd", "", false},
+		{`\etc\passwd`, "", false},
+		{`C:\Windows\win.ini`, "", false},
+		{"c:content.txt", "", false},
+	}
+
+	for _, tc := range cases {
+		got, err := sanitizeArchivePath(tc.name)
+		if tc.valid != (err == nil) {
+			t.Errorf("sanitizeArchivePath(%q) error = %v, want valid %t", tc.name, err, tc.valid)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("sanitizeArchivePath(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeContentName(t *testing.T) {
+	cases := []struct {
+		name  string
+		want  string
+		valid bool
+	}{
+		{"content.txt", "content.txt", true},
+		{"./content.txt", "content.txt", true},
+		{`sub\content.txt`, "sub/content.txt", true},
+		{"sub//./content.txt", "sub/content.txt", true},
+		{"", "", false},
+		{".", "", false},
+		{"./", "", false},
+		{"sub/", "", false},
+		{"/content.txt", "", false},
+		{`\content.txt`, "", false},
+		{"sub/../content.txt", "", false},
+		{`sub\..\content.txt`, "", false},
+	}
+
+	for _, tc := range cases {
+		got, err := sanitizeContentName(tc.name)
+		if tc.valid != (err == nil) {
+			t.Errorf("sanitizeContentName(%q) error = %v, want valid %t", tc.name, err, tc.valid)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("sanitizeContentName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestArchiveNames_CaseCheck(t *testing.T) {
+	add := func(n archiveNames, name string, isDir bool) error {
+		_, err := n.add(name, isDir)
+		return err
+	}
+
+	for _, check := range []string{"", CaseCheckNone, CaseCheckWarn} {
+		n := newArchiveNames(DuplicatesError, check)
+		if err := add(n, "README.md", false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := add(n, "readme.md", false); err != nil {
+			t.Errorf("expected no error with check %q, got %s", check, err)
+		}
+	}
+
+	n := newArchiveNames(DuplicatesError, CaseCheckError)
+	for _, entry := range []struct {
+		name  string
+		isDir bool
+	}{{"README.md", false}, {"Lib", true}, {"lib", true}, {"lib/index.js", false}} {
+		if err := add(n, entry.name, entry.isDir); err != nil {
+			t.Fatalf("unexpected error adding %s: %s", entry.name, err)
+		}
+	}
+	for _, entry := range []struct {
+		name  string
+		isDir bool
+	}{{"readme.md", false}, {"ReadMe.md", true}, {"LIB", false}, {"lib/Index.js", false}} {
+		if err := add(n, entry.name, entry.isDir); err == nil || !strings.Contains(err.Error(), "differ only in case") {
+			t.Errorf("expected case error adding %s, got %v", entry.name, err)
+		}
+	}
+}
+
+func TestArchiveVerifier(t *testing.T) {
+	var manifest archiveManifest
+	manifest.add("dir/", os.ModeDir|0755, time.Time{})
+	manifest.add("dir/file.txt", 0644, time.Time{}).Write([]byte("This is some content"))
+	entries := manifest.entries()
+
+	v := newArchiveVerifier(entries)
+	if err := v.check("dir/", strings.NewReader("")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := v.check("dir/file.txt", strings.NewReader("This is some content")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := v.finish(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := v.check("extra.txt", strings.NewReader("")); err == nil || !strings.Contains(err.Error(), "unexpected entry extra.txt") {
+		t.Errorf("expected unexpected entry error, got %v", err)
+	}
+
+	v = newArchiveVerifier(entries)
+	v.check("dir/", strings.NewReader(""))
+	if err := v.check("dir/file.txt", strings.NewReader("This is other content")); err == nil || !strings.Contains(err.Error(), "differs") {
+		t.Errorf("expected content error, got %v", err)
+	}
+
+	v = newArchiveVerifier(entries)
+	if err := v.check("dir/file.txt", strings.NewReader("This is some content")); err == nil || !strings.Contains(err.Error(), "instead of dir/") {
+		t.Errorf("expected name error, got %v", err)
+	}
+
+	v = newArchiveVerifier(entries)
+	v.check("dir/", strings.NewReader(""))
+	if err := v.finish(); err == nil || !strings.Contains(err.Error(), "dir/file.txt is missing") {
+		t.Errorf("expected missing entry error, got %v", err)
+	}
+
+	v = newArchiveVerifier(entries)
+	v.check("dir/", strings.NewReader(""))
+	if err := v.check("dir/file.txt", iotest.ErrReader(errors.New("checksum error"))); err == nil || !strings.Contains(err.Error(), "checksum error") {
+		t.Errorf("expected read error, got %v", err)
+	}
+}
+
+func TestArchiver_Skipped(t *testing.T) {
+	dir := tempDir(t, "archive-skipped")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, ".archiveignore"), "ignored.txt\n")
+	writeTestFile(t, filepath.Join(dir, ".env"), "SECRET=1")
+	writeTestFile(t, filepath.Join(dir, "big.txt"), strings.Repeat("x", 100))
+	writeTestFile(t, filepath.Join(dir, "build", "out.txt"), "out")
+	writeTestFile(t, filepath.Join(dir, "ignored.txt"), "ignored")
+	writeTestFile(t, filepath.Join(dir, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(dir, "notes.md"), "notes")
+	if err := os.Symlink("keep.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+	want := []SkippedFile{
+		{Name: ".archiveignore", Reason: SkippedHidden},
+		{Name: ".env", Reason: SkippedHidden},
+		{Name: "big.txt", Reason: SkippedTooLarge},
+		{Name: "build/", Reason: SkippedExcluded, Pattern: "build"},
+		{Name: "ignored.txt", Reason: SkippedIgnored},
+		{Name: "link.txt", Reason: SkippedSymlink},
+		{Name: "notes.md", Reason: SkippedNotIncluded},
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		for _, sortEntries := range []bool{false, true} {
+			archiver := getArchiver(archiveType, "archive-skipped."+archiveType)
+			opts := ArchiveDirOptions{
+				Excludes:    []string{"build"},
+				Includes:    []string{"*.txt"},
+				IgnoreFile:  ".archiveignore",
+				SkipHidden:  true,
+				Symlinks:    SymlinkSkip,
+				MaxFileSize: 10,
+				SortEntries: sortEntries,
+			}
+			if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+			if got := archiver.Skipped(); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: sort entries %t: got skipped files %v, want %v", archiveType, sortEntries, got, want)
+			}
+		}
+	}
+}
+
+func TestArchiver_SkippedPattern(t *testing.T) {
+	dir := tempDir(t, "archive-skipped-pattern")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "a.tmp"), "a")
+	writeTestFile(t, filepath.Join(dir, "build", "out.txt"), "out")
+	writeTestFile(t, filepath.Join(dir, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(dir, "sub", "b.tmp"), "b")
+	want := []SkippedFile{
+		{Name: "a.tmp", Reason: SkippedExcluded, Pattern: "*.tmp"},
+		{Name: "build/", Reason: SkippedExcluded, Pattern: "build"},
+		{Name: "sub/b.tmp", Reason: SkippedExcluded, Pattern: "**/*.tmp"},
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		archiver := getArchiver(archiveType, "archive-skipped-pattern."+archiveType)
+		opts := ArchiveDirOptions{
+			Excludes: []string{"*.tmp", "build", "**/*.tmp", "**/build"},
+		}
+		if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		got := archiver.Skipped()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got skipped files %v, want %v", archiveType, got, want)
+		}
+		if desc, want := describeSkippedFiles(got), "a.tmp (excluded by *.tmp), build/ (excluded by build), sub/b.tmp (excluded by **/*.tmp)"; desc != want {
+			t.Errorf("%s: got description %q, want %q", archiveType, desc, want)
+		}
+	}
+}
+
+func TestArchiver_ExcludeRegexes(t *testing.T) {
+	dir := tempDir(t, "archive-exclude-regexes")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "app.js"), "app")
+	writeTestFile(t, filepath.Join(dir, "app.test.js"), "test")
+	writeTestFile(t, filepath.Join(dir, "lib", "util.spec.js"), "spec")
+	writeTestFile(t, filepath.Join(dir, "lib", "vendor"), "file")
+	writeTestFile(t, filepath.Join(dir, "vendor", "dep.js"), "dep")
+	writeTestFile(t, filepath.Join(dir, "notes.tmp"), "notes")
+	want := []SkippedFile{
+		{Name: "app.test.js", Reason: SkippedExcluded, Pattern: `\.(test|spec)\.js$`},
+		{Name: "lib/util.spec.js", Reason: SkippedExcluded, Pattern: `\.(test|spec)\.js$`},
+		{Name: "notes.tmp", Reason: SkippedExcluded, Pattern: "*.tmp"},
+		{Name: "vendor/", Reason: SkippedExcluded, Pattern: `(^|/)vendor/$`},
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		archiver := getArchiver(archiveType, "archive-exclude-regexes."+archiveType)
+		opts := ArchiveDirOptions{
+			Excludes:       []string{"*.tmp"},
+			ExcludeRegexes: []string{`\.(test|spec)\.js$`, `(^|/)vendor/$`, `\.tmp$`},
+			// Excludes win over includes.
+			Includes:    []string{"**"},
+			SortEntries: true,
+		}
+		if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		var names []string
+		for _, entry := range archiver.Entries() {
+			names = append(names, entry.Name)
+		}
+		if wantNames := []string{"app.js", "lib/vendor"}; !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("%s: got entries %v, want %v", archiveType, names, wantNames)
+		}
+		if got := archiver.Skipped(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got skipped files %v, want %v", archiveType, got, want)
+		}
+
+		opts = ArchiveDirOptions{ExcludeRegexes: []string{`(unclosed`}}
+		if err := archiver.ArchiveDirWithOptions(dir, opts); err == nil {
+			t.Errorf("%s: expected error for a malformed regular expression", archiveType)
+		}
+	}
+}
+
+func TestArchiver_Progress(t *testing.T) {
+	dir := tempDir(t, "archive-progress")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(dir, "big.txt"), strings.Repeat("x", 100))
+	writeTestFile(t, filepath.Join(dir, "build", "out.txt"), "out")
+	writeTestFile(t, filepath.Join(dir, "sub", "b.txt"), "b")
+	writeTestFile(t, filepath.Join(dir, "sub", "c.txt"), "c")
+	want := []string{"a.txt", "sub/b.txt", "sub/c.txt"}
+
+	for _, tc := range []struct {
+		archiveType string
+		parallelism int
+	}{
+		{"zip", 0},
+		{"zip", 4},
+		{"tar.gz", 0},
+	} {
+		var got []string
+		archiver := getArchiver(tc.archiveType, "archive-progress."+tc.archiveType)
+		archiver.SetOptions(ArchiveOptions{
+			Progress: func(filesDone, filesTotal int, currentPath string) {
+				if filesDone != len(got)+1 || filesTotal != len(want) {
+					t.Errorf("%s: got progress %d of %d, want %d of %d", tc.archiveType, filesDone, filesTotal, len(got)+1, len(want))
+				}
+				got = append(got, currentPath)
+			},
+		})
+		opts := ArchiveDirOptions{
+			Excludes:    []string{"build"},
+			MaxFileSize: 10,
+			Parallelism: tc.parallelism,
+		}
+		if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.archiveType, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: parallelism %d: got progress for %v, want %v", tc.archiveType, tc.parallelism, got, want)
+		}
+		// Content added outside of a walk isn't reported.
+		if err := archiver.ArchiveContent([]byte("content"), "content.txt"); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.archiveType, err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: expected no progress for content, got %v", tc.archiveType, got)
+		}
+	}
+}
+
+func TestArchiver_AtomicOutput(t *testing.T) {
+	dir := tempDir(t, "archive-atomic")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(src, "b.txt"), strings.Repeat("b", 100))
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatalf("could not create output dir: %s", err)
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		outfile := filepath.Join(out, "archive."+archiveType)
+		writeTestFile(t, outfile, "previous archive")
+		archiver := getArchiver(archiveType, outfile)
+		// The second file takes the archive over its maximum size once the
+		// first has been written.
+		archiver.SetOptions(ArchiveOptions{MaxSize: 50})
+		if err := archiver.ArchiveDir(src); err == nil {
+			t.Fatalf("%s: expected error exceeding the maximum size", archiveType)
+		}
+		if got, err := ioutil.ReadFile(outfile); err != nil || string(got) != "previous archive" {
+			t.Errorf("%s: expected the previous archive to be left as it was, got %q: %v", archiveType, got, err)
+		}
+
+		archiver.SetOptions(ArchiveOptions{})
+		if err := archiver.ArchiveDir(src); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		if fi, err := os.Stat(outfile); err != nil || fi.Mode().Perm() != 0644 {
+			t.Errorf("%s: expected the archive to be written with mode 0644: %v", archiveType, err)
+		}
+		files, err := ioutil.ReadDir(out)
+		if err != nil {
+			t.Fatalf("could not read output dir: %s", err)
+		}
+		if len(files) != 1 || files[0].Name() != filepath.Base(outfile) {
+			t.Errorf("%s: expected only the archive in the output dir, got %d files", archiveType, len(files))
+		}
+		os.Remove(outfile)
+	}
+}
+
+func TestArchiver_MultipleOrdered(t *testing.T) {
+	content := []ContentEntry{
+		{Name: "MANIFEST", Content: []byte("z.txt\na.txt\n")},
+		{Name: "z.txt", Content: []byte("z")},
+		{Name: "a.txt", Content: []byte("a")},
+	}
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		archiver := getArchiver(archiveType, "archive-multiple-ordered."+archiveType)
+		if err := archiver.ArchiveMultipleOrdered(content); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		var names []string
+		for _, entry := range archiver.Entries() {
+			names = append(names, entry.Name)
+		}
+		if want := []string{"MANIFEST", "z.txt", "a.txt"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: got entries %v, want %v", archiveType, names, want)
+		}
+
+		duplicate := append(content, ContentEntry{Name: "./z.txt", Content: []byte("new z")})
+		if err := archiver.ArchiveMultipleOrdered(duplicate); err == nil {
+			t.Errorf("%s: expected error for a duplicate name", archiveType)
+		}
+		archiver.SetOptions(ArchiveOptions{Duplicates: DuplicatesOverwrite})
+		if err := archiver.ArchiveMultipleOrdered(duplicate); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		entries := archiver.Entries()
+		if len(entries) != 3 || entries[1].Name != "z.txt" || entries[1].Size != 5 {
+			t.Errorf("%s: expected the later z.txt to replace the earlier in place, got %v", archiveType, entries)
+		}
+	}
+}
+
+func TestSubstituteTransformer(t *testing.T) {
+	transform := SubstituteTransformer(map[string]string{
+		"ENV":    "prod",
+		"REGION": "${ENV}-west",
+		"A":      "a",
+		"A}B":    "ab",
+	})
+	cases := []struct {
+		content string
+		want    string
+	}{
+		{`{"env": "${ENV}", "region": "${REGION}"}`, `{"env": "prod", "region": "${ENV}-west"}`},
+		{"${UNSET} $ENV {ENV} ${ENV", "${UNSET} $ENV {ENV} ${ENV"},
+		{"${A}B}", "aB}"},
+		{"", ""},
+	}
+	for _, tc := range cases {
+		got, err := transform("config.json", []byte(tc.content))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("substituting %q: got %q, want %q", tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestArchiver_Transforms(t *testing.T) {
+	dir := tempDir(t, "archive-transforms")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "config.JSON"), "{\n  \"a\": 1\n}\n")
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), "left  as  it  is\n")
+	collapse := func(name string, content []byte) ([]byte, error) {
+		return []byte(strings.Join(strings.Fields(string(content)), "")), nil
+	}
+	wants := map[string][]byte{
+		"config.JSON": []byte(`{"a":1}`),
+		"notes.txt":   []byte("left  as  it  is\n"),
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		for _, parallelism := range []int{0, 2} {
+			outfile := fmt.Sprintf("archive-transforms-%d.%s", parallelism, archiveType)
+			archiver := getArchiver(archiveType, outfile)
+			archiver.SetOptions(ArchiveOptions{Transforms: map[string]FileTransformer{"json": collapse}})
+			if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Parallelism: parallelism}); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+			if archiveType == "zip" {
+				ensureContents(t, outfile, wants)
+			} else {
+				ensureTarGzContents(t, outfile, wants)
+			}
+			if entries := archiver.Entries(); entries[0].Size != int64(len(wants["config.JSON"])) {
+				t.Errorf("%s: expected the entry to record the transformed size, got %d", archiveType, entries[0].Size)
+			}
+		}
+
+		outfile := "archive-transforms-content." + archiveType
+		archiver := getArchiver(archiveType, outfile)
+		archiver.SetOptions(ArchiveOptions{Transforms: map[string]FileTransformer{".json": collapse}})
+		if err := archiver.ArchiveContent([]byte("{ \"b\": 2 }"), "content.json"); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		if archiveType == "zip" {
+			ensureContents(t, outfile, map[string][]byte{"content.json": []byte(`{"b":2}`)})
+		} else {
+			ensureTarGzContents(t, outfile, map[string][]byte{"content.json": []byte(`{"b":2}`)})
+		}
+
+		archiver.SetOptions(ArchiveOptions{Transforms: map[string]FileTransformer{"json": func(name string, content []byte) ([]byte, error) {
+			return nil, errors.New("invalid JSON")
+		}}})
+		err := archiver.ArchiveDir(dir)
+		var archiveErr *ArchiveError
+		if !errors.As(err, &archiveErr) || archiveErr.Op != "transforming file for archival" || archiveErr.Path != "config.JSON" {
+			t.Errorf("%s: expected an ArchiveError transforming config.JSON, got %v", archiveType, err)
+		}
+
+		// Extensions match regardless of case, so which of these applies
+		// would depend on the order of the map.
+		archiver.SetOptions(ArchiveOptions{Transforms: map[string]FileTransformer{".JSON": collapse, "json": collapse}})
+		if err := archiver.ArchiveDir(dir); err == nil || !strings.Contains(err.Error(), "are the same extension") {
+			t.Errorf("%s: expected error for transforms of the same extension, got %v", archiveType, err)
+		}
+	}
+}
+
+func TestArchiver_MaxFiles(t *testing.T) {
+	for _, tc := range []struct {
+		archiveType string
+		opts        ArchiveOptions
+		parallelism int
+	}{
+		{"zip", ArchiveOptions{}, 0},
+		{"zip", ArchiveOptions{}, 4},
+		{"zip", ArchiveOptions{ZipCreator: ZipCreatorInfoZipUnix}, 0},
+		{"tar.gz", ArchiveOptions{}, 0},
+	} {
+		archiver := getArchiver(tc.archiveType, "archive-max-files."+tc.archiveType)
+		opts := tc.opts
+		opts.MaxFiles = 3
+		archiver.SetOptions(opts)
+		dirOpts := ArchiveDirOptions{DirEntries: DirEntriesAll, Parallelism: tc.parallelism}
+		// Directory entries don't count.
+		if err := archiver.ArchiveDirWithOptions("./test-fixtures", dirOpts); err == nil || !strings.Contains(err.Error(), "maximum of 3 files") {
+			t.Errorf("%s: expected file limit error, got %v", tc.archiveType, err)
+		}
+		if err := archiver.ArchiveDirWithOptions("./test-fixtures/test-dir", dirOpts); err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.archiveType, err)
+		}
+
+		opts.MaxFiles = 1
+		archiver.SetOptions(opts)
+		err := archiver.ArchiveMultiple(map[string][]byte{"a.txt": []byte("a"), "b.txt": []byte("b")})
+		if err == nil || !strings.Contains(err.Error(), "maximum of 1 files while adding b.txt") {
+			t.Errorf("%s: expected file limit error for b.txt, got %v", tc.archiveType, err)
+		}
+	}
+}
+
+func TestArchiver_FileModes(t *testing.T) {
+	dir := tempDir(t, "archive-file-modes")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "bin", "handler"), "handler")
+	writeTestFile(t, filepath.Join(dir, "lib.txt"), "lib")
+	for _, name := range []string{"bin/handler", "lib.txt"} {
+		if err := os.Chmod(filepath.Join(dir, filepath.FromSlash(name)), 0644); err != nil {
+			t.Fatalf("could not change mode: %s", err)
+		}
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		archiver := getArchiver(archiveType, "archive-file-modes."+archiveType)
+		archiver.SetOptions(ArchiveOptions{
+			Prefix:    "opt",
+			FileModes: map[string]os.FileMode{"opt/bin/handler": 0755, "opt/handler": 0700},
+		})
+		if err := archiver.ArchiveDir(dir); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		modes := map[string]os.FileMode{}
+		for _, entry := range archiver.Entries() {
+			modes[entry.Name] = entry.Mode.Perm()
+		}
+		if want := map[string]os.FileMode{"opt/bin/handler": 0755, "opt/lib.txt": 0644}; !reflect.DeepEqual(modes, want) {
+			t.Errorf("%s: got modes %v, want %v", archiveType, modes, want)
+		}
+
+		// FileModes wins over FileMode, which applies to the other files.
+		archiver.SetOptions(ArchiveOptions{
+			FileMode:  0600,
+			FileModes: map[string]os.FileMode{"handler": 0755},
+		})
+		if err := archiver.ArchiveFile(filepath.Join(dir, "bin", "handler")); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		if entries := archiver.Entries(); entries[0].Mode.Perm() != 0755 {
+			t.Errorf("%s: expected mode 0755 from FileModes, got %04o", archiveType, entries[0].Mode.Perm())
+		}
+		if err := archiver.ArchiveFile(filepath.Join(dir, "lib.txt")); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		if entries := archiver.Entries(); entries[0].Mode.Perm() != 0600 {
+			t.Errorf("%s: expected mode 0600 from FileMode, got %04o", archiveType, entries[0].Mode.Perm())
+		}
+	}
+}
+
+func TestArchiver_DenyPatterns(t *testing.T) {
+	dir := tempDir(t, "archive-deny-patterns")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "main.txt"), "main")
+	writeTestFile(t, filepath.Join(dir, "deploy", "keys", "id_rsa"), "secret")
+	writeTestFile(t, filepath.Join(dir, "certs", "server.pem"), "secret")
+
+	cases := []struct {
+		opts ArchiveDirOptions
+		err  string
+	}{
+		{ArchiveDirOptions{DenyPatterns: []string{"*.key"}}, ""},
+		{ArchiveDirOptions{DenyPatterns: []string{"id_rsa"}}, `deploy/keys/id_rsa, which matches the deny pattern "id_rsa"`},
+		{ArchiveDirOptions{DenyPatterns: []string{"**/*.pem"}}, `certs/server.pem, which matches the deny pattern "**/*.pem"`},
+		{ArchiveDirOptions{DenyPatterns: []string{"deploy/keys"}}, `deploy/keys, which matches the deny pattern "deploy/keys"`},
+		// Files that are left out anyway don't fail the archive.
+		{ArchiveDirOptions{DenyPatterns: []string{"id_rsa", "*.pem"}, Excludes: []string{"deploy/**", "certs"}}, ""},
+	}
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		for i, tc := range cases {
+			archiver := getArchiver(archiveType, "archive-deny-patterns."+archiveType)
+			err := archiver.ArchiveDirWithOptions(dir, tc.opts)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("%s: case %d: unexpected error: %s", archiveType, i, err)
+			case tc.err != "" && (err == nil || !strings.Contains(filepath.ToSlash(err.Error()), tc.err)):
+				t.Errorf("%s: case %d: expected error containing %q, got %v", archiveType, i, tc.err, err)
+			}
+		}
+	}
+
+	archiver := getArchiver("zip", "archive-deny-patterns.zip")
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DenyPatterns: []string{"[oops"}}); err == nil {
+		t.Errorf("expected error for a malformed deny pattern")
+	}
+}
+
+func TestArchiver_ContinueOnError(t *testing.T) {
+	dir := tempDir(t, "archive-continue-on-error")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "main.txt"), "main")
+	if err := os.Symlink("missing.txt", filepath.Join(dir, "broken.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+	// Root can read any file, so only the broken symlink is unreadable
+	// when the tests run as root.
+	unreadable := []string{"broken.txt"}
+	if os.Geteuid() != 0 {
+		writeTestFile(t, filepath.Join(dir, "secret.txt"), "secret")
+		if err := os.Chmod(filepath.Join(dir, "secret.txt"), 0); err != nil {
+			t.Fatalf("could not change mode: %s", err)
+		}
+		unreadable = append(unreadable, "secret.txt")
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		for _, opts := range []ArchiveDirOptions{
+			{ContinueOnError: true},
+			{ContinueOnError: true, SortEntries: true},
+			{ContinueOnError: true, Parallelism: 2},
+		} {
+			archiver := getArchiver(archiveType, "archive-continue-on-error."+archiveType)
+			if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{}); err == nil {
+				t.Errorf("%s: expected error for an unreadable file", archiveType)
+			}
+			if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+			var got []string
+			for _, file := range archiver.Skipped() {
+				if file.Reason != SkippedUnreadable || file.Err == nil {
+					t.Errorf("%s: expected %s to be unreadable with an error, got %+v", archiveType, file.Name, file)
+				}
+				got = append(got, file.Name)
+			}
+			if !reflect.DeepEqual(got, unreadable) {
+				t.Errorf("%s: got unreadable files %v, want %v", archiveType, got, unreadable)
+			}
+			if entries := archiver.Entries(); len(entries) != 1 || entries[0].Name != "main.txt" {
+				t.Errorf("%s: expected only main.txt to be archived, got %+v", archiveType, entries)
+			}
+		}
+		os.Remove("archive-continue-on-error." + archiveType)
+	}
+}
+
+func TestArchiver_MaxNameLength(t *testing.T) {
+	dir := tempDir(t, "archive-max-name-length")
+	defer os.RemoveAll(dir)
+	long := strings.Repeat("a", 20)
+	writeTestFile(t, filepath.Join(dir, "node_modules", long, "index.js"), "")
+
+	cases := []struct {
+		options ArchiveOptions
+		err     string
+	}{
+		{ArchiveOptions{}, ""},
+		{ArchiveOptions{MaxNameLength: 42, MaxNameComponentLength: 20}, ""},
+		{ArchiveOptions{MaxNameLength: 41}, "archive entry node_modules/" + long + "/index.js is 42 bytes long"},
+		{ArchiveOptions{MaxNameComponentLength: 19}, "archive entry node_modules/" + long + "/index.js has a component, " + long + ", that is 20 bytes long"},
+	}
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		for i, tc := range cases {
+			archiver := getArchiver(archiveType, "archive-max-name-length."+archiveType)
+			archiver.SetOptions(tc.options)
+			err := archiver.ArchiveDir(dir)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("%s: case %d: unexpected error: %s", archiveType, i, err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("%s: case %d: expected error containing %q, got %v", archiveType, i, tc.err, err)
+			}
+		}
+
+		// Entries copied from a base archive are checked as well.
+		base := "archive-max-name-length-base." + archiveType
+		if err := getArchiver(archiveType, base).ArchiveDir(dir); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		archiver := getArchiver(archiveType, "archive-max-name-length."+archiveType)
+		archiver.SetOptions(ArchiveOptions{BaseArchive: base, MaxNameLength: 41})
+		err := archiver.ArchiveContent([]byte("short"), "short.txt")
+		if want := "archive entry node_modules/" + long + "/index.js is 42 bytes long"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error containing %q for the base archive, got %v", archiveType, want, err)
+		}
+		os.Remove(base)
+	}
+}
+
+func TestArchiver_OutputPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("could not get working directory: %s", err)
+	}
+	defer os.Chdir(wd)
+	dir := tempDir(t, "archive-output-path")
+	defer os.RemoveAll(dir)
+	// The temporary directory may be reached through a symlink, as on
+	// macOS, which Getwd resolves.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatalf("could not resolve temp dir: %s", err)
+	}
+	writeTestFile(t, filepath.Join(dir, "file.txt"), "file")
+	if err := os.Mkdir(filepath.Join(dir, "other"), 0755); err != nil {
+		t.Fatalf("could not create dir: %s", err)
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz", "gz"} {
+		if err := os.Chdir(dir); err != nil {
+			t.Fatalf("could not change working directory: %s", err)
+		}
+		// Relative paths are resolved against the working directory when
+		// the archiver is created, however it changes afterwards.
+		archiver := getArchiver(archiveType, "out/archive."+archiveType)
+		bad := getArchiver(archiveType, filepath.Join("file.txt", "archive."+archiveType))
+		if err := os.Chdir(filepath.Join(dir, "other")); err != nil {
+			t.Fatalf("could not change working directory: %s", err)
+		}
+		archiver.SetOptions(ArchiveOptions{CreateOutputDir: true})
+		if err := archiver.ArchiveContent([]byte("content"), "content.txt"); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "out", "archive."+archiveType)); err != nil {
+			t.Errorf("%s: expected the archive relative to the original working directory: %s", archiveType, err)
+		}
+
+		err := bad.ArchiveContent([]byte("content"), "content.txt")
+		if want := filepath.Join(dir, "file.txt", "archive."+archiveType); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error naming %s, got %v", archiveType, want, err)
+		}
+	}
+}
+
+func TestArchiver_Tee(t *testing.T) {
+	dir := tempDir(t, "archive-tee")
+	defer os.RemoveAll(dir)
+
+	for _, archiveType := range []string{"zip", "tar.gz", "gz"} {
+		outfile := filepath.Join(dir, "archive."+archiveType)
+		checksums := newChecksumWriter()
+		archiver := getArchiver(archiveType, outfile)
+		// Entries added out of order are sorted by writing the archive again,
+		// which has to start the checksums over.
+		archiver.SetOptions(ArchiveOptions{SortEntries: archiveType != "gz", Tee: checksums})
+		if archiveType == "gz" {
+			if err := archiver.ArchiveContent([]byte("This is content"), "content.txt"); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+		} else {
+			if err := archiver.Open(); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+			for _, name := range []string{"b.txt", "a.txt"} {
+				if err := archiver.AddContent([]byte("This is content"), name); err != nil {
+					t.Fatalf("%s: unexpected error: %s", archiveType, err)
+				}
+			}
+			if err := archiver.Close(); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+		}
+
+		want, err := genFileShas(outfile)
+		if err != nil {
+			t.Fatalf("could not generate checksums: %s", err)
+		}
+		if got := checksums.sums(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got checksums %+v, want %+v", archiveType, got, want)
+		}
+	}
+}
+
+func TestArchiver_Busy(t *testing.T) {
+	dir := tempDir(t, "archive-busy")
+	defer os.RemoveAll(dir)
+	infile := filepath.Join(dir, "held.txt")
+	writeTestFile(t, infile, "held")
+
+	for _, archiveType := range []string{"zip", "tar.gz", "gz"} {
+		archiver := getArchiver(archiveType, filepath.Join(dir, "archive."+archiveType))
+		// The transform holds the first call in the middle of writing the
+		// archive until the second has been made.
+		started, release := make(chan struct{}), make(chan struct{})
+		archiver.SetOptions(ArchiveOptions{Transforms: map[string]FileTransformer{".txt": func(name string, content []byte) ([]byte, error) {
+			close(started)
+			<-release
+			return content, nil
+		}}})
+		done := make(chan error)
+		go func() {
+			done <- archiver.ArchiveFile(infile)
+		}()
+		<-started
+		err := archiver.ArchiveContent([]byte("content"), "content.md")
+		if err == nil || !strings.Contains(err.Error(), "already being written by another call") {
+			t.Errorf("%s: expected error while another call is writing the archive, got %v", archiveType, err)
+		}
+		close(release)
+		if err := <-done; err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		if err := archiver.ArchiveContent([]byte("content"), "content.md"); err != nil {
+			t.Errorf("%s: expected the archiver to be reusable once the first call finished, got %s", archiveType, err)
+		}
+	}
+}
+
+func TestArchiver_ArchiveError(t *testing.T) {
+	dir := tempDir(t, "archive-error")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "file.txt"), "file")
+	link := filepath.Join(dir, "missing.txt")
+	if err := os.Symlink("nowhere.txt", link); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		archiver := getArchiver(archiveType, "archive-error."+archiveType)
+		err := archiver.ArchiveDir(dir)
+		var archiveErr *ArchiveError
+		if !errors.As(err, &archiveErr) {
+			t.Fatalf("%s: expected an ArchiveError, got %v", archiveType, err)
+		}
+		if archiveErr.Op != "following symlink for archival" || archiveErr.Path != link {
+			t.Errorf("%s: got error %q on %s, want it to follow %s", archiveType, archiveErr.Op, archiveErr.Path, link)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected the error to wrap %s, got %v", archiveType, os.ErrNotExist, err)
+		}
+
+		// Errors that aren't about an entry wrap their cause too.
+		archiver = getArchiver(archiveType, "archive-error."+archiveType)
+		archiver.SetOptions(ArchiveOptions{BaseArchive: filepath.Join(dir, "base."+archiveType)})
+		err = archiver.ArchiveContent([]byte("file"), "file.txt")
+		if err == nil || !strings.Contains(err.Error(), "error opening base archive") || !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected the error opening the base archive to wrap %s, got %v", archiveType, os.ErrNotExist, err)
+		}
+	}
+}
+
+func TestArchiver_Order(t *testing.T) {
+	want := []string{"file3.txt", "file1.txt", "file2.txt"}
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		outputPath := "archive-order." + archiveType
+		archiver := getArchiver(archiveType, outputPath)
+		archiver.SetOptions(ArchiveOptions{Order: []string{"file3.txt", "file1.txt"}})
+		if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		var names []string
+		for _, entry := range archiver.Entries() {
+			names = append(names, entry.Name)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: got entries %v, want %v", archiveType, names, want)
+		}
+		if archiveType == "zip" {
+			r, err := zip.OpenReader(outputPath)
+			if err != nil {
+				t.Fatalf("could not open archive: %s", err)
+			}
+			names = nil
+			for _, f := range r.File {
+				names = append(names, f.Name)
+			}
+			r.Close()
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("got archived entries %v, want %v", names, want)
+			}
+		}
+
+		archiver.SetOptions(ArchiveOptions{Order: []string{"missing.txt"}})
+		if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err == nil || !strings.Contains(err.Error(), "missing.txt") {
+			t.Errorf("%s: expected error for an ordered entry that isn't in the archive, got %v", archiveType, err)
+		}
+		os.Remove(outputPath)
+	}
+}
+
+func TestArchiver_SortEntries(t *testing.T) {
+	adds := []func(a Archiver) error{
+		func(a Archiver) error {
+			return a.AddDir(context.Background(), "./test-fixtures/test-dir", ArchiveDirOptions{})
+		},
+		func(a Archiver) error {
+			return a.AddContent([]byte("This is content"), "content/a.txt")
+		},
+		func(a Archiver) error {
+			return a.AddFile("./test-fixtures/test-file.txt", "test-file.txt")
+		},
+		func(a Archiver) error {
+			return a.AddContent([]byte("This is more content"), "content.txt")
+		},
+	}
+	want := []string{"content.txt", "content/a.txt", "file1.txt", "file2.txt", "file3.txt", "test-file.txt"}
+
+	for _, archiveType := range []string{"zip", "tar.gz"} {
+		var outputs [][]byte
+		for seed := int64(0); seed < 5; seed++ {
+			order := rand.New(rand.NewSource(seed)).Perm(len(adds))
+			outputPath := fmt.Sprintf("archive-sort-entries-%d.%s", seed, archiveType)
+			archiver := getArchiver(archiveType, outputPath)
+			archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true, SortEntries: true})
+			if err := archiver.Open(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for _, i := range order {
+				if err := adds[i](archiver); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if err := archiver.Close(); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+
+			var names []string
+			for _, entry := range archiver.Entries() {
+				names = append(names, entry.Name)
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("%s: order %v: got entries %v, want %v", archiveType, order, names, want)
+			}
+			b, err := ioutil.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("could not read archive: %s", err)
+			}
+			outputs = append(outputs, b)
+		}
+		for i := range outputs[1:] {
+			if !bytes.Equal(outputs[0], outputs[i+1]) {
+				t.Errorf("%s: expected identical output whatever the order entries are added in", archiveType)
+			}
+		}
+
+		var output bytes.Buffer
+		archiver := getArchiver(archiveType, "archive-sort-entries-output."+archiveType)
+		archiver.SetOptions(ArchiveOptions{SortEntries: true, Output: &output})
+		if err := archiver.ArchiveMultiple(map[string][]byte{"b.txt": nil, "a.txt": nil}); err != nil {
+			t.Errorf("%s: unexpected error archiving sorted content: %s", archiveType, err)
+		}
+		if err := archiver.Open(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		archiver.AddContent([]byte("b"), "b.txt")
+		archiver.AddContent([]byte("a"), "a.txt")
+		if err := archiver.Close(); err == nil || !strings.Contains(err.Error(), "can only be sorted") {
+			t.Errorf("%s: expected error sorting an archive written to Output, got %v", archiveType, err)
+		}
+	}
+}
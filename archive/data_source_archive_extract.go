@@ -0,0 +1,45 @@
+package archive
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceExtract() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceExtractRead,
+
+		Schema: map[string]*schema.Schema{
+			"source_path": &schema.Schema{
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Path of the zip archive to extract",
+			},
+			"output_dir": &schema.Schema{
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Directory the archive is extracted into",
+			},
+		},
+	}
+}
+
+func dataSourceExtractRead(d *schema.ResourceData, meta interface{}) error {
+	sourcePath := d.Get("source_path").(string)
+	outputDir := d.Get("output_dir").(string)
+
+	if err := Unzip(sourcePath, outputDir); err != nil {
+		return fmt.Errorf("error extracting archive: %w", err)
+	}
+
+	sums, err := genFileShas(sourcePath)
+	if err != nil {
+		return fmt.Errorf("could not generate file checksum sha1: %w", err)
+	}
+	d.SetId(sums.sha1)
+
+	return nil
+}
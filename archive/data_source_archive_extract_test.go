@@ -0,0 +1,57 @@
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	r "github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestAccArchiveExtract_Basic(t *testing.T) {
+	outputDir := filepath.Join(os.TempDir(), "test-extract")
+	defer os.RemoveAll(outputDir)
+
+	r.Test(t, r.TestCase{
+		Providers: testProviders,
+		Steps: []r.TestStep{
+			r.TestStep{
+				Config: fmt.Sprintf(testAccArchiveExtractConfig, outputDir),
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveExtractFile(filepath.Join(outputDir, "file1.txt"), "This is file 1"),
+					testAccArchiveExtractFile(filepath.Join(outputDir, "file2.txt"), "This is file 2"),
+					testAccArchiveExtractFile(filepath.Join(outputDir, "file3.txt"), "This is file 3"),
+				),
+			},
+		},
+	})
+}
+
+func testAccArchiveExtractFile(filename string, want string) r.TestCheckFunc {
+	return func(s *terraform.State) error {
+		got, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if string(got) != want {
+			return fmt.Errorf("mismatched content for %s, got %q, want %q", filename, got, want)
+		}
+		return nil
+	}
+}
+
+var testAccArchiveExtractConfig = `
+data "archive_file" "foo" {
+  type        = "zip"
+  source_dir  = "test-fixtures/test-dir"
+  output_path = "zip_extract_acc_test.zip"
+}
+
+data "archive_extract" "foo" {
+  source_path = "${data.archive_file.foo.output_path}"
+  output_dir  = "%s"
+}
+`
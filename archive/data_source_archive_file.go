@@ -1,16 +1,28 @@
 package archive
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/terraform/helper/hashcode"
 	"github.com/hashicorp/terraform/helper/schema"
@@ -65,141 +77,1674 @@ func dataSourceFile() *schema.Resource {
 				ForceNew:      true,
 				ConflictsWith: []string{"source_file", "source_dir"},
 			},
+			"source_content_mode": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ValidateFunc:  validateFileMode,
+				ConflictsWith: []string{"source_file", "source_dir"},
+				Description:   "Octal permission bits, such as 0755, stored for source_content",
+			},
 			"source_file": &schema.Schema{
 				Type:          schema.TypeString,
 				Optional:      true,
 				ForceNew:      true,
 				ConflictsWith: []string{"source_content", "source_content_filename", "source_dir"},
 			},
+			"source_files": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"source", "source_content", "source_content_filename", "source_file", "source_dir", "source_directory", "source_filename", "source_manifest"},
+				Description:   "Files to archive, each stored at its path relative to source_root",
+			},
+			"source_manifest": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"source", "source_content", "source_content_filename", "source_file", "source_dir", "source_directory", "source_filename"},
+				Description:   "File listing the files to archive, one path relative to source_root per line",
+			},
 			"source_dir": &schema.Schema{
 				Type:          schema.TypeString,
 				Optional:      true,
 				ForceNew:      true,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file", "source_directory"},
+			},
+			"source_directory": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"path": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						"prefix": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+						},
+					},
+				},
+				ConflictsWith: []string{"source", "source_content", "source_content_filename", "source_file", "source_dir"},
+			},
+			"excludes": &schema.Schema{
+				Type:          schema.TypeSet,
+				Optional:      true,
+				ForceNew:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"exclude_regex": &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				ForceNew: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateRegexp,
+				},
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Regular expressions matching the paths of files and directories to leave out",
+			},
+			"deny_patterns": &schema.Schema{
+				Type:          schema.TypeSet,
+				Optional:      true,
+				ForceNew:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Patterns of files and directories, such as credentials, whose presence fails the archive",
+			},
+			"includes": &schema.Schema{
+				Type:          schema.TypeSet,
+				Optional:      true,
+				ForceNew:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"ignore_file": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"include_hidden": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       true,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Whether files and directories whose names start with a dot are archived",
+			},
+			"symlink": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       SymlinkFollow,
+				ValidateFunc:  validateSymlinkPolicy,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"allow_empty": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       true,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"sort_entries": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				ForceNew: true,
+				Default:  false,
+			},
+			"order": &schema.Schema{
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Names of entries to write first, in this order, with the rest following sorted by name",
+			},
+			"follow_symlinks": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       false,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"exclude_symlink_directories": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       false,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file", "follow_symlinks"},
+				Description:   "Leave out symlinks to directories found in the directory, whatever symlink does with links to files",
+			},
+			"directory_entries": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       DirEntriesNone,
+				ValidateFunc:  validateDirEntriesPolicy,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"special_files": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       SpecialFilesError,
+				ValidateFunc:  validateSpecialFilesPolicy,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"skip_missing": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       false,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"continue_on_error": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       false,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Leave out the files that can't be read, listing their errors in errors, instead of failing the archive",
+			},
+			"max_file_size": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ForceNew:      true,
+				ValidateFunc:  validateMaxSize,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Size in bytes above which files found in the directory are left out, or 0 for no limit",
+			},
+			"flatten": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       false,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Store every file found in the directory at the archive root under its base name",
+			},
+			"strip_components": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       0,
+				ValidateFunc:  validateStripComponents,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file", "flatten"},
+				Description:   "Number of leading directories to drop from the path of each file found in the directory",
+			},
+			"include_source_dir": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       false,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Store the files found in the directory under the directory's base name",
+			},
+			"parallelism": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       1,
+				ValidateFunc:  validateParallelism,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+			},
+			"source_root": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_dir"},
+			},
+			"source_filename": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_dir", "source_root"},
+			},
+			"verify": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Whether the archive is read back and checked once it is written",
+			},
+			"timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateTimeout,
+				Description:  "Seconds archiving may take before it is stopped, or 0 for no limit",
+			},
+			"source_file_timeout": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       60,
+				ValidateFunc:  validateSourceFileTimeout,
+				ConflictsWith: []string{"source_content", "source_content_filename", "source_dir"},
+				Description:   "Seconds to wait for source_file to download when it is a URL",
+			},
+			"normalize_timestamps": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Store a fixed modification time for every entry so archives are reproducible",
+			},
+			"mtime": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ValidateFunc:  validateModTime,
+				ConflictsWith: []string{"normalize_timestamps"},
+				Description:   "RFC 3339 timestamp stored as the modification time of every file",
+			},
+			"directory_mode": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       "0755",
+				ValidateFunc:  validateFileMode,
 				ConflictsWith: []string{"source_content", "source_content_filename", "source_file"},
+				Description:   "Octal permission bits, such as 0775, stored for directory entries",
+			},
+			"file_mode": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateFileMode,
+				Description:  "Octal permission bits, such as 0644, stored for every file instead of its own",
+			},
+			"file_modes": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				ForceNew:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateFileModes,
+				Description:  "Octal permission bits, such as 0755, stored for the files stored under each of the given names instead of their own",
+			},
+			"owner": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateOwner,
+				Description:  "UID:GID stored as the owner of every tar entry",
+			},
+			"compression": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      CompressionDeflate,
+				ValidateFunc: validateCompression,
+				Description:  "Method zip entries are compressed with, deflate or zstd",
+			},
+			"store_compressed": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				Default:       false,
+				ConflictsWith: []string{"store_extensions"},
+				Description:   "Store files of common already compressed formats without compressing them",
+			},
+			"store_extensions": &schema.Schema{
+				Type:          schema.TypeSet,
+				Optional:      true,
+				ForceNew:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"store_compressed"},
+				Description:   "Extensions of files to store without compressing them",
+			},
+			"substitutions": &schema.Schema{
+				Type:        schema.TypeMap,
+				Optional:    true,
+				ForceNew:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Values substituted for ${NAME} placeholders in the files with substitution_extensions",
+			},
+			"substitution_extensions": &schema.Schema{
+				Type:        schema.TypeSet,
+				Optional:    true,
+				ForceNew:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Extensions of the files placeholders are substituted in",
+			},
+			"extension_compression": &schema.Schema{
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Compression method and level of the zip entries of files with the given extensions",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"extensions": &schema.Schema{
+							Type:     schema.TypeSet,
+							Required: true,
+							ForceNew: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+						"method": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							ValidateFunc: validateCompression,
+						},
+						"level": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ForceNew:     true,
+							Default:      compressionLevelDefault,
+							ValidateFunc: validateCompressionLevel,
+						},
+					},
+				},
+			},
+			"min_compress_size": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      0,
+				ValidateFunc: validateMaxSize,
+				Description:  "Size in bytes below which files are stored in zip archives without compression",
+			},
+			"compression_level": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      compressionLevelDefault,
+				ValidateFunc: validateCompressionLevel,
+				Description:  "Compression level from 1 (fastest) to 9 (smallest), 0 to store entries uncompressed, or -1 for the default level",
+			},
+			"prefix": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Directory inside the archive that every file is stored under",
+			},
+			"lambda_layer_runtime": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ValidateFunc:  validateLambdaLayerRuntime,
+				ConflictsWith: []string{"prefix"},
+				Description:   "AWS Lambda runtime, such as python3.12, whose layer directory every file is stored under",
+			},
+			"comment": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Comment to store in the archive, such as a build identifier",
+			},
+			"base_archive": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Existing archive whose entries are copied into the output before the sources",
+			},
+			"duplicates": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      DuplicatesError,
+				ValidateFunc: validateDuplicatesPolicy,
+				Description:  "What to do when two files are stored under the same path: error or overwrite",
+			},
+			"zip_creator": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      zipCreatorGo,
+				ValidateFunc: validateZipCreator,
+				Description:  "Tool whose zip entry headers are matched: go or info-zip-unix",
+			},
+			"zip_data_descriptors": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Write every zip file entry with a data descriptor, for streaming extractors",
+			},
+			"utf8_names": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Mark the name of every zip entry as UTF-8, not only non-ASCII names",
+			},
+			"case_insensitive_check": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      CaseCheckNone,
+				ValidateFunc: validateCaseCheck,
+				Description:  "What to do when two paths differ only in case: none, warn or error",
+			},
+			"max_size": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateMaxSize,
+				Description:  "Maximum number of uncompressed bytes the archive may contain, or 0 for no limit",
+			},
+			"max_files": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateMaxSize,
+				Description:  "Maximum number of files the archive may contain, or 0 for no limit",
+			},
+			"max_name_length": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateMaxSize,
+				Description:  "Maximum length, in bytes, of the name of an entry, or 0 for no limit",
+			},
+			"max_name_component_length": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateMaxSize,
+				Description:  "Maximum length, in bytes, of each directory and file name in the name of an entry, or 0 for no limit",
 			},
 			"output_path": &schema.Schema{
 				Type:     schema.TypeString,
 				Required: true,
 			},
+			"split_size": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ForceNew:      true,
+				ValidateFunc:  validateSplitSize,
+				ConflictsWith: []string{"cache"},
+				Description:   "Size in bytes of the volumes a zip archive is split into, or 0 to not split it",
+			},
+			"output_parts": &schema.Schema{
+				Type:        schema.TypeList,
+				Computed:    true,
+				ForceNew:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Paths of the volumes the archive was split into, in order, ending with output_path",
+			},
+			"output_base64_enabled": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Export the archive itself, base64 encoded, as output_base64",
+			},
+			"dry_run": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Compute the archive's checksums and contents without writing output_path",
+			},
+			"cache": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Skip writing the archive when output_path was written from the same arguments and files, as recorded in <output_path>.fingerprint",
+			},
 			"output_size": &schema.Schema{
 				Type:     schema.TypeInt,
 				Computed: true,
 				ForceNew: true,
 			},
+			"uncompressed_size": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Total size of the archive's entries before compression",
+			},
+			"content_hash": &schema.Schema{
+				Type:        schema.TypeString,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Hash of the names and content of the archive's files, ignoring their metadata and compression",
+			},
+			"output_base64": &schema.Schema{
+				Type:        schema.TypeString,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Base64 encoded archive, when output_base64_enabled is set",
+			},
 			"output_sha": &schema.Schema{
 				Type:        schema.TypeString,
 				Computed:    true,
 				ForceNew:    true,
 				Description: "SHA1 checksum of output file",
 			},
+			"output_sha256": &schema.Schema{
+				Type:        schema.TypeString,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "SHA256 checksum of output file",
+			},
 			"output_base64sha256": &schema.Schema{
 				Type:        schema.TypeString,
 				Computed:    true,
 				ForceNew:    true,
 				Description: "Base64 Encoded SHA256 checksum of output file",
 			},
+			"output_sha512": &schema.Schema{
+				Type:        schema.TypeString,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "SHA512 checksum of output file",
+			},
 			"output_md5": &schema.Schema{
 				Type:        schema.TypeString,
 				Computed:    true,
 				ForceNew:    true,
 				Description: "MD5 of output file",
 			},
+			"skipped_files": &schema.Schema{
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Files and directories found in source_dir or source_directory that were left out of the archive, and why",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"reason": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"pattern": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"error": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+			"errors": &schema.Schema{
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Errors reading the files left out by continue_on_error",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"contents": &schema.Schema{
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Entries written to the archive, in the order they were written",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"size": &schema.Schema{
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"mode": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"crc32": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"md5": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
 		},
 	}
 }
 
 func dataSourceFileRead(d *schema.ResourceData, meta interface{}) error {
 	outputPath := d.Get("output_path").(string)
+	base64Enabled := d.Get("output_base64_enabled").(bool)
 
-	outputDirectory := path.Dir(outputPath)
-	if outputDirectory != "" {
-		if _, err := os.Stat(outputDirectory); err != nil {
-			if err := os.MkdirAll(outputDirectory, 0755); err != nil {
-				return err
-			}
+	// The checksums are computed while the archive is written, rather than
+	// by reading it back.
+	checksums := newChecksumWriter()
+	// A dry run writes the archive to a temporary directory instead of to
+	// output_path, as sorting entries or overwriting duplicates rewrites
+	// the file.
+	archivePath := outputPath
+	// The archive_file resource has no dry_run, as it always writes the archive.
+	dryRun, _ := d.Get("dry_run").(bool)
+	if dryRun {
+		dir, err := ioutil.TempDir("", "terraform-provider-archive")
+		if err != nil {
+			return fmt.Errorf("could not create directory for dry run: %w", err)
 		}
+		defer os.RemoveAll(dir)
+		archivePath = filepath.Join(dir, filepath.Base(outputPath))
 	}
 
-	if err := archive(d); err != nil {
-		return err
+	archiveType := d.Get("type").(string)
+	archiver := getArchiver(archiveType, archivePath)
+	if archiver == nil {
+		return fmt.Errorf("archive type not supported: %s", archiveType)
+	}
+	// The volumes of a split archive are named after output_path, with the
+	// last at output_path itself.
+	splitSize := int64(d.Get("split_size").(int))
+	if splitSize > 0 && archiveType != "zip" {
+		return fmt.Errorf("split_size is only supported for zip archives, got %s", archiveType)
+	}
+	if splitSize > 0 && !strings.EqualFold(filepath.Ext(outputPath), ".zip") {
+		return fmt.Errorf("split_size needs an output_path ending in .zip, got %s", outputPath)
+	}
+	ctx, cancel := archiveContext(meta, d)
+	defer cancel()
+	fingerprintPath := outputPath + ".fingerprint"
+	var fingerprint string
+	var cache *archiveCache
+	if d.Get("cache").(bool) && !dryRun {
+		var err error
+		if fingerprint, err = inputFingerprint(d); err != nil {
+			return err
+		}
+		if fingerprint != "" {
+			if cache, err = readCachedArchive(outputPath, fingerprintPath, fingerprint, checksums); err != nil {
+				return err
+			}
+		}
+	}
+	if cache != nil {
+		setArchiveEntries(d, cache.Entries, cache.Skipped)
+	} else {
+		if err := archive(ctx, d, archiver, nil, checksums); err != nil {
+			return err
+		}
+		// The fingerprint was found before the files were read, so one
+		// changed while the archive was written gives another fingerprint
+		// the next time.
+		if fingerprint != "" {
+			cache = &archiveCache{
+				Fingerprint: fingerprint,
+				Entries:     archiver.Entries(),
+				Skipped:     flattenSkippedFiles(archiver.Skipped()),
+			}
+			if err := writeArchiveCache(fingerprintPath, cache); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Generate archived file stats
-	fi, err := os.Stat(outputPath)
-	if err != nil {
-		return err
-	}
+	sums := checksums.sums()
+	d.Set("output_sha", sums.sha1)
+	d.Set("output_sha256", sums.sha256)
+	d.Set("output_base64sha256", sums.base64sha256)
+	d.Set("output_sha512", sums.sha512)
+	d.Set("output_md5", sums.md5)
 
-	sha1, base64sha256, md5, err := genFileShas(outputPath)
-	if err != nil {
+	d.Set("output_size", sums.size)
 
-		return fmt.Errorf("could not generate file checksum sha256: %s", err)
+	// The archive is only stored in the state when asked for, as it can
+	// be large.
+	if base64Enabled {
+		b, err := ioutil.ReadFile(archivePath)
+		if err != nil {
+			return fmt.Errorf("could not read archive for base64 encoding: %w", err)
+		}
+		d.Set("output_base64", base64.StdEncoding.EncodeToString(b))
+	} else {
+		d.Set("output_base64", "")
+	}
+
+	// The archive is split once it is complete, so that its checksums and
+	// output_base64 are still of the whole archive.
+	var parts []string
+	if splitSize > 0 && !dryRun {
+		var err error
+		if parts, err = splitZipFile(outputPath, splitSize); err != nil {
+			return err
+		}
 	}
-	d.Set("output_sha", sha1)
-	d.Set("output_base64sha256", base64sha256)
-	d.Set("output_md5", md5)
+	d.Set("output_parts", parts)
 
-	d.Set("output_size", fi.Size())
 	d.SetId(d.Get("output_sha").(string))
 
 	return nil
 }
 
-func archive(d *schema.ResourceData) error {
-	archiveType := d.Get("type").(string)
-	outputPath := d.Get("output_path").(string)
+// archiveContext returns the context archiving for d stops with: the
+// provider's stop context, with a deadline when the timeout attribute is set.
+func archiveContext(meta interface{}, d *schema.ResourceData) (context.Context, context.CancelFunc) {
+	ctx := stopContext(meta)
+	if timeout := d.Get("timeout").(int); timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
 
-	archiver := getArchiver(archiveType, outputPath)
-	if archiver == nil {
-		return fmt.Errorf("archive type not supported: %s", archiveType)
+// archive writes the archive described by d with archiver, to output, or to
+// the archiver's path when output is nil, copying what is written to the
+// path to tee when it is set.
+func archive(ctx context.Context, d *schema.ResourceData, archiver Archiver, output, tee io.Writer) error {
+	// The time was checked by validateModTime.
+	modTime, _ := expandModTime(d.Get("mtime").(string))
+	// As is the owner, by validateOwner.
+	owner, _ := expandOwner(d.Get("owner").(string))
+	prefix := d.Get("prefix").(string)
+	if runtime, ok := d.GetOk("lambda_layer_runtime"); ok {
+		// The runtime was checked by validateLambdaLayerRuntime.
+		prefix, _ = lambdaLayerPrefix(runtime.(string))
+	}
+	var storeExtensions []string
+	if v, ok := d.GetOk("store_extensions"); ok {
+		storeExtensions = expandStringSet(v.(*schema.Set))
+	} else if d.Get("store_compressed").(bool) {
+		storeExtensions = CompressedExtensions
+	}
+	extensionCompression, err := expandExtensionCompression(d.Get("extension_compression").([]interface{}))
+	if err != nil {
+		return err
+	}
+	transforms, err := expandSubstitutions(d)
+	if err != nil {
+		return err
+	}
+	archiver.SetOptions(ArchiveOptions{
+		NormalizeTimestamps:    d.Get("normalize_timestamps").(bool),
+		DirMode:                expandFileMode(d.Get("directory_mode").(string)),
+		FileMode:               expandFileMode(d.Get("file_mode").(string)),
+		FileModes:              expandFileModes(d.Get("file_modes").(map[string]interface{})),
+		Transforms:             transforms,
+		ModTime:                modTime,
+		CompressionLevel:       expandCompressionLevel(d.Get("compression_level").(int)),
+		Compression:            d.Get("compression").(string),
+		StoreExtensions:        storeExtensions,
+		ExtensionCompression:   extensionCompression,
+		MinCompressSize:        int64(d.Get("min_compress_size").(int)),
+		Comment:                d.Get("comment").(string),
+		Prefix:                 prefix,
+		BaseArchive:            d.Get("base_archive").(string),
+		Duplicates:             d.Get("duplicates").(string),
+		CaseInsensitiveCheck:   d.Get("case_insensitive_check").(string),
+		ZipCreator:             zipCreators[d.Get("zip_creator").(string)],
+		UTF8Names:              d.Get("utf8_names").(bool),
+		ZipDataDescriptors:     d.Get("zip_data_descriptors").(bool),
+		MaxSize:                int64(d.Get("max_size").(int)),
+		MaxFiles:               d.Get("max_files").(int),
+		MaxNameLength:          d.Get("max_name_length").(int),
+		MaxNameComponentLength: d.Get("max_name_component_length").(int),
+		SortEntries:            d.Get("sort_entries").(bool),
+		Order:                  expandStringList(d.Get("order").([]interface{})),
+		CreateOutputDir:        true,
+		Owner:                  owner,
+		Verify:                 d.Get("verify").(bool),
+		Output:                 output,
+		Tee:                    tee,
+		Progress:               logProgress(progressLogInterval),
+	})
+
+	if err := archiveSources(ctx, d, archiver); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			files := 0
+			for _, entry := range archiver.Entries() {
+				if !strings.HasSuffix(entry.Name, "/") {
+					files++
+				}
+			}
+			return fmt.Errorf("archiving timed out after %d seconds, with %d files archived: %w", d.Get("timeout").(int), files, err)
+		}
+		return err
+	}
+
+	skipped := archiver.Skipped()
+	if len(skipped) > 0 {
+		log.Printf("[WARN] %d files and directories were left out of the archive: %s", len(skipped), describeSkippedFiles(skipped))
+	}
+	if readErrors := setArchiveEntries(d, archiver.Entries(), flattenSkippedFiles(skipped)); len(readErrors) > 0 {
+		log.Printf("[WARN] %d files couldn't be read and were left out of the archive: %s", len(readErrors), strings.Join(readErrors, "; "))
 	}
+	return nil
+}
 
+// setArchiveEntries sets the attributes of d describing the entries of the
+// archive and the files left out of it, flattened by flattenSkippedFiles,
+// returning the errors of those that couldn't be read.
+func setArchiveEntries(d *schema.ResourceData, entries []ArchiveEntry, skipped []interface{}) []string {
+	d.Set("contents", flattenArchiveEntries(entries))
+	var uncompressed int64
+	for _, entry := range entries {
+		uncompressed += entry.Size
+	}
+	d.Set("uncompressed_size", int(uncompressed))
+	d.Set("content_hash", contentHash(entries))
+	d.Set("skipped_files", skipped)
+	var readErrors []string
+	for _, v := range skipped {
+		file := v.(map[string]interface{})
+		if err := file["error"].(string); err != "" {
+			readErrors = append(readErrors, fmt.Sprintf("%s: %s", file["name"], err))
+		}
+	}
+	d.Set("errors", readErrors)
+	return readErrors
+}
+
+// archiveSources archives the sources configured in d.
+func archiveSources(ctx context.Context, d *schema.ResourceData, archiver Archiver) error {
 	if dir, ok := d.GetOk("source_dir"); ok {
-		if err := archiver.ArchiveDir(dir.(string)); err != nil {
-			return fmt.Errorf("error archiving directory: %s", err)
+		if err := archiver.ArchiveDirContext(ctx, dir.(string), expandDirOptions(d)); err != nil {
+			return fmt.Errorf("error archiving directory: %w", err)
+		}
+	} else if v, ok := d.GetOk("source_directory"); ok {
+		if err := archiver.ArchiveDirsContext(ctx, expandDirSources(v.([]interface{})), expandDirOptions(d)); err != nil {
+			return fmt.Errorf("error archiving directories: %w", err)
 		}
 	} else if file, ok := d.GetOk("source_file"); ok {
-		if err := archiver.ArchiveFile(file.(string)); err != nil {
-			return fmt.Errorf("error archiving file: %s", err)
+		if isURL(file.(string)) {
+			name := d.Get("source_filename").(string)
+			if name == "" {
+				var err error
+				if name, err = urlFileName(file.(string)); err != nil {
+					return fmt.Errorf("error archiving file: %w", err)
+				}
+			}
+			timeout := time.Duration(d.Get("source_file_timeout").(int)) * time.Second
+			if err := archiveURL(ctx, archiver, file.(string), name, timeout); err != nil {
+				return fmt.Errorf("error archiving file: %w", err)
+			}
+		} else if name, ok := d.GetOk("source_filename"); ok {
+			if err := archiver.ArchiveFileAs(file.(string), name.(string)); err != nil {
+				return fmt.Errorf("error archiving file: %w", err)
+			}
+		} else if err := archiver.ArchiveFileFrom(file.(string), d.Get("source_root").(string)); err != nil {
+			return fmt.Errorf("error archiving file: %w", err)
+		}
+	} else if v, ok := d.GetOk("source_files"); ok {
+		if err := archiver.ArchiveFiles(expandStringList(v.([]interface{})), d.Get("source_root").(string)); err != nil {
+			return fmt.Errorf("error archiving files: %w", err)
+		}
+	} else if manifest, ok := d.GetOk("source_manifest"); ok {
+		files, base, err := readSourceManifest(manifest.(string), d.Get("source_root").(string))
+		if err != nil {
+			return fmt.Errorf("error reading source manifest: %w", err)
+		}
+		if err := archiver.ArchiveFiles(files, base); err != nil {
+			return fmt.Errorf("error archiving files: %w", err)
 		}
 	} else if filename, ok := d.GetOk("source_content_filename"); ok {
 		content := d.Get("source_content").(string)
-		if err := archiver.ArchiveContent([]byte(content), filename.(string)); err != nil {
-			return fmt.Errorf("error archiving content: %s", err)
+		var err error
+		if mode, ok := d.GetOk("source_content_mode"); ok {
+			err = archiver.ArchiveContentMode([]byte(content), filename.(string), expandFileMode(mode.(string)))
+		} else {
+			err = archiver.ArchiveContent([]byte(content), filename.(string))
+		}
+		if err != nil {
+			return fmt.Errorf("error archiving content: %w", err)
 		}
 	} else if v, ok := d.GetOk("source"); ok {
 		vL := v.(*schema.Set).List()
 		content := make(map[string][]byte)
 		for _, v := range vL {
 			src := v.(map[string]interface{})
-			content[src["filename"].(string)] = []byte(src["content"].(string))
+			filename := src["filename"].(string)
+			if _, ok := content[filename]; ok {
+				return fmt.Errorf("error archiving content: more than one source block has the filename %s", filename)
+			}
+			content[filename] = []byte(src["content"].(string))
 		}
 		if err := archiver.ArchiveMultiple(content); err != nil {
-			return fmt.Errorf("error archiving content: %s", err)
+			return fmt.Errorf("error archiving content: %w", err)
 		}
 	} else {
-		return fmt.Errorf("one of 'source_dir', 'source_file', 'source_content_filename' must be specified")
+		return fmt.Errorf("one of 'source_dir', 'source_directory', 'source_file', 'source_files', 'source_manifest', 'source_content_filename' must be specified")
 	}
 	return nil
 }
 
-func genFileShas(filename string) (string, string, string, error) {
-	data, err := ioutil.ReadFile(filename)
+// readSourceManifest returns the files listed in the manifest filename, one
+// path per line, for ArchiveFiles, along with the directory they are relative
+// to: root, or the directory of the manifest when root is empty. Whitespace
+// around each path is trimmed, and blank lines and lines starting with # are
+// skipped.
+func readSourceManifest(filename, root string) ([]string, string, error) {
+	if root == "" {
+		root = filepath.Dir(filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var files []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		file := filepath.FromSlash(line)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(root, file)
+		}
+		if _, err := os.Stat(file); err != nil {
+			if os.IsNotExist(err) {
+				return nil, "", fmt.Errorf("line %d of %s lists %s, which does not exist", n, filename, line)
+			}
+			return nil, "", err
+		}
+		files = append(files, file)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	return files, root, nil
+}
+
+func flattenArchiveEntries(entries []ArchiveEntry) []interface{} {
+	contents := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		contents[i] = map[string]interface{}{
+			"name":  entry.Name,
+			"size":  int(entry.Size),
+			"mode":  fmt.Sprintf("%04o", entry.Mode.Perm()),
+			"crc32": fmt.Sprintf("%08x", entry.CRC32),
+			"md5":   hex.EncodeToString(entry.MD5),
+		}
+	}
+	return contents
+}
+
+// contentHash returns a hash of the names and content of the files of an
+// archive, in the byte order of their names, which changes only when what
+// they extract to does, not when their modification times, modes,
+// compression or order in the archive do. Directory entries are left out,
+// as they have no content. The content is hashed as it is written, into
+// the SHA-256 of each entry.
+func contentHash(entries []ArchiveEntry) string {
+	var files []ArchiveEntry
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, "/") {
+			files = append(files, entry)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	h := sha256.New()
+	for _, entry := range files {
+		fmt.Fprintf(h, "%s\x00%x\n", entry.Name, entry.SHA256)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// inputFingerprint returns a hash of the arguments of d and of the files
+// archiving d would read: the path, size, mode and modification time of each,
+// found without reading them. It is empty when the archive can't be cached,
+// as for a source_file URL, whose content is only known once it is
+// downloaded.
+func inputFingerprint(d *schema.ResourceData) (string, error) {
+	s := dataSourceFile().Schema
+	keys := make([]string, 0, len(s))
+	for k, v := range s {
+		if v.Optional || v.Required {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		v := d.Get(k)
+		if set, ok := v.(*schema.Set); ok {
+			v = set.List()
+		}
+		fmt.Fprintf(h, "%s=%v\n", k, v)
+	}
+
+	if base := d.Get("base_archive").(string); base != "" {
+		fingerprintFile(h, base)
+	}
+	var sources []ArchiveDirSource
+	if dir, ok := d.GetOk("source_dir"); ok {
+		sources = []ArchiveDirSource{{Path: dir.(string)}}
+	} else if v, ok := d.GetOk("source_directory"); ok {
+		sources = expandDirSources(v.([]interface{}))
+	} else if file, ok := d.GetOk("source_file"); ok {
+		if isURL(file.(string)) {
+			return "", nil
+		}
+		fingerprintFile(h, file.(string))
+	} else if v, ok := d.GetOk("source_files"); ok {
+		for _, file := range expandStringList(v.([]interface{})) {
+			fingerprintFile(h, file)
+		}
+	} else if manifest, ok := d.GetOk("source_manifest"); ok {
+		files, _, err := readSourceManifest(manifest.(string), d.Get("source_root").(string))
+		if err != nil {
+			return "", fmt.Errorf("error reading source manifest: %w", err)
+		}
+		for _, file := range files {
+			fingerprintFile(h, file)
+		}
+	}
+	if len(sources) > 0 {
+		opts, err := prepareDirOptions(expandDirOptions(d))
+		if err != nil {
+			return "", err
+		}
+		fingerprintDirs(h, sources, opts)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintDirs writes what inputFingerprint hashes of every entry walking
+// sources with opts would archive, skipping what the walk would skip, as
+// countFiles does. Anything that can't be read is hashed as missing, for the
+// walk itself to fail on or skip.
+func fingerprintDirs(h io.Writer, sources []ArchiveDirSource, opts ArchiveDirOptions) {
+	for _, dir := range sources {
+		ignores := newIgnoreMatcher(dir.Path, opts.IgnoreFile)
+		walkTree(dir.Path, opts.FollowDirSymlinks, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(h, "%s\x00missing\n", path)
+				return nil
+			}
+			reason, _, err := skipReason(dir.Path, ignores, path, info, opts)
+			switch {
+			case err != nil:
+				fmt.Fprintf(h, "%s\x00missing\n", path)
+				return nil
+			case reason != "" && info.IsDir():
+				return filepath.SkipDir
+			case reason != "":
+				return nil
+			}
+			fingerprintInfo(h, path, info)
+			// The content of a link's target is archived unless the link
+			// itself is stored.
+			if info.Mode()&os.ModeSymlink != 0 {
+				fingerprintFile(h, path)
+			}
+			return nil
+		})
+	}
+}
+
+// fingerprintFile writes what inputFingerprint hashes of the file at path,
+// following symlinks.
+func fingerprintFile(h io.Writer, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(h, "%s\x00missing\n", path)
+		return
+	}
+	fingerprintInfo(h, path, info)
+}
+
+func fingerprintInfo(h io.Writer, path string, info os.FileInfo) {
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00%s\n", path, info.Size(), info.Mode(), info.ModTime().UTC().Format(time.RFC3339Nano))
+}
+
+// archiveCache is stored next to an archive written with the cache argument,
+// at its path with .fingerprint appended: the inputFingerprint it was written
+// from, and its entries and skipped files, flattened by flattenSkippedFiles,
+// which describe the archive when it is kept.
+type archiveCache struct {
+	Fingerprint string
+	Entries     []ArchiveEntry
+	Skipped     []interface{}
+}
+
+// readCachedArchive returns the archiveCache stored at fingerprintPath when
+// the archive at path was written with fingerprint, copying the archive to
+// checksums, or nil when it wasn't. A fingerprint file that can't be decoded,
+// such as one written by an older version, is a mismatch too.
+func readCachedArchive(path, fingerprintPath, fingerprint string, checksums io.Writer) (*archiveCache, error) {
+	b, err := ioutil.ReadFile(fingerprintPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive fingerprint: %w", err)
+	}
+	cache := new(archiveCache)
+	if err := json.Unmarshal(b, cache); err != nil || cache.Fingerprint != fingerprint {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading cached archive: %w", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(checksums, f); err != nil {
+		return nil, fmt.Errorf("error reading cached archive: %w", err)
+	}
+	return cache, nil
+}
+
+// writeArchiveCache stores cache for the archive just written at path,
+// replacing it only once it is complete.
+func writeArchiveCache(path string, cache *archiveCache) (err error) {
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("error writing archive fingerprint: %w", err)
+	}
+	f, err := createArchiveFile(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = commitArchiveFile(f.Name(), path, closeArchiveFile(f, err))
+	}()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing archive fingerprint: %w", err)
+	}
+	return nil
+}
+
+// expandSubstitutions returns the ArchiveOptions.Transforms that substitute
+// the substitutions of d into the files with substitution_extensions, or nil
+// when there are none.
+func expandSubstitutions(d *schema.ResourceData) (map[string]FileTransformer, error) {
+	substitutions := d.Get("substitutions").(map[string]interface{})
+	if len(substitutions) == 0 {
+		return nil, nil
+	}
+	extensions := expandStringSet(d.Get("substitution_extensions").(*schema.Set))
+	if len(extensions) == 0 {
+		return nil, fmt.Errorf("substitution_extensions must list the extensions of the files to substitute into")
+	}
+	vars := make(map[string]string, len(substitutions))
+	for name, value := range substitutions {
+		vars[name] = value.(string)
+	}
+	transform := SubstituteTransformer(vars)
+	// The same extension may be listed in different cases, which
+	// ArchiveOptions.Transforms doesn't allow.
+	transforms := make(map[string]FileTransformer, len(extensions))
+	for _, ext := range extensions {
+		transforms[strings.ToLower("."+strings.TrimPrefix(ext, "."))] = transform
+	}
+	return transforms, nil
+}
+
+func flattenSkippedFiles(skipped []SkippedFile) []interface{} {
+	files := make([]interface{}, len(skipped))
+	for i, file := range skipped {
+		var err string
+		if file.Err != nil {
+			err = file.Err.Error()
+		}
+		files[i] = map[string]interface{}{
+			"name":    file.Name,
+			"reason":  file.Reason,
+			"pattern": file.Pattern,
+			"error":   err,
+		}
+	}
+	return files
+}
+
+// describeSkippedFiles lists the skipped files with their reasons, and the
+// pattern that excluded them, such as "build/ (excluded by build),
+// notes.txt (not included)", for logging.
+func describeSkippedFiles(skipped []SkippedFile) string {
+	descriptions := make([]string, len(skipped))
+	for i, file := range skipped {
+		if file.Pattern != "" {
+			descriptions[i] = fmt.Sprintf("%s (%s by %s)", file.Name, file.Reason, file.Pattern)
+			continue
+		}
+		descriptions[i] = fmt.Sprintf("%s (%s)", file.Name, file.Reason)
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// progressLogInterval is how often the progress of archiving a directory is
+// logged.
+const progressLogInterval = 10 * time.Second
+
+// logProgress returns an ArchiveOptions.Progress that logs the files
+// archived so far at most once every interval, and once the last of them is
+// archived, so that a large directory can be told from a hung one.
+func logProgress(interval time.Duration) func(filesDone, filesTotal int, currentPath string) {
+	last := time.Now()
+	return func(filesDone, filesTotal int, currentPath string) {
+		if filesDone != filesTotal && time.Since(last) < interval {
+			return
+		}
+		last = time.Now()
+		log.Printf("[INFO] archived %d of %d files, most recently %s", filesDone, filesTotal, currentPath)
+	}
+}
+
+func validateCompressionLevel(v interface{}, k string) (ws []string, es []error) {
+	level := v.(int)
+	if level < compressionLevelDefault || level > 9 {
+		es = append(es, fmt.Errorf("%q must be between 0 and 9, or -1 for the default level, got %d", k, level))
+	}
+	return
+}
+
+func validateMaxSize(v interface{}, k string) (ws []string, es []error) {
+	if size := v.(int); size < 0 {
+		es = append(es, fmt.Errorf("%q must not be negative, got %d", k, size))
+	}
+	return
+}
+
+// validateSplitSize allows 0, for not splitting an archive, or a volume size
+// from minZipSplitSize to maxZipSplitSize.
+func validateSplitSize(v interface{}, k string) (ws []string, es []error) {
+	if size := int64(v.(int)); size != 0 && (size < minZipSplitSize || size > maxZipSplitSize) {
+		es = append(es, fmt.Errorf("%q must be 0 or from %d to %d, got %d", k, minZipSplitSize, int64(maxZipSplitSize), size))
+	}
+	return
+}
+
+func validateStripComponents(v interface{}, k string) (ws []string, es []error) {
+	if n := v.(int); n < 0 {
+		es = append(es, fmt.Errorf("%q must not be negative, got %d", k, n))
+	}
+	return
+}
+
+func validateSpecialFilesPolicy(v interface{}, k string) (ws []string, es []error) {
+	switch v.(string) {
+	case SpecialFilesError, SpecialFilesSkip:
+	default:
+		es = append(es, fmt.Errorf("%q must be one of %q or %q", k, SpecialFilesError, SpecialFilesSkip))
+	}
+	return
+}
+
+func validateDuplicatesPolicy(v interface{}, k string) (ws []string, es []error) {
+	switch v.(string) {
+	case DuplicatesError, DuplicatesOverwrite:
+	default:
+		es = append(es, fmt.Errorf("%q must be one of %q or %q", k, DuplicatesError, DuplicatesOverwrite))
+	}
+	return
+}
+
+// Values of the zip_creator attribute.
+const (
+	zipCreatorGo          = "go"
+	zipCreatorInfoZipUnix = "info-zip-unix"
+)
+
+// zipCreators maps the zip_creator attribute to ArchiveOptions.ZipCreator.
+var zipCreators = map[string]uint16{
+	zipCreatorGo:          0,
+	zipCreatorInfoZipUnix: ZipCreatorInfoZipUnix,
+}
+
+func validateZipCreator(v interface{}, k string) (ws []string, es []error) {
+	if _, ok := zipCreators[v.(string)]; !ok {
+		es = append(es, fmt.Errorf("%q must be one of %q or %q", k, zipCreatorGo, zipCreatorInfoZipUnix))
+	}
+	return
+}
+
+// lambdaLayerRuntimes matches the AWS Lambda runtimes that lambda_layer_runtime
+// accepts, with the version captured for the runtimes whose layer directory
+// includes it.
+var lambdaLayerRuntimes = regexp.MustCompile(`^(?:python(3\.\d+)|nodejs\d+\.x|ruby(3\.\d+)|java\d+)$`)
+
+// lambdaLayerPrefix returns the directory of an AWS Lambda layer that the
+// runtime loads libraries from, or false if runtime isn't a runtime
+// lambdaLayerRuntimes matches.
+func lambdaLayerPrefix(runtime string) (string, bool) {
+	m := lambdaLayerRuntimes.FindStringSubmatch(runtime)
+	switch {
+	case m == nil:
+		return "", false
+	case m[1] != "":
+		return "python/lib/python" + m[1] + "/site-packages", true
+	case m[2] != "":
+		return "ruby/gems/" + m[2] + ".0", true
+	case strings.HasPrefix(runtime, "nodejs"):
+		return "nodejs/node_modules", true
+	default:
+		return "java/lib", true
+	}
+}
+
+func validateLambdaLayerRuntime(v interface{}, k string) (ws []string, es []error) {
+	if _, ok := lambdaLayerPrefix(v.(string)); !ok {
+		es = append(es, fmt.Errorf("%q must be a python3, nodejs, ruby3 or java AWS Lambda runtime, such as python3.12 or nodejs20.x", k))
+	}
+	return
+}
+
+func validateCaseCheck(v interface{}, k string) (ws []string, es []error) {
+	switch v.(string) {
+	case CaseCheckNone, CaseCheckWarn, CaseCheckError:
+	default:
+		es = append(es, fmt.Errorf("%q must be one of %q, %q or %q", k, CaseCheckNone, CaseCheckWarn, CaseCheckError))
+	}
+	return
+}
+
+func validateTimeout(v interface{}, k string) (ws []string, es []error) {
+	if timeout := v.(int); timeout < 0 {
+		es = append(es, fmt.Errorf("%q must not be negative, got %d", k, timeout))
+	}
+	return
+}
+
+func validateSourceFileTimeout(v interface{}, k string) (ws []string, es []error) {
+	if timeout := v.(int); timeout < 1 {
+		es = append(es, fmt.Errorf("%q must be at least 1, got %d", k, timeout))
+	}
+	return
+}
+
+// expandFileMode returns the octal permission bits v, as checked by
+// validateFileMode.
+func expandFileMode(v string) os.FileMode {
+	perm, _ := strconv.ParseUint(v, 8, 32)
+	return os.FileMode(perm)
+}
+
+func expandFileModes(m map[string]interface{}) map[string]os.FileMode {
+	if len(m) == 0 {
+		return nil
+	}
+	modes := make(map[string]os.FileMode, len(m))
+	for name, v := range m {
+		modes[name] = expandFileMode(v.(string))
+	}
+	return modes
+}
+
+// expandModTime parses the mtime attribute, where an empty string leaves the
+// modification times of the source files.
+func expandModTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func validateModTime(v interface{}, k string) (ws []string, es []error) {
+	modTime, err := expandModTime(v.(string))
 	if err != nil {
-		return "", "", "", fmt.Errorf("could not compute file '%s' checksum: %s", filename, err)
+		es = append(es, fmt.Errorf("%q must be an RFC 3339 timestamp: %w", k, err))
+	} else if err := assertValidModTime(ArchiveOptions{ModTime: modTime}); err != nil {
+		es = append(es, fmt.Errorf("%q: %w", k, err))
 	}
-	h := sha1.New()
-	h.Write([]byte(data))
-	sha1 := hex.EncodeToString(h.Sum(nil))
+	return
+}
 
-	h256 := sha256.New()
-	h256.Write([]byte(data))
-	shaSum := h256.Sum(nil)
-	sha256base64 := base64.StdEncoding.EncodeToString(shaSum[:])
+// expandOwner parses an owner given as UID:GID, returning nil if v is empty.
+func expandOwner(v string) (*FileOwner, error) {
+	if v == "" {
+		return nil, nil
+	}
+	parts := strings.Split(v, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected UID:GID, got %q", v)
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID %q", parts[0])
+	}
+	gid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid GID %q", parts[1])
+	}
+	owner := &FileOwner{UID: uid, GID: gid}
+	if err := assertValidOwner(owner); err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+func validateOwner(v interface{}, k string) (ws []string, es []error) {
+	if _, err := expandOwner(v.(string)); err != nil {
+		es = append(es, fmt.Errorf("%q: %w", k, err))
+	}
+	return
+}
+
+func validateFileMode(v interface{}, k string) (ws []string, es []error) {
+	perm, err := strconv.ParseUint(v.(string), 8, 32)
+	if err != nil || perm > 0777 {
+		es = append(es, fmt.Errorf("%q must be octal permission bits, such as 0755, got %q", k, v))
+	}
+	return
+}
+
+func validateFileModes(v interface{}, k string) (ws []string, es []error) {
+	for name, mode := range v.(map[string]interface{}) {
+		_, errs := validateFileMode(mode, fmt.Sprintf("%s[%q]", k, name))
+		es = append(es, errs...)
+	}
+	return
+}
 
-	md5 := md5.New()
-	md5.Write([]byte(data))
-	md5Sum := hex.EncodeToString(md5.Sum(nil))
+func validateRegexp(v interface{}, k string) (ws []string, es []error) {
+	if _, err := regexp.Compile(v.(string)); err != nil {
+		es = append(es, fmt.Errorf("%q must be a valid regular expression: %w", k, err))
+	}
+	return
+}
+
+func validateParallelism(v interface{}, k string) (ws []string, es []error) {
+	if n := v.(int); n < 1 {
+		es = append(es, fmt.Errorf("%q must be at least 1, got %d", k, n))
+	}
+	return
+}
+
+func validateCompression(v interface{}, k string) (ws []string, es []error) {
+	switch v.(string) {
+	case CompressionDeflate, CompressionZstd:
+	default:
+		es = append(es, fmt.Errorf("%q must be one of %q or %q", k, CompressionDeflate, CompressionZstd))
+	}
+	return
+}
+
+func validateSymlinkPolicy(v interface{}, k string) (ws []string, es []error) {
+	switch v.(string) {
+	case SymlinkFollow, SymlinkStore, SymlinkSkip:
+	default:
+		es = append(es, fmt.Errorf("%q must be one of %q, %q or %q", k, SymlinkFollow, SymlinkStore, SymlinkSkip))
+	}
+	return
+}
+
+func validateDirEntriesPolicy(v interface{}, k string) (ws []string, es []error) {
+	switch v.(string) {
+	case DirEntriesNone, DirEntriesEmpty, DirEntriesAll:
+	default:
+		es = append(es, fmt.Errorf("%q must be one of %q, %q or %q", k, DirEntriesNone, DirEntriesEmpty, DirEntriesAll))
+	}
+	return
+}
+
+// compressionLevelDefault is the compression_level that leaves the level to
+// each format, which for zip archives is archive/zip's own, so that archives
+// written without a level don't change.
+const compressionLevelDefault = -1
+
+// expandCompressionLevel maps the compression_level attribute, which follows
+// the zip command line convention of 0 meaning store, to ArchiveOptions.
+func expandCompressionLevel(level int) int {
+	switch level {
+	case compressionLevelDefault:
+		return DefaultCompression
+	case 0:
+		return NoCompression
+	}
+	return level
+}
+
+func expandDirOptions(d *schema.ResourceData) ArchiveDirOptions {
+	opts := ArchiveDirOptions{
+		Symlinks:           d.Get("symlink").(string),
+		IgnoreFile:         d.Get("ignore_file").(string),
+		SkipHidden:         !d.Get("include_hidden").(bool),
+		FollowDirSymlinks:  d.Get("follow_symlinks").(bool),
+		ExcludeSymlinkDirs: d.Get("exclude_symlink_directories").(bool),
+		SortEntries:        d.Get("sort_entries").(bool),
+		RequireFiles:       !d.Get("allow_empty").(bool),
+		DirEntries:         d.Get("directory_entries").(string),
+		Parallelism:        d.Get("parallelism").(int),
+		SpecialFiles:       d.Get("special_files").(string),
+		SkipMissing:        d.Get("skip_missing").(bool),
+		ContinueOnError:    d.Get("continue_on_error").(bool),
+		MaxFileSize:        int64(d.Get("max_file_size").(int)),
+		Flatten:            d.Get("flatten").(bool),
+		StripComponents:    d.Get("strip_components").(int),
+		IncludeSourceDir:   d.Get("include_source_dir").(bool),
+	}
+	if v, ok := d.GetOk("excludes"); ok {
+		opts.Excludes = expandStringSet(v.(*schema.Set))
+	}
+	if v, ok := d.GetOk("includes"); ok {
+		opts.Includes = expandStringSet(v.(*schema.Set))
+	}
+	if v, ok := d.GetOk("exclude_regex"); ok {
+		opts.ExcludeRegexes = expandStringSet(v.(*schema.Set))
+	}
+	if v, ok := d.GetOk("deny_patterns"); ok {
+		opts.DenyPatterns = expandStringSet(v.(*schema.Set))
+	}
+	return opts
+}
 
-	return sha1, sha256base64, md5Sum, nil
+func expandDirSources(vL []interface{}) []ArchiveDirSource {
+	sources := make([]ArchiveDirSource, len(vL))
+	for i, v := range vL {
+		src := v.(map[string]interface{})
+		sources[i] = ArchiveDirSource{
+			Path:   src["path"].(string),
+			Prefix: src["prefix"].(string),
+		}
+	}
+	return sources
+}
+
+// expandExtensionCompression returns the compression of each extension listed
+// by the extension_compression blocks, erroring if an extension is listed
+// more than once.
+func expandExtensionCompression(vL []interface{}) (map[string]EntryCompression, error) {
+	if len(vL) == 0 {
+		return nil, nil
+	}
+	compression := make(map[string]EntryCompression)
+	for _, v := range vL {
+		block := v.(map[string]interface{})
+		c := EntryCompression{
+			Method: block["method"].(string),
+			Level:  expandCompressionLevel(block["level"].(int)),
+		}
+		for _, ext := range expandStringSet(block["extensions"].(*schema.Set)) {
+			if _, ok := compression[ext]; ok {
+				return nil, fmt.Errorf("extension %s is in more than one extension_compression block", ext)
+			}
+			compression[ext] = c
+		}
+	}
+	return compression, nil
+}
+
+func expandStringSet(set *schema.Set) []string {
+	return expandStringList(set.List())
+}
+
+func expandStringList(vL []interface{}) []string {
+	strs := make([]string, len(vL))
+	for i, v := range vL {
+		strs[i] = v.(string)
+	}
+	return strs
+}
+
+// fileChecksums holds the hex or base64 encoded checksums of an output file.
+type fileChecksums struct {
+	sha1         string
+	sha256       string
+	base64sha256 string
+	sha512       string
+	md5          string
+	size         int64
+}
+
+// genFileShas computes every output checksum in a single pass over the file.
+func genFileShas(filename string) (*fileChecksums, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute file '%s' checksum: %w", filename, err)
+	}
+	defer f.Close()
+
+	w := newChecksumWriter()
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, fmt.Errorf("could not compute file '%s' checksum: %w", filename, err)
+	}
+	return w.sums(), nil
+}
+
+// checksumWriter computes every output checksum, and the size, of what is
+// written to it.
+type checksumWriter struct {
+	sha1   hash.Hash
+	sha256 hash.Hash
+	sha512 hash.Hash
+	md5    hash.Hash
+	size   int64
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{
+		sha1:   sha1.New(),
+		sha256: sha256.New(),
+		sha512: sha512.New(),
+		md5:    md5.New(),
+	}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	// Hashes never return an error.
+	w.sha1.Write(p)
+	w.sha256.Write(p)
+	w.sha512.Write(p)
+	w.md5.Write(p)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// Reset starts the checksums over, for an archive that is rewritten.
+func (w *checksumWriter) Reset() {
+	w.sha1.Reset()
+	w.sha256.Reset()
+	w.sha512.Reset()
+	w.md5.Reset()
+	w.size = 0
+}
+
+func (w *checksumWriter) sums() *fileChecksums {
+	sha256Sum := w.sha256.Sum(nil)
+	return &fileChecksums{
+		sha1:         hex.EncodeToString(w.sha1.Sum(nil)),
+		sha256:       hex.EncodeToString(sha256Sum),
+		base64sha256: base64.StdEncoding.EncodeToString(sha256Sum),
+		sha512:       hex.EncodeToString(w.sha512.Sum(nil)),
+		md5:          hex.EncodeToString(w.md5.Sum(nil)),
+		size:         w.size,
+	}
 }
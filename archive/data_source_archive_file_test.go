@@ -1,12 +1,24 @@
 package archive
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	r "github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
 
@@ -35,6 +47,19 @@ func TestAccArchiveFile_Basic(t *testing.T) {
 					r.TestMatchResourceAttr(
 						"data.archive_file.foo", "output_sha", regexp.MustCompile(`^[0-9a-f]{40}$`),
 					),
+					r.TestMatchResourceAttr(
+						"data.archive_file.foo", "output_sha256", regexp.MustCompile(`^[0-9a-f]{64}$`),
+					),
+					r.TestMatchResourceAttr(
+						"data.archive_file.foo", "output_sha512", regexp.MustCompile(`^[0-9a-f]{128}$`),
+					),
+					r.TestCheckResourceAttr("data.archive_file.foo", "uncompressed_size", "20"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.#", "1"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.name", "content.txt"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.size", "20"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.crc32", "e004bade"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.md5", "ee428920507e39e8d89c2cabe6641b67"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "output_base64", ""),
 				),
 			},
 			r.TestStep{
@@ -44,6 +69,22 @@ func TestAccArchiveFile_Basic(t *testing.T) {
 					r.TestCheckResourceAttrPtr("data.archive_file.foo", "output_size", &fileSize),
 				),
 			},
+			r.TestStep{
+				Config: testAccArchiveFileFileRootConfig,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileExists("zip_file_acc_test.zip", &fileSize),
+					r.TestCheckResourceAttrPtr("data.archive_file.foo", "output_size", &fileSize),
+				),
+			},
+			r.TestStep{
+				Config: testAccArchiveFileFilesConfig,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileExists("zip_file_acc_test.zip", &fileSize),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.#", "2"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.name", "test-dir/file3.txt"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.1.name", "test-file.txt"),
+				),
+			},
 			r.TestStep{
 				Config: testAccArchiveFileDirConfig,
 				Check: r.ComposeTestCheckFunc(
@@ -58,6 +99,59 @@ func TestAccArchiveFile_Basic(t *testing.T) {
 					r.TestCheckResourceAttrPtr("data.archive_file.foo", "output_size", &fileSize),
 				),
 			},
+			r.TestStep{
+				Config: testAccArchiveFileDirExcludesConfig,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileExists("zip_file_acc_test.zip", &fileSize),
+					r.TestCheckResourceAttrPtr("data.archive_file.foo", "output_size", &fileSize),
+				),
+			},
+			r.TestStep{
+				Config: testAccArchiveFileDirectoriesConfig,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileExists("zip_file_acc_test.zip", &fileSize),
+					r.TestCheckResourceAttrPtr("data.archive_file.foo", "output_size", &fileSize),
+				),
+			},
+			r.TestStep{
+				Config: testAccArchiveFileBase64Config,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileBase64("zip_file_acc_test.zip", "data.archive_file.foo"),
+				),
+			},
+			r.TestStep{
+				Config: testAccArchiveFileContentModeConfig,
+				Check: r.ComposeTestCheckFunc(
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.name", "bootstrap"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.mode", "0755"),
+				),
+			},
+			r.TestStep{
+				Config: testAccArchiveFileDryRunConfig,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileMissing("zip_file_dry_run_acc_test.zip"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.name", "content.txt"),
+					r.TestMatchResourceAttr(
+						"data.archive_file.foo", "output_sha256", regexp.MustCompile(`^[0-9a-f]{64}$`),
+					),
+				),
+			},
+			r.TestStep{
+				Config: testAccArchiveFileDryRunSortConfig,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileMissing("zip_file_dry_run_acc_test.zip"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.#", "6"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.0.name", "a/file1.txt"),
+					r.TestCheckResourceAttr("data.archive_file.foo", "contents.3.name", "b/file1.txt"),
+				),
+			},
+			r.TestStep{
+				Config: testAccArchiveFileTarGzConfig,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileExists("tar_gz_file_acc_test.tar.gz", &fileSize),
+					r.TestCheckResourceAttrPtr("data.archive_file.foo", "output_size", &fileSize),
+				),
+			},
 			r.TestStep{
 				Config: testAccArchiveFileOutputPath,
 				Check: r.ComposeTestCheckFunc(
@@ -68,6 +162,513 @@ func TestAccArchiveFile_Basic(t *testing.T) {
 	})
 }
 
+func TestDataSourceFileRead_DefaultCompression(t *testing.T) {
+	dir := tempDir(t, "archive-default-compression")
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.zip")
+
+	// The content is long and varied enough to deflate differently at each
+	// level.
+	var content strings.Builder
+	words := []string{"archive", "zip", "file", "entry", "deflate", "level", "output", "source"}
+	for i := 0; content.Len() < 64<<10; i++ {
+		content.WriteString(words[(i*7919+i*i*31+i*i*i)%997%len(words)])
+		content.WriteByte(' ')
+	}
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":                    "zip",
+		"source_content":          content.String(),
+		"source_content_filename": "words.txt",
+		"output_path":             output,
+	})
+	if err := dataSourceFileRead(d, context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err)
+	}
+
+	// Writing the same entries with a plain archive/zip writer, which
+	// deflates at its own level, gives the same bytes.
+	zr, err := zip.NewReader(bytes.NewReader(got), int64(len(got)))
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err)
+	}
+	var want bytes.Buffer
+	zw := zip.NewWriter(&want)
+	for _, f := range zr.File {
+		fh := f.FileHeader
+		fh.Extra = nil
+		fh.Modified = time.Time{}
+		w, err := zw.CreateHeader(&fh)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		src, err := f.Open()
+		if err != nil {
+			t.Fatalf("could not read %s: %s", f.Name, err)
+		}
+		_, err = io.Copy(w, src)
+		src.Close()
+		if err != nil {
+			t.Fatalf("could not copy %s: %s", f.Name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("expected the default archive to match archive/zip's, got %d bytes, want %d", len(got), want.Len())
+	}
+	if d.Get("compression_level").(int) != compressionLevelDefault {
+		t.Errorf("expected compression_level to default to %d", compressionLevelDefault)
+	}
+}
+
+func TestDataSourceFileRead_Timeout(t *testing.T) {
+	output := "zip_file_timeout_test.zip"
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":        "zip",
+		"source_dir":  "./test-fixtures/test-dir",
+		"output_path": output,
+		"timeout":     30,
+	})
+	// The provider's stop context is already past its deadline, as if the
+	// walk had taken longer than the timeout.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	err := dataSourceFileRead(d, ctx)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 30 seconds, with 0 files archived") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("expected the partial archive to be removed: %v", err)
+	}
+}
+
+func TestDataSourceFileRead_ContentHash(t *testing.T) {
+	dir := tempDir(t, "archive-content-hash")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "index.js"), "index")
+	writeTestFile(t, filepath.Join(src, "lib", "util.js"), "util")
+
+	contentHash := func(archiveType, dirEntries string) string {
+		d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+			"type":              archiveType,
+			"source_dir":        src,
+			"directory_entries": dirEntries,
+			"output_path":       filepath.Join(dir, "out."+archiveType),
+		})
+		if err := dataSourceFileRead(d, context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return d.Get("content_hash").(string)
+	}
+
+	want := contentHash("zip", DirEntriesNone)
+	// Modes, modification times, directory entries and the archive format
+	// aren't part of the hash.
+	if err := os.Chmod(filepath.Join(src, "index.js"), 0755); err != nil {
+		t.Fatalf("could not change mode: %s", err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "lib", "util.js"), modTime, modTime); err != nil {
+		t.Fatalf("could not change modification time: %s", err)
+	}
+	if got := contentHash("tar.gz", DirEntriesAll); got != want {
+		t.Errorf("expected the same hash for the same content, got %s, want %s", got, want)
+	}
+
+	writeTestFile(t, filepath.Join(src, "lib", "util.js"), "changed")
+	if got := contentHash("zip", DirEntriesNone); got == want {
+		t.Errorf("expected the hash to change with the content")
+	}
+}
+
+func TestDataSourceFileRead_Cache(t *testing.T) {
+	dir := tempDir(t, "archive-cache")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "index.js"), "index")
+	output := filepath.Join(dir, "out.zip")
+
+	mtime := ""
+	read := func(comment string) *schema.ResourceData {
+		d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+			"type":        "zip",
+			"source_dir":  src,
+			"output_path": output,
+			"comment":     comment,
+			"mtime":       mtime,
+			"cache":       true,
+		})
+		if err := dataSourceFileRead(d, context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return d
+	}
+
+	want := read("").Get("output_sha").(string)
+	if _, err := os.Stat(output + ".fingerprint"); err != nil {
+		t.Fatalf("expected a fingerprint to be written: %s", err)
+	}
+	// An archive written from the same arguments and entries is kept, so
+	// replacing it shows whether it was written again.
+	writeTestFile(t, output, "cached")
+	d := read("")
+	if got := d.Get("output_sha").(string); got == want || d.Get("output_size").(int) != len("cached") {
+		t.Errorf("expected the cached archive to be kept")
+	}
+	if contents := d.Get("contents").([]interface{}); len(contents) != 1 {
+		t.Errorf("expected the contents of the cached archive, got %v", contents)
+	}
+
+	if got := read("changed").Get("output_sha").(string); got == want || got == d.Get("output_sha").(string) {
+		t.Errorf("expected the archive to be written again when the arguments change")
+	}
+	want = read("").Get("output_sha").(string)
+	writeTestFile(t, filepath.Join(src, "index.js"), "changed")
+	if got := read("").Get("output_sha").(string); got == want {
+		t.Errorf("expected the archive to be written again when the files change")
+	}
+
+	// The files aren't read to find the fingerprint, so touching one
+	// writes the archive again, even when mtime fixes the time stored.
+	touch := func(modTime time.Time) {
+		if err := os.Chtimes(filepath.Join(src, "index.js"), modTime, modTime); err != nil {
+			t.Fatalf("could not touch file: %s", err)
+		}
+	}
+	read("")
+	writeTestFile(t, output, "cached")
+	touch(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	if d := read(""); d.Get("output_size").(int) == len("cached") {
+		t.Errorf("expected the archive to be written again when a file is touched")
+	}
+	mtime = "2021-01-01T00:00:00Z"
+	read("")
+	writeTestFile(t, output, "cached")
+	touch(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	if d := read(""); d.Get("output_size").(int) == len("cached") {
+		t.Errorf("expected the archive to be written again when mtime is set and a file is touched")
+	}
+
+	// A kept archive is described by the entries stored with its
+	// fingerprint, as the files aren't read again.
+	d = read("")
+	want = d.Get("content_hash").(string)
+	writeTestFile(t, output, "cached")
+	d = read("")
+	if d.Get("output_size").(int) != len("cached") {
+		t.Fatalf("expected the cached archive to be kept")
+	}
+	if got := d.Get("content_hash").(string); got != want {
+		t.Errorf("expected the content hash of the cached archive, got %s, want %s", got, want)
+	}
+	if got := d.Get("contents.0.name").(string); got != "index.js" {
+		t.Errorf("expected the contents of the cached archive, got %s", got)
+	}
+}
+
+func TestDataSourceFileRead_ContinueOnError(t *testing.T) {
+	dir := tempDir(t, "archive-continue-on-error")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "main.txt"), "main")
+	if err := os.Symlink("missing.txt", filepath.Join(src, "broken.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":              "zip",
+		"source_dir":        src,
+		"output_path":       filepath.Join(dir, "out.zip"),
+		"continue_on_error": true,
+	})
+	if err := dataSourceFileRead(d, context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	errs := expandStringList(d.Get("errors").([]interface{}))
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "broken.txt: ") {
+		t.Errorf("expected an error for broken.txt, got %v", errs)
+	}
+	if got := d.Get("skipped_files.0.reason").(string); got != SkippedUnreadable {
+		t.Errorf("expected broken.txt to be skipped as %s, got %s", SkippedUnreadable, got)
+	}
+	ensureContents(t, filepath.Join(dir, "out.zip"), map[string][]byte{"main.txt": []byte("main")})
+}
+
+func TestDataSourceFileRead_Substitutions(t *testing.T) {
+	dir := tempDir(t, "archive-substitutions")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "config.json"), `{"env": "${ENV}"}`)
+	writeTestFile(t, filepath.Join(src, "index.js"), "var env = '${ENV}'")
+	output := filepath.Join(dir, "out.zip")
+
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":                    "zip",
+		"source_dir":              src,
+		"output_path":             output,
+		"substitutions":           map[string]interface{}{"ENV": "prod"},
+		"substitution_extensions": []interface{}{"json", ".JSON"},
+	})
+	if err := dataSourceFileRead(d, context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, output, map[string][]byte{
+		"config.json": []byte(`{"env": "prod"}`),
+		"index.js":    []byte("var env = '${ENV}'"),
+	})
+
+	d = schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":          "zip",
+		"source_dir":    src,
+		"output_path":   output,
+		"substitutions": map[string]interface{}{"ENV": "prod"},
+	})
+	if err := dataSourceFileRead(d, context.Background()); err == nil {
+		t.Errorf("expected error for substitutions without substitution_extensions")
+	}
+}
+
+func TestDataSourceFileRead_SplitSize(t *testing.T) {
+	dir := tempDir(t, "archive-split-size")
+	defer os.RemoveAll(dir)
+	// The random content doesn't compress, so the archive needs volumes.
+	content := make([]byte, 150*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "a.bin"), string(content))
+	writeTestFile(t, filepath.Join(src, "b.txt"), "small")
+	output := filepath.Join(dir, "out.zip")
+
+	read := func(raw map[string]interface{}) (*schema.ResourceData, error) {
+		raw["source_dir"] = src
+		d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, raw)
+		return d, dataSourceFileRead(d, context.Background())
+	}
+	d, err := read(map[string]interface{}{
+		"type":        "zip",
+		"output_path": output,
+		"split_size":  minZipSplitSize,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parts := expandStringList(d.Get("output_parts").([]interface{}))
+	want := []string{filepath.Join(dir, "out.z01"), filepath.Join(dir, "out.z02"), output}
+	if !reflect.DeepEqual(parts, want) {
+		t.Fatalf("got volumes %v, want %v", parts, want)
+	}
+
+	// The checksums are those of the archive before it was split, which
+	// has the entries of the joined volumes.
+	whole := filepath.Join(dir, "whole.zip")
+	wholeData, err := read(map[string]interface{}{
+		"type":        "zip",
+		"output_path": whole,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := d.Get("output_sha256"), wholeData.Get("output_sha256"); got != want {
+		t.Errorf("expected the checksum of the archive before it was split, %s, got %s", want, got)
+	}
+	b, err := ioutil.ReadFile(whole)
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err)
+	}
+	ensureSameZipEntries(t, joinZipVolumes(t, parts), b)
+
+	// Splitting the archive into fewer volumes removes the rest.
+	d, err = read(map[string]interface{}{
+		"type":        "zip",
+		"output_path": output,
+		"split_size":  len(b),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if parts := expandStringList(d.Get("output_parts").([]interface{})); !reflect.DeepEqual(parts, []string{output}) {
+		t.Errorf("expected the archive as the only volume, got %v", parts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.z01")); !os.IsNotExist(err) {
+		t.Errorf("expected the volumes left over to be removed: %v", err)
+	}
+
+	// Only zip archives ending in .zip are split.
+	if _, err := read(map[string]interface{}{
+		"type":        "tar.gz",
+		"output_path": filepath.Join(dir, "out.tar.gz"),
+		"split_size":  minZipSplitSize,
+	}); err == nil {
+		t.Errorf("expected error for split_size with a tar.gz archive")
+	}
+	if _, err := read(map[string]interface{}{
+		"type":        "zip",
+		"output_path": filepath.Join(dir, "out.jar"),
+		"split_size":  minZipSplitSize,
+	}); err == nil {
+		t.Errorf("expected error for split_size with an output_path not ending in .zip")
+	}
+}
+
+func TestDataSourceFileRead_SourceManifest(t *testing.T) {
+	dir := tempDir(t, "archive-source-manifest")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "bin", "app"), "app")
+	writeTestFile(t, filepath.Join(dir, "config.json"), "{}")
+	writeTestFile(t, filepath.Join(dir, "lib", "util.js"), "util")
+	manifest := filepath.Join(dir, "files.txt")
+	writeTestFile(t, manifest, "# Build artifacts\nlib/util.js\n\n  config.json  \nbin/app\n")
+
+	output := filepath.Join(dir, "out.zip")
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":            "zip",
+		"source_manifest": manifest,
+		"output_path":     output,
+	})
+	if err := dataSourceFileRead(d, context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, output, map[string][]byte{
+		"bin/app":     []byte("app"),
+		"config.json": []byte("{}"),
+		"lib/util.js": []byte("util"),
+	})
+	var names []string
+	for _, v := range d.Get("contents").([]interface{}) {
+		names = append(names, v.(map[string]interface{})["name"].(string))
+	}
+	if want := []string{"bin/app", "config.json", "lib/util.js"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+
+	writeTestFile(t, manifest, "config.json\nmissing.txt\n")
+	d = schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":            "zip",
+		"source_manifest": manifest,
+		"output_path":     output,
+	})
+	err := dataSourceFileRead(d, context.Background())
+	if err == nil || !strings.Contains(err.Error(), "line 2 of "+manifest+" lists missing.txt, which does not exist") {
+		t.Errorf("expected error for a missing file, got %v", err)
+	}
+}
+
+func TestDataSourceFileRead_SourceBlocks(t *testing.T) {
+	dir := tempDir(t, "archive-source-blocks")
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.zip")
+
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type": "zip",
+		"source": []interface{}{
+			map[string]interface{}{"filename": "config/b.json", "content": "b"},
+			map[string]interface{}{"filename": "a.json", "content": "a"},
+			map[string]interface{}{"filename": "config/a.json", "content": "config a"},
+		},
+		"output_path": output,
+	})
+	if err := dataSourceFileRead(d, context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var names []string
+	for _, v := range d.Get("contents").([]interface{}) {
+		names = append(names, v.(map[string]interface{})["name"].(string))
+	}
+	if want := []string{"a.json", "config/a.json", "config/b.json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+
+	d = schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type": "zip",
+		"source": []interface{}{
+			map[string]interface{}{"filename": "a.json", "content": "a"},
+			map[string]interface{}{"filename": "a.json", "content": "other a"},
+		},
+		"output_path": output,
+	})
+	err := dataSourceFileRead(d, context.Background())
+	if err == nil || !strings.Contains(err.Error(), "more than one source block has the filename a.json") {
+		t.Errorf("expected error for a duplicate filename, got %v", err)
+	}
+}
+
+func TestDataSourceFileRead_LambdaLayerRuntime(t *testing.T) {
+	dir := tempDir(t, "archive-lambda-layer")
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "layer.zip")
+
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"type":                    "zip",
+		"source_content":          "content",
+		"source_content_filename": "requests/__init__.py",
+		"lambda_layer_runtime":    "python3.12",
+		"output_path":             output,
+	})
+	if err := dataSourceFileRead(d, context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	contents := d.Get("contents").([]interface{})
+	if len(contents) != 1 || contents[0].(map[string]interface{})["name"] != "python/lib/python3.12/site-packages/requests/__init__.py" {
+		t.Errorf("expected the content under the python layer directory, got %v", contents)
+	}
+
+	for runtime, want := range map[string]string{
+		"python3.9":  "python/lib/python3.9/site-packages",
+		"nodejs20.x": "nodejs/node_modules",
+		"ruby3.3":    "ruby/gems/3.3.0",
+		"java21":     "java/lib",
+	} {
+		if got, ok := lambdaLayerPrefix(runtime); !ok || got != want {
+			t.Errorf("lambdaLayerPrefix(%q) = %q, %t, want %q", runtime, got, ok, want)
+		}
+	}
+	for _, runtime := range []string{"", "python2.7", "go1.x", "provided.al2", "nodejs", "python3.12 "} {
+		if _, es := validateLambdaLayerRuntime(runtime, "lambda_layer_runtime"); len(es) == 0 {
+			t.Errorf("expected error for runtime %q", runtime)
+		}
+	}
+}
+
+func TestExpandExtensionCompression(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"extension_compression": []interface{}{
+			map[string]interface{}{"extensions": []interface{}{".js", ".css"}, "level": 9},
+			map[string]interface{}{"extensions": []interface{}{".png"}, "level": 0},
+			map[string]interface{}{"extensions": []interface{}{".json"}, "method": "zstd"},
+		},
+	})
+	got, err := expandExtensionCompression(d.Get("extension_compression").([]interface{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]EntryCompression{
+		".js":   {Level: 9},
+		".css":  {Level: 9},
+		".png":  {Level: NoCompression},
+		".json": {Method: CompressionZstd, Level: DefaultCompression},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	d = schema.TestResourceDataRaw(t, dataSourceFile().Schema, map[string]interface{}{
+		"extension_compression": []interface{}{
+			map[string]interface{}{"extensions": []interface{}{".js"}, "level": 9},
+			map[string]interface{}{"extensions": []interface{}{".js"}, "level": 0},
+		},
+	})
+	if _, err := expandExtensionCompression(d.Get("extension_compression").([]interface{})); err == nil || !strings.Contains(err.Error(), "more than one") {
+		t.Errorf("expected error for an extension in two blocks, got %v", err)
+	}
+}
+
 func testAccArchiveFileExists(filename string, fileSize *string) r.TestCheckFunc {
 	return func(s *terraform.State) error {
 		*fileSize = ""
@@ -80,6 +681,25 @@ func testAccArchiveFileExists(filename string, fileSize *string) r.TestCheckFunc
 	}
 }
 
+func testAccArchiveFileMissing(filename string) r.TestCheckFunc {
+	return func(s *terraform.State) error {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			return fmt.Errorf("expected %s not to be written: %v", filename, err)
+		}
+		return nil
+	}
+}
+
+func testAccArchiveFileBase64(filename, name string) r.TestCheckFunc {
+	return func(s *terraform.State) error {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		return r.TestCheckResourceAttr(name, "output_base64", base64.StdEncoding.EncodeToString(data))(s)
+	}
+}
+
 var testAccArchiveFileContentConfig = `
 data "archive_file" "foo" {
   type                    = "zip"
@@ -89,6 +709,49 @@ data "archive_file" "foo" {
 }
 `
 
+var testAccArchiveFileContentModeConfig = `
+data "archive_file" "foo" {
+  type                    = "zip"
+  source_content          = "#!/bin/sh"
+  source_content_filename = "bootstrap"
+  source_content_mode     = "0755"
+  output_path             = "zip_file_acc_test.zip"
+}
+`
+
+var testAccArchiveFileDryRunConfig = `
+data "archive_file" "foo" {
+  type                    = "zip"
+  source_content          = "This is some content"
+  source_content_filename = "content.txt"
+  output_path             = "zip_file_dry_run_acc_test.zip"
+  dry_run                 = true
+}
+`
+
+var testAccArchiveFileDryRunSortConfig = `
+data "archive_file" "foo" {
+  type         = "zip"
+  output_path  = "zip_file_dry_run_acc_test.zip"
+  dry_run      = true
+  sort_entries = true
+  duplicates   = "overwrite"
+
+  source_directory {
+    path   = "test-fixtures/test-dir"
+    prefix = "b"
+  }
+  source_directory {
+    path   = "test-fixtures/test-dir"
+    prefix = "a"
+  }
+  source_directory {
+    path   = "test-fixtures/test-dir"
+    prefix = "a"
+  }
+}
+`
+
 var tmpDir = os.TempDir() + "/test"
 var testAccArchiveFileOutputPath = fmt.Sprintf(`
 data "archive_file" "foo" {
@@ -99,6 +762,15 @@ data "archive_file" "foo" {
 }
 `, tmpDir)
 
+var testAccArchiveFileBase64Config = `
+data "archive_file" "foo" {
+  type                  = "zip"
+  source_file           = "test-fixtures/test-file.txt"
+  output_path           = "zip_file_acc_test.zip"
+  output_base64_enabled = true
+}
+`
+
 var testAccArchiveFileFileConfig = `
 data "archive_file" "foo" {
   type        = "zip"
@@ -107,6 +779,24 @@ data "archive_file" "foo" {
 }
 `
 
+var testAccArchiveFileFileRootConfig = `
+data "archive_file" "foo" {
+  type        = "zip"
+  source_file = "test-fixtures/test-dir/file1.txt"
+  source_root = "test-fixtures"
+  output_path = "zip_file_acc_test.zip"
+}
+`
+
+var testAccArchiveFileFilesConfig = `
+data "archive_file" "foo" {
+  type         = "zip"
+  source_files = ["test-fixtures/test-file.txt", "test-fixtures/test-dir/file3.txt"]
+  source_root  = "test-fixtures"
+  output_path  = "zip_file_acc_test.zip"
+}
+`
+
 var testAccArchiveFileDirConfig = `
 data "archive_file" "foo" {
   type        = "zip"
@@ -115,6 +805,40 @@ data "archive_file" "foo" {
 }
 `
 
+var testAccArchiveFileDirExcludesConfig = `
+data "archive_file" "foo" {
+  type        = "zip"
+  source_dir  = "test-fixtures/test-dir"
+  excludes    = ["file2.txt"]
+  output_path = "zip_file_acc_test.zip"
+}
+`
+
+var testAccArchiveFileDirectoriesConfig = `
+data "archive_file" "foo" {
+  type        = "zip"
+  output_path = "zip_file_acc_test.zip"
+
+  source_directory {
+    path   = "test-fixtures/test-dir"
+    prefix = "first"
+  }
+
+  source_directory {
+    path   = "test-fixtures/test-dir"
+    prefix = "second"
+  }
+}
+`
+
+var testAccArchiveFileTarGzConfig = `
+data "archive_file" "foo" {
+  type        = "tar.gz"
+  source_dir  = "test-fixtures/test-dir"
+  output_path = "tar_gz_file_acc_test.tar.gz"
+}
+`
+
 var testAccArchiveFileMultiConfig = `
 data "archive_file" "foo" {
   type        = "zip"
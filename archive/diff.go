@@ -0,0 +1,130 @@
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+)
+
+// ArchiveDiff is how one zip file differs from another, as returned by
+// DiffZips, such as to find out why an archive's checksum changed between
+// builds.
+type ArchiveDiff struct {
+	// Added lists the names of the entries only in the new archive, in its
+	// order.
+	Added []string
+
+	// Removed lists the names of the entries only in the old archive, in
+	// its order.
+	Removed []string
+
+	// Changed lists the entries in both archives that differ, in the order
+	// of the new archive.
+	Changed []ChangedEntry
+
+	// Reordered is set when the entries in both archives are in a different
+	// order, which changes the archive even when no entry does.
+	Reordered bool
+
+	// CommentChanged is set when the archives have different comments.
+	CommentChanged bool
+}
+
+// ChangedEntry is an entry that differs between two archives.
+type ChangedEntry struct {
+	// Name is the name of the entry.
+	Name string
+
+	// Fields lists what differs, in this order: "content", by the CRC-32
+	// and size of the entry, "mode", "modified" for the modification time,
+	// and "method" for the compression method.
+	Fields []string
+}
+
+// Empty reports whether the archives have the same entries, in the same
+// order and with the same content and metadata, and the same comment. Their
+// compressed content may still differ.
+func (d *ArchiveDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && !d.Reordered && !d.CommentChanged
+}
+
+// DiffZips compares the zip files at oldPath and newPath, entry by entry,
+// without extracting either. Entries are matched by name; when an archive
+// has more than one entry with the same name, the first is compared.
+func DiffZips(oldPath, newPath string) (*ArchiveDiff, error) {
+	oldZip, err := openZip(oldPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive: %w", err)
+	}
+	defer oldZip.Close()
+	newZip, err := openZip(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive: %w", err)
+	}
+	defer newZip.Close()
+
+	diff := &ArchiveDiff{CommentChanged: oldZip.Comment != newZip.Comment}
+	oldFiles := zipFilesByName(oldZip.File)
+	newFiles := zipFilesByName(newZip.File)
+
+	// The entries in both archives, in the order of each, tell whether
+	// they were reordered.
+	var oldCommon, newCommon []string
+	for _, f := range oldZip.File {
+		if newFiles[f.Name] == nil {
+			diff.Removed = append(diff.Removed, f.Name)
+		} else if oldFiles[f.Name] == f {
+			oldCommon = append(oldCommon, f.Name)
+		}
+	}
+	for _, f := range newZip.File {
+		old := oldFiles[f.Name]
+		switch {
+		case old == nil:
+			diff.Added = append(diff.Added, f.Name)
+			continue
+		case newFiles[f.Name] != f:
+			continue
+		}
+		newCommon = append(newCommon, f.Name)
+		if fields := changedZipFields(old, f); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ChangedEntry{Name: f.Name, Fields: fields})
+		}
+	}
+	for i := range oldCommon {
+		if oldCommon[i] != newCommon[i] {
+			diff.Reordered = true
+			break
+		}
+	}
+	return diff, nil
+}
+
+// zipFilesByName returns the first of files with each name.
+func zipFilesByName(files []*zip.File) map[string]*zip.File {
+	byName := make(map[string]*zip.File, len(files))
+	for _, f := range files {
+		if byName[f.Name] == nil {
+			byName[f.Name] = f
+		}
+	}
+	return byName
+}
+
+// changedZipFields lists what differs between the entries oldFile and
+// newFile, as ChangedEntry.Fields does.
+func changedZipFields(oldFile, newFile *zip.File) []string {
+	var fields []string
+	if oldFile.CRC32 != newFile.CRC32 || oldFile.UncompressedSize64 != newFile.UncompressedSize64 {
+		fields = append(fields, "content")
+	}
+	if oldFile.Mode() != newFile.Mode() {
+		fields = append(fields, "mode")
+	}
+	if !oldFile.Modified.Equal(newFile.Modified) {
+		fields = append(fields, "modified")
+	}
+	if oldFile.Method != newFile.Method {
+		fields = append(fields, "method")
+	}
+	return fields
+}
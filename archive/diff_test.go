@@ -0,0 +1,66 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffZips(t *testing.T) {
+	dir := tempDir(t, "archive-diff")
+	defer os.RemoveAll(dir)
+
+	write := func(name string, opts ArchiveOptions, content []ContentEntry) string {
+		path := filepath.Join(dir, name)
+		archiver := NewZipArchiver(path)
+		opts.NormalizeTimestamps = true
+		archiver.SetOptions(opts)
+		if err := archiver.ArchiveMultipleOrdered(content); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return path
+	}
+	oldPath := write("old.zip", ArchiveOptions{}, []ContentEntry{
+		{Name: "a.txt", Content: []byte("a")},
+		{Name: "b.txt", Content: []byte("b")},
+		{Name: "c.txt", Content: []byte("c")},
+		{Name: "removed.txt", Content: []byte("removed")},
+	})
+
+	diff, err := DiffZips(oldPath, oldPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !diff.Empty() {
+		t.Errorf("expected no differences between an archive and itself, got %+v", diff)
+	}
+
+	newPath := write("new.zip", ArchiveOptions{Comment: "build 2", FileModes: map[string]os.FileMode{"b.txt": 0755}}, []ContentEntry{
+		{Name: "c.txt", Content: []byte("c")},
+		{Name: "a.txt", Content: []byte("changed")},
+		{Name: "added.txt", Content: []byte("added")},
+		{Name: "b.txt", Content: []byte("b")},
+	})
+	diff, err = DiffZips(oldPath, newPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := &ArchiveDiff{
+		Added:   []string{"added.txt"},
+		Removed: []string{"removed.txt"},
+		Changed: []ChangedEntry{
+			{Name: "a.txt", Fields: []string{"content"}},
+			{Name: "b.txt", Fields: []string{"mode"}},
+		},
+		Reordered:      true,
+		CommentChanged: true,
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("got %+v, want %+v", diff, want)
+	}
+
+	if _, err := DiffZips(oldPath, filepath.Join(dir, "missing.zip")); err == nil {
+		t.Errorf("expected error for a missing archive")
+	}
+}
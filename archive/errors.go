@@ -0,0 +1,32 @@
+package archive
+
+import "fmt"
+
+// ArchiveError is returned when reading a file, or writing its entry, fails
+// while archiving, naming the file and what was being done with it. Use
+// errors.As to get it from the error of an Archiver, and errors.Is or
+// errors.As on it to check the error it wraps, such as os.ErrNotExist.
+type ArchiveError struct {
+	// Op is what failed, such as "reading file for archival" or "creating
+	// file inside archive".
+	Op string
+
+	// Path is the path of the file read from disk, or the name of the
+	// entry being written to the archive.
+	Path string
+
+	// Err is the error Op failed with.
+	Err error
+}
+
+func (e *ArchiveError) Error() string {
+	return fmt.Sprintf("error %s: %s: %s", e.Op, e.Path, e.Err)
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+func archiveError(op, path string, err error) error {
+	return &ArchiveError{Op: op, Path: path, Err: err}
+}
@@ -0,0 +1,173 @@
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Unzip extracts the zip file at archivePath into destDir, creating destDir
+// and any directories the entries need, and applying the stored file modes.
+// Entries, or symlink targets, that would land outside destDir are rejected
+// before anything is written for them.
+func Unzip(archivePath, destDir string) error {
+	r, err := openZip(archivePath)
+	if err != nil {
+		return fmt.Errorf("could not open archive: %w", err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("could not create output directory: %w", err)
+	}
+
+	// Directory modes are applied last so that read-only directories can
+	// still have their contents extracted.
+	dirModes := map[string]os.FileMode{}
+	for _, f := range r.File {
+		target, err := extractPath(destDir, f.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("could not create directory %s: %w", f.Name, err)
+			}
+			if mode.Perm() != 0 {
+				dirModes[target] = mode.Perm()
+			}
+		case mode&os.ModeSymlink != 0:
+			if err := extractZipSymlink(f, destDir, target); err != nil {
+				return err
+			}
+		default:
+			if err := extractZipFile(f, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	for dir, mode := range dirModes {
+		if err := os.Chmod(dir, mode); err != nil {
+			return fmt.Errorf("could not set directory mode: %w", err)
+		}
+	}
+	return nil
+}
+
+// openZip opens the zip file at path, with the decompressors for every method
+// the archivers write.
+func openZip(path string) (*zip.ReadCloser, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	r.RegisterDecompressor(zipZstd, zstdDecompressor)
+	return r, nil
+}
+
+// zstdDecompressor reads zip entries compressed with Zstandard.
+func zstdDecompressor(r io.Reader) io.ReadCloser {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return ioutil.NopCloser(errReader{err})
+	}
+	return d.IOReadCloser()
+}
+
+// errReader fails every read with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// extractPath returns where the entry called name is extracted to within
+// destDir, or an error if it would be outside of it. Backslashes are treated
+// as separators so that names written on Windows can't escape either.
+func extractPath(destDir, name string) (string, error) {
+	sanitized, err := sanitizeArchivePath(name)
+	if err != nil {
+		return "", err
+	}
+	slashed := strings.Replace(sanitized, `\`, "/", -1)
+	return filepath.Join(destDir, filepath.FromSlash(slashed)), nil
+}
+
+func extractZipFile(f *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("could not create directory for %s: %w", f.Name, err)
+	}
+
+	perm := f.Mode().Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+
+	src, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("could not open %s in archive: %w", f.Name, err)
+	}
+	defer src.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("could not create file %s: %w", f.Name, err)
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return fmt.Errorf("could not extract file %s: %w", f.Name, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("could not extract file %s: %w", f.Name, err)
+	}
+
+	// The mode passed to OpenFile is filtered by the umask.
+	return os.Chmod(target, perm)
+}
+
+func extractZipSymlink(f *zip.File, destDir, target string) error {
+	src, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("could not open %s in archive: %w", f.Name, err)
+	}
+	defer src.Close()
+	linkname, err := ioutil.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("could not read symlink %s: %w", f.Name, err)
+	}
+
+	// The link target is resolved from the directory containing the link,
+	// and must stay within destDir.
+	slashed := strings.Replace(string(linkname), `\`, "/", -1)
+	if path.IsAbs(slashed) || hasDriveLetter(slashed) {
+		return fmt.Errorf("illegal symlink target in archive: %s -> %s", f.Name, linkname)
+	}
+	rel, err := filepath.Rel(destDir, filepath.Dir(target))
+	if err == nil {
+		_, err = extractPath(destDir, path.Join(filepath.ToSlash(rel), slashed))
+	}
+	if err != nil {
+		return fmt.Errorf("illegal symlink target in archive: %s -> %s", f.Name, linkname)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("could not create directory for %s: %w", f.Name, err)
+	}
+	if err := os.Symlink(filepath.FromSlash(string(linkname)), target); err != nil {
+		return fmt.Errorf("could not create symlink %s: %w", f.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package archive
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestUnzip_RoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes and symlinks are not supported on windows")
+	}
+
+	srcdir := tempDir(t, "archive-unzip-src")
+	defer os.RemoveAll(srcdir)
+	destdir := tempDir(t, "archive-unzip-dest")
+	defer os.RemoveAll(destdir)
+
+	writeTestFile(t, filepath.Join(srcdir, "lib", "lib.txt"), "lib")
+	writeTestFile(t, filepath.Join(srcdir, "bootstrap"), "#!/bin/sh")
+	if err := os.Chmod(filepath.Join(srcdir, "bootstrap"), 0755); err != nil {
+		t.Fatalf("could not chmod file: %s", err)
+	}
+	if err := os.Mkdir(filepath.Join(srcdir, "tmp"), 0755); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+	if err := os.Symlink("lib/lib.txt", filepath.Join(srcdir, "link.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	zipfilepath := "archive-unzip.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirWithOptions(srcdir, ArchiveDirOptions{
+		Symlinks:   SymlinkStore,
+		DirEntries: DirEntriesEmpty,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := Unzip(zipfilepath, destdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(destdir, "lib", "lib.txt"))
+	if err != nil || string(content) != "lib" {
+		t.Errorf("expected lib/lib.txt to be extracted, got %q: %v", content, err)
+	}
+	if fi, err := os.Stat(filepath.Join(destdir, "bootstrap")); err != nil || fi.Mode() != 0755 {
+		t.Errorf("expected bootstrap to be extracted with mode 0755: %v %v", fi, err)
+	}
+	if fi, err := os.Stat(filepath.Join(destdir, "tmp")); err != nil || !fi.IsDir() {
+		t.Errorf("expected tmp directory to be extracted: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(destdir, "link.txt")); err != nil || target != "lib/lib.txt" {
+		t.Errorf("expected link.txt to be extracted as a symlink to lib/lib.txt, got %q: %v", target, err)
+	}
+}
+
+func TestUnzip_ContentMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+
+	destdir := tempDir(t, "archive-unzip-content-mode")
+	defer os.RemoveAll(destdir)
+
+	zipfilepath := "archive-unzip-content-mode.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "bootstrap", 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := Unzip(zipfilepath, destdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fi, err := os.Stat(filepath.Join(destdir, "bootstrap")); err != nil || fi.Mode() != 0755 {
+		t.Errorf("expected bootstrap to be extracted with mode 0755: %v %v", fi, err)
+	}
+}
+
+func TestUnzip_Zstd(t *testing.T) {
+	destdir := tempDir(t, "archive-unzip-zstd-dest")
+	defer os.RemoveAll(destdir)
+
+	zipfilepath := "archive-unzip-zstd.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{Compression: CompressionZstd})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := Unzip(zipfilepath, destdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(destdir, "file1.txt"))
+	if err != nil || string(content) != "This is file 1" {
+		t.Errorf("expected file1.txt to be extracted, got %q: %v", content, err)
+	}
+}
+
+func TestUnzip_Traversal(t *testing.T) {
+	cases := map[string]func(w *zip.Writer) error{
+		"parent": func(w *zip.Writer) error {
+			return writeZipEntry(w, "../evil.txt", "evil", 0644)
+		},
+		"nested parent": func(w *zip.Writer) error {
+			return writeZipEntry(w, "sub/../../evil.txt", "evil", 0644)
+		},
+		"absolute": func(w *zip.Writer) error {
+			return writeZipEntry(w, "/evil.txt", "evil", 0644)
+		},
+		"backslash parent": func(w *zip.Writer) error {
+			return writeZipEntry(w, `..\evil.txt`, "evil", 0644)
+		},
+		"symlink parent": func(w *zip.Writer) error {
+			return writeZipEntry(w, "link", "../../etc", os.ModeSymlink|0777)
+		},
+		"symlink absolute": func(w *zip.Writer) error {
+			return writeZipEntry(w, "link", "/etc/passwd", os.ModeSymlink|0777)
+		},
+	}
+
+	for name, build := range cases {
+		destdir := tempDir(t, "archive-unzip-traversal")
+		defer os.RemoveAll(destdir)
+
+		zipfilepath := "archive-unzip-traversal.zip"
+		f, err := os.Create(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not create zip file: %s", err)
+		}
+		w := zip.NewWriter(f)
+		if err := build(w); err != nil {
+			t.Fatalf("could not write zip entry: %s", err)
+		}
+		w.Close()
+		f.Close()
+
+		if err := Unzip(zipfilepath, filepath.Join(destdir, "out")); err == nil {
+			t.Errorf("%s: expected error extracting malicious entry", name)
+		}
+		if _, err := os.Lstat(filepath.Join(destdir, "evil.txt")); err == nil {
+			t.Errorf("%s: file was extracted outside of the output directory", name)
+		}
+	}
+}
+
+func writeZipEntry(w *zip.Writer, name, content string, mode os.FileMode) error {
+	fh := &zip.FileHeader{Name: name}
+	fh.SetMode(mode)
+	f, err := w.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(content))
+	return err
+}
+
+func TestUnzip_Bundle(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+
+	srcdir := tempDir(t, "archive-unzip-bundle-src")
+	defer os.RemoveAll(srcdir)
+
+	// A macOS framework, whose top level entries are symlinks through
+	// Versions/Current to the current version of the framework.
+	framework := filepath.Join(srcdir, "Foo.framework")
+	writeTestFile(t, filepath.Join(framework, "Versions", "A", "Foo"), "This is the binary")
+	if err := os.Chmod(filepath.Join(framework, "Versions", "A", "Foo"), 0755); err != nil {
+		t.Fatalf("could not chmod file: %s", err)
+	}
+	writeTestFile(t, filepath.Join(framework, "Versions", "A", "Resources", "Info.plist"), "<plist/>")
+	links := map[string]string{
+		"Foo.framework/Versions/Current": "A",
+		"Foo.framework/Foo":              "Versions/Current/Foo",
+		"Foo.framework/Resources":        "Versions/Current/Resources",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(srcdir, filepath.FromSlash(link))); err != nil {
+			t.Fatalf("could not create symlink: %s", err)
+		}
+	}
+
+	for _, opts := range []ArchiveOptions{{}, {ZipCreator: ZipCreatorInfoZipUnix}} {
+		zipfilepath := "archive-unzip-bundle.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(opts)
+		if err := archiver.ArchiveDirWithOptions(srcdir, ArchiveDirOptions{Symlinks: SymlinkStore}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// Links are stored with the mode of the link and its target as
+		// the content, as zip --symlinks and ditto store them.
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		for _, f := range r.File {
+			target, ok := links[f.Name]
+			if !ok {
+				continue
+			}
+			fi, err := os.Lstat(filepath.Join(srcdir, filepath.FromSlash(f.Name)))
+			if err != nil {
+				t.Fatalf("could not stat symlink: %s", err)
+			}
+			if f.Mode() != fi.Mode() || f.Method != zip.Store {
+				t.Errorf("expected %s to be stored with mode %s, got %s with method %d", f.Name, fi.Mode(), f.Mode(), f.Method)
+			}
+			ensureContent(t, map[string][]byte{f.Name: []byte(target)}, f)
+		}
+		r.Close()
+
+		destdir := tempDir(t, "archive-unzip-bundle-dest")
+		defer os.RemoveAll(destdir)
+		if err := Unzip(zipfilepath, destdir); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for link, want := range links {
+			path := filepath.Join(destdir, filepath.FromSlash(link))
+			if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("expected %s to be extracted as a symlink: %v %v", link, fi, err)
+				continue
+			}
+			if target, err := os.Readlink(path); err != nil || target != want {
+				t.Errorf("expected %s to link to %s, got %q: %v", link, want, target, err)
+			}
+		}
+		content, err := ioutil.ReadFile(filepath.Join(destdir, "Foo.framework", "Resources", "Info.plist"))
+		if err != nil || string(content) != "<plist/>" {
+			t.Errorf("expected Info.plist to be read through the links, got %q: %v", content, err)
+		}
+		if fi, err := os.Stat(filepath.Join(destdir, "Foo.framework", "Foo")); err != nil || fi.Mode() != 0755 {
+			t.Errorf("expected the binary to be extracted with mode 0755: %v %v", fi, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package archive
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// validatePatterns checks that every pattern is well formed so that matching
+// during a walk can't fail part way through an archive.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, segment := range strings.Split(pattern, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchPattern reports whether the slash separated name matches pattern.
+// Each segment of pattern is matched against the corresponding segment of
+// name with path.Match, except for a "**" segment which matches zero or more
+// whole segments.
+func matchPattern(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"), false)
+}
+
+// matchSegments matches the segments of name against those of pattern. With
+// dots, as in shell globs, a segment starting with a dot is only matched by a
+// pattern segment that starts with a dot too, and never by "**".
+func matchSegments(pattern, name []string, dots bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:], dots) {
+					return true
+				}
+				if dots && i < len(name) && strings.HasPrefix(name[i], ".") {
+					break
+				}
+			}
+			return false
+		}
+		if len(name) == 0 || !matchSegment(pattern[0], name[0], dots) {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchPrefixSegments reports whether pattern could match a path inside the
+// directory whose segments are name, matching like matchSegments.
+func matchPrefixSegments(pattern, name []string, dots bool) bool {
+	for len(name) > 0 {
+		if len(pattern) == 0 {
+			return false
+		}
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchPrefixSegments(pattern[1:], name[i:], dots) {
+					return true
+				}
+				if dots && i < len(name) && strings.HasPrefix(name[i], ".") {
+					break
+				}
+			}
+			// The "**" can also take the rest of name along with whatever
+			// is inside it.
+			return !dots || !hasHiddenSegment(name)
+		}
+		if !matchSegment(pattern[0], name[0], dots) {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(pattern) > 0
+}
+
+func matchSegment(pattern, name string, dots bool) bool {
+	if dots && strings.HasPrefix(name, ".") && !strings.HasPrefix(pattern, ".") {
+		return false
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func hasHiddenSegment(name []string) bool {
+	for _, segment := range name {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether name matches at least one of patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludingPattern returns the first of the exclude patterns that path,
+// taken relative to indirname, matches, or "" if it matches none. indirname
+// itself is never excluded.
+func excludingPattern(indirname, path string, excludes []string) string {
+	relname, err := filepath.Rel(indirname, path)
+	if err != nil || relname == "." {
+		return ""
+	}
+	name := filepath.ToSlash(relname)
+	for _, pattern := range excludes {
+		if matchPattern(pattern, name) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// excludingRegexp returns the first of regexps matching the file or
+// directory at path, taken relative to indirname with a trailing slash for
+// directories, or "" if none does.
+func excludingRegexp(indirname, path string, isDir bool, regexps []*regexp.Regexp) string {
+	relname, err := filepath.Rel(indirname, path)
+	if err != nil || relname == "." {
+		return ""
+	}
+	name := filepath.ToSlash(relname)
+	if isDir {
+		name += "/"
+	}
+	for _, re := range regexps {
+		if re.MatchString(name) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// checkDenied errors if the file or directory at path, taken relative to
+// indirname, matches one of the deny patterns, naming the pattern. Patterns
+// without a slash are matched against the base name.
+func checkDenied(indirname, path string, denies []string) error {
+	relname, err := filepath.Rel(indirname, path)
+	if err != nil || relname == "." {
+		return nil
+	}
+	name := filepath.ToSlash(relname)
+	for _, pattern := range denies {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = filepath.Base(relname)
+		}
+		if matchPattern(pattern, target) {
+			return fmt.Errorf("refusing to archive %s, which matches the deny pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+// isHidden reports whether the file or directory at path, taken relative to
+// indirname, is left out by SkipHidden: its name starts with a dot, and no
+// include pattern names it with a segment starting with a dot, such as
+// ".env" or ".well-known/**". A hidden directory is walked when an include
+// pattern could match a path inside it.
+func isHidden(indirname, path string, isDir bool, opts ArchiveDirOptions) bool {
+	if !opts.SkipHidden || !strings.HasPrefix(filepath.Base(path), ".") {
+		return false
+	}
+	relname, err := filepath.Rel(indirname, path)
+	if err != nil || relname == "." {
+		return false
+	}
+	name := strings.Split(filepath.ToSlash(relname), "/")
+	for _, pattern := range opts.Includes {
+		segments := strings.Split(pattern, "/")
+		if isDir && matchPrefixSegments(segments, name, true) || !isDir && matchSegments(segments, name, true) {
+			return false
+		}
+	}
+	return true
+}
+
+// isIncluded reports whether the file at path, taken relative to indirname,
+// matches one of the include patterns. Every file is included when there are
+// no patterns.
+func isIncluded(indirname, path string, includes []string) bool {
+	if len(includes) == 0 {
+		return true
+	}
+	relname, err := filepath.Rel(indirname, path)
+	if err != nil {
+		return false
+	}
+	return matchAny(includes, filepath.ToSlash(relname))
+}
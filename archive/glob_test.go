@@ -0,0 +1,79 @@
+package archive
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.log", "debug.log", true},
+		{"*.log", "logs/debug.log", false},
+		{"**/*.log", "debug.log", true},
+		{"**/*.log", "logs/debug.log", true},
+		{"**/*.log", "logs/2018/debug.log", true},
+		{"node_modules", "node_modules", true},
+		{"node_modules", "lib/node_modules", false},
+		{"**/.git/**", ".git", true},
+		{"**/.git/**", ".git/config", true},
+		{"**/.git/**", "vendor/lib/.git/objects/ab", true},
+		{"**/.git/**", ".gitignore", false},
+		{"src/*/main.go", "src/cmd/main.go", true},
+		{"src/*/main.go", "src/cmd/tool/main.go", false},
+		{"src/**/main.go", "src/cmd/tool/main.go", true},
+		{"file?.txt", "file1.txt", true},
+		{"file[23].txt", "file1.txt", false},
+	}
+
+	for _, tc := range cases {
+		if got := matchPattern(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("matchPattern(%q, %q) = %t, want %t", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	if err := validatePatterns([]string{"*.log", "**/.git/**"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := validatePatterns([]string{"[.log"}); err == nil {
+		t.Errorf("expected error for malformed pattern")
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	cases := []struct {
+		name     string
+		isDir    bool
+		includes []string
+		want     bool
+	}{
+		{"main.go", false, nil, false},
+		{".env", false, nil, true},
+		{"lib/.env", false, nil, true},
+		{".git", true, nil, true},
+		{".env", false, []string{"*"}, true},
+		{".env", false, []string{"**/*"}, true},
+		{".env", false, []string{".env"}, false},
+		{"lib/.env", false, []string{"**/.env"}, false},
+		{"lib/.env", false, []string{"lib/.*"}, false},
+		{".git", true, []string{"**"}, true},
+		{".git", true, []string{"**/.env"}, true},
+		{".git", true, []string{".git"}, true},
+		{".github", true, []string{".github/**"}, false},
+		{".github", true, []string{".github/*.yml"}, false},
+		{"lib/.config", true, []string{"**/.config/*"}, false},
+		{"lib/.config", true, []string{"lib/*/file"}, true},
+	}
+
+	for _, tc := range cases {
+		opts := ArchiveDirOptions{SkipHidden: true, Includes: tc.includes}
+		if got := isHidden("root", "root/"+tc.name, tc.isDir, opts); got != tc.want {
+			t.Errorf("isHidden(%q, %t) with includes %q = %t, want %t", tc.name, tc.isDir, tc.includes, got, tc.want)
+		}
+	}
+	if isHidden("root", "root/.env", false, ArchiveDirOptions{}) {
+		t.Errorf("expected nothing to be hidden without SkipHidden")
+	}
+}
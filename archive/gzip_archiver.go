@@ -0,0 +1,267 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// GzipArchiver writes a single file compressed with gzip, such as file.js.gz
+// for serving a pre-compressed static asset. gzip has no container, so
+// archiving a directory or more than one file is an error, and options that
+// only apply to containers, such as Prefix and Owner, are ignored.
+type GzipArchiver struct {
+	filepath string
+	manifest archiveManifest
+	options  ArchiveOptions
+	guard    archiveGuard
+	// discard writes nothing, only recording the entries, as set by
+	// getDiscardArchiver.
+	discard bool
+}
+
+// NewGzipArchiver returns an Archiver for gzip compressed files.
+func NewGzipArchiver(filepath string) Archiver {
+	return &GzipArchiver{
+		filepath: absOutputPath(filepath),
+	}
+}
+
+func (a *GzipArchiver) ArchiveContent(content []byte, infilename string) error {
+	return a.ArchiveReader(bytes.NewReader(content), infilename)
+}
+
+func (a *GzipArchiver) ArchiveReader(r io.Reader, infilename string) error {
+	return a.write(r, infilename, 0644, time.Time{})
+}
+
+func (a *GzipArchiver) ArchiveContentMode(content []byte, infilename string, mode os.FileMode) error {
+	return a.write(bytes.NewReader(content), infilename, mode, time.Time{})
+}
+
+func (a *GzipArchiver) ArchiveFile(infilename string) error {
+	return a.ArchiveFileFrom(infilename, "")
+}
+
+func (a *GzipArchiver) ArchiveFileFrom(infilename, root string) error {
+	archivePath, err := archivePathFrom(root, infilename)
+	if err != nil {
+		return err
+	}
+	return a.ArchiveFileAs(infilename, archivePath)
+}
+
+// ArchiveFiles compresses the only file of files, erroring if there is more
+// than one.
+func (a *GzipArchiver) ArchiveFiles(files []string, base string) error {
+	if len(files) != 1 {
+		return fmt.Errorf("gzip files hold a single file, so %d files can't be archived as gzip", len(files))
+	}
+	listed, err := listFiles(files, base, "")
+	if err != nil {
+		return err
+	}
+	return a.ArchiveFileAs(listed[0].path, listed[0].name)
+}
+
+// ArchiveFileAs compresses infilename, storing the base name of archivePath
+// and the file's modification time in the gzip header.
+func (a *GzipArchiver) ArchiveFileAs(infilename, archivePath string) error {
+	fi, err := assertValidFile(infilename)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(infilename)
+	if err != nil {
+		return archiveError("reading file for archival", infilename, err)
+	}
+	defer src.Close()
+	return a.write(src, filepath.ToSlash(archivePath), fi.Mode(), fi.ModTime())
+}
+
+func (a *GzipArchiver) ArchiveDir(indirname string) error {
+	return a.ArchiveDirWithOptions(indirname, ArchiveDirOptions{})
+}
+
+func (a *GzipArchiver) ArchiveDirWithOptions(indirname string, opts ArchiveDirOptions) error {
+	return a.ArchiveDirContext(context.Background(), indirname, opts)
+}
+
+func (a *GzipArchiver) ArchiveDirContext(ctx context.Context, indirname string, opts ArchiveDirOptions) error {
+	return a.ArchiveDirsContext(ctx, []ArchiveDirSource{{Path: indirname}}, opts)
+}
+
+func (a *GzipArchiver) ArchiveDirsContext(ctx context.Context, sources []ArchiveDirSource, opts ArchiveDirOptions) error {
+	return fmt.Errorf("gzip files hold a single file, so directories can't be archived as gzip")
+}
+
+// ArchiveMultiple compresses the only file of content, erroring if there is
+// more than one.
+func (a *GzipArchiver) ArchiveMultiple(content map[string][]byte) error {
+	if len(content) != 1 {
+		return fmt.Errorf("gzip files hold a single file, so %d files can't be archived as gzip", len(content))
+	}
+	for name, data := range content {
+		return a.ArchiveContent(data, name)
+	}
+	return nil
+}
+
+// ArchiveMultipleOrdered compresses the only file of content, erroring if
+// there is more than one.
+func (a *GzipArchiver) ArchiveMultipleOrdered(content []ContentEntry) error {
+	if len(content) != 1 {
+		return fmt.Errorf("gzip files hold a single file, so %d files can't be archived as gzip", len(content))
+	}
+	return a.ArchiveContent(content[0].Content, content[0].Name)
+}
+
+// ArchiveExistingZip errors, as a zip file's entries can't be compressed into
+// a single gzip file.
+func (a *GzipArchiver) ArchiveExistingZip(path, prefix string) error {
+	return fmt.Errorf("gzip files hold a single file, so the entries of %s can't be archived as gzip", path)
+}
+
+// Open errors, as a gzip file can't have entries added to it.
+func (a *GzipArchiver) Open() error {
+	return fmt.Errorf("gzip files hold a single file, so %s can't be opened to add entries", a.filepath)
+}
+
+func (a *GzipArchiver) AddContent(content []byte, infilename string) error {
+	return fmt.Errorf("archive %s is not open", a.filepath)
+}
+
+func (a *GzipArchiver) AddFile(infilename, archivePath string) error {
+	return fmt.Errorf("archive %s is not open", a.filepath)
+}
+
+func (a *GzipArchiver) AddDir(ctx context.Context, indirname string, opts ArchiveDirOptions) error {
+	return fmt.Errorf("archive %s is not open", a.filepath)
+}
+
+// Close does nothing, as the archive is never open.
+func (a *GzipArchiver) Close() error {
+	return nil
+}
+
+func (a *GzipArchiver) SetOptions(opts ArchiveOptions) {
+	a.options = opts
+}
+
+// Entries returns the file written by the last call that archived anything.
+func (a *GzipArchiver) Entries() []ArchiveEntry {
+	return a.manifest.entries()
+}
+
+// Skipped returns nil, as no directory is walked to skip files from.
+func (a *GzipArchiver) Skipped() []SkippedFile {
+	return nil
+}
+
+// write compresses everything read from r as the file name. The gzip header
+// stores the base name of the file and its modification time, which
+// NormalizeTimestamps leaves unset, as a zero time, for reproducible output.
+func (a *GzipArchiver) write(r io.Reader, name string, mode os.FileMode, modTime time.Time) (err error) {
+	if err := a.guard.acquire(a.filepath); err != nil {
+		return err
+	}
+	defer a.guard.release()
+	name, err = sanitizeArchivePath(name)
+	if err != nil {
+		return err
+	}
+	if err := assertValidCompressionLevel(a.options.CompressionLevel); err != nil {
+		return err
+	}
+	if err := assertValidModTime(a.options); err != nil {
+		return err
+	}
+	if err := assertValidTransforms(a.options.Transforms); err != nil {
+		return err
+	}
+	if a.options.BaseArchive != "" {
+		return fmt.Errorf("gzip files hold a single file, so they can't have a base archive")
+	}
+	r, _, err = a.options.transformReader(r, -1, name)
+	if err != nil {
+		return err
+	}
+
+	w := a.options.Output
+	if a.discard {
+		w = ioutil.Discard
+	} else if w == nil {
+		if err := prepareOutputDir(a.filepath, a.options.CreateOutputDir); err != nil {
+			return err
+		}
+		f, err := createArchiveFile(a.filepath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = closeArchiveFile(f, err)
+			if err == nil && a.options.Verify {
+				err = a.verify(f.Name(), name)
+			}
+			err = commitArchiveFile(f.Name(), a.filepath, err)
+		}()
+		w = a.options.teeOutput(f)
+	}
+
+	level := gzip.DefaultCompression
+	switch a.options.CompressionLevel {
+	case DefaultCompression:
+	case NoCompression:
+		level = gzip.NoCompression
+	default:
+		level = a.options.CompressionLevel
+	}
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	gw.Name = path.Base(name)
+	gw.Comment = a.options.Comment
+	switch {
+	case !a.options.ModTime.IsZero():
+		gw.ModTime = a.options.ModTime
+	case !a.options.NormalizeTimestamps:
+		gw.ModTime = modTime
+	}
+
+	a.manifest = nil
+	entry := a.manifest.add(name, mode.Perm(), gw.ModTime)
+	size := sizeLimit{max: a.options.MaxSize}
+	if _, err := io.Copy(&limitWriter{w: gw, entry: entry, limit: &size}, r); err != nil {
+		gw.Close()
+		return err
+	}
+	return gw.Close()
+}
+
+// verify reads the finished file back from path, before it is moved into
+// place, which checks that it decompresses to the CRC-32 in its trailer, and
+// compares it with the content written.
+func (a *GzipArchiver) verify(path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error verifying archive: %w", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("error verifying archive: %w", err)
+	}
+	v := newArchiveVerifier(a.manifest.entries())
+	if err := v.check(name, zr); err != nil {
+		return err
+	}
+	return v.finish()
+}
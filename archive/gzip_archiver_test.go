@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGzipArchiver_Content(t *testing.T) {
+	gzfilepath := "archive-content.js.gz"
+	archiver := NewGzipArchiver(gzfilepath)
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.js"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	zr := openGzip(t, gzfilepath)
+	if zr.Name != "content.js" {
+		t.Errorf("got name %q, want %q", zr.Name, "content.js")
+	}
+	ensureGzipContent(t, zr, "This is some content")
+	entries := archiver.Entries()
+	if len(entries) != 1 || entries[0].Name != "content.js" || entries[0].Size != 20 {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestGzipArchiver_File(t *testing.T) {
+	gzfilepath := "archive-file.txt.gz"
+	archiver := NewGzipArchiver(gzfilepath)
+	archiver.SetOptions(ArchiveOptions{Comment: "built by terraform", CompressionLevel: 9})
+	if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fi, err := os.Stat("./test-fixtures/test-file.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	zr := openGzip(t, gzfilepath)
+	if zr.Name != "test-file.txt" {
+		t.Errorf("got name %q, want %q", zr.Name, "test-file.txt")
+	}
+	if zr.Comment != "built by terraform" {
+		t.Errorf("got comment %q, want %q", zr.Comment, "built by terraform")
+	}
+	if !zr.ModTime.Equal(fi.ModTime().Truncate(time.Second)) {
+		t.Errorf("got modification time %s, want %s", zr.ModTime, fi.ModTime())
+	}
+	ensureGzipContent(t, zr, "This is test content")
+}
+
+func TestGzipArchiver_NormalizeTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-gzip")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "test-file.txt")
+	writeTestFile(t, source, "This is test content")
+
+	var contents [2][]byte
+	for i := range contents {
+		gzfilepath := "archive-normalize-timestamps.txt.gz"
+		archiver := NewGzipArchiver(gzfilepath)
+		archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true})
+		if err := archiver.ArchiveFile(source); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if zr := openGzip(t, gzfilepath); !zr.ModTime.IsZero() {
+			t.Errorf("got modification time %s, want none", zr.ModTime)
+		}
+		contents[i], err = ioutil.ReadFile(gzfilepath)
+		if err != nil {
+			t.Fatalf("could not read gzip file: %s", err)
+		}
+		modTime := time.Now().Add(time.Hour)
+		if err := os.Chtimes(source, modTime, modTime); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if !bytes.Equal(contents[0], contents[1]) {
+		t.Errorf("expected identical output after the source's modification time changed")
+	}
+}
+
+func TestGzipArchiver_SingleFile(t *testing.T) {
+	gzfilepath := "archive-single-file.gz"
+	os.Remove(gzfilepath)
+	archiver := NewGzipArchiver(gzfilepath)
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err == nil {
+		t.Errorf("expected error archiving a directory")
+	}
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+	}); err == nil {
+		t.Errorf("expected error archiving multiple files")
+	}
+	if err := archiver.Open(); err == nil {
+		t.Errorf("expected error opening the archive")
+	}
+	if _, err := os.Stat(gzfilepath); err == nil {
+		t.Errorf("expected no archive to be created")
+	}
+
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureGzipContent(t, openGzip(t, gzfilepath), "This is file 1")
+}
+
+func openGzip(t *testing.T, gzfilepath string) *gzip.Reader {
+	content, err := ioutil.ReadFile(gzfilepath)
+	if err != nil {
+		t.Fatalf("could not read gzip file: %s", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("could not open gzip file: %s", err)
+	}
+	return zr
+}
+
+func ensureGzipContent(t *testing.T, zr *gzip.Reader, want string) {
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("could not read gzip file: %s", err)
+	}
+	if string(got) != want {
+		t.Errorf("got content %q, want %q", got, want)
+	}
+}
+
+func TestGzipArchiver_Verify(t *testing.T) {
+	gzipfilepath := "archive-content-verify.js.gz"
+	archiver := NewGzipArchiver(gzipfilepath)
+	archiver.SetOptions(ArchiveOptions{Verify: true})
+	if err := archiver.ArchiveContent([]byte("console.log('hi')"), "index.js"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureGzipContent(t, openGzip(t, gzipfilepath), "console.log('hi')")
+}
@@ -0,0 +1,52 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// isURL reports whether source is an http or https URL rather than a local
+// path.
+func isURL(source string) bool {
+	u, err := url.Parse(source)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// urlFileName returns the name a file fetched from rawurl is archived under
+// by default, which is the last element of the URL's path.
+func urlFileName(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", rawurl, err)
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "", fmt.Errorf("could not name the file fetched from %s, as its path is empty", rawurl)
+	}
+	return name, nil
+}
+
+// archiveURL fetches rawurl and archives the response body under name. The
+// timeout covers both the request and reading the body.
+func archiveURL(ctx context.Context, archiver Archiver, rawurl, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", rawurl, err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", rawurl, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching %s: unexpected status %s", rawurl, resp.Status)
+	}
+	return archiver.ArchiveReader(resp.Body, name)
+}
@@ -0,0 +1,70 @@
+package archive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsURL(t *testing.T) {
+	cases := map[string]bool{
+		"http://example.com/app.zip":  true,
+		"https://example.com/app.zip": true,
+		"ftp://example.com/app.zip":   false,
+		"test-fixtures/test-file.txt": false,
+		"/tmp/app.zip":                false,
+		`C:\build\app.zip`:            false,
+	}
+	for source, want := range cases {
+		if got := isURL(source); got != want {
+			t.Errorf("isURL(%q) = %t, want %t", source, got, want)
+		}
+	}
+}
+
+func TestURLFileName(t *testing.T) {
+	name, err := urlFileName("https://example.com/builds/app.jar?version=5")
+	if err != nil || name != "app.jar" {
+		t.Errorf("got %q, %v, want app.jar", name, err)
+	}
+	for _, rawurl := range []string{"https://example.com", "https://example.com/"} {
+		if _, err := urlFileName(rawurl); err == nil {
+			t.Errorf("expected error naming the file fetched from %s", rawurl)
+		}
+	}
+}
+
+func TestArchiveURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app.txt":
+			w.Write([]byte("This is the app"))
+		case "/slow.txt":
+			time.Sleep(time.Second)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	zipfilepath := "archive-url.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiveURL(context.Background(), archiver, server.URL+"/app.txt", "app.txt", time.Minute); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"app.txt": []byte("This is the app"),
+	})
+
+	err := archiveURL(context.Background(), archiver, server.URL+"/missing.txt", "missing.txt", time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	err = archiveURL(context.Background(), archiver, server.URL+"/slow.txt", "slow.txt", 10*time.Millisecond)
+	if err == nil {
+		t.Errorf("expected timeout error")
+	}
+}
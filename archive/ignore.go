@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreMatcher matches the paths found while walking a directory against
+// ignore files with .gitignore syntax, read from the directory and its
+// subdirectories as they are needed. A nil matcher ignores nothing.
+type ignoreMatcher struct {
+	root string
+	name string
+	// rules holds the rules of the ignore file in each directory, by the
+	// directory's slash separated path relative to root.
+	rules map[string][]ignoreRule
+}
+
+// ignoreRule is a pattern from an ignore file, matched against paths
+// relative to the directory of the ignore file.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// newIgnoreMatcher returns a matcher for the ignore files called name in the
+// directory root, or nil if name is empty.
+func newIgnoreMatcher(root, name string) *ignoreMatcher {
+	if name == "" {
+		return nil
+	}
+	return &ignoreMatcher{
+		root:  root,
+		name:  name,
+		rules: map[string][]ignoreRule{},
+	}
+}
+
+// ignored reports whether the entry at path is ignored by the ignore files in
+// root or in the directories between root and path. The last rule matching
+// path wins, with rules from deeper directories matched after those of their
+// parents. Entries inside an ignored directory aren't matched by ignored, so
+// the walk has to skip the directory.
+func (m *ignoreMatcher) ignored(path string, isDir bool) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	relname, err := filepath.Rel(m.root, path)
+	if err != nil || relname == "." {
+		return false, nil
+	}
+	segments := strings.Split(filepath.ToSlash(relname), "/")
+
+	ignored := false
+	for i := range segments {
+		rules, err := m.load(strings.Join(segments[:i], "/"))
+		if err != nil {
+			return false, err
+		}
+		name := strings.Join(segments[i:], "/")
+		for _, rule := range rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if matchPattern(rule.pattern, name) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored, nil
+}
+
+// load returns the rules of the ignore file in the directory dir, relative to
+// root, reading it the first time it is needed.
+func (m *ignoreMatcher) load(dir string) ([]ignoreRule, error) {
+	if rules, ok := m.rules[dir]; ok {
+		return rules, nil
+	}
+	filename := filepath.Join(m.root, filepath.FromSlash(dir), m.name)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		m.rules[dir] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading ignore file: %w", err)
+	}
+	defer f.Close()
+
+	rules, err := parseIgnoreRules(bufio.NewScanner(f))
+	if err != nil {
+		return nil, fmt.Errorf("error reading ignore file %s: %w", filename, err)
+	}
+	m.rules[dir] = rules
+	return rules, nil
+}
+
+// parseIgnoreRules parses each line scanned as a .gitignore rule. Blank lines
+// and lines starting with # are skipped.
+func parseIgnoreRules(scanner *bufio.Scanner) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		// Trailing spaces are dropped unless they are escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// A pattern with a slash, other than a trailing one, is relative to
+		// the directory of the ignore file. Any other pattern matches at
+		// any depth.
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		// Character classes are negated with ! in .gitignore files, and
+		// with ^ by path.Match.
+		rule.pattern = strings.Replace(line, "[!", "[^", -1)
+		if err := validatePatterns([]string{rule.pattern}); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
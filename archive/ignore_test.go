@@ -0,0 +1,72 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-ignore")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, ".gitignore"), `# Build output
+*.log
+!keep.log
+build/
+/root-only.txt
+docs/*.tmp
+trailing.txt   
+[!a]z.txt
+`)
+	writeTestFile(t, filepath.Join(dir, "lib", ".gitignore"), `!debug.log
+local.txt
+`)
+
+	cases := []struct {
+		path   string
+		isDir  bool
+		ignore bool
+	}{
+		{"main.txt", false, false},
+		{"debug.log", false, true},
+		{"src/deep/debug.log", false, true},
+		{"lib/deep/debug.log", false, false},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"lib/build", true, true},
+		{"build", false, false},
+		{"root-only.txt", false, true},
+		{"lib/root-only.txt", false, false},
+		{"docs/a.tmp", false, true},
+		{"docs/sub/a.tmp", false, false},
+		{"trailing.txt", false, true},
+		{"bz.txt", false, true},
+		{"az.txt", false, false},
+		{"lib/debug.log", false, false},
+		{"lib/local.txt", false, true},
+		{"local.txt", false, false},
+	}
+	m := newIgnoreMatcher(dir, ".gitignore")
+	for _, tc := range cases {
+		got, err := m.ignored(filepath.Join(dir, filepath.FromSlash(tc.path)), tc.isDir)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != tc.ignore {
+			t.Errorf("ignored(%q, %t) = %t, want %t", tc.path, tc.isDir, got, tc.ignore)
+		}
+	}
+
+	if ignored, err := newIgnoreMatcher(dir, "").ignored(filepath.Join(dir, "debug.log"), false); err != nil || ignored {
+		t.Errorf("expected nothing to be ignored without an ignore file, got %t: %v", ignored, err)
+	}
+	writeTestFile(t, filepath.Join(dir, "bad", ".gitignore"), "[oops\n")
+	if _, err := newIgnoreMatcher(dir, ".gitignore").ignored(filepath.Join(dir, "bad", "file.txt"), false); err == nil {
+		t.Errorf("expected error for a malformed ignore file")
+	}
+}
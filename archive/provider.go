@@ -1,20 +1,33 @@
 package archive
 
 import (
+	"context"
+
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
 
 func Provider() terraform.ResourceProvider {
-	return &schema.Provider{
+	p := &schema.Provider{
 		DataSourcesMap: map[string]*schema.Resource{
-			"archive_file": dataSourceFile(),
+			"archive_file":    dataSourceFile(),
+			"archive_extract": dataSourceExtract(),
 		},
 		ResourcesMap: map[string]*schema.Resource{
-			"archive_file": schema.DataSourceResourceShim(
-				"archive_file",
-				dataSourceFile(),
-			),
+			"archive_file": resourceArchiveFile(),
 		},
 	}
+	p.ConfigureFunc = func(d *schema.ResourceData) (interface{}, error) {
+		return p.StopContext(), nil
+	}
+	return p
+}
+
+// stopContext returns the context, passed to data sources as their meta,
+// that is cancelled when Terraform interrupts the provider.
+func stopContext(meta interface{}) context.Context {
+	if ctx, ok := meta.(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
 }
@@ -0,0 +1,105 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// resourceArchiveFile manages an archive with the same arguments as the
+// archive_file data source. Instead of writing the archive on every read, it
+// keeps a hash of the archive's entries in its state and only writes the
+// archive again when the hash, or the configuration, changes.
+func resourceArchiveFile() *schema.Resource {
+	s := dataSourceFile().Schema
+	// The archive always has to be written for the resource to manage it.
+	delete(s, "dry_run")
+	// There is no update, so any change to the arguments rebuilds the archive.
+	for _, v := range s {
+		if !v.Computed {
+			v.ForceNew = true
+		}
+	}
+	s["input_hash"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Computed:    true,
+		Description: "Hash of the archive's entries, which rebuilds the archive when it changes",
+	}
+
+	return &schema.Resource{
+		Create: resourceArchiveFileCreate,
+		Read:   resourceArchiveFileRead,
+		Delete: resourceArchiveFileDelete,
+
+		Schema: s,
+	}
+}
+
+func resourceArchiveFileCreate(d *schema.ResourceData, meta interface{}) error {
+	if err := dataSourceFileRead(d, meta); err != nil {
+		return err
+	}
+	d.Set("input_hash", inputHash(d.Get("contents").([]interface{})))
+	return nil
+}
+
+// resourceArchiveFileRead removes the archive from the state, so that it is
+// written again, when the output file is gone or the entries it would have
+// now differ from those it was written with. The entries are found without
+// compressing or writing anything.
+func resourceArchiveFileRead(d *schema.ResourceData, meta interface{}) error {
+	outputPath := d.Get("output_path").(string)
+	for _, path := range append([]string{outputPath}, expandStringList(d.Get("output_parts").([]interface{}))...) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			d.SetId("")
+			return nil
+		}
+	}
+
+	archiveType := d.Get("type").(string)
+	archiver := getDiscardArchiver(archiveType)
+	if archiver == nil {
+		return fmt.Errorf("archive type not supported: %s", archiveType)
+	}
+	ctx, cancel := archiveContext(meta, d)
+	defer cancel()
+	if err := archive(ctx, d, archiver, nil, nil); err != nil {
+		return err
+	}
+	if inputHash(d.Get("contents").([]interface{})) != d.Get("input_hash").(string) {
+		d.SetId("")
+	}
+	return nil
+}
+
+func resourceArchiveFileDelete(d *schema.ResourceData, meta interface{}) error {
+	if err := os.Remove(d.Get("output_path").(string)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing archive: %w", err)
+	}
+	if err := os.Remove(d.Get("output_path").(string) + ".fingerprint"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing archive fingerprint: %w", err)
+	}
+	for _, part := range expandStringList(d.Get("output_parts").([]interface{})) {
+		if err := os.Remove(part); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing archive part: %w", err)
+		}
+	}
+	d.SetId("")
+	return nil
+}
+
+// inputHash returns a hash of the entries of an archive, as flattened into
+// its contents: their names, sizes, modes and checksums, in order.
+// Modification times are left out, so that files which are only touched, such
+// as by a new checkout, don't rebuild the archive.
+func inputHash(contents []interface{}) string {
+	h := sha256.New()
+	for _, v := range contents {
+		entry := v.(map[string]interface{})
+		fmt.Fprintf(h, "%s\x00%d\x00%s\x00%s\x00%s\n", entry["name"], entry["size"], entry["mode"], entry["crc32"], entry["md5"])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	r "github.com/hashicorp/terraform/helper/resource"
+)
+
+func TestAccArchiveFileResource_Basic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-resource")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source.txt")
+	output := filepath.Join(dir, "archive.zip")
+	writeTestFile(t, source, "This is some content")
+	config := fmt.Sprintf(`
+resource "archive_file" "foo" {
+  type        = "zip"
+  source_file = %q
+  output_path = %q
+}
+`, source, output)
+
+	var fileSize string
+	r.Test(t, r.TestCase{
+		Providers:    testProviders,
+		CheckDestroy: testAccArchiveFileMissing(output),
+		Steps: []r.TestStep{
+			r.TestStep{
+				Config: config,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileExists(output, &fileSize),
+					r.TestCheckResourceAttrPtr("archive_file.foo", "output_size", &fileSize),
+					r.TestCheckResourceAttr("archive_file.foo", "contents.0.size", "20"),
+					r.TestMatchResourceAttr(
+						"archive_file.foo", "input_hash", regexp.MustCompile(`^[0-9a-f]{64}$`),
+					),
+				),
+			},
+			r.TestStep{
+				// Touching the source doesn't rebuild the archive, which the
+				// empty plan after the step checks.
+				PreConfig: func() {
+					writeTestFile(t, source, "This is some content")
+				},
+				Config: config,
+			},
+			r.TestStep{
+				PreConfig: func() {
+					writeTestFile(t, source, "This is some other content")
+				},
+				Config: config,
+				Check: r.ComposeTestCheckFunc(
+					testAccArchiveFileExists(output, &fileSize),
+					r.TestCheckResourceAttrPtr("archive_file.foo", "output_size", &fileSize),
+					r.TestCheckResourceAttr("archive_file.foo", "contents.0.size", "26"),
+				),
+			},
+			r.TestStep{
+				PreConfig: func() {
+					os.Remove(output)
+				},
+				Config: config,
+				Check:  testAccArchiveFileExists(output, &fileSize),
+			},
+		},
+	})
+}
+
+func TestInputHash(t *testing.T) {
+	entry := func(name string, size int) map[string]interface{} {
+		return map[string]interface{}{
+			"name":  name,
+			"size":  size,
+			"mode":  "0644",
+			"crc32": "e004bade",
+			"md5":   "ee428920507e39e8d89c2cabe6641b67",
+		}
+	}
+	a := inputHash([]interface{}{entry("a.txt", 20), entry("b.txt", 20)})
+	if a != inputHash([]interface{}{entry("a.txt", 20), entry("b.txt", 20)}) {
+		t.Errorf("expected the same entries to have the same hash")
+	}
+	for _, contents := range [][]interface{}{
+		{entry("a.txt", 20)},
+		{entry("b.txt", 20), entry("a.txt", 20)},
+		{entry("a.txt", 20), entry("b.txt", 21)},
+	} {
+		if inputHash(contents) == a {
+			t.Errorf("expected different entries to have a different hash: %v", contents)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestArchiver_DirSpecialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-special-files")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "file.txt"), "This is a file")
+	if err := syscall.Mkfifo(filepath.Join(dir, "pipe"), 0644); err != nil {
+		t.Skipf("could not create named pipe: %s", err)
+	}
+
+	for _, archiver := range []Archiver{
+		NewZipArchiver("archive-dir-special-files.zip"),
+		NewTarGzArchiver("archive-dir-special-files.tar.gz"),
+	} {
+		err := archiver.ArchiveDir(dir)
+		if err == nil || !strings.Contains(err.Error(), "named pipe") {
+			t.Errorf("expected named pipe error, got %v", err)
+		}
+
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{SpecialFiles: SpecialFilesSkip}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	ensureContents(t, "archive-dir-special-files.zip", map[string][]byte{
+		"file.txt": []byte("This is a file"),
+	})
+	ensureTarGzContents(t, "archive-dir-special-files.tar.gz", map[string][]byte{
+		"file.txt": []byte("This is a file"),
+	})
+}
@@ -0,0 +1,1152 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/ulikunitz/xz"
+)
+
+// TarArchiver writes tar files, optionally wrapped in a compression format
+// such as gzip.
+type TarArchiver struct {
+	filepath   string
+	format     tarFormat
+	filewriter *os.File
+	compressor io.WriteCloser
+	writer     *tar.Writer
+	names      archiveNames
+	size       sizeLimit
+	files      fileLimit
+	manifest   archiveManifest
+	skipped    skippedFiles
+	progress   archiveProgress
+	session    archiveSession
+	guard      archiveGuard
+	options    ArchiveOptions
+	// discard writes nothing, only recording the entries, as set by
+	// getDiscardArchiver.
+	discard bool
+}
+
+// tarFormat is the compression format a tar file is wrapped in. The zero
+// value leaves it uncompressed.
+type tarFormat struct {
+	compress   func(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.Reader, error)
+}
+
+// tarGzFormat compresses tar files with gzip, storing ArchiveOptions.Comment
+// in the gzip header.
+var tarGzFormat = tarFormat{
+	compress: func(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error) {
+		level := gzip.DefaultCompression
+		switch opts.CompressionLevel {
+		case DefaultCompression:
+		case NoCompression:
+			level = gzip.NoCompression
+		default:
+			level = opts.CompressionLevel
+		}
+		gw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		gw.Comment = opts.Comment
+		return gw, nil
+	},
+	decompress: func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// tarBz2Format compresses tar files with bzip2. bzip2 has no way to store
+// data uncompressed, so NoCompression selects its fastest level.
+var tarBz2Format = tarFormat{
+	compress: func(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error) {
+		level := opts.CompressionLevel
+		switch level {
+		case DefaultCompression:
+			level = bzip2.DefaultCompression
+		case NoCompression:
+			level = bzip2.BestSpeed
+		}
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+	},
+	decompress: func(r io.Reader) (io.Reader, error) {
+		return bzip2.NewReader(r, nil)
+	},
+}
+
+// tarXzFormat compresses tar files with xz. The xz encoder has no
+// compression levels, so CompressionLevel is ignored.
+var tarXzFormat = tarFormat{
+	compress: func(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	},
+	decompress: func(r io.Reader) (io.Reader, error) {
+		return xz.NewReader(r)
+	},
+}
+
+// NewTarArchiver returns an Archiver for uncompressed tar files.
+func NewTarArchiver(filepath string) Archiver {
+	return &TarArchiver{
+		filepath: absOutputPath(filepath),
+	}
+}
+
+// NewTarGzArchiver returns an Archiver for gzip compressed tar files.
+func NewTarGzArchiver(filepath string) Archiver {
+	return &TarArchiver{
+		filepath: absOutputPath(filepath),
+		format:   tarGzFormat,
+	}
+}
+
+// NewTarBz2Archiver returns an Archiver for bzip2 compressed tar files.
+func NewTarBz2Archiver(filepath string) Archiver {
+	return &TarArchiver{
+		filepath: absOutputPath(filepath),
+		format:   tarBz2Format,
+	}
+}
+
+// NewTarXzArchiver returns an Archiver for xz compressed tar files.
+func NewTarXzArchiver(filepath string) Archiver {
+	return &TarArchiver{
+		filepath: absOutputPath(filepath),
+		format:   tarXzFormat,
+	}
+}
+
+func (a *TarArchiver) ArchiveContent(content []byte, infilename string) error {
+	return a.ArchiveReader(bytes.NewReader(content), infilename)
+}
+
+// ArchiveReader stores everything read from r as the file infilename. Tar
+// headers record the size of a file before its content, so unless r reports
+// its length, the content is spooled to a temporary file rather than held in
+// memory.
+func (a *TarArchiver) ArchiveReader(r io.Reader, infilename string) error {
+	return a.archiveReader(r, infilename, false)
+}
+
+// archiveReader stores everything read from r as the file infilename, adding
+// to the archive kept open by Open when add is set.
+func (a *TarArchiver) archiveReader(r io.Reader, infilename string, add bool) (err error) {
+	infilename, err = prefixedArchivePath(a.options.Prefix, infilename)
+	if err != nil {
+		return err
+	}
+
+	r, size, cleanup, err := spoolReader(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	held, err := a.open(add)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	return a.writeReader(r, size, infilename, a.contentMode(infilename))
+}
+
+func (a *TarArchiver) ArchiveContentMode(content []byte, infilename string, mode os.FileMode) (err error) {
+	infilename, err = prefixedArchivePath(a.options.Prefix, infilename)
+	if err != nil {
+		return err
+	}
+
+	held, err := a.open(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	return a.writeContent(content, infilename, mode)
+}
+
+func (a *TarArchiver) ArchiveFile(infilename string) error {
+	return a.ArchiveFileFrom(infilename, "")
+}
+
+// ArchiveFileFrom stores infilename at its path relative to root, keeping the
+// directories between them, or at the archive root when root is empty.
+func (a *TarArchiver) ArchiveFileFrom(infilename, root string) error {
+	archivePath, err := archivePathFrom(root, infilename)
+	if err != nil {
+		return err
+	}
+	return a.ArchiveFileAs(infilename, archivePath)
+}
+
+func (a *TarArchiver) ArchiveFileAs(infilename, archivePath string) error {
+	return a.archiveFileAs(infilename, archivePath, false)
+}
+
+// archiveFileAs stores infilename as archivePath, adding to the archive kept
+// open by Open when add is set.
+func (a *TarArchiver) archiveFileAs(infilename, archivePath string, add bool) (err error) {
+	fi, err := assertValidFile(infilename)
+	if err != nil {
+		return err
+	}
+	archivePath, err = prefixedArchivePath(a.options.Prefix, filepath.ToSlash(archivePath))
+	if err != nil {
+		return err
+	}
+
+	held, err := a.open(add)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+	return a.writeFile(listedFile{path: infilename, name: archivePath, info: fi})
+}
+
+// ArchiveFiles stores each of files at its path relative to base, in the
+// byte order of those paths. A file outside of base is an error.
+func (a *TarArchiver) ArchiveFiles(files []string, base string) (err error) {
+	listed, err := listFiles(files, base, a.options.Prefix)
+	if err != nil {
+		return err
+	}
+
+	held, err := a.open(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+	for _, file := range listed {
+		if err := a.writeFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile stores the content of a file read from disk.
+func (a *TarArchiver) writeFile(file listedFile) error {
+	src, err := os.Open(file.path)
+	if err != nil {
+		return archiveError("reading file for archival", file.path, err)
+	}
+	defer src.Close()
+	r, size, err := a.options.transformReader(src, file.info.Size(), file.name)
+	if err != nil {
+		return err
+	}
+
+	fh, err := tar.FileInfoHeader(file.info, "")
+	if err != nil {
+		return archiveError("creating file header", file.path, err)
+	}
+	fh.Name = file.name
+	fh.Size = size
+	fh.ModTime = a.options.entryModTime(fh.ModTime)
+	a.setOwner(fh)
+	a.setFileMode(fh)
+
+	w, err := a.writeHeader(fh)
+	if err != nil {
+		return archiveError("creating file inside archive", file.name, err)
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *TarArchiver) ArchiveDir(indirname string) error {
+	return a.ArchiveDirWithOptions(indirname, ArchiveDirOptions{})
+}
+
+func (a *TarArchiver) ArchiveDirWithOptions(indirname string, opts ArchiveDirOptions) error {
+	return a.ArchiveDirContext(context.Background(), indirname, opts)
+}
+
+// ArchiveDirContext archives indirname like ArchiveDirWithOptions, stopping
+// with ctx's error and removing the partially written archive if ctx is
+// cancelled before it completes.
+func (a *TarArchiver) ArchiveDirContext(ctx context.Context, indirname string, opts ArchiveDirOptions) error {
+	return a.ArchiveDirsContext(ctx, []ArchiveDirSource{{Path: indirname}}, opts)
+}
+
+// ArchiveDirsContext archives every source directory into the one archive
+// like ArchiveDirContext, erroring if two sources have an entry with the
+// same name.
+func (a *TarArchiver) ArchiveDirsContext(ctx context.Context, sources []ArchiveDirSource, opts ArchiveDirOptions) error {
+	return a.archiveDirs(ctx, sources, opts, false)
+}
+
+// archiveDirs archives sources like ArchiveDirsContext, adding to the
+// archive kept open by Open when add is set.
+func (a *TarArchiver) archiveDirs(ctx context.Context, sources []ArchiveDirSource, opts ArchiveDirOptions, add bool) (err error) {
+	sources, err = prepareDirSources(sources, a.options.Prefix, opts)
+	if err != nil {
+		return err
+	}
+	if a.options.Output == nil && !a.discard {
+		if err := checkOutputOutside(sources, a.filepath); err != nil {
+			return err
+		}
+	}
+	opts, err = prepareDirOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	held, err := a.open(add)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	a.progress = newArchiveProgress(a.options.Progress, sources, opts)
+	defer func() { a.progress = archiveProgress{} }()
+	baseFiles := a.manifest.fileCount()
+	for _, dir := range sources {
+		if err := a.walkDir(ctx, dir, opts); err != nil {
+			return err
+		}
+	}
+	return checkFilesFound(sources, opts, a.manifest.fileCount()-baseFiles)
+}
+
+// walkDir writes the entries found in dir.
+func (a *TarArchiver) walkDir(ctx context.Context, dir ArchiveDirSource, opts ArchiveDirOptions) error {
+	return walkSource(dir.Path, opts, a.walkFunc(ctx, dir, opts))
+}
+
+// walkFunc returns the filepath.WalkFunc that walkDir writes each entry
+// with.
+func (a *TarArchiver) walkFunc(ctx context.Context, dir ArchiveDirSource, opts ArchiveDirOptions) filepath.WalkFunc {
+	ignores := newIgnoreMatcher(dir.Path, opts.IgnoreFile)
+	return func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		relname, relErr := filepath.Rel(dir.Path, path)
+		if relErr != nil {
+			return archiveError("relativizing file for archival", path, relErr)
+		}
+		name, named := walkedEntryName(dir.Prefix, relname, opts)
+		if err != nil {
+			// A directory that can't be listed is passed again with its
+			// info, after its entry was written, and only its contents
+			// are skipped.
+			if reason := skipReadError(path, err, opts); reason != "" {
+				a.skipped.addReadError(name, info != nil && info.IsDir(), reason, err)
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return err
+		}
+		reason, pattern, err := skipReason(dir.Path, ignores, path, info, opts)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			a.skipped.addMatched(name, info.IsDir(), reason, pattern)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := checkDenied(dir.Path, path, opts.DenyPatterns); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if opts.Flatten || !named {
+				return nil
+			}
+			ok, err := wantDirEntry(dir.Path, path, opts.DirEntries)
+			if err != nil || !ok {
+				return err
+			}
+			return a.writeDir(name, info)
+		}
+		if !named {
+			return fmt.Errorf("stripping %d components from %s leaves no name to archive it under", opts.StripComponents, filepath.ToSlash(relname))
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if opts.ExcludeSymlinkDirs && isDirSymlink(path) {
+				a.skipped.add(name, true, SkippedSymlinkDir)
+				return nil
+			}
+			switch opts.Symlinks {
+			case SymlinkSkip:
+				a.skipped.add(name, false, SkippedSymlink)
+				return nil
+			case SymlinkStore:
+				return a.writeSymlink(path, name, info)
+			}
+			info, err = followSymlink(path)
+			if err != nil {
+				if readErr := unreadableSymlink(path, err, opts); readErr != nil {
+					a.skipped.addReadError(name, false, SkippedUnreadable, readErr)
+					return nil
+				}
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			if err := specialFileError(path, info, opts.SpecialFiles); err != nil {
+				return err
+			}
+			a.skipped.add(name, false, SkippedSpecialFile)
+			return nil
+		}
+		if tooLarge(path, info, opts) {
+			a.skipped.add(name, false, SkippedTooLarge)
+			return nil
+		}
+		fh, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return archiveError("creating file header", path, err)
+		}
+		fh.Name = name
+		fh.ModTime = a.options.entryModTime(fh.ModTime)
+		a.setOwner(fh)
+		a.setFileMode(fh)
+		src, err := os.Open(path)
+		if err != nil {
+			if reason := skipReadError(path, err, opts); reason != "" {
+				a.skipped.addReadError(name, false, reason, err)
+				return nil
+			}
+			return archiveError("reading file for archival", path, err)
+		}
+		defer src.Close()
+		r, size, err := a.options.transformReader(&contextReader{ctx: ctx, r: src}, info.Size(), name)
+		if err != nil {
+			return err
+		}
+		fh.Size = size
+		w, err := a.writeHeader(fh)
+		if err != nil {
+			return archiveError("creating file inside archive", name, err)
+		}
+		_, err = io.Copy(w, r)
+		return err
+	}
+}
+
+// writeDir stores an entry for a directory.
+func (a *TarArchiver) writeDir(name string, info os.FileInfo) error {
+	fh, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return archiveError("creating file header", name, err)
+	}
+	fh.Name = name + "/"
+	fh.Mode = int64(a.options.dirMode())
+	fh.ModTime = a.options.entryModTime(fh.ModTime)
+	a.setOwner(fh)
+	if _, err := a.writeHeader(fh); err != nil {
+		return archiveError("creating directory inside archive", name, err)
+	}
+	return nil
+}
+
+// writeSymlink stores the symlink at path as a symbolic link entry.
+func (a *TarArchiver) writeSymlink(path, name string, info os.FileInfo) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return archiveError("reading symlink for archival", path, err)
+	}
+	fh, err := tar.FileInfoHeader(info, filepath.ToSlash(target))
+	if err != nil {
+		return archiveError("creating file header", path, err)
+	}
+	fh.Name = name
+	fh.ModTime = a.options.entryModTime(fh.ModTime)
+	a.setOwner(fh)
+	if _, err := a.writeHeader(fh); err != nil {
+		return archiveError("creating file inside archive", name, err)
+	}
+	return nil
+}
+
+func (a *TarArchiver) ArchiveMultiple(content map[string][]byte) error {
+	entries, err := sanitizeArchivePaths(content, a.options.Prefix, a.options.Duplicates)
+	if err != nil {
+		return err
+	}
+	return a.writeContentEntries(entries)
+}
+
+// ArchiveMultipleOrdered archives content like ArchiveMultiple, but writes
+// the entries in the order given rather than sorted by name, for formats
+// where the position of an entry matters.
+func (a *TarArchiver) ArchiveMultipleOrdered(content []ContentEntry) error {
+	entries, err := sanitizeContentEntries(content, a.options.Prefix, a.options.Duplicates)
+	if err != nil {
+		return err
+	}
+	return a.writeContentEntries(entries)
+}
+
+// ArchiveExistingZip adds every entry of the zip file at path to the
+// archive, under prefix when it is set, decompressing its files, directories
+// and symlinks into tar entries.
+func (a *TarArchiver) ArchiveExistingZip(path, prefix string) (err error) {
+	prefix, err = joinPrefixes(a.options.Prefix, prefix)
+	if err != nil {
+		return err
+	}
+	r, err := openZip(path)
+	if err != nil {
+		return fmt.Errorf("error opening zip to archive: %w", err)
+	}
+	defer r.Close()
+
+	held, err := a.open(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	for _, zf := range r.File {
+		name, err := prefixedArchivePath(prefix, zf.Name)
+		if err != nil {
+			return err
+		}
+		if err := a.copyZipEntry(zf, name); err != nil {
+			return archiveError("copying zip entry", zf.Name, err)
+		}
+	}
+	return nil
+}
+
+// copyZipEntry writes the entry zf of a zip file to the archive as name.
+func (a *TarArchiver) copyZipEntry(zf *zip.File, name string) error {
+	info := zf.FileInfo()
+	if info.IsDir() {
+		return a.writeDir(strings.TrimSuffix(name, "/"), info)
+	}
+	src, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var target string
+	if info.Mode()&os.ModeSymlink != 0 {
+		// Zip files store the target of a symlink as its content.
+		b, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		target = string(b)
+	}
+	fh, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	fh.Name = name
+	fh.ModTime = a.options.entryModTime(fh.ModTime)
+	a.setOwner(fh)
+	if fh.Typeflag == tar.TypeReg {
+		a.setFileMode(fh)
+	}
+	w, err := a.writeHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// writeContentEntries writes an archive of the sanitized entries, in order.
+func (a *TarArchiver) writeContentEntries(entries []ContentEntry) (err error) {
+	held, err := a.open(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	for _, entry := range entries {
+		if err := a.writeContent(entry.Content, entry.Name, a.contentMode(entry.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentMode returns the mode of a file entry added without one, 0644 unless
+// ArchiveOptions.FileModes or FileMode give another.
+func (a *TarArchiver) contentMode(name string) os.FileMode {
+	if mode, ok := a.options.fileMode(name); ok {
+		return mode
+	}
+	return 0644
+}
+
+// writeContent adds an in-memory regular file entry. Unlike zip, tar
+// headers must declare the entry size and mode up front.
+func (a *TarArchiver) writeContent(content []byte, infilename string, mode os.FileMode) error {
+	return a.writeReader(bytes.NewReader(content), int64(len(content)), infilename, mode)
+}
+
+func (a *TarArchiver) writeReader(r io.Reader, size int64, infilename string, mode os.FileMode) error {
+	r, size, err := a.options.transformReader(r, size, infilename)
+	if err != nil {
+		return err
+	}
+	fh := &tar.Header{
+		Name:     infilename,
+		Mode:     int64(mode.Perm()),
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	}
+	a.setOwner(fh)
+	w, err := a.writeHeader(fh)
+	if err != nil {
+		return archiveError("creating file inside archive", infilename, err)
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// spoolReader returns a reader for the content of r along with its length,
+// copying r to a temporary file first if it doesn't report its length. The
+// returned cleanup function removes any temporary file.
+func spoolReader(r io.Reader) (io.Reader, int64, func(), error) {
+	if l, ok := r.(interface{ Len() int }); ok {
+		return r, int64(l.Len()), func() {}, nil
+	}
+
+	f, err := ioutil.TempFile("", "terraform-provider-archive")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("error buffering content for archival: %w", err)
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	size, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("error buffering content for archival: %w", err)
+	}
+	return f, size, cleanup, nil
+}
+
+// Open starts an archive that entries are added to, by the Add methods or
+// any of the Archive methods, until Close finishes it, rather than each call
+// writing an archive of its own. A call that fails may leave part of its
+// entries in the archive, and Close still has to be called. Options should
+// not change while the archive is open.
+func (a *TarArchiver) Open() error {
+	a.session.mu.Lock()
+	defer a.session.mu.Unlock()
+	if a.session.open {
+		return fmt.Errorf("archive %s is already open", a.filepath)
+	}
+	if err := a.begin(); err != nil {
+		return err
+	}
+	a.session.open = true
+	return nil
+}
+
+// AddContent adds content as the file infilename to the archive started by
+// Open. The Add methods, and the Archive methods while the archive is open,
+// may be called from several goroutines at once.
+func (a *TarArchiver) AddContent(content []byte, infilename string) error {
+	return a.archiveReader(bytes.NewReader(content), infilename, true)
+}
+
+// AddFile adds infilename, stored as archivePath, to the archive started by
+// Open.
+func (a *TarArchiver) AddFile(infilename, archivePath string) error {
+	return a.archiveFileAs(infilename, archivePath, true)
+}
+
+// AddDir adds the contents of indirname to the archive started by Open. A
+// cancelled ctx stops the walk, but leaves the archive open.
+func (a *TarArchiver) AddDir(ctx context.Context, indirname string, opts ArchiveDirOptions) error {
+	return a.archiveDirs(ctx, []ArchiveDirSource{{Path: indirname}}, opts, true)
+}
+
+// Close finishes the archive started by Open. It does nothing if the
+// archive isn't open.
+func (a *TarArchiver) Close() error {
+	a.session.mu.Lock()
+	defer a.session.mu.Unlock()
+	if !a.session.open {
+		return nil
+	}
+	a.session.open = false
+	return a.close(false, nil)
+}
+
+func (a *TarArchiver) SetOptions(opts ArchiveOptions) {
+	a.options = opts
+}
+
+// Entries returns the entries written by the last call that archived
+// anything, or since Open, including those copied from a base archive.
+func (a *TarArchiver) Entries() []ArchiveEntry {
+	return a.manifest.entries()
+}
+
+// Skipped returns the files and directories left out of the directories
+// walked by the last call that archived anything, or since Open.
+func (a *TarArchiver) Skipped() []SkippedFile {
+	return a.skipped
+}
+
+// open starts a call writing to the archive. While the archive is kept open
+// by Open, it locks the session until close, so that calls take turns adding
+// to it, reporting that the call holds the lock, and it errors for the Add
+// methods, with add set, if it isn't open. Otherwise it creates the archive
+// for the call.
+func (a *TarArchiver) open(add bool) (bool, error) {
+	if held, err := a.session.lock(a.filepath, add); held || err != nil {
+		return held, err
+	}
+	return false, a.begin()
+}
+
+// begin creates the archive, erroring if another call is still writing one.
+func (a *TarArchiver) begin() error {
+	if err := a.guard.acquire(a.filepath); err != nil {
+		return err
+	}
+	if err := a.create(); err != nil {
+		return a.close(false, err)
+	}
+	return nil
+}
+
+// create starts writing the archive, which close finishes, whether or not
+// create succeeds.
+func (a *TarArchiver) create() error {
+	if err := assertValidCompressionLevel(a.options.CompressionLevel); err != nil {
+		return err
+	}
+	if err := assertValidDuplicates(a.options.Duplicates); err != nil {
+		return err
+	}
+	if err := assertValidCaseCheck(a.options.CaseInsensitiveCheck); err != nil {
+		return err
+	}
+	if err := assertValidModTime(a.options); err != nil {
+		return err
+	}
+	if err := assertValidTransforms(a.options.Transforms); err != nil {
+		return err
+	}
+	if err := assertValidOwner(a.options.Owner); err != nil {
+		return err
+	}
+	if err := assertValidOutput(a.options.Output, a.options.Duplicates); err != nil {
+		return err
+	}
+
+	var base *os.File
+	if a.options.BaseArchive != "" {
+		var err error
+		base, err = os.Open(a.options.BaseArchive)
+		if err != nil {
+			return fmt.Errorf("error opening base archive: %w", err)
+		}
+		defer base.Close()
+	}
+
+	w := a.options.Output
+	if a.discard {
+		w = ioutil.Discard
+	} else if w == nil {
+		if err := prepareOutputDir(a.filepath, a.options.CreateOutputDir); err != nil {
+			return err
+		}
+		f, err := createArchiveFile(a.filepath)
+		if err != nil {
+			return err
+		}
+		a.filewriter = f
+		w = a.options.teeOutput(f)
+	}
+	if a.format.compress != nil && !a.discard {
+		var err error
+		a.compressor, err = a.format.compress(w, a.options)
+		if err != nil {
+			return err
+		}
+		w = a.compressor
+	}
+	a.writer = tar.NewWriter(w)
+	a.names = newArchiveNames(a.options.Duplicates, a.options.CaseInsensitiveCheck)
+	a.size = sizeLimit{max: a.options.MaxSize}
+	a.files = fileLimit{max: a.options.MaxFiles}
+	a.manifest = nil
+	a.skipped = nil
+	if base != nil {
+		if err := a.copyBase(base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBase writes every entry of the base archive to the new archive.
+func (a *TarArchiver) copyBase(base io.Reader) error {
+	if a.format.decompress != nil {
+		var err error
+		base, err = a.format.decompress(base)
+		if err != nil {
+			return fmt.Errorf("error reading base archive: %w", err)
+		}
+	}
+
+	tr := tar.NewReader(base)
+	for {
+		fh, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading base archive: %w", err)
+		}
+		w, err := a.writeHeader(fh)
+		if err != nil {
+			return fmt.Errorf("error copying base archive: %w", err)
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return fmt.Errorf("error copying base archive: %w", err)
+		}
+	}
+}
+
+// setOwner stores the configured owner in a new entry's header. Headers
+// made by tar.FileInfoHeader otherwise keep the source file's owner, which
+// is only known on Unix systems.
+func (a *TarArchiver) setOwner(fh *tar.Header) {
+	if owner := a.options.Owner; owner != nil {
+		fh.Uid, fh.Gid = owner.UID, owner.GID
+		fh.Uname, fh.Gname = "", ""
+	}
+}
+
+// setFileMode stores the mode given for a new file entry by
+// ArchiveOptions.FileModes or FileMode, if any, in its header instead of the
+// mode of its source.
+func (a *TarArchiver) setFileMode(fh *tar.Header) {
+	if mode, ok := a.options.fileMode(fh.Name); ok {
+		fh.Mode = int64(mode)
+	}
+}
+
+// writeHeader adds an entry to the archive, returning the writer for its
+// content. It errors if an entry with the same name was already written, its
+// name is too long, or the entry would take the archive over its size or file
+// limit. A directory
+// entry that was already written is skipped instead.
+func (a *TarArchiver) writeHeader(fh *tar.Header) (io.Writer, error) {
+	if err := a.options.checkNameLength(fh.Name); err != nil {
+		return nil, err
+	}
+	isDir := fh.Typeflag == tar.TypeDir
+	ok, err := a.names.add(strings.TrimSuffix(fh.Name, "/"), isDir)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return ioutil.Discard, nil
+	}
+	// Tar headers carry the size of the entry, so the limit is checked
+	// before any of its content is written.
+	if err := a.size.add(fh.Name, fh.Size); err != nil {
+		return nil, err
+	}
+	if err := a.files.add(fh.Name, isDir); err != nil {
+		return nil, err
+	}
+	if err := a.writer.WriteHeader(fh); err != nil {
+		return nil, err
+	}
+	entry := a.manifest.add(fh.Name, fh.FileInfo().Mode(), fh.ModTime)
+	if !isDir {
+		a.progress.add(fh.Name)
+	}
+	return io.MultiWriter(a.writer, entry), nil
+}
+
+// close finishes the archive, unless the call holds the lock on the archive
+// kept open by Open, as held reports, which it releases instead.
+func (a *TarArchiver) close(held bool, err error) error {
+	if a.session.unlock(held) {
+		return err
+	}
+	if a.writer != nil {
+		if closeErr := a.writer.Close(); err == nil {
+			err = closeErr
+		}
+		a.writer = nil
+	}
+	if a.compressor != nil {
+		if closeErr := a.compressor.Close(); err == nil {
+			err = closeErr
+		}
+		a.compressor = nil
+	}
+	// The archive is written to a temporary file, which is only moved into
+	// place once it is rewritten and verified.
+	var tmp string
+	if a.filewriter != nil {
+		tmp = a.filewriter.Name()
+		err = closeArchiveFile(a.filewriter, err)
+		a.filewriter = nil
+	}
+	if err == nil {
+		err = a.options.checkOrder(a.manifest)
+	}
+	if err == nil && needsRewrite(a.names, a.manifest, a.options) {
+		switch {
+		case a.discard:
+			a.manifest.removeReplaced(a.names)
+			if a.options.sortsEntries() {
+				a.manifest.sort(a.options.entryLess())
+			}
+		case tmp == "" || tmp == a.filepath:
+			err = fmt.Errorf("entries can only be sorted when the archive is written to a regular file")
+		default:
+			var rewritten string
+			if rewritten, err = a.rewrite(tmp); err == nil {
+				os.Remove(tmp)
+				tmp = rewritten
+			}
+		}
+	}
+	if err == nil && tmp != "" && a.options.Verify {
+		err = a.verify(tmp)
+	}
+	if tmp != "" {
+		err = commitArchiveFile(tmp, a.filepath, err)
+	}
+	a.names = archiveNames{}
+	a.guard.release()
+	return err
+}
+
+// verify reads every entry of the finished archive back from path, before it
+// is moved into place, decompressing it, and compares it with the content
+// written.
+func (a *TarArchiver) verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error verifying archive: %w", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if a.format.decompress != nil {
+		r, err = a.format.decompress(f)
+		if err != nil {
+			return fmt.Errorf("error verifying archive: %w", err)
+		}
+	}
+
+	v := newArchiveVerifier(a.manifest.entries())
+	tr := tar.NewReader(r)
+	for {
+		fh, err := tr.Next()
+		if err == io.EOF {
+			return v.finish()
+		}
+		if err != nil {
+			return fmt.Errorf("error verifying archive: %w", err)
+		}
+		if err := v.check(fh.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// rewrite rewrites the finished archive at path, into another temporary
+// file whose name it returns, without the entries that were replaced by a
+// later entry with the same name, and in the order of their names when
+// SortEntries or Order is set.
+func (a *TarArchiver) rewrite(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading archive to rewrite it: %w", err)
+	}
+	defer src.Close()
+	var r io.Reader = src
+	if a.format.decompress != nil {
+		r, err = a.format.decompress(src)
+		if err != nil {
+			return "", fmt.Errorf("error reading archive to rewrite it: %w", err)
+		}
+	}
+	// Tar archives can only be read in order, so the entries are held in
+	// a temporary file to be written out sorted.
+	var spool *tarSpool
+	if a.options.sortsEntries() {
+		if spool, err = newTarSpool(); err != nil {
+			return "", fmt.Errorf("error rewriting archive: %w", err)
+		}
+		defer spool.Close()
+	}
+
+	f, err := createArchiveFile(a.filepath)
+	if err != nil {
+		return "", err
+	}
+	var w io.Writer = a.options.teeOutput(f)
+	var compressor io.WriteCloser
+	if a.format.compress != nil {
+		compressor, err = a.format.compress(w, a.options)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+		w = compressor
+	}
+	tw := tar.NewWriter(w)
+	keep := a.names.keep()
+	tr := tar.NewReader(r)
+	for {
+		var fh *tar.Header
+		fh, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+		if !keep(fh.Name) {
+			continue
+		}
+		if spool != nil {
+			if err = spool.add(fh, tr); err != nil {
+				break
+			}
+			continue
+		}
+		if err = tw.WriteHeader(fh); err != nil {
+			break
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			break
+		}
+	}
+	if err == nil && spool != nil {
+		err = spool.writeSorted(tw, a.options.entryLess())
+	}
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if compressor != nil {
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err = closeArchiveFile(f, err); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error rewriting archive: %w", err)
+	}
+	a.manifest.removeReplaced(a.names)
+	if a.options.sortsEntries() {
+		a.manifest.sort(a.options.entryLess())
+	}
+	return f.Name(), nil
+}
+
+// tarSpool holds the entries of a tar archive in a temporary file, so that
+// they can be written out again in another order.
+type tarSpool struct {
+	f       *os.File
+	entries []spooledTarEntry
+	size    int64
+}
+
+// spooledTarEntry is an entry of a tarSpool, whose content is stored at
+// offset in the spool's file.
+type spooledTarEntry struct {
+	header *tar.Header
+	offset int64
+	size   int64
+}
+
+func newTarSpool() (*tarSpool, error) {
+	f, err := ioutil.TempFile("", "terraform-provider-archive-spool")
+	if err != nil {
+		return nil, err
+	}
+	return &tarSpool{f: f}, nil
+}
+
+// add stores an entry with the content read from r.
+func (s *tarSpool) add(header *tar.Header, r io.Reader) error {
+	n, err := io.Copy(s.f, r)
+	if err != nil {
+		return err
+	}
+	s.entries = append(s.entries, spooledTarEntry{header: header, offset: s.size, size: n})
+	s.size += n
+	return nil
+}
+
+// writeSorted writes the entries to tw in the order of their names given by
+// less, keeping entries with the same name in the order they were added.
+func (s *tarSpool) writeSorted(tw *tar.Writer, less func(a, b string) bool) error {
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return less(s.entries[i].header.Name, s.entries[j].header.Name)
+	})
+	for _, entry := range s.entries {
+		if err := tw.WriteHeader(entry.header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, io.NewSectionReader(s.f, entry.offset, entry.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close removes the spool's file.
+func (s *tarSpool) Close() error {
+	err := s.f.Close()
+	if removeErr := os.Remove(s.f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
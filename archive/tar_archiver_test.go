@@ -0,0 +1,502 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/ulikunitz/xz"
+)
+
+func TestTarArchiver_Content(t *testing.T) {
+	tarfilepath := "archive-content.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "bootstrap", 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+	hdr, err := tar.NewReader(f).Next()
+	if err != nil {
+		t.Fatalf("could not read tar entry: %s", err)
+	}
+	if hdr.Name != "bootstrap" {
+		t.Errorf("mismatched name, got %s, want %s", hdr.Name, "bootstrap")
+	}
+	if got := hdr.FileInfo().Mode(); got != 0755 {
+		t.Errorf("mismatched mode, got %s, want %s", got, os.FileMode(0755))
+	}
+
+	// The mode given wins over the modes set for every file.
+	os.Remove(tarfilepath)
+	archiver = NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{FileMode: 0644, FileModes: map[string]os.FileMode{"bootstrap": 0600}})
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "bootstrap", 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hdrs := readTarHeaders(t, tarfilepath)
+	if len(hdrs) != 1 || hdrs[0].FileInfo().Mode() != 0755 {
+		t.Errorf("expected bootstrap to be stored with mode %s, got %v", os.FileMode(0755), hdrs)
+	}
+}
+
+func TestTarArchiver_Dir(t *testing.T) {
+	tarfilepath := "archive-dir.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+		"file3.txt": []byte("This is file 3"),
+	})
+}
+
+func TestTarArchiver_Entries(t *testing.T) {
+	archiver := NewTarArchiver("archive-entries.tar")
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := wantDirEntries(t, "./test-fixtures/test-dir")
+	if got := archiver.Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %v, want %v", got, want)
+	}
+}
+
+func TestTarArchiver_OpenClose(t *testing.T) {
+	tarfilepath := "archive-open-close.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	if err := archiver.Open(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Calls to the Archive methods while the archive is open take turns
+	// with the Add methods.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, add := range []func() error{
+		func() error { return archiver.AddContent([]byte("This is content"), "content.txt") },
+		func() error { return archiver.ArchiveContent([]byte("This is more content"), "more.txt") },
+		func() error { return archiver.AddFile("./test-fixtures/test-file.txt", "test-file.txt") },
+		func() error {
+			return archiver.AddDir(context.Background(), "./test-fixtures/test-dir", ArchiveDirOptions{})
+		},
+	} {
+		wg.Add(1)
+		go func(add func() error) {
+			defer wg.Done()
+			errs <- add()
+		}(add)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"content.txt":   []byte("This is content"),
+		"more.txt":      []byte("This is more content"),
+		"test-file.txt": []byte("This is test content"),
+		"file1.txt":     []byte("This is file 1"),
+		"file2.txt":     []byte("This is file 2"),
+		"file3.txt":     []byte("This is file 3"),
+	})
+}
+
+func TestTarArchiver_Files(t *testing.T) {
+	tarfilepath := "archive-files.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	if err := archiver.ArchiveFiles([]string{
+		"./test-fixtures/test-file.txt",
+		"./test-fixtures/test-dir/file1.txt",
+	}, "./test-fixtures"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	headers := readTarHeaders(t, tarfilepath)
+	if len(headers) != 2 || headers[0].Name != "test-dir/file1.txt" || headers[1].Name != "test-file.txt" {
+		t.Errorf("expected test-dir/file1.txt then test-file.txt, got %v", headers)
+	}
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"test-dir/file1.txt": []byte("This is file 1"),
+		"test-file.txt":      []byte("This is test content"),
+	})
+}
+
+func TestTarArchiver_Owner(t *testing.T) {
+	tarfilepath := "archive-owner.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{Owner: &FileOwner{UID: 1000, GID: 1001}})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, hdr := range readTarHeaders(t, tarfilepath) {
+		if hdr.Uid != 1000 || hdr.Gid != 1001 || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: got owner %d:%d (%q:%q), want 1000:1001", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+		}
+	}
+
+	archiver.SetOptions(ArchiveOptions{Owner: &FileOwner{UID: -1, GID: 0}})
+	if err := archiver.ArchiveContent([]byte("content"), "content.txt"); err == nil {
+		t.Fatalf("expected error for a negative owner")
+	}
+}
+
+// readTarHeaders returns the headers of every entry in the tar file.
+func readTarHeaders(t *testing.T, tarfilepath string) []*tar.Header {
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+	var hdrs []*tar.Header
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs
+		}
+		if err != nil {
+			t.Fatalf("could not read tar entry: %s", err)
+		}
+		hdrs = append(hdrs, hdr)
+	}
+}
+
+func TestTarArchiver_Reproducible(t *testing.T) {
+	var outputs [][]byte
+	for _, tarfilepath := range []string{"archive-reproducible-1.tar", "archive-reproducible-2.tar"} {
+		archiver := NewTarArchiver(tarfilepath)
+		archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true})
+		if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		b, err := ioutil.ReadFile(tarfilepath)
+		if err != nil {
+			t.Fatalf("could not read tar file: %s", err)
+		}
+		outputs = append(outputs, b)
+	}
+
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("expected identical output for identical input")
+	}
+}
+
+func TestTarArchiver_DirMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-max-file-size")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "small.txt"), "small")
+	writeTestFile(t, filepath.Join(dir, "large.bin"), strings.Repeat("x", 100))
+	// Followed symlinks are measured by the file they point to.
+	if err := os.Symlink("large.bin", filepath.Join(dir, "link.bin")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	tarfilepath := "archive-dir-max-file-size.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{MaxFileSize: 10}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"small.txt": []byte("small"),
+	})
+	if got, want := archiver.Skipped(), []SkippedFile{{Name: "large.bin", Reason: SkippedTooLarge}, {Name: "link.bin", Reason: SkippedTooLarge}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got skipped files %v, want %v", got, want)
+	}
+}
+
+func TestTarArchiver_DirFlatten(t *testing.T) {
+	dir := tempDir(t, "archive-dir-flatten")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "a", "x.txt"), "x")
+	writeTestFile(t, filepath.Join(dir, "b", "c", "y.txt"), "y")
+
+	tarfilepath := "archive-dir-flatten.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	sources := []ArchiveDirSource{{Path: dir, Prefix: "lib"}}
+	if err := archiver.ArchiveDirsContext(context.Background(), sources, ArchiveDirOptions{Flatten: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"lib/x.txt": []byte("x"),
+		"lib/y.txt": []byte("y"),
+	})
+}
+
+func TestTarArchiver_FileMode(t *testing.T) {
+	dir := tempDir(t, "archive-file-mode")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "run.sh"), "#!/bin/sh")
+	if err := os.Chmod(filepath.Join(dir, "run.sh"), 0775); err != nil {
+		t.Fatalf("could not chmod file: %s", err)
+	}
+
+	tarfilepath := "archive-file-mode.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{FileMode: 0755})
+	if err := archiver.ArchiveDir(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hdrs := readTarHeaders(t, tarfilepath)
+	if len(hdrs) != 1 || hdrs[0].FileInfo().Mode() != 0755 {
+		t.Errorf("expected run.sh to be stored with mode %s, got %v", os.FileMode(0755), hdrs)
+	}
+
+	// Content is stored with FileMode, unless given a mode of its own.
+	os.Remove(tarfilepath)
+	archiver = NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{FileMode: 0755})
+	if err := archiver.ArchiveMultipleOrdered([]ContentEntry{{Name: "run.sh", Content: []byte("#!/bin/sh")}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hdrs = readTarHeaders(t, tarfilepath)
+	if len(hdrs) != 1 || hdrs[0].FileInfo().Mode() != 0755 {
+		t.Errorf("expected run.sh to be stored with mode %s, got %v", os.FileMode(0755), hdrs)
+	}
+
+	os.Remove(tarfilepath)
+	archiver = NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{FileMode: 0755})
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "run.sh", 0700); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hdrs = readTarHeaders(t, tarfilepath)
+	if len(hdrs) != 1 || hdrs[0].FileInfo().Mode() != 0700 {
+		t.Errorf("expected run.sh to be stored with mode %s, got %v", os.FileMode(0700), hdrs)
+	}
+}
+
+func TestTarArchiver_DirEntryMode(t *testing.T) {
+	dir := tempDir(t, "archive-dir-entry-mode")
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "cache"), 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+
+	tarfilepath := "archive-dir-entry-mode.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{DirMode: 0775})
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DirEntries: DirEntriesAll}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hdrs := readTarHeaders(t, tarfilepath)
+	if len(hdrs) != 1 || hdrs[0].Name != "cache/" || hdrs[0].FileInfo().Mode() != os.ModeDir|0775 {
+		t.Errorf("expected cache/ to be stored with mode %s, got %v", os.ModeDir|0775, hdrs)
+	}
+}
+
+func TestTarArchiver_Verify(t *testing.T) {
+	tarfilepath := "archive-dir-verify.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{Verify: true})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+		"file3.txt": []byte("This is file 3"),
+	})
+}
+
+func TestTarArchiver_Output(t *testing.T) {
+	var output bytes.Buffer
+	archiver := NewTarGzArchiver("archive-output.tar.gz")
+	archiver.SetOptions(ArchiveOptions{Output: &output})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Stat("archive-output.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("expected no archive file to be written")
+	}
+	gz, err := gzip.NewReader(&output)
+	if err != nil {
+		t.Fatalf("could not read gzip output: %s", err)
+	}
+	hdr, err := tar.NewReader(gz).Next()
+	if err != nil || hdr.Name != "content.txt" {
+		t.Errorf("expected content.txt in the output, got %v: %v", hdr, err)
+	}
+}
+
+func TestTarArchiver_CompressedFormats(t *testing.T) {
+	decompressors := map[string]func(io.Reader) (io.Reader, error){
+		"tar.bz2": func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r, nil) },
+		"tar.xz":  func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+	}
+	for archiveType, decompress := range decompressors {
+		var outputs [][]byte
+		for i, level := range []int{DefaultCompression, DefaultCompression, NoCompression, 9} {
+			tarfilepath := fmt.Sprintf("archive-formats-%d.%s", i, archiveType)
+			archiver := getArchiver(archiveType, tarfilepath)
+			archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true, CompressionLevel: level})
+			if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+				t.Fatalf("%s: unexpected error: %s", archiveType, err)
+			}
+
+			b, err := ioutil.ReadFile(tarfilepath)
+			if err != nil {
+				t.Fatalf("could not read tar file: %s", err)
+			}
+			r, err := decompress(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("%s: could not decompress: %s", archiveType, err)
+			}
+			ensureTarEntries(t, r, map[string][]byte{
+				"file1.txt": []byte("This is file 1"),
+				"file2.txt": []byte("This is file 2"),
+				"file3.txt": []byte("This is file 3"),
+			})
+			outputs = append(outputs, b)
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("%s: expected identical output for identical input", archiveType)
+		}
+
+		// Base archives are decompressed before their entries are copied.
+		tarfilepath := "archive-formats-base." + archiveType
+		archiver := getArchiver(archiveType, tarfilepath)
+		archiver.SetOptions(ArchiveOptions{BaseArchive: "archive-formats-0." + archiveType})
+		if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+			t.Fatalf("%s: unexpected error: %s", archiveType, err)
+		}
+		f, err := os.Open(tarfilepath)
+		if err != nil {
+			t.Fatalf("could not open tar file: %s", err)
+		}
+		r, err := decompress(f)
+		if err != nil {
+			t.Fatalf("%s: could not decompress: %s", archiveType, err)
+		}
+		ensureTarEntries(t, r, map[string][]byte{
+			"file1.txt":   []byte("This is file 1"),
+			"file2.txt":   []byte("This is file 2"),
+			"file3.txt":   []byte("This is file 3"),
+			"content.txt": []byte("This is some content"),
+		})
+		f.Close()
+	}
+}
+
+func TestTarArchiver_ExistingZip(t *testing.T) {
+	dir := tempDir(t, "archive-existing-zip")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeTestFile(t, filepath.Join(src, "lib", "file.txt"), "file")
+	if err := os.Symlink("file.txt", filepath.Join(src, "lib", "link.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+	deps := filepath.Join(dir, "deps.zip")
+	if err := NewZipArchiver(deps).ArchiveDirWithOptions(src, ArchiveDirOptions{Symlinks: SymlinkStore}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tarfilepath := filepath.Join(dir, "app.tar")
+	archiver := NewTarArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{Prefix: "opt"})
+	if err := archiver.ArchiveExistingZip(deps, "deps"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"opt/deps/lib/file.txt": []byte("file"),
+		"opt/deps/lib/link.txt": {},
+	})
+	for _, fh := range readTarHeaders(t, tarfilepath) {
+		if fh.Name == "opt/deps/lib/link.txt" && (fh.Typeflag != tar.TypeSymlink || fh.Linkname != "file.txt") {
+			t.Errorf("expected a symlink to file.txt, got type %c to %q", fh.Typeflag, fh.Linkname)
+		}
+	}
+}
+
+func TestTarArchiver_ExistingZipZstd(t *testing.T) {
+	dir := tempDir(t, "archive-existing-zip-zstd")
+	defer os.RemoveAll(dir)
+	deps := filepath.Join(dir, "deps.zip")
+	depsArchiver := NewZipArchiver(deps)
+	depsArchiver.SetOptions(ArchiveOptions{Compression: CompressionZstd})
+	if err := depsArchiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tarfilepath := filepath.Join(dir, "app.tar")
+	if err := NewTarArchiver(tarfilepath).ArchiveExistingZip(deps, "deps"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarContents(t, tarfilepath, map[string][]byte{
+		"deps/file1.txt": []byte("This is file 1"),
+		"deps/file2.txt": []byte("This is file 2"),
+		"deps/file3.txt": []byte("This is file 3"),
+	})
+}
+
+func ensureTarContents(t *testing.T, tarfilepath string, wants map[string][]byte) {
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+
+	ensureTarEntries(t, f, wants)
+}
+
+func ensureTarEntries(t *testing.T, r io.Reader, wants map[string][]byte) {
+	got := map[string][]byte{}
+	count := 0
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("could not read tar entry: %s", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("could not read file: %s", err)
+		}
+		got[hdr.Name] = content
+		count++
+	}
+
+	if count != len(wants) {
+		t.Errorf("mismatched file count, got %d, want %d", count, len(wants))
+	}
+	for name, gotContentBytes := range got {
+		want, ok := wants[name]
+		if !ok {
+			t.Errorf("additional file in tar: %s", name)
+			continue
+		}
+		wantContent := string(want)
+		gotContent := string(gotContentBytes)
+		if gotContent != wantContent {
+			t.Errorf("mismatched content\ngot\n%s\nwant\n%s", gotContent, wantContent)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarArchiver_SourceOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-source-owner")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// A new file is owned by the user running the test.
+	infilename := filepath.Join(dir, "owned.txt")
+	writeTestFile(t, infilename, "owned")
+
+	tarfilepath := "archive-source-owner.tar"
+	archiver := NewTarArchiver(tarfilepath)
+	if err := archiver.ArchiveFile(infilename); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, hdr := range readTarHeaders(t, tarfilepath) {
+		if hdr.Uid != os.Getuid() || hdr.Gid != os.Getgid() {
+			t.Errorf("%s: got owner %d:%d, want %d:%d", hdr.Name, hdr.Uid, hdr.Gid, os.Getuid(), os.Getgid())
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarGzArchiver_Content(t *testing.T) {
+	tarfilepath := "archive-content.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"content.txt": []byte("This is some content"),
+	})
+}
+
+func TestTarGzArchiver_Reader(t *testing.T) {
+	tarfilepath := "archive-reader.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	r := io.MultiReader(strings.NewReader("This is "), strings.NewReader("streamed content"))
+	if err := archiver.ArchiveReader(r, "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"content.txt": []byte("This is streamed content"),
+	})
+}
+
+func TestTarGzArchiver_ContentMode(t *testing.T) {
+	tarfilepath := "archive-content-mode.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "bootstrap", 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("could not open gzip stream: %s", err)
+	}
+	hdr, err := tar.NewReader(gr).Next()
+	if err != nil {
+		t.Fatalf("could not read tar entry: %s", err)
+	}
+	if got := hdr.FileInfo().Mode(); got != 0755 {
+		t.Errorf("mismatched mode, got %s, want %s", got, os.FileMode(0755))
+	}
+}
+
+func TestTarGzArchiver_CloseError(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("/dev/full is not available")
+	}
+
+	archiver := NewTarGzArchiver("/dev/full")
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err == nil {
+		t.Fatalf("expected error flushing archive to a full device")
+	}
+}
+
+func TestTarGzArchiver_File(t *testing.T) {
+	tarfilepath := "archive-file.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"test-file.txt": []byte("This is test content"),
+	})
+}
+
+func TestTarGzArchiver_FileStreamed(t *testing.T) {
+	dir := tempDir(t, "archive-file-streamed")
+	defer os.RemoveAll(dir)
+	// The random content is bigger than the buffers it is copied through,
+	// and doesn't compress.
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	writeTestFile(t, filepath.Join(dir, "src", "big.bin"), string(content))
+
+	tarfilepath := filepath.Join(dir, "file.tar.gz")
+	if err := NewTarGzArchiver(tarfilepath).ArchiveFile(filepath.Join(dir, "src", "big.bin")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"big.bin": content,
+	})
+
+	tarfilepath = filepath.Join(dir, "dir.tar.gz")
+	if err := NewTarGzArchiver(tarfilepath).ArchiveDir(filepath.Join(dir, "src")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"big.bin": content,
+	})
+
+	// A reader that doesn't report its length is spooled to find the size
+	// the header records.
+	tarfilepath = filepath.Join(dir, "reader.tar.gz")
+	r := io.MultiReader(bytes.NewReader(content[:1000]), bytes.NewReader(content[1000:]))
+	if err := NewTarGzArchiver(tarfilepath).ArchiveReader(r, "big.bin"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"big.bin": content,
+	})
+}
+
+func TestTarGzArchiver_FileAs(t *testing.T) {
+	tarfilepath := "archive-file-as.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveFileAs("./test-fixtures/test-dir/file1.txt", "test-dir/file1.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"test-dir/file1.txt": []byte("This is file 1"),
+	})
+}
+
+func TestTarGzArchiver_Dir(t *testing.T) {
+	tarfilepath := "archive-dir.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+		"file3.txt": []byte("This is file 3"),
+	})
+}
+
+func TestTarGzArchiver_DirExcludes(t *testing.T) {
+	tarfilepath := "archive-dir-excludes.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveDirWithOptions("./test-fixtures/test-dir", ArchiveDirOptions{
+		Excludes: []string{"file2.txt"},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file3.txt": []byte("This is file 3"),
+	})
+}
+
+func TestTarGzArchiver_DirSymlinkStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "archive-dir-symlinks")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "file.txt"), "This is a file")
+	if err := os.Symlink("file.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	tarfilepath := "archive-dir-symlinks.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Symlinks: SymlinkStore}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("could not open gzip stream: %s", err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatalf("missing symlink in tar")
+		}
+		if err != nil {
+			t.Fatalf("could not read tar entry: %s", err)
+		}
+		if hdr.Name != "link.txt" {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "file.txt" {
+			t.Errorf("expected symlink to file.txt, got type %c to %q", hdr.Typeflag, hdr.Linkname)
+		}
+		break
+	}
+}
+
+func TestTarGzArchiver_DirEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-entries")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "lib", "lib.txt"), "lib")
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0755); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+
+	tarfilepath := "archive-dir-entries.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DirEntries: DirEntriesEmpty}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"lib/lib.txt": []byte("lib"),
+		"tmp/":        []byte(""),
+	})
+}
+
+func TestTarGzArchiver_DirWalkError(t *testing.T) {
+	fi, err := os.Stat("./test-fixtures/test-dir")
+	if err != nil {
+		t.Fatalf("could not stat directory: %s", err)
+	}
+
+	archiver := NewTarGzArchiver("archive-dir-walk-error.tar.gz").(*TarArchiver)
+	walkFn := archiver.walkFunc(context.Background(), ArchiveDirSource{Path: "./test-fixtures"}, ArchiveDirOptions{})
+	walkErr := errors.New("permission denied")
+	for _, info := range []os.FileInfo{nil, fi} {
+		if err := walkFn("./test-fixtures/test-dir", info, walkErr); err != walkErr {
+			t.Errorf("expected walk error to be returned, got %v", err)
+		}
+	}
+}
+
+func TestTarGzArchiver_DirContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tarfilepath := "archive-dir-cancelled.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveDirContext(ctx, "./test-fixtures/test-dir", ArchiveDirOptions{}); err != context.Canceled {
+		t.Fatalf("expected %s, got %v", context.Canceled, err)
+	}
+	if _, err := os.Stat(tarfilepath); !os.IsNotExist(err) {
+		t.Errorf("expected partial archive to be removed, got %v", err)
+	}
+}
+
+func TestTarGzArchiver_Multiple(t *testing.T) {
+	tarfilepath := "archive-content.tar.gz"
+	content := map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+		"file3.txt": []byte("This is file 3"),
+	}
+
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveMultiple(content); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, content)
+}
+
+func TestTarGzArchiver_CompressionLevel(t *testing.T) {
+	content := map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+	}
+
+	for _, level := range []int{NoCompression, 1, 9} {
+		tarfilepath := fmt.Sprintf("archive-compression-level-%d.tar.gz", level)
+		archiver := NewTarGzArchiver(tarfilepath)
+		archiver.SetOptions(ArchiveOptions{CompressionLevel: level})
+		if err := archiver.ArchiveMultiple(content); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		ensureTarGzContents(t, tarfilepath, content)
+	}
+}
+
+func TestTarGzArchiver_Comment(t *testing.T) {
+	tarfilepath := "archive-comment.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{Comment: "build 1234"})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("could not open gzip stream: %s", err)
+	}
+	if gr.Comment != "build 1234" {
+		t.Errorf("mismatched comment, got %q, want %q", gr.Comment, "build 1234")
+	}
+}
+
+func TestTarGzArchiver_BaseArchive(t *testing.T) {
+	basefilepath := "archive-base-1.tar.gz"
+	archiver := NewTarGzArchiver(basefilepath)
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tarfilepath := "archive-base-2.tar.gz"
+	archiver = NewTarGzArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{BaseArchive: basefilepath})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"file1.txt":   []byte("This is file 1"),
+		"file2.txt":   []byte("This is file 2"),
+		"file3.txt":   []byte("This is file 3"),
+		"content.txt": []byte("This is some content"),
+	})
+}
+
+func TestTarGzArchiver_DuplicatesOverwrite(t *testing.T) {
+	tarfilepath := "archive-duplicates-overwrite.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{Duplicates: DuplicatesOverwrite})
+	err := archiver.ArchiveDirsContext(context.Background(), []ArchiveDirSource{
+		{Path: "./test-fixtures/test-dir"},
+		{Path: "./test-fixtures/test-dir"},
+	}, ArchiveDirOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+		"file3.txt": []byte("This is file 3"),
+	})
+	if got := len(archiver.Entries()); got != 3 {
+		t.Errorf("got %d entries, want 3", got)
+	}
+}
+
+func TestTarGzArchiver_MultipleNames(t *testing.T) {
+	tarfilepath := "archive-multiple-names.tar.gz"
+	for _, name := range []string{"", "sub/", `\content.txt`, `sub\..\content.txt`} {
+		archiver := NewTarGzArchiver(tarfilepath)
+		if err := archiver.ArchiveMultiple(map[string][]byte{
+			name: []byte("This is some content"),
+		}); err == nil {
+			t.Errorf("expected error archiving multiple content with %q", name)
+		}
+	}
+
+	archiver := NewTarGzArchiver(tarfilepath)
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		`sub\file1.txt`: []byte("This is file 1"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureTarGzContents(t, tarfilepath, map[string][]byte{
+		"sub/file1.txt": []byte("This is file 1"),
+	})
+}
+
+func TestTarGzArchiver_MaxSize(t *testing.T) {
+	archiver := NewTarGzArchiver("archive-max-size.tar.gz")
+	archiver.SetOptions(ArchiveOptions{MaxSize: 20})
+	err := archiver.ArchiveMultiple(map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "maximum size of 20 bytes") || !strings.Contains(err.Error(), "file2.txt") {
+		t.Fatalf("expected size limit error for file2.txt, got %v", err)
+	}
+}
+
+func TestTarGzArchiver_ModTime(t *testing.T) {
+	modTime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	tarfilepath := "archive-mod-time.tar.gz"
+	archiver := NewTarGzArchiver(tarfilepath)
+	archiver.SetOptions(ArchiveOptions{ModTime: modTime})
+	if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("could not open gzip reader: %s", err)
+	}
+	hdr, err := tar.NewReader(gr).Next()
+	if err != nil {
+		t.Fatalf("could not read tar entry: %s", err)
+	}
+	if !hdr.ModTime.Equal(modTime) {
+		t.Errorf("mismatched modification time, got %s, want %s", hdr.ModTime, modTime)
+	}
+}
+
+func TestTarGzArchiver_Reproducible(t *testing.T) {
+	content := map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+		"file3.txt": []byte("This is file 3"),
+	}
+
+	var outputs [][]byte
+	for _, tarfilepath := range []string{"archive-reproducible-1.tar.gz", "archive-reproducible-2.tar.gz"} {
+		archiver := NewTarGzArchiver(tarfilepath)
+		if err := archiver.ArchiveMultiple(content); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		b, err := ioutil.ReadFile(tarfilepath)
+		if err != nil {
+			t.Fatalf("could not read tar file: %s", err)
+		}
+		outputs = append(outputs, b)
+	}
+
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("expected identical output for identical input")
+	}
+}
+
+func ensureTarGzContents(t *testing.T, tarfilepath string, wants map[string][]byte) {
+	f, err := os.Open(tarfilepath)
+	if err != nil {
+		t.Fatalf("could not open tar file: %s", err)
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("could not open gzip stream: %s", err)
+	}
+	defer gr.Close()
+
+	ensureTarEntries(t, gr, wants)
+}
@@ -0,0 +1,135 @@
+package archive
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// zip64 tests write several gigabytes to disk, so they only run when
+// TF_ARCHIVE_TEST_LARGE is set.
+const testLargeEnvVar = "TF_ARCHIVE_TEST_LARGE"
+
+// zip64Size is just over the largest size representable without zip64.
+const zip64Size = 1<<32 + 1<<20
+
+func TestZipArchiver_Zip64Member(t *testing.T) {
+	skipUnlessLarge(t)
+
+	dir := tempDir(t, "archive-zip64-member")
+	defer os.RemoveAll(dir)
+
+	infilename := filepath.Join(dir, "large.bin")
+	writeSparseFile(t, infilename, zip64Size)
+
+	zipfilepath := filepath.Join(dir, "archive-zip64-member.zip")
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveFile(infilename); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureLargeContents(t, zipfilepath, map[string]uint64{
+		"large.bin": zip64Size,
+	})
+}
+
+func TestZipArchiver_Zip64Archive(t *testing.T) {
+	skipUnlessLarge(t)
+
+	dir := tempDir(t, "archive-zip64-archive")
+	defer os.RemoveAll(dir)
+
+	srcdir := filepath.Join(dir, "src")
+	if err := os.Mkdir(srcdir, 0755); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+	wants := map[string]uint64{}
+	for _, name := range []string{"part1.bin", "part2.bin", "part3.bin"} {
+		writeSparseFile(t, filepath.Join(srcdir, name), zip64Size/3)
+		wants[name] = zip64Size / 3
+	}
+
+	// Store the entries so the archive itself, not just the sum of its
+	// members, is larger than 4 GB.
+	zipfilepath := filepath.Join(dir, "archive-zip64-archive.zip")
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{CompressionLevel: NoCompression})
+	if err := archiver.ArchiveDir(srcdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fi, err := os.Stat(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not stat zip file: %s", err)
+	}
+	if fi.Size() < zip64Size {
+		t.Fatalf("expected archive larger than %d bytes, got %d", zip64Size, fi.Size())
+	}
+
+	ensureLargeContents(t, zipfilepath, wants)
+}
+
+func skipUnlessLarge(t *testing.T) {
+	if os.Getenv(testLargeEnvVar) == "" {
+		t.Skipf("set %s to run tests that write archives larger than 4 GB", testLargeEnvVar)
+	}
+}
+
+func tempDir(t *testing.T, prefix string) string {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	return dir
+}
+
+func writeSparseFile(t *testing.T, name string, size int64) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("could not create file: %s", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("could not size file: %s", err)
+	}
+}
+
+// ensureLargeContents reads every entry back in full, which also verifies
+// each entry's CRC, and checks its uncompressed size.
+func ensureLargeContents(t *testing.T, zipfilepath string, wants map[string]uint64) {
+	r, err := zip.OpenReader(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+
+	if len(r.File) != len(wants) {
+		t.Errorf("mismatched file count, got %d, want %d", len(r.File), len(wants))
+	}
+	for _, cf := range r.File {
+		want, ok := wants[cf.Name]
+		if !ok {
+			t.Errorf("additional file in zip: %s", cf.Name)
+			continue
+		}
+		if cf.UncompressedSize64 != want {
+			t.Errorf("mismatched size for %s, got %d, want %d", cf.Name, cf.UncompressedSize64, want)
+		}
+
+		rc, err := cf.Open()
+		if err != nil {
+			t.Fatalf("could not open file: %s", err)
+		}
+		n, err := io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("could not read file %s: %s", cf.Name, err)
+		}
+		if uint64(n) != want {
+			t.Errorf("mismatched bytes read for %s, got %d, want %d", cf.Name, n, want)
+		}
+	}
+}
@@ -2,159 +2,1234 @@ package archive
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
 )
 
+// zipZstd is the zip compression method registered for Zstandard.
+const zipZstd uint16 = 93
+
+// zipUTF8Flag is the general purpose flag bit marking an entry's name and
+// comment as UTF-8.
+const zipUTF8Flag = 0x800
+
+// zipBufferSize is the size of the buffer between the zip writer and the
+// archive file, which would otherwise get a write for every header and
+// every small entry.
+const zipBufferSize = 64 * 1024
+
+// ZipArchiver writes zip files. Entries are streamed with data descriptors,
+// so archives and individual entries larger than 4 GB are written in the
+// zip64 format, with the zip64 end of central directory records emitted when
+// the archive is closed.
 type ZipArchiver struct {
 	filepath   string
 	filewriter *os.File
+	buffer     *bufio.Writer
 	writer     *zip.Writer
+	names      archiveNames
+	size       sizeLimit
+	files      fileLimit
+	manifest   archiveManifest
+	skipped    skippedFiles
+	progress   archiveProgress
+	session    archiveSession
+	guard      archiveGuard
+	pending    []*zipJob
+	out        io.Writer
+	options    ArchiveOptions
+	// level is the compression level of the entry being created, for the
+	// compressors registered with writer.
+	level int
+	// discard writes nothing, only recording the entries, as set by
+	// getDiscardArchiver.
+	discard bool
 }
 
 func NewZipArchiver(filepath string) Archiver {
 	return &ZipArchiver{
-		filepath: filepath,
+		filepath: absOutputPath(filepath),
+	}
+}
+
+// NewZipArchiverWriter returns an archiver that writes to w instead of a
+// file, such as to stream the archive or keep it in memory. Every call that
+// archives anything writes a whole archive to w, so an archive built from
+// several calls needs them to be made between Open and Close.
+func NewZipArchiverWriter(w io.Writer) Archiver {
+	return &ZipArchiver{
+		out: w,
 	}
 }
 
 func (a *ZipArchiver) ArchiveContent(content []byte, infilename string) error {
-	if err := a.open(); err != nil {
+	return a.archiveReader(bytes.NewReader(content), infilename, int64(len(content)), false)
+}
+
+// ArchiveReader stores everything read from r as the file infilename,
+// streaming it into the archive rather than holding it in memory. Its size
+// isn't known up front, so MinCompressSize doesn't apply to it.
+func (a *ZipArchiver) ArchiveReader(r io.Reader, infilename string) error {
+	return a.archiveReader(r, infilename, -1, false)
+}
+
+// archiveReader stores everything read from r, size bytes or -1 if unknown,
+// as the file infilename, adding to the archive kept open by Open when add is
+// set.
+func (a *ZipArchiver) archiveReader(r io.Reader, infilename string, size int64, add bool) (err error) {
+	infilename, err = prefixedArchivePath(a.options.Prefix, infilename)
+	if err != nil {
+		return err
+	}
+	r, size, err = a.options.transformReader(r, size, infilename)
+	if err != nil {
+		return err
+	}
+
+	held, err := a.open(add)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	fh := &zip.FileHeader{
+		Name:   infilename,
+		Method: a.entryMethod(infilename, size),
+	}
+	a.setFileMode(fh)
+	f, err := a.createHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (a *ZipArchiver) ArchiveContentMode(content []byte, infilename string, mode os.FileMode) (err error) {
+	infilename, err = prefixedArchivePath(a.options.Prefix, infilename)
+	if err != nil {
+		return err
+	}
+	r, size, err := a.options.transformReader(bytes.NewReader(content), int64(len(content)), infilename)
+	if err != nil {
 		return err
 	}
-	defer a.close()
 
-	f, err := a.writer.Create(infilename)
+	held, err := a.open(false)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		err = a.close(held, err)
+	}()
 
-	_, err = f.Write(content)
+	fh := &zip.FileHeader{
+		Name:   infilename,
+		Method: a.entryMethod(infilename, size),
+	}
+	fh.SetMode(mode)
+
+	f, err := a.createHeader(fh)
+	if err != nil {
+		return archiveError("creating file inside archive", infilename, err)
+	}
+
+	_, err = io.Copy(f, r)
 	return err
 }
 
 func (a *ZipArchiver) ArchiveFile(infilename string) error {
+	return a.ArchiveFileFrom(infilename, "")
+}
+
+// ArchiveFileFrom stores infilename at its path relative to root, keeping the
+// directories between them, or at the archive root when root is empty.
+func (a *ZipArchiver) ArchiveFileFrom(infilename, root string) error {
+	archivePath, err := archivePathFrom(root, infilename)
+	if err != nil {
+		return err
+	}
+	return a.ArchiveFileAs(infilename, archivePath)
+}
+
+func (a *ZipArchiver) ArchiveFileAs(infilename, archivePath string) error {
+	return a.archiveFileAs(infilename, archivePath, false)
+}
+
+// archiveFileAs stores infilename as archivePath, adding to the archive kept
+// open by Open when add is set.
+func (a *ZipArchiver) archiveFileAs(infilename, archivePath string, add bool) (err error) {
 	fi, err := assertValidFile(infilename)
 	if err != nil {
 		return err
 	}
+	archivePath, err = prefixedArchivePath(a.options.Prefix, filepath.ToSlash(archivePath))
+	if err != nil {
+		return err
+	}
 
-	content, err := ioutil.ReadFile(infilename)
+	held, err := a.open(add)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+	return a.writeFile(listedFile{path: infilename, name: archivePath, info: fi})
+}
+
+// ArchiveFiles stores each of files at its path relative to base, in the
+// byte order of those paths. A file outside of base is an error.
+func (a *ZipArchiver) ArchiveFiles(files []string, base string) (err error) {
+	listed, err := listFiles(files, base, a.options.Prefix)
 	if err != nil {
 		return err
 	}
 
-	if err := a.open(); err != nil {
+	held, err := a.open(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+	for _, file := range listed {
+		if err := a.writeFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile stores the content of a file read from disk.
+func (a *ZipArchiver) writeFile(file listedFile) error {
+	src, err := os.Open(file.path)
+	if err != nil {
+		return archiveError("reading file for archival", file.path, err)
+	}
+	defer src.Close()
+	r, size, err := a.options.transformReader(src, file.info.Size(), file.name)
+	if err != nil {
 		return err
 	}
-	defer a.close()
 
-	fh, err := zip.FileInfoHeader(fi)
+	fh, err := zip.FileInfoHeader(file.info)
 	if err != nil {
-		return fmt.Errorf("error creating file header: %s", err)
+		return archiveError("creating file header", file.path, err)
 	}
-	fh.Name = fi.Name()
-	fh.Method = zip.Deflate
+	fh.Name = file.name
+	fh.Modified = a.options.entryModTime(fh.Modified)
+	fh.Method = a.entryMethod(file.name, size)
+	a.setFileMode(fh)
 
-	f, err := a.writer.CreateHeader(fh)
+	f, err := a.createHeader(fh)
 	if err != nil {
-		return fmt.Errorf("error creating file inside archive: %s", err)
+		return archiveError("creating file inside archive", file.name, err)
 	}
 
-	_, err = f.Write(content)
+	_, err = io.Copy(f, r)
 	return err
 }
 
 func (a *ZipArchiver) ArchiveDir(indirname string) error {
-	_, err := assertValidDir(indirname)
+	return a.ArchiveDirWithOptions(indirname, ArchiveDirOptions{})
+}
+
+func (a *ZipArchiver) ArchiveDirWithOptions(indirname string, opts ArchiveDirOptions) error {
+	return a.ArchiveDirContext(context.Background(), indirname, opts)
+}
+
+// ArchiveDirContext archives indirname like ArchiveDirWithOptions, stopping
+// with ctx's error and removing the partially written archive if ctx is
+// cancelled before it completes.
+func (a *ZipArchiver) ArchiveDirContext(ctx context.Context, indirname string, opts ArchiveDirOptions) error {
+	return a.ArchiveDirsContext(ctx, []ArchiveDirSource{{Path: indirname}}, opts)
+}
+
+// ArchiveDirsContext archives every source directory into the one archive
+// like ArchiveDirContext, erroring if two sources have an entry with the
+// same name.
+func (a *ZipArchiver) ArchiveDirsContext(ctx context.Context, sources []ArchiveDirSource, opts ArchiveDirOptions) error {
+	return a.archiveDirs(ctx, sources, opts, false)
+}
+
+// archiveDirs archives sources like ArchiveDirsContext, adding to the
+// archive kept open by Open when add is set.
+func (a *ZipArchiver) archiveDirs(ctx context.Context, sources []ArchiveDirSource, opts ArchiveDirOptions, add bool) (err error) {
+	sources, err = prepareDirSources(sources, a.options.Prefix, opts)
+	if err != nil {
+		return err
+	}
+	if a.output() == nil && !a.discard {
+		if err := checkOutputOutside(sources, a.filepath); err != nil {
+			return err
+		}
+	}
+	opts, err = prepareDirOptions(opts)
 	if err != nil {
 		return err
 	}
 
-	if err := a.open(); err != nil {
+	held, err := a.open(add)
+	if err != nil {
 		return err
 	}
-	defer a.close()
+	defer func() {
+		err = a.close(held, err)
+	}()
+	return a.writeDirs(ctx, sources, opts)
+}
 
-	return filepath.Walk(indirname, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
+// ArchiveDirInto writes the entries found walking indirname to w, a zip
+// writer owned by the caller, such as one it also writes entries of its own
+// to, with opts and the options that apply to entries, as
+// ArchiveDirContext would. w is neither created nor closed, so options that
+// need the whole archive, such as BaseArchive, Comment, SortEntries, Order
+// and Verify, are errors. Entry names are only checked against the other
+// entries written by the same call. Compressors for the compression options
+// are registered with w, and stay registered. It returns the entries
+// written, and the files and directories left out. A call that fails may
+// leave part of its entries in w.
+func ArchiveDirInto(ctx context.Context, w *zip.Writer, indirname string, opts ArchiveDirOptions, options ArchiveOptions) ([]ArchiveEntry, []SkippedFile, error) {
+	if err := assertValidWriterOptions(options); err != nil {
+		return nil, nil, err
+	}
+	a := &ZipArchiver{options: options}
+	if err := a.checkOptions(); err != nil {
+		return nil, nil, err
+	}
+	sources, err := prepareDirSources([]ArchiveDirSource{{Path: indirname}}, options.Prefix, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts, err = prepareDirOptions(opts); err != nil {
+		return nil, nil, err
+	}
+	a.writer = w
+	a.start()
+	if err := a.writeDirs(ctx, sources, opts); err != nil {
+		return nil, nil, err
+	}
+	return a.manifest.entries(), a.skipped, nil
+}
+
+// assertValidWriterOptions errors for the options that ArchiveDirInto can't
+// apply to a zip writer it doesn't own.
+func assertValidWriterOptions(options ArchiveOptions) error {
+	switch {
+	case options.BaseArchive != "":
+		return fmt.Errorf("a base archive can't be copied into a zip writer owned by the caller")
+	case options.Comment != "":
+		return fmt.Errorf("the comment of a zip writer owned by the caller has to be set with its SetComment")
+	case options.sortsEntries():
+		return fmt.Errorf("entries can't be sorted in a zip writer owned by the caller")
+	case options.Verify:
+		return fmt.Errorf("a zip writer owned by the caller can't be verified")
+	case options.Output != nil || options.Tee != nil:
+		return fmt.Errorf("a zip writer owned by the caller already has its output")
+	case options.Duplicates == DuplicatesOverwrite:
+		return fmt.Errorf("entries written to a zip writer owned by the caller can't be overwritten")
+	}
+	return nil
+}
+
+// writeDirs writes the entries found walking sources to the open archive.
+func (a *ZipArchiver) writeDirs(ctx context.Context, sources []ArchiveDirSource, opts ArchiveDirOptions) error {
+	defer a.discardPending()
+	a.progress = newArchiveProgress(a.options.Progress, sources, opts)
+	defer func() { a.progress = archiveProgress{} }()
+	baseFiles := a.manifest.fileCount()
+	for _, dir := range sources {
+		if err := a.walkDir(ctx, dir, opts); err != nil {
+			return err
 		}
+	}
+	if err := a.flushPending(); err != nil {
+		return err
+	}
+	return checkFilesFound(sources, opts, a.manifest.fileCount()-baseFiles)
+}
+
+// walkDir writes the entries found in dir.
+func (a *ZipArchiver) walkDir(ctx context.Context, dir ArchiveDirSource, opts ArchiveDirOptions) error {
+	return walkSource(dir.Path, opts, a.walkFunc(ctx, dir, opts))
+}
+
+// walkFunc returns the filepath.WalkFunc that walkDir writes each entry
+// with.
+func (a *ZipArchiver) walkFunc(ctx context.Context, dir ArchiveDirSource, opts ArchiveDirOptions) filepath.WalkFunc {
+	ignores := newIgnoreMatcher(dir.Path, opts.IgnoreFile)
+	return func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// info may be nil when err is set, so the error has to be
+		// checked before anything else.
+		relname, relErr := filepath.Rel(dir.Path, path)
+		if relErr != nil {
+			return archiveError("relativizing file for archival", path, relErr)
+		}
+		name, named := walkedEntryName(dir.Prefix, relname, opts)
 		if err != nil {
+			// A directory that can't be listed is passed again with its
+			// info, after its entry was written, and only its contents
+			// are skipped.
+			if reason := skipReadError(path, err, opts); reason != "" {
+				a.skipped.addReadError(name, info != nil && info.IsDir(), reason, err)
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			return err
 		}
-		relname, err := filepath.Rel(indirname, path)
+		reason, pattern, err := skipReason(dir.Path, ignores, path, info, opts)
 		if err != nil {
-			return fmt.Errorf("error relativizing file for archival: %s", err)
+			return err
+		}
+		if reason != "" {
+			a.skipped.addMatched(name, info.IsDir(), reason, pattern)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := checkDenied(dir.Path, path, opts.DenyPatterns); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if opts.Flatten || !named {
+				return nil
+			}
+			ok, err := wantDirEntry(dir.Path, path, opts.DirEntries)
+			if err != nil || !ok {
+				return err
+			}
+			return a.writeDir(name, info)
+		}
+		if !named {
+			return fmt.Errorf("stripping %d components from %s leaves no name to archive it under", opts.StripComponents, filepath.ToSlash(relname))
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if opts.ExcludeSymlinkDirs && isDirSymlink(path) {
+				a.skipped.add(name, true, SkippedSymlinkDir)
+				return nil
+			}
+			switch opts.Symlinks {
+			case SymlinkSkip:
+				a.skipped.add(name, false, SkippedSymlink)
+				return nil
+			case SymlinkStore:
+				return a.writeSymlink(path, name, info)
+			}
+			info, err = followSymlink(path)
+			if err != nil {
+				if readErr := unreadableSymlink(path, err, opts); readErr != nil {
+					a.skipped.addReadError(name, false, SkippedUnreadable, readErr)
+					return nil
+				}
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			if err := specialFileError(path, info, opts.SpecialFiles); err != nil {
+				return err
+			}
+			a.skipped.add(name, false, SkippedSpecialFile)
+			return nil
+		}
+		if tooLarge(path, info, opts) {
+			a.skipped.add(name, false, SkippedTooLarge)
+			return nil
 		}
 		fh, err := zip.FileInfoHeader(info)
 		if err != nil {
-			return fmt.Errorf("error creating file header: %s", err)
+			return archiveError("creating file header", path, err)
+		}
+		fh.Name = name
+		fh.Modified = a.options.entryModTime(fh.Modified)
+		fh.Method = a.entryMethod(name, info.Size())
+		a.setFileMode(fh)
+		if opts.Parallelism > 1 {
+			return a.queueFile(ctx, path, fh, opts)
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			if reason := skipReadError(path, err, opts); reason != "" {
+				a.skipped.addReadError(name, false, reason, err)
+				return nil
+			}
+			return archiveError("reading file for archival", path, err)
 		}
-		fh.Name = relname
-		fh.Method = zip.Deflate
-		f, err := a.writer.CreateHeader(fh)
+		defer src.Close()
+		r, size, err := a.options.transformReader(&contextReader{ctx: ctx, r: src}, info.Size(), name)
 		if err != nil {
-			return fmt.Errorf("error creating file inside archive: %s", err)
+			return err
 		}
-		content, err := ioutil.ReadFile(path)
+		fh.Method = a.entryMethod(name, size)
+		f, err := a.createHeader(fh)
 		if err != nil {
-			return fmt.Errorf("error reading file for archival: %s", err)
+			return archiveError("creating file inside archive", name, err)
 		}
-		_, err = f.Write(content)
+		_, err = io.Copy(f, r)
 		return err
-	})
+	}
+}
 
+// writeDir stores an entry for a directory. Directory entry names end with a
+// slash.
+func (a *ZipArchiver) writeDir(name string, info os.FileInfo) error {
+	fh, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return archiveError("creating file header", name, err)
+	}
+	fh.Name = name + "/"
+	fh.SetMode(a.options.dirMode() | os.ModeDir)
+	fh.Modified = a.options.entryModTime(fh.Modified)
+	fh.Method = zip.Store
+	if _, err := a.createHeader(fh); err != nil {
+		return archiveError("creating directory inside archive", name, err)
+	}
+	return nil
+}
+
+// writeSymlink stores the symlink at path as a link entry whose content is
+// the link target, as the zip command line tool does.
+func (a *ZipArchiver) writeSymlink(path, name string, info os.FileInfo) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return archiveError("reading symlink for archival", path, err)
+	}
+	fh, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return archiveError("creating file header", path, err)
+	}
+	fh.Name = name
+	fh.Modified = a.options.entryModTime(fh.Modified)
+	fh.Method = zip.Store
+	f, err := a.createHeader(fh)
+	if err != nil {
+		return archiveError("creating file inside archive", name, err)
+	}
+	_, err = io.WriteString(f, filepath.ToSlash(target))
+	return err
 }
 
 func (a *ZipArchiver) ArchiveMultiple(content map[string][]byte) error {
-	if err := a.open(); err != nil {
+	entries, err := sanitizeArchivePaths(content, a.options.Prefix, a.options.Duplicates)
+	if err != nil {
+		return err
+	}
+	return a.writeContentEntries(entries)
+}
+
+// ArchiveMultipleOrdered archives content like ArchiveMultiple, but writes
+// the entries in the order given rather than sorted by name, for formats
+// where the position of an entry matters.
+func (a *ZipArchiver) ArchiveMultipleOrdered(content []ContentEntry) error {
+	entries, err := sanitizeContentEntries(content, a.options.Prefix, a.options.Duplicates)
+	if err != nil {
+		return err
+	}
+	return a.writeContentEntries(entries)
+}
+
+// ArchiveExistingZip copies every entry of the zip file at path into the
+// archive, under prefix when it is set. The entries are copied as they are
+// compressed, without being decompressed and compressed again, so options
+// that change the content or mode of an entry, such as CompressionLevel and
+// FileMode, don't apply to them, while their names, modification times and
+// duplicates are handled like those of any other entry.
+func (a *ZipArchiver) ArchiveExistingZip(path, prefix string) (err error) {
+	prefix, err = joinPrefixes(a.options.Prefix, prefix)
+	if err != nil {
+		return err
+	}
+	r, err := openZip(path)
+	if err != nil {
+		return fmt.Errorf("error opening zip to archive: %w", err)
+	}
+	defer r.Close()
+
+	held, err := a.open(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	for _, zf := range r.File {
+		name, err := prefixedArchivePath(prefix, zf.Name)
+		if err != nil {
+			return err
+		}
+		if err := a.copyZipEntry(zf, name); err != nil {
+			return archiveError("copying zip entry", zf.Name, err)
+		}
+	}
+	return nil
+}
+
+// copyZipEntry writes the entry zf of another zip file to the archive as
+// name, copying its compressed content. The content is read decompressed as
+// well, which checks its CRC-32 and gives the checksums of its manifest
+// entry, before the entry is written.
+func (a *ZipArchiver) copyZipEntry(zf *zip.File, name string) error {
+	_, err := a.copyRaw(zf, name, a.options.entryModTime(zf.Modified))
+	return err
+}
+
+// copyRaw writes the entry of another zip file under name, stored as it is
+// compressed there, reporting whether it was written rather than skipped as
+// a duplicate.
+func (a *ZipArchiver) copyRaw(zf *zip.File, name string, modified time.Time) (bool, error) {
+	if err := a.flushPending(); err != nil {
+		return false, err
+	}
+	if err := a.options.checkNameLength(name); err != nil {
+		return false, err
+	}
+	isDir := strings.HasSuffix(name, "/")
+	ok, err := a.names.add(strings.TrimSuffix(name, "/"), isDir)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := a.size.add(name, int64(zf.UncompressedSize64)); err != nil {
+		return false, err
+	}
+	if err := a.files.add(name, isDir); err != nil {
+		return false, err
+	}
+	entry := newManifestEntry(name, zf.Mode(), modified)
+	src, err := zf.Open()
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(entry, src)
+	src.Close()
+	if err != nil {
+		return false, err
+	}
+
+	// The extra fields are rewritten by archive/zip where it needs them,
+	// so they aren't copied to avoid duplicates.
+	fh := zf.FileHeader
+	fh.Name = name
+	fh.Extra = nil
+	fh.Modified = entry.Modified
+	w, err := a.createRaw(&fh)
+	if err != nil {
+		return false, err
+	}
+	raw, err := zf.OpenRaw()
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w, raw); err != nil {
+		return false, err
+	}
+	a.manifest = append(a.manifest, entry)
+	return true, nil
+}
+
+// writeContentEntries writes an archive of the sanitized entries, in order.
+func (a *ZipArchiver) writeContentEntries(entries []ContentEntry) (err error) {
+	held, err := a.open(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = a.close(held, err)
+	}()
+
+	for _, entry := range entries {
+		r, size, err := a.options.transformReader(bytes.NewReader(entry.Content), int64(len(entry.Content)), entry.Name)
+		if err != nil {
+			return err
+		}
+		fh := &zip.FileHeader{
+			Name:   entry.Name,
+			Method: a.entryMethod(entry.Name, size),
+		}
+		a.setFileMode(fh)
+		f, err := a.createHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open starts an archive that entries are added to, by the Add methods or
+// any of the Archive methods, until Close finishes it, rather than each call
+// writing an archive of its own. A call that fails may leave part of its
+// entries in the archive, and Close still has to be called. Options should
+// not change while the archive is open.
+func (a *ZipArchiver) Open() error {
+	a.session.mu.Lock()
+	defer a.session.mu.Unlock()
+	if a.session.open {
+		return fmt.Errorf("archive %s is already open", a.filepath)
+	}
+	if err := a.begin(); err != nil {
+		return err
+	}
+	a.session.open = true
+	return nil
+}
+
+// AddContent adds content as the file infilename to the archive started by
+// Open. The Add methods, and the Archive methods while the archive is open,
+// may be called from several goroutines at once.
+func (a *ZipArchiver) AddContent(content []byte, infilename string) error {
+	return a.archiveReader(bytes.NewReader(content), infilename, int64(len(content)), true)
+}
+
+// AddFile adds infilename, stored as archivePath, to the archive started by
+// Open.
+func (a *ZipArchiver) AddFile(infilename, archivePath string) error {
+	return a.archiveFileAs(infilename, archivePath, true)
+}
+
+// AddDir adds the contents of indirname to the archive started by Open. A
+// cancelled ctx stops the walk, but leaves the archive open.
+func (a *ZipArchiver) AddDir(ctx context.Context, indirname string, opts ArchiveDirOptions) error {
+	return a.archiveDirs(ctx, []ArchiveDirSource{{Path: indirname}}, opts, true)
+}
+
+// Close finishes the archive started by Open. It does nothing if the
+// archive isn't open.
+func (a *ZipArchiver) Close() error {
+	a.session.mu.Lock()
+	defer a.session.mu.Unlock()
+	if !a.session.open {
+		return nil
+	}
+	a.session.open = false
+	return a.close(false, nil)
+}
+
+func (a *ZipArchiver) SetOptions(opts ArchiveOptions) {
+	a.options = opts
+}
+
+// Entries returns the entries written by the last call that archived
+// anything, or since Open, including those copied from a base archive.
+func (a *ZipArchiver) Entries() []ArchiveEntry {
+	return a.manifest.entries()
+}
+
+// Skipped returns the files and directories left out of the directories
+// walked by the last call that archived anything, or since Open.
+func (a *ZipArchiver) Skipped() []SkippedFile {
+	return a.skipped
+}
+
+// output returns the writer the archive is written to instead of its file,
+// or nil to write the file. ArchiveOptions.Output wins over the writer given
+// to NewZipArchiverWriter.
+func (a *ZipArchiver) output() io.Writer {
+	if a.options.Output != nil {
+		return a.options.Output
+	}
+	return a.out
+}
+
+// method returns the zip compression method used for new entries.
+func (a *ZipArchiver) method() uint16 {
+	if a.discard || a.options.CompressionLevel == NoCompression {
+		return zip.Store
+	}
+	if a.options.Compression == CompressionZstd {
+		return zipZstd
+	}
+	return zip.Deflate
+}
+
+// entryMethod returns the compression method for a new entry called name of
+// size bytes, or -1 if unknown, which is the method of its
+// ExtensionCompression, or zip.Store for names with one of the
+// StoreExtensions and for entries smaller than MinCompressSize.
+func (a *ZipArchiver) entryMethod(name string, size int64) uint16 {
+	if a.discard {
+		return zip.Store
+	}
+	if c, ok := a.extensionCompression(name); ok {
+		method := c.Method
+		if method == "" {
+			method = a.options.Compression
+		}
+		switch {
+		case c.Level == NoCompression:
+			return zip.Store
+		case method == CompressionZstd:
+			return zipZstd
+		}
+		return zip.Deflate
+	}
+	if hasExtension(name, a.options.StoreExtensions) {
+		return zip.Store
+	}
+	if size >= 0 && size < a.options.MinCompressSize {
+		return zip.Store
+	}
+	return a.method()
+}
+
+// entryLevel returns the compression level for a new entry called name.
+func (a *ZipArchiver) entryLevel(name string) int {
+	if c, ok := a.extensionCompression(name); ok {
+		return c.Level
+	}
+	return a.options.CompressionLevel
+}
+
+// extensionCompression returns the ExtensionCompression for the extension
+// of name, if it has one.
+func (a *ZipArchiver) extensionCompression(name string) (EntryCompression, bool) {
+	ext := path.Ext(name)
+	if ext == "" {
+		return EntryCompression{}, false
+	}
+	for e, c := range a.options.ExtensionCompression {
+		if isExtension(ext, e) {
+			return c, true
+		}
+	}
+	return EntryCompression{}, false
+}
+
+// compressor returns a writer compressing entries written to out with method
+// at level.
+func (a *ZipArchiver) compressor(out io.Writer, method uint16, level int) (io.WriteCloser, error) {
+	if method == zipZstd {
+		speed := zstd.SpeedDefault
+		if level > DefaultCompression {
+			speed = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(out, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+	}
+	if level <= DefaultCompression {
+		level = zipDefaultLevel
+	}
+	return flate.NewWriter(out, level)
+}
+
+// registeredCompressor returns the compressor registered with writer for
+// method, which compresses each entry at the level createHeader sets.
+func (a *ZipArchiver) registeredCompressor(method uint16) zip.Compressor {
+	return func(out io.Writer) (io.WriteCloser, error) {
+		return a.compressor(out, method, a.level)
+	}
+}
+
+// open starts a call writing to the archive. While the archive is kept open
+// by Open, it locks the session until close, so that calls take turns adding
+// to it, reporting that the call holds the lock, and it errors for the Add
+// methods, with add set, if it isn't open. Otherwise it creates the archive
+// for the call.
+func (a *ZipArchiver) open(add bool) (bool, error) {
+	if held, err := a.session.lock(a.filepath, add); held || err != nil {
+		return held, err
+	}
+	return false, a.begin()
+}
+
+// begin creates the archive, erroring if another call is still writing one.
+func (a *ZipArchiver) begin() error {
+	if err := a.guard.acquire(a.filepath); err != nil {
 		return err
 	}
-	defer a.close()
+	if err := a.create(); err != nil {
+		return a.close(false, err)
+	}
+	return nil
+}
 
-	// Ensure files are processed in the same order so hashes don't change
-	keys := make([]string, len(content))
-	i := 0
-	for k := range content {
-		keys[i] = k
-		i++
+// create starts writing the archive, which close finishes, whether or not
+// create succeeds.
+func (a *ZipArchiver) create() error {
+	if err := a.checkOptions(); err != nil {
+		return err
+	}
+	if err := assertValidOutput(a.output(), a.options.Duplicates); err != nil {
+		return err
 	}
-	sort.Strings(keys)
 
-	for _, filename := range keys {
-		f, err := a.writer.Create(filename)
+	var base *zip.ReadCloser
+	if a.options.BaseArchive != "" {
+		var err error
+		base, err = openZip(a.options.BaseArchive)
 		if err != nil {
+			return fmt.Errorf("error opening base archive: %w", err)
+		}
+		defer base.Close()
+	}
+
+	w := a.output()
+	if a.discard {
+		w = ioutil.Discard
+	} else if w == nil {
+		if err := prepareOutputDir(a.filepath, a.options.CreateOutputDir); err != nil {
 			return err
 		}
-		_, err = f.Write(content[filename])
+		f, err := createArchiveFile(a.filepath)
 		if err != nil {
 			return err
 		}
+		a.filewriter = f
+		a.buffer = bufio.NewWriterSize(a.options.teeOutput(f), zipBufferSize)
+		w = a.buffer
+	}
+	a.writer = zip.NewWriter(w)
+	a.start()
+	if a.options.Comment != "" {
+		if err := a.writer.SetComment(a.options.Comment); err != nil {
+			return fmt.Errorf("error setting archive comment: %w", err)
+		}
+	}
+	if base != nil {
+		if err := a.copyBase(base); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (a *ZipArchiver) open() error {
-	f, err := os.Create(a.filepath)
-	if err != nil {
+// checkOptions errors for options that entries can't be written with.
+func (a *ZipArchiver) checkOptions() error {
+	if err := assertValidCompressionLevel(a.options.CompressionLevel); err != nil {
+		return err
+	}
+	if err := assertValidCompression(a.options.Compression); err != nil {
+		return err
+	}
+	if err := assertValidExtensionCompression(a.options.ExtensionCompression); err != nil {
+		return err
+	}
+	if a.options.MinCompressSize < 0 {
+		return fmt.Errorf("invalid minimum compression size: %d", a.options.MinCompressSize)
+	}
+	if err := assertValidDuplicates(a.options.Duplicates); err != nil {
+		return err
+	}
+	if err := assertValidCaseCheck(a.options.CaseInsensitiveCheck); err != nil {
+		return err
+	}
+	if err := assertValidTransforms(a.options.Transforms); err != nil {
 		return err
 	}
-	a.filewriter = f
-	a.writer = zip.NewWriter(f)
+	return assertValidModTime(a.options)
+}
+
+// start resets the state of the entries for the archive a.writer writes, and
+// registers the compressors its options need with it.
+func (a *ZipArchiver) start() {
+	a.names = newArchiveNames(a.options.Duplicates, a.options.CaseInsensitiveCheck)
+	a.size = sizeLimit{max: a.options.MaxSize}
+	a.files = fileLimit{max: a.options.MaxFiles}
+	a.manifest = nil
+	a.skipped = nil
+	// archive/zip deflates at zipDefaultLevel itself, so a compressor only
+	// has to be registered for other methods and levels.
+	if len(a.options.ExtensionCompression) > 0 {
+		a.writer.RegisterCompressor(zip.Deflate, a.registeredCompressor(zip.Deflate))
+		a.writer.RegisterCompressor(zipZstd, a.registeredCompressor(zipZstd))
+	} else if method := a.method(); method == zipZstd || method == zip.Deflate && a.options.CompressionLevel > DefaultCompression {
+		a.writer.RegisterCompressor(method, a.registeredCompressor(method))
+	}
+}
+
+// copyBase writes every entry of the base archive to the new archive, as it
+// is compressed there, so entries keep their method whatever the
+// compressors registered for the new archive.
+func (a *ZipArchiver) copyBase(base *zip.ReadCloser) error {
+	for _, bf := range base.File {
+		ok, err := a.copyRaw(bf, bf.Name, bf.Modified)
+		if err != nil {
+			return fmt.Errorf("error copying base archive: %w", err)
+		}
+		if ok && !strings.HasSuffix(bf.Name, "/") {
+			a.progress.add(bf.Name)
+		}
+	}
 	return nil
 }
 
-func (a *ZipArchiver) close() {
+// createRaw writes the header of an entry whose content is already
+// compressed, as given apart from the options that apply to every entry,
+// returning the writer for the compressed content.
+func (a *ZipArchiver) createRaw(fh *zip.FileHeader) (io.Writer, error) {
+	// Raw entries are written with the header as given, so the MS-DOS
+	// time fields have to match an overridden modification time too.
+	fh.SetModTime(fh.Modified)
+	if creator := a.options.ZipCreator; creator != 0 {
+		// The version made by holds the system in the high byte and the
+		// zip specification version in the low byte, and the version
+		// needed is the lowest one that extracts the method.
+		fh.CreatorVersion = creator
+		fh.ReaderVersion = zipReaderVersion(fh.Method)
+		// The sizes are known, so no data descriptor follows the content.
+		fh.Flags &^= 0x8
+	}
+	if a.options.ZipDataDescriptors && !strings.HasSuffix(fh.Name, "/") {
+		// archive/zip already writes the entries it compresses itself
+		// with a data descriptor, never seeking back to fill in the local
+		// header, but raw entries, such as those compressed in parallel
+		// or for ZipCreator, otherwise have their sizes there. With the
+		// flag set it leaves the checksum and sizes out of the local
+		// header, writing them after the content. Directory entries have
+		// no content, so they never get one.
+		fh.Flags |= 0x8
+	}
+	setUTF8Flag(fh, a.options.UTF8Names)
+	return a.writer.CreateRaw(fh)
+}
+
+// createHeader adds an entry to the archive, erroring if an entry with the
+// same name was already written. A directory entry that was already written
+// is skipped instead. Files still being compressed in parallel are written
+// first so that entries keep the order they were found in.
+func (a *ZipArchiver) createHeader(fh *zip.FileHeader) (io.Writer, error) {
+	if err := a.flushPending(); err != nil {
+		return nil, err
+	}
+	if a.options.ZipCreator != 0 {
+		return a.createRawHeader(fh)
+	}
+	if err := a.options.checkNameLength(fh.Name); err != nil {
+		return nil, err
+	}
+	isDir := strings.HasSuffix(fh.Name, "/")
+	ok, err := a.names.add(strings.TrimSuffix(fh.Name, "/"), isDir)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return ioutil.Discard, nil
+	}
+	if err := a.files.add(fh.Name, isDir); err != nil {
+		return nil, err
+	}
+	a.level = a.entryLevel(fh.Name)
+	setUTF8Flag(fh, a.options.UTF8Names)
+	w, err := a.writer.CreateHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	entry := a.manifest.add(fh.Name, fh.Mode(), fh.Modified)
+	if !isDir {
+		a.progress.add(fh.Name)
+	}
+	return &limitWriter{w: w, entry: entry, limit: &a.size}, nil
+}
+
+// setFileMode stores the mode given for a new file entry by
+// ArchiveOptions.FileModes or FileMode, if any, in its header instead of the
+// mode of its source.
+func (a *ZipArchiver) setFileMode(fh *zip.FileHeader) {
+	if mode, ok := a.options.fileMode(fh.Name); ok {
+		fh.SetMode(mode)
+	}
+}
+
+// setUTF8Flag marks the name and comment of fh as UTF-8 when either is not
+// ASCII, or always with force, as long as both are valid UTF-8. archive/zip
+// sets the flag in CreateHeader, though only for names that can't be read as
+// CP-437, but never in CreateRaw.
+func setUTF8Flag(fh *zip.FileHeader, force bool) {
+	if fh.NonUTF8 || !utf8.ValidString(fh.Name) || !utf8.ValidString(fh.Comment) {
+		return
+	}
+	if force || !isASCII(fh.Name) || !isASCII(fh.Comment) {
+		fh.Flags |= zipUTF8Flag
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// limitWriter counts the bytes written to an entry against the archive's
+// size limit, and writes them to the entry's manifest entry.
+type limitWriter struct {
+	w     io.Writer
+	entry *manifestEntry
+	limit *sizeLimit
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if err := w.limit.add(w.entry.Name, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.entry.Write(p[:n])
+	return n, err
+}
+
+// close finishes the archive, unless the call holds the lock on the archive
+// kept open by Open, as held reports, which it releases instead.
+func (a *ZipArchiver) close(held bool, err error) error {
+	if a.session.unlock(held) {
+		return err
+	}
+	// Closing the zip writer flushes the central directory, including any
+	// zip64 records, and then the buffer has to be flushed, before the file
+	// is closed. Entries queued by createRawHeader are written first.
 	if a.writer != nil {
-		a.writer.Close()
+		if flushErr := a.flushPending(); err == nil {
+			err = flushErr
+		}
+		a.discardPending()
+		if closeErr := a.writer.Close(); err == nil {
+			err = closeErr
+		}
 		a.writer = nil
 	}
+	if a.buffer != nil {
+		if flushErr := a.buffer.Flush(); err == nil && flushErr != nil {
+			err = fmt.Errorf("error writing archive: %w", flushErr)
+		}
+		a.buffer = nil
+	}
+	// The archive is written to a temporary file, which is only moved into
+	// place once it is rewritten and verified.
+	var tmp string
 	if a.filewriter != nil {
-		a.filewriter.Close()
+		tmp = a.filewriter.Name()
+		err = closeArchiveFile(a.filewriter, err)
 		a.filewriter = nil
 	}
+	if err == nil {
+		err = a.options.checkOrder(a.manifest)
+	}
+	if err == nil && needsRewrite(a.names, a.manifest, a.options) {
+		switch {
+		case a.discard:
+			a.manifest.removeReplaced(a.names)
+			if a.options.sortsEntries() {
+				a.manifest.sort(a.options.entryLess())
+			}
+		case tmp == "" || tmp == a.filepath:
+			err = fmt.Errorf("entries can only be sorted when the archive is written to a regular file")
+		default:
+			var rewritten string
+			if rewritten, err = a.rewrite(tmp); err == nil {
+				os.Remove(tmp)
+				tmp = rewritten
+			}
+		}
+	}
+	if err == nil && tmp != "" && a.options.Verify {
+		err = a.verify(tmp)
+	}
+	if tmp != "" {
+		err = commitArchiveFile(tmp, a.filepath, err)
+	}
+	a.names = archiveNames{}
+	a.guard.release()
+	return err
+}
+
+// verify reads every entry of the finished archive back from path, before it
+// is moved into place, which checks that it decompresses to the CRC-32 stored
+// for it, and compares it with the content written.
+func (a *ZipArchiver) verify(path string) error {
+	r, err := openZip(path)
+	if err != nil {
+		return fmt.Errorf("error verifying archive: %w", err)
+	}
+	defer r.Close()
+
+	v := newArchiveVerifier(a.manifest.entries())
+	for _, f := range r.File {
+		src, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("error verifying archive: could not open %s: %w", f.Name, err)
+		}
+		err = v.check(f.Name, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return v.finish()
+}
+
+// rewrite rewrites the finished archive at path, into another temporary
+// file whose name it returns, without the entries that were replaced by a
+// later entry with the same name, and in the order of their names when
+// SortEntries or Order is set. The remaining entries are copied without
+// being compressed again.
+func (a *ZipArchiver) rewrite(path string) (string, error) {
+	r, err := openZip(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading archive to rewrite it: %w", err)
+	}
+	defer r.Close()
+
+	f, err := createArchiveFile(a.filepath)
+	if err != nil {
+		return "", err
+	}
+	w := zip.NewWriter(a.options.teeOutput(f))
+	err = w.SetComment(r.Comment)
+	keep := a.names.keep()
+	var files []*zip.File
+	for _, zf := range r.File {
+		if keep(zf.Name) {
+			files = append(files, zf)
+		}
+	}
+	if a.options.sortsEntries() {
+		less := a.options.entryLess()
+		sort.SliceStable(files, func(i, j int) bool {
+			return less(files[i].Name, files[j].Name)
+		})
+	}
+	for _, zf := range files {
+		if err != nil {
+			break
+		}
+		err = w.Copy(zf)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err = closeArchiveFile(f, err); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error rewriting archive: %w", err)
+	}
+	a.manifest.removeReplaced(a.names)
+	if a.options.sortsEntries() {
+		a.manifest.sort(a.options.entryLess())
+	}
+	return f.Name(), nil
 }
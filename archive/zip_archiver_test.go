@@ -2,8 +2,26 @@ package archive
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestZipArchiver_Content(t *testing.T) {
@@ -18,30 +36,2328 @@ func TestZipArchiver_Content(t *testing.T) {
 	})
 }
 
+func TestZipArchiver_Reader(t *testing.T) {
+	zipfilepath := "archive-reader.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	r := io.MultiReader(strings.NewReader("This is "), strings.NewReader("streamed content"))
+	if err := archiver.ArchiveReader(r, "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"content.txt": []byte("This is streamed content"),
+	})
+}
+
+func TestZipArchiver_ContentMode(t *testing.T) {
+	zipfilepath := "archive-content-mode.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "bootstrap", 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"bootstrap": []byte("#!/bin/sh"),
+	})
+	ensureFileMode(t, zipfilepath, "bootstrap", 0755)
+
+	// The mode given wins over the modes set for every file.
+	os.Remove(zipfilepath)
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{FileMode: 0644, FileModes: map[string]os.FileMode{"bootstrap": 0600}})
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "bootstrap", 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureFileMode(t, zipfilepath, "bootstrap", 0755)
+}
+
+func TestZipArchiver_ContentTraversal(t *testing.T) {
+	for _, name := range []string{"../../etc/passwd", "/etc/passwd", `..\evil.txt`} {
+		zipfilepath := "archive-content-traversal.zip"
+		os.Remove(zipfilepath)
+
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveContent([]byte("This is some content"), name); err == nil {
+			t.Errorf("expected error archiving content as %q", name)
+		}
+		if err := archiver.ArchiveMultiple(map[string][]byte{
+			"content.txt": []byte("This is some content"),
+			name:          []byte("This is some content"),
+		}); err == nil {
+			t.Errorf("expected error archiving multiple content with %q", name)
+		}
+		if _, err := os.Stat(zipfilepath); err == nil {
+			t.Errorf("expected no archive to be created for %q", name)
+		}
+	}
+}
+
+func TestZipArchiver_MultipleNames(t *testing.T) {
+	zipfilepath := "archive-multiple-names.zip"
+	for _, name := range []string{"", ".", "sub/", "/content.txt", "sub/../content.txt"} {
+		os.Remove(zipfilepath)
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveMultiple(map[string][]byte{
+			name: []byte("This is some content"),
+		}); err == nil {
+			t.Errorf("expected error archiving multiple content with %q", name)
+		}
+		if _, err := os.Stat(zipfilepath); err == nil {
+			t.Errorf("expected no archive to be created for %q", name)
+		}
+	}
+
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		`sub\file1.txt`:      []byte("This is file 1"),
+		"./sub//./file2.txt": []byte("This is file 2"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"sub/file1.txt": []byte("This is file 1"),
+		"sub/file2.txt": []byte("This is file 2"),
+	})
+}
+
+func TestZipArchiver_ContentLeadingDot(t *testing.T) {
+	zipfilepath := "archive-content-leading-dot.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveContent([]byte("This is some content"), "./content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"content.txt": []byte("This is some content"),
+	})
+}
+
+func TestZipArchiver_CloseError(t *testing.T) {
+	// Writes to /dev/full fail with ENOSPC, and small archives are only
+	// flushed to the file when the zip writer is closed.
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("/dev/full is not available")
+	}
+
+	archiver := NewZipArchiver("/dev/full")
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err == nil {
+		t.Fatalf("expected error flushing archive to a full device")
+	}
+}
+
+// failingWriter fails every write, counting them.
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("write failed")
+}
+
+func TestZipArchiver_FlushError(t *testing.T) {
+	dir := tempDir(t, "archive-flush-error")
+	defer os.RemoveAll(dir)
+
+	// A small archive is only written out of its buffer once the zip
+	// writer is closed, so Tee sees a single write, from the flush.
+	tee := &failingWriter{}
+	zipfilepath := filepath.Join(dir, "out.zip")
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{Tee: tee})
+	err := archiver.ArchiveContent([]byte("This is some content"), "content.txt")
+	if err == nil || !strings.Contains(err.Error(), "write failed") {
+		t.Fatalf("expected the flush error, got %v", err)
+	}
+	if tee.writes != 1 {
+		t.Errorf("expected one write, when the buffer is flushed, got %d", tee.writes)
+	}
+	if _, err := os.Stat(zipfilepath); !os.IsNotExist(err) {
+		t.Errorf("expected no archive to be left: %v", err)
+	}
+}
+
 func TestZipArchiver_File(t *testing.T) {
 	zipfilepath := "archive-file.zip"
 	archiver := NewZipArchiver(zipfilepath)
-	if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err != nil {
+	if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"test-file.txt": []byte("This is test content"),
+	})
+}
+
+func TestZipArchiver_FileStreamed(t *testing.T) {
+	dir := tempDir(t, "archive-file-streamed")
+	defer os.RemoveAll(dir)
+	// The random content is bigger than the buffers it is copied through,
+	// and doesn't compress.
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	writeTestFile(t, filepath.Join(dir, "src", "big.bin"), string(content))
+
+	zipfilepath := filepath.Join(dir, "file.zip")
+	if err := NewZipArchiver(zipfilepath).ArchiveFile(filepath.Join(dir, "src", "big.bin")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"big.bin": content,
+	})
+
+	zipfilepath = filepath.Join(dir, "dir.zip")
+	if err := NewZipArchiver(zipfilepath).ArchiveDir(filepath.Join(dir, "src")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"big.bin": content,
+	})
+}
+
+func TestZipArchiver_FileAs(t *testing.T) {
+	zipfilepath := "archive-file-as.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveFileAs("./test-fixtures/test-dir/file1.txt", "test-dir/file1.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"test-dir/file1.txt": []byte("This is file 1"),
+	})
+}
+
+func TestZipArchiver_FileFrom(t *testing.T) {
+	cases := map[string]string{
+		"":                          "file1.txt",
+		"./test-fixtures":           "test-dir/file1.txt",
+		"./test-fixtures/test-dir/": "file1.txt",
+	}
+	for root, want := range cases {
+		zipfilepath := "archive-file-from.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveFileFrom("./test-fixtures/test-dir/file1.txt", root); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			want: []byte("This is file 1"),
+		})
+	}
+
+	archiver := NewZipArchiver("archive-file-from-outside.zip")
+	err := archiver.ArchiveFileFrom("./test-fixtures/test-file.txt", "./test-fixtures/test-dir")
+	if err == nil || !strings.Contains(err.Error(), "not inside root") {
+		t.Fatalf("expected error archiving a file outside of root, got %v", err)
+	}
+}
+
+func TestZipArchiver_OpenClose(t *testing.T) {
+	zipfilepath := "archive-open-close.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.AddContent([]byte("content"), "content.txt"); err == nil || !strings.Contains(err.Error(), "not open") {
+		t.Fatalf("expected error adding to an archive that isn't open, got %v", err)
+	}
+
+	if err := archiver.Open(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.Open(); err == nil || !strings.Contains(err.Error(), "already open") {
+		t.Fatalf("expected error opening an archive twice, got %v", err)
+	}
+	// Calls to the Archive methods while the archive is open take turns
+	// with the Add methods.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content, name := []byte(fmt.Sprintf("This is content %d", i)), fmt.Sprintf("content%d.txt", i)
+			if i%2 == 0 {
+				errs <- archiver.ArchiveContent(content, name)
+			} else {
+				errs <- archiver.AddContent(content, name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := archiver.AddFile("./test-fixtures/test-file.txt", "files/test-file.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.AddDir(context.Background(), "./test-fixtures/test-dir", ArchiveDirOptions{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// The convenience methods add to the open archive too.
+	if err := archiver.ArchiveContent([]byte("more"), "more.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatalf("unexpected error closing twice: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"content1.txt":        []byte("This is content 1"),
+		"content2.txt":        []byte("This is content 2"),
+		"content3.txt":        []byte("This is content 3"),
+		"content4.txt":        []byte("This is content 4"),
+		"files/test-file.txt": []byte("This is test content"),
+		"file1.txt":           []byte("This is file 1"),
+		"file2.txt":           []byte("This is file 2"),
+		"file3.txt":           []byte("This is file 3"),
+		"more.txt":            []byte("more"),
+	})
+	if got := len(archiver.Entries()); got != 9 {
+		t.Errorf("got %d entries, want 9", got)
+	}
+
+	// Once closed, every call writes an archive of its own again.
+	if err := archiver.ArchiveContent([]byte("alone"), "alone.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"alone.txt": []byte("alone"),
+	})
+}
+
+func TestZipArchiver_Output(t *testing.T) {
+	zipfilepath := "archive-output.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want, err := ioutil.ReadFile(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not read zip file: %s", err)
+	}
+	os.Remove(zipfilepath)
+
+	var output bytes.Buffer
+	archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true, Output: &output})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(output.Bytes(), want) {
+		t.Errorf("expected the archive written to the output to match the archive file")
+	}
+	if _, err := os.Stat(zipfilepath); !os.IsNotExist(err) {
+		t.Errorf("expected no archive file to be written")
+	}
+	if got := len(archiver.Entries()); got != 3 {
+		t.Errorf("got %d entries, want 3", got)
+	}
+
+	archiver.SetOptions(ArchiveOptions{Output: &output, Duplicates: DuplicatesOverwrite})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err == nil {
+		t.Errorf("expected error overwriting duplicates while writing to an output")
+	}
+}
+
+func TestZipArchiverWriter(t *testing.T) {
+	var buf bytes.Buffer
+	archiver := NewZipArchiverWriter(&buf)
+	if err := archiver.Open(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.AddContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.AddDir(context.Background(), "./test-fixtures/test-dir", ArchiveDirOptions{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("could not read zip output: %s", err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"content.txt", "file1.txt", "file2.txt", "file3.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %q, want %q", names, want)
+	}
+}
+
+func TestZipArchiver_StoreExtensions(t *testing.T) {
+	zipfilepath := "archive-store-extensions.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{StoreExtensions: []string{".png", "gz"}})
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"image.png":   []byte("This is an image"),
+		"IMAGE.PNG":   []byte("This is another image"),
+		"bundle.gz":   []byte("This is a bundle"),
+		"content.txt": []byte("This is some content"),
+		"png":         []byte("This has no extension"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r, err := zip.OpenReader(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+	want := map[string]uint16{
+		"image.png":   zip.Store,
+		"IMAGE.PNG":   zip.Store,
+		"bundle.gz":   zip.Store,
+		"content.txt": zip.Deflate,
+		"png":         zip.Deflate,
+	}
+	for _, f := range r.File {
+		if f.Method != want[f.Name] {
+			t.Errorf("%s: got method %d, want %d", f.Name, f.Method, want[f.Name])
+		}
+	}
+}
+
+func TestZipArchiver_OutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-output-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zipfilepath := filepath.Join(dir, "missing", "archive.zip")
+
+	archiver := NewZipArchiver(zipfilepath)
+	err = archiver.ArchiveFile("./test-fixtures/test-file.txt")
+	if err == nil || !strings.Contains(err.Error(), "output directory "+filepath.Dir(zipfilepath)+" does not exist") {
+		t.Fatalf("expected missing output directory error, got %v", err)
+	}
+
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{CreateOutputDir: true})
+	if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"test-file.txt": []byte("This is test content"),
+	})
+}
+
+func TestZipArchiver_FileAsSeparators(t *testing.T) {
+	zipfilepath := "archive-file-as-separators.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	// filepath.Join uses backslashes on Windows.
+	if err := archiver.ArchiveFileAs("./test-fixtures/test-file.txt", filepath.Join("sub", "dir", "test-file.txt")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"sub/dir/test-file.txt": []byte("This is test content"),
+	})
+}
+
+func TestZipArchiver_Files(t *testing.T) {
+	zipfilepath := "archive-files.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{Prefix: "app"})
+	if err := archiver.ArchiveFiles([]string{
+		"./test-fixtures/test-file.txt",
+		"./test-fixtures/test-dir/file2.txt",
+		"test-fixtures/test-dir/file1.txt",
+	}, "test-fixtures"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var names []string
+	for _, entry := range archiver.Entries() {
+		names = append(names, entry.Name)
+	}
+	if want := []string{"app/test-dir/file1.txt", "app/test-dir/file2.txt", "app/test-file.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"app/test-dir/file1.txt": []byte("This is file 1"),
+		"app/test-dir/file2.txt": []byte("This is file 2"),
+		"app/test-file.txt":      []byte("This is test content"),
+	})
+
+	if err := archiver.ArchiveFiles([]string{"./test-fixtures/test-file.txt"}, "./test-fixtures/test-dir"); err == nil || !strings.Contains(err.Error(), "not inside root") {
+		t.Errorf("expected error for a file outside of base, got %v", err)
+	}
+	if err := archiver.ArchiveFiles([]string{"./test-fixtures/test-dir"}, "."); err == nil || !strings.Contains(err.Error(), "directory") {
+		t.Errorf("expected error for a directory, got %v", err)
+	}
+	if err := archiver.ArchiveFiles([]string{"./test-fixtures/missing.txt"}, "."); err == nil || !strings.Contains(err.Error(), "missing file") {
+		t.Errorf("expected error for a missing file, got %v", err)
+	}
+}
+
+func TestZipArchiver_Dir(t *testing.T) {
+	zipfilepath := "archive-dir.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is file 2"),
+		"file3.txt": []byte("This is file 3"),
+	})
+}
+
+func TestZipArchiver_DirExcludes(t *testing.T) {
+	zipfilepath := "archive-dir-excludes.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirWithOptions("./test-fixtures/test-dir", ArchiveDirOptions{
+		Excludes: []string{"file2.txt"},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file3.txt": []byte("This is file 3"),
+	})
+}
+
+func TestZipArchiver_DirExcludesNested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-excludes")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"main.txt":          "main",
+		"logs/debug.log":    "debug",
+		"lib/lib.txt":       "lib",
+		"lib/.git/config":   "config",
+		"node_modules/a.js": "a",
+	} {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+
+	zipfilepath := "archive-dir-excludes-nested.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{
+		Excludes: []string{"**/.git/**", "**/*.log", "node_modules"},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Nested entries are stored with forward slashes on every platform.
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"main.txt":    []byte("main"),
+		"lib/lib.txt": []byte("lib"),
+	})
+}
+
+func TestZipArchiver_DirMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-max-file-size")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "small.txt"), "small")
+	writeTestFile(t, filepath.Join(dir, "exact.txt"), "0123456789")
+	writeTestFile(t, filepath.Join(dir, "fixtures", "large.bin"), strings.Repeat("x", 100))
+
+	for _, parallelism := range []int{0, 2} {
+		zipfilepath := "archive-dir-max-file-size.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{MaxFileSize: 10, Parallelism: parallelism}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"small.txt": []byte("small"),
+			"exact.txt": []byte("0123456789"),
+		})
+		if got, want := archiver.Skipped(), []SkippedFile{{Name: "fixtures/large.bin", Reason: SkippedTooLarge}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("parallelism %d: got skipped files %v, want %v", parallelism, got, want)
+		}
+
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Parallelism: parallelism}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := archiver.Skipped(); len(got) != 0 {
+			t.Errorf("parallelism %d: expected no skipped files without a limit, got %v", parallelism, got)
+		}
+	}
+}
+
+func TestZipArchiver_DirStripComponents(t *testing.T) {
+	dir := tempDir(t, "archive-dir-strip-components")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "a", "b", "c.txt"), "c")
+	writeTestFile(t, filepath.Join(dir, "a", "d.txt"), "d")
+
+	zipfilepath := "archive-dir-strip-components.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	opts := ArchiveDirOptions{StripComponents: 1, DirEntries: DirEntriesAll}
+	if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var names []string
+	for _, entry := range archiver.Entries() {
+		names = append(names, entry.Name)
+	}
+	if want := []string{"b/", "b/c.txt", "d.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+
+	opts.StripComponents = 2
+	err := archiver.ArchiveDirWithOptions(dir, opts)
+	if err == nil || !strings.Contains(err.Error(), "stripping 2 components from a/d.txt leaves no name") {
+		t.Errorf("expected error for a file with no name left, got %v", err)
+	}
+
+	opts = ArchiveDirOptions{StripComponents: 1, Flatten: true}
+	if err := archiver.ArchiveDirWithOptions(dir, opts); err == nil {
+		t.Errorf("expected error stripping components from flattened entries")
+	}
+}
+
+func TestZipArchiver_DirIncludeSourceDir(t *testing.T) {
+	dir := tempDir(t, "archive-dir-include-source-dir")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "dist")
+	writeTestFile(t, filepath.Join(src, "index.html"), "index")
+	writeTestFile(t, filepath.Join(src, "js", "app.js"), "app")
+
+	zipfilepath := "archive-dir-include-source-dir.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	opts := ArchiveDirOptions{IncludeSourceDir: true, DirEntries: DirEntriesAll}
+	if err := archiver.ArchiveDirWithOptions(src+string(filepath.Separator), opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var names []string
+	for _, entry := range archiver.Entries() {
+		names = append(names, entry.Name)
+	}
+	if want := []string{"dist/index.html", "dist/js/", "dist/js/app.js"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+
+	archiver.SetOptions(ArchiveOptions{Prefix: "www"})
+	opts = ArchiveDirOptions{IncludeSourceDir: true}
+	if err := archiver.ArchiveDirsContext(context.Background(), []ArchiveDirSource{{Path: src, Prefix: "site"}}, opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"www/site/dist/index.html": []byte("index"),
+		"www/site/dist/js/app.js":  []byte("app"),
+	})
+}
+
+func TestZipArchiver_DirExcludeSymlinkDirs(t *testing.T) {
+	dir := tempDir(t, "archive-dir-exclude-symlink-dirs")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "cache", "huge.bin"), "huge")
+	writeTestFile(t, filepath.Join(dir, "src", "main.txt"), "main")
+	if err := os.Symlink("../cache", filepath.Join(dir, "src", "vendor")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+	if err := os.Symlink("main.txt", filepath.Join(dir, "src", "link.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	zipfilepath := "archive-dir-exclude-symlink-dirs.zip"
+	for _, policy := range []string{SymlinkFollow, SymlinkStore} {
+		archiver := NewZipArchiver(zipfilepath)
+		opts := ArchiveDirOptions{Symlinks: policy, ExcludeSymlinkDirs: true}
+		if err := archiver.ArchiveDirWithOptions(filepath.Join(dir, "src"), opts); err != nil {
+			t.Fatalf("%s: unexpected error: %s", policy, err)
+		}
+		link := []byte("main")
+		if policy == SymlinkStore {
+			link = []byte("main.txt")
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"link.txt": link,
+			"main.txt": []byte("main"),
+		})
+		if got, want := archiver.Skipped(), []SkippedFile{{Name: "vendor/", Reason: SkippedSymlinkDir}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got skipped files %v, want %v", policy, got, want)
+		}
+	}
+
+	archiver := NewZipArchiver(zipfilepath)
+	opts := ArchiveDirOptions{FollowDirSymlinks: true, ExcludeSymlinkDirs: true}
+	if err := archiver.ArchiveDirWithOptions(filepath.Join(dir, "src"), opts); err == nil {
+		t.Errorf("expected error both following and excluding directory symlinks")
+	}
+}
+
+func TestZipArchiver_UTF8Names(t *testing.T) {
+	dir := tempDir(t, "archive-utf8-names")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "日本語.txt"), "日本語")
+	writeTestFile(t, filepath.Join(dir, "plain.txt"), "plain")
+
+	cases := []struct {
+		opts        ArchiveOptions
+		parallelism int
+	}{
+		{ArchiveOptions{}, 0},
+		{ArchiveOptions{}, 2},
+		{ArchiveOptions{ZipCreator: ZipCreatorInfoZipUnix}, 0},
+	}
+	zipfilepath := "archive-utf8-names.zip"
+	for _, tc := range cases {
+		for _, force := range []bool{false, true} {
+			archiver := NewZipArchiver(zipfilepath)
+			opts := tc.opts
+			opts.UTF8Names = force
+			archiver.SetOptions(opts)
+			if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Parallelism: tc.parallelism}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			r, err := zip.OpenReader(zipfilepath)
+			if err != nil {
+				t.Fatalf("could not open zip file: %s", err)
+			}
+			want := map[string]bool{"日本語.txt": true, "plain.txt": force}
+			for _, cf := range r.File {
+				if got := cf.Flags&0x800 != 0; got != want[cf.Name] {
+					t.Errorf("creator %#x, parallelism %d, force %t: got UTF-8 flag %t for %s, want %t", tc.opts.ZipCreator, tc.parallelism, force, got, cf.Name, want[cf.Name])
+				}
+			}
+			r.Close()
+		}
+	}
+}
+
+func TestZipArchiver_DirFlatten(t *testing.T) {
+	dir := tempDir(t, "archive-dir-flatten")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "a", "x.txt"), "x")
+	writeTestFile(t, filepath.Join(dir, "b", "c", "y.txt"), "y")
+	writeTestFile(t, filepath.Join(dir, "z.txt"), "z")
+
+	zipfilepath := "archive-dir-flatten.zip"
+	for _, parallelism := range []int{0, 2} {
+		archiver := NewZipArchiver(zipfilepath)
+		opts := ArchiveDirOptions{Flatten: true, DirEntries: DirEntriesAll, Parallelism: parallelism}
+		if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"x.txt": []byte("x"),
+			"y.txt": []byte("y"),
+			"z.txt": []byte("z"),
+		})
+	}
+
+	writeTestFile(t, filepath.Join(dir, "b", "x.txt"), "other x")
+	archiver := NewZipArchiver(zipfilepath)
+	err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Flatten: true})
+	if err == nil || !strings.Contains(err.Error(), "duplicate file path in archive: x.txt") {
+		t.Errorf("expected error for files flattened to the same name, got %v", err)
+	}
+
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{Duplicates: DuplicatesOverwrite})
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Flatten: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"x.txt": []byte("other x"),
+		"y.txt": []byte("y"),
+		"z.txt": []byte("z"),
+	})
+}
+
+func TestZipArchiver_Verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-verify")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "file1.txt"), "This is file 1")
+	writeTestFile(t, filepath.Join(dir, "nested", "file2.txt"), "This is file 2")
+
+	for _, parallelism := range []int{0, 2} {
+		zipfilepath := "archive-dir-verify.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{Verify: true})
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Parallelism: parallelism}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"file1.txt":        []byte("This is file 1"),
+			"nested/file2.txt": []byte("This is file 2"),
+		})
+	}
+}
+
+func TestZipArchiver_DirSkipHidden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-skip-hidden")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"index.html":                 "index",
+		".htaccess":                  "htaccess",
+		".DS_Store":                  "store",
+		".git/config":                "config",
+		"lib/.env":                   "env",
+		"lib/main.js":                "main",
+		".well-known/security.txt":   "security",
+		".well-known/.hidden/ignore": "ignore",
+	} {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+
+	for _, parallelism := range []int{0, 2} {
+		zipfilepath := "archive-dir-skip-hidden.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{SkipHidden: true, Parallelism: parallelism}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"index.html":  []byte("index"),
+			"lib/main.js": []byte("main"),
+		})
+
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{
+			SkipHidden:  true,
+			Includes:    []string{"**", ".htaccess", "**/.env", ".well-known/**"},
+			SortEntries: true,
+			Parallelism: parallelism,
+		}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"index.html":               []byte("index"),
+			".htaccess":                []byte("htaccess"),
+			"lib/.env":                 []byte("env"),
+			"lib/main.js":              []byte("main"),
+			".well-known/security.txt": []byte("security"),
+		})
+	}
+}
+
+func TestZipArchiver_DirIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-includes")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"main.py":              "main",
+		"requirements.txt":     "requests",
+		"README.md":            "readme",
+		"lib/util.py":          "util",
+		"lib/requirements.txt": "nested",
+		"tests/test_main.py":   "test",
+	} {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+
+	zipfilepath := "archive-dir-includes.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{
+		Includes:    []string{"**/*.py", "requirements.txt"},
+		Excludes:    []string{"tests"},
+		SortEntries: true,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"main.py":          []byte("main"),
+		"requirements.txt": []byte("requests"),
+		"lib/util.py":      []byte("util"),
+	})
+	var names []string
+	for _, entry := range archiver.Entries() {
+		names = append(names, entry.Name)
+	}
+	if want := []string{"lib/util.py", "main.py", "requirements.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got entries %q, want %q", names, want)
+	}
+
+	archiver = NewZipArchiver("archive-dir-includes-invalid.zip")
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{
+		Includes: []string{"[file"},
+	}); err == nil {
+		t.Fatalf("expected error for malformed include pattern")
+	}
+}
+
+func TestZipArchiver_DirOutputInside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-output-inside")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "file.txt"), "file")
+
+	for _, zipfilepath := range []string{
+		filepath.Join(dir, "archive.zip"),
+		filepath.Join(dir, "missing", "archive.zip"),
+		filepath.Join(dir, "..", filepath.Base(dir), "archive.zip"),
+	} {
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{CreateOutputDir: true})
+		err := archiver.ArchiveDir(dir)
+		if err == nil || !strings.Contains(err.Error(), "is inside source directory") {
+			t.Errorf("%s: expected error writing the archive inside the source directory, got %v", zipfilepath, err)
+		}
+		if _, err := os.Stat(zipfilepath); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no archive to be written", zipfilepath)
+		}
+	}
+}
+
+func TestZipArchiver_DirIgnoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-ignore-file")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		".archiveignore":      "node_modules/\n*.log\n",
+		"main.js":             "main",
+		"debug.log":           "debug",
+		"node_modules/a/a.js": "a",
+		"lib/.archiveignore":  "!important.log\n",
+		"lib/lib.js":          "lib",
+		"lib/important.log":   "important",
+	} {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+
+	for _, sortEntries := range []bool{false, true} {
+		zipfilepath := "archive-dir-ignore-file.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{
+			IgnoreFile:  ".archiveignore",
+			SortEntries: sortEntries,
+		}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			".archiveignore":     []byte("node_modules/\n*.log\n"),
+			"main.js":            []byte("main"),
+			"lib/.archiveignore": []byte("!important.log\n"),
+			"lib/lib.js":         []byte("lib"),
+			"lib/important.log":  []byte("important"),
+		})
+	}
+}
+
+func TestZipArchiver_DirSkipMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-skip-missing")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The file is removed after the walk found it, but before it is read.
+	path := filepath.Join(dir, "removed.txt")
+	writeTestFile(t, path, "removed")
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("could not stat file: %s", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("could not remove file: %s", err)
+	}
+
+	for _, parallelism := range []int{1, 2} {
+		for _, skip := range []bool{false, true} {
+			archiver := &ZipArchiver{filepath: "archive-dir-skip-missing.zip"}
+			held, err := archiver.open(false)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fn := archiver.walkFunc(context.Background(), ArchiveDirSource{Path: dir}, ArchiveDirOptions{
+				SkipMissing: skip,
+				Parallelism: parallelism,
+			})
+			err = fn(path, info, nil)
+			if err == nil {
+				err = archiver.flushPending()
+			}
+			if err == nil {
+				// Walking reports the file as missing if it is removed
+				// before it is found.
+				err = fn(path, nil, os.ErrNotExist)
+			}
+			err = archiver.close(held, err)
+			if skip && err != nil {
+				t.Errorf("parallelism %d: unexpected error skipping a removed file: %s", parallelism, err)
+			}
+			if !skip && err == nil {
+				t.Errorf("parallelism %d: expected error for a removed file", parallelism)
+			}
+			if skip && len(archiver.Entries()) != 0 {
+				t.Errorf("parallelism %d: expected no entries, got %v", parallelism, archiver.Entries())
+			}
+		}
+	}
+}
+
+func TestZipArchiver_DirExcludesInvalid(t *testing.T) {
+	archiver := NewZipArchiver("archive-dir-excludes-invalid.zip")
+	if err := archiver.ArchiveDirWithOptions("./test-fixtures/test-dir", ArchiveDirOptions{
+		Excludes: []string{"[file"},
+	}); err == nil {
+		t.Fatalf("expected error for malformed exclude pattern")
+	}
+}
+
+func TestZipArchiver_DirSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "archive-dir-symlinks")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "file.txt"), "This is a file")
+	if err := os.Symlink("file.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	cases := map[string]map[string][]byte{
+		SymlinkFollow: {
+			"file.txt": []byte("This is a file"),
+			"link.txt": []byte("This is a file"),
+		},
+		SymlinkStore: {
+			"file.txt": []byte("This is a file"),
+			"link.txt": []byte("file.txt"),
+		},
+		SymlinkSkip: {
+			"file.txt": []byte("This is a file"),
+		},
+	}
+	for policy, wants := range cases {
+		zipfilepath := fmt.Sprintf("archive-dir-symlinks-%s.zip", policy)
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Symlinks: policy}); err != nil {
+			t.Fatalf("unexpected error for %s: %s", policy, err)
+		}
+
+		ensureContents(t, zipfilepath, wants)
+		switch policy {
+		case SymlinkFollow:
+			ensureFileMode(t, zipfilepath, "link.txt", 0644)
+		case SymlinkStore:
+			ensureFileMode(t, zipfilepath, "link.txt", os.ModeSymlink|0777)
+		}
+	}
+}
+
+func TestZipArchiver_DirSymlinkToDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "archive-dir-symlink-to-dir")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "sub", "file.txt"), "This is a file")
+	if err := os.Symlink("sub", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	archiver := NewZipArchiver("archive-dir-symlink-to-dir.zip")
+	if err := archiver.ArchiveDir(dir); err == nil {
+		t.Fatalf("expected error following symlink to directory")
+	}
+}
+
+func TestZipArchiver_DirFollowDirSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "archive-dir-follow-dir-symlinks")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "releases", "v5", "app.txt"), "v5")
+	if err := os.Symlink(filepath.Join("releases", "v5"), filepath.Join(dir, "current")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	zipfilepath := "archive-dir-follow-dir-symlinks.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{FollowDirSymlinks: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"current/app.txt":     []byte("v5"),
+		"releases/v5/app.txt": []byte("v5"),
+	})
+}
+
+func TestZipArchiver_DirFollowDirSymlinksCycle(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "archive-dir-follow-dir-symlinks-cycle")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A link to an ancestor, and a pair of links to each other's
+	// directories, would both be walked forever.
+	writeTestFile(t, filepath.Join(dir, "a", "file.txt"), "a")
+	writeTestFile(t, filepath.Join(dir, "b", "file.txt"), "b")
+	links := map[string]map[string]string{
+		"ancestor": {filepath.Join("a", "up"): ".."},
+		"mutual": {
+			filepath.Join("a", "to-b"): filepath.Join("..", "b"),
+			filepath.Join("b", "to-a"): filepath.Join("..", "a"),
+		},
+	}
+	for name, symlinks := range links {
+		for link, target := range symlinks {
+			if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+				t.Fatalf("could not create symlink: %s", err)
+			}
+		}
+
+		archiver := NewZipArchiver("archive-dir-follow-dir-symlinks-cycle.zip")
+		err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{FollowDirSymlinks: true})
+		if err == nil || !strings.Contains(err.Error(), "symlink cycle") {
+			t.Errorf("%s: expected symlink cycle error, got %v", name, err)
+		}
+
+		for link := range symlinks {
+			os.Remove(filepath.Join(dir, link))
+		}
+	}
+}
+
+func TestZipArchiver_DirFollowDirSymlinksPolicy(t *testing.T) {
+	archiver := NewZipArchiver("archive-dir-follow-dir-symlinks-policy.zip")
+	opts := ArchiveDirOptions{Symlinks: SymlinkStore, FollowDirSymlinks: true}
+	if err := archiver.ArchiveDirWithOptions("./test-fixtures/test-dir", opts); err == nil {
+		t.Fatalf("expected error following directory symlinks without the follow policy")
+	}
+}
+
+func TestZipArchiver_DirSortEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-sort-entries")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A directory is walked before a sibling whose name only continues
+	// past the directory's name, but its entries sort after it.
+	for _, name := range []string{"B.txt", "a.txt", "lib/x.txt", "lib-b.txt", "lib/A/y.txt"} {
+		writeTestFile(t, filepath.Join(dir, filepath.FromSlash(name)), name)
+	}
+
+	for _, tc := range []struct {
+		opts ArchiveDirOptions
+		want []string
+	}{
+		{
+			ArchiveDirOptions{},
+			[]string{"B.txt", "a.txt", "lib/A/y.txt", "lib/x.txt", "lib-b.txt"},
+		},
+		{
+			ArchiveDirOptions{SortEntries: true},
+			[]string{"B.txt", "a.txt", "lib-b.txt", "lib/A/y.txt", "lib/x.txt"},
+		},
+		{
+			ArchiveDirOptions{SortEntries: true, DirEntries: DirEntriesAll, Excludes: []string{"lib/A"}},
+			[]string{"B.txt", "a.txt", "lib-b.txt", "lib/", "lib/x.txt"},
+		},
+	} {
+		zipfilepath := "archive-dir-sort-entries.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveDirWithOptions(dir, tc.opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := zipEntryNames(t, zipfilepath); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: got entries %q, want %q", tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestZipArchiver_DirRequireFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-require-files")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "lib", "debug.log"), "debug")
+
+	zipfilepath := "archive-dir-require-files.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	opts := ArchiveDirOptions{Excludes: []string{"**/*.log"}, DirEntries: DirEntriesAll}
+	if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	opts.RequireFiles = true
+	err = archiver.ArchiveDirWithOptions(dir, opts)
+	if err == nil || !strings.Contains(err.Error(), "no files found") {
+		t.Fatalf("expected no files found error, got %v", err)
+	}
+
+	opts.Excludes = nil
+	if err := archiver.ArchiveDirWithOptions(dir, opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestZipArchiver_FileMode(t *testing.T) {
+	// The same files checked out with different umasks give the same
+	// archive.
+	dirs := map[os.FileMode]string{}
+	for _, mode := range []os.FileMode{0664, 0600} {
+		dir := tempDir(t, "archive-file-mode")
+		defer os.RemoveAll(dir)
+		for _, name := range []string{"a.txt", filepath.Join("lib", "b.txt")} {
+			writeTestFile(t, filepath.Join(dir, name), name)
+			if err := os.Chmod(filepath.Join(dir, name), mode); err != nil {
+				t.Fatalf("could not chmod file: %s", err)
+			}
+		}
+		dirs[mode] = dir
+	}
+
+	for _, parallelism := range []int{0, 2} {
+		var outputs [][]byte
+		for _, mode := range []os.FileMode{0664, 0600} {
+			zipfilepath := fmt.Sprintf("archive-file-mode-%o.zip", mode)
+			archiver := NewZipArchiver(zipfilepath)
+			archiver.SetOptions(ArchiveOptions{FileMode: 0644, NormalizeTimestamps: true})
+			if err := archiver.ArchiveDirWithOptions(dirs[mode], ArchiveDirOptions{Parallelism: parallelism}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			ensureFileMode(t, zipfilepath, "a.txt", 0644)
+			ensureFileMode(t, zipfilepath, "lib/b.txt", 0644)
+			b, err := ioutil.ReadFile(zipfilepath)
+			if err != nil {
+				t.Fatalf("could not read archive: %s", err)
+			}
+			outputs = append(outputs, b)
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("parallelism %d: expected identical output whatever the modes of the files", parallelism)
+		}
+	}
+
+	zipfilepath := "archive-file-mode-content.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{FileMode: 0644})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureFileMode(t, zipfilepath, "content.txt", 0644)
+
+	// A mode given with the content is kept.
+	os.Remove(zipfilepath)
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{FileMode: 0644})
+	if err := archiver.ArchiveContentMode([]byte("#!/bin/sh"), "bootstrap", 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureFileMode(t, zipfilepath, "bootstrap", 0755)
+}
+
+func TestZipArchiver_DirEntryMode(t *testing.T) {
+	dir := tempDir(t, "archive-dir-entry-mode")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"cache", "private"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatalf("could not create directory: %s", err)
+		}
+	}
+
+	zipfilepath := "archive-dir-entry-mode.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DirEntries: DirEntriesAll}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureFileMode(t, zipfilepath, "cache/", os.ModeDir|0755)
+	ensureFileMode(t, zipfilepath, "private/", os.ModeDir|0755)
+
+	archiver.SetOptions(ArchiveOptions{DirMode: 0775})
+	if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DirEntries: DirEntriesAll}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureFileMode(t, zipfilepath, "cache/", os.ModeDir|0775)
+	ensureFileMode(t, zipfilepath, "private/", os.ModeDir|0775)
+}
+
+func TestZipArchiver_DirEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-entries")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "lib", "lib.txt"), "lib")
+	for _, name := range []string{"cache", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("could not create directory: %s", err)
+		}
+	}
+
+	cases := map[string][]string{
+		DirEntriesNone:  {"lib/lib.txt"},
+		DirEntriesEmpty: {"cache/", "lib/lib.txt", "tmp/"},
+		DirEntriesAll:   {"cache/", "lib/", "lib/lib.txt", "tmp/"},
+	}
+	for policy, wants := range cases {
+		zipfilepath := fmt.Sprintf("archive-dir-entries-%s.zip", policy)
+		archiver := NewZipArchiver(zipfilepath)
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DirEntries: policy}); err != nil {
+			t.Fatalf("unexpected error for %s: %s", policy, err)
+		}
+
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		var got []string
+		for _, cf := range r.File {
+			got = append(got, cf.Name)
+			if strings.HasSuffix(cf.Name, "/") && !cf.Mode().IsDir() {
+				t.Errorf("expected directory mode for %s, got %s", cf.Name, cf.Mode())
+			}
+		}
+		r.Close()
+
+		if !reflect.DeepEqual(got, wants) {
+			t.Errorf("mismatched entries for %s\ngot  %q\nwant %q", policy, got, wants)
+		}
+	}
+}
+
+func TestZipArchiver_Dirs(t *testing.T) {
+	zipfilepath := "archive-dirs.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirsContext(context.Background(), []ArchiveDirSource{
+		{Path: "./test-fixtures/test-dir", Prefix: "b"},
+		{Path: "./test-fixtures/test-dir", Prefix: "a/"},
+	}, ArchiveDirOptions{Excludes: []string{"file3.txt"}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"a/file1.txt": []byte("This is file 1"),
+		"a/file2.txt": []byte("This is file 2"),
+		"b/file1.txt": []byte("This is file 1"),
+		"b/file2.txt": []byte("This is file 2"),
+	})
+
+	r, err := zip.OpenReader(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+	if got := r.File[0].Name; got != "a/file1.txt" {
+		t.Errorf("expected sources to be archived in prefix order, got %s first", got)
+	}
+}
+
+func TestZipArchiver_DirsDuplicate(t *testing.T) {
+	zipfilepath := "archive-dirs-duplicate.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	err := archiver.ArchiveDirsContext(context.Background(), []ArchiveDirSource{
+		{Path: "./test-fixtures/test-dir"},
+		{Path: "./test-fixtures/test-dir"},
+	}, ArchiveDirOptions{})
+	if err == nil || !strings.Contains(err.Error(), "duplicate file path") {
+		t.Fatalf("expected duplicate file path error, got %v", err)
+	}
+}
+
+func TestZipArchiver_DirWalkError(t *testing.T) {
+	fi, err := os.Stat("./test-fixtures/test-dir")
+	if err != nil {
+		t.Fatalf("could not stat directory: %s", err)
+	}
+
+	archiver := NewZipArchiver("archive-dir-walk-error.zip").(*ZipArchiver)
+	walkFn := archiver.walkFunc(context.Background(), ArchiveDirSource{Path: "./test-fixtures"}, ArchiveDirOptions{})
+	walkErr := errors.New("permission denied")
+	for _, info := range []os.FileInfo{nil, fi} {
+		if err := walkFn("./test-fixtures/test-dir", info, walkErr); err != walkErr {
+			t.Errorf("expected walk error to be returned, got %v", err)
+		}
+	}
+}
+
+func TestZipArchiver_DirParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-parallel")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wants := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("dir%d/file%02d.txt", i%3, i)
+		content := strings.Repeat(fmt.Sprintf("This is file %d\n", i), i*100)
+		writeTestFile(t, filepath.Join(dir, filepath.FromSlash(name)), content)
+		wants[name] = []byte(content)
+	}
+
+	serialpath := "archive-dir-serial.zip"
+	if err := NewZipArchiver(serialpath).ArchiveDir(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var outputs [][]byte
+	for _, zipfilepath := range []string{"archive-dir-parallel-1.zip", "archive-dir-parallel-2.zip"} {
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true})
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Parallelism: 4}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, wants)
+		if got, want := zipEntryNames(t, zipfilepath), zipEntryNames(t, serialpath); !reflect.DeepEqual(got, want) {
+			t.Errorf("mismatched entry order, got %v, want %v", got, want)
+		}
+
+		b, err := ioutil.ReadFile(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not read zip file: %s", err)
+		}
+		outputs = append(outputs, b)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("expected identical output for identical input")
+	}
+}
+
+func TestZipArchiver_Prefix(t *testing.T) {
+	for i, prefix := range []string{"python", "python/", "/python/", `python\`} {
+		zipfilepath := fmt.Sprintf("archive-prefix-%d.zip", i)
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{Prefix: prefix})
+		if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"python/file1.txt": []byte("This is file 1"),
+			"python/file2.txt": []byte("This is file 2"),
+			"python/file3.txt": []byte("This is file 3"),
+		})
+	}
+
+	zipfilepath := "archive-prefix-content.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{Prefix: "nodejs"})
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"index.js":         []byte("index"),
+		"lib/helper.js":    []byte("helper"),
+		"./lib/handler.js": []byte("handler"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"nodejs/index.js":       []byte("index"),
+		"nodejs/lib/helper.js":  []byte("helper"),
+		"nodejs/lib/handler.js": []byte("handler"),
+	})
+
+	if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"nodejs/test-file.txt": []byte("This is test content"),
+	})
+}
+
+func TestZipArchiver_PrefixTraversal(t *testing.T) {
+	archiver := NewZipArchiver("archive-prefix-traversal.zip")
+	archiver.SetOptions(ArchiveOptions{Prefix: "../python"})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err == nil {
+		t.Fatalf("expected error for prefix outside of the archive")
+	}
+}
+
+func TestZipArchiver_Entries(t *testing.T) {
+	want := wantDirEntries(t, "./test-fixtures/test-dir")
+	for _, parallelism := range []int{1, 4} {
+		zipfilepath := fmt.Sprintf("archive-entries-%d.zip", parallelism)
+		archiver := NewZipArchiver(zipfilepath)
+		opts := ArchiveDirOptions{Parallelism: parallelism}
+		if err := archiver.ArchiveDirWithOptions("./test-fixtures/test-dir", opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := archiver.Entries(); !reflect.DeepEqual(got, want) {
+			t.Errorf("parallelism %d: got entries %v, want %v", parallelism, got, want)
+		}
+	}
+}
+
+// wantDirEntries returns the entries archiving the flat directory dir is
+// expected to produce.
+func wantDirEntries(t *testing.T, dir string) []ArchiveEntry {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not read directory: %s", err)
+	}
+	var entries []ArchiveEntry
+	for _, info := range infos {
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatalf("could not read file: %s", err)
+		}
+		sum := md5.Sum(content)
+		sha := sha256.Sum256(content)
+		entries = append(entries, ArchiveEntry{
+			Name:     info.Name(),
+			Size:     info.Size(),
+			Mode:     info.Mode(),
+			Modified: info.ModTime().UTC(),
+			CRC32:    crc32.ChecksumIEEE(content),
+			MD5:      sum[:],
+			SHA256:   sha[:],
+		})
+	}
+	return entries
+}
+
+func TestZipArchiver_DirContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	zipfilepath := "archive-dir-cancelled.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDirContext(ctx, "./test-fixtures/test-dir", ArchiveDirOptions{}); err != context.Canceled {
+		t.Fatalf("expected %s, got %v", context.Canceled, err)
+	}
+	if _, err := os.Stat(zipfilepath); !os.IsNotExist(err) {
+		t.Errorf("expected partial archive to be removed, got %v", err)
+	}
+}
+
+func TestZipArchiver_DirMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file mode bits are not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "archive-dir-mode")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bootstrap := filepath.Join(dir, "bootstrap")
+	if err := ioutil.WriteFile(bootstrap, []byte("#!/bin/sh"), 0755); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+	if err := os.Chmod(bootstrap, 0755); err != nil {
+		t.Fatalf("could not chmod file: %s", err)
+	}
+
+	zipfilepath := "archive-dir-mode.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDir(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ensureFileMode(t, zipfilepath, "bootstrap", 0755)
+}
+
+func TestZipArchiver_ModTime(t *testing.T) {
+	modTime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, parallelism := range []int{1, 2} {
+		zipfilepath := fmt.Sprintf("archive-mod-time-%d.zip", parallelism)
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{ModTime: modTime})
+		opts := ArchiveDirOptions{Parallelism: parallelism}
+		if err := archiver.ArchiveDirWithOptions("./test-fixtures/test-dir", opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		for _, cf := range r.File {
+			if !cf.Modified.Equal(modTime) {
+				t.Errorf("parallelism %d: mismatched modification time for %s, got %s, want %s", parallelism, cf.Name, cf.Modified, modTime)
+			}
+		}
+		r.Close()
+	}
+
+	archiver := NewZipArchiver("archive-mod-time-invalid.zip")
+	for _, opts := range []ArchiveOptions{
+		{ModTime: time.Date(1979, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{ModTime: time.Date(2108, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ModTime: modTime, NormalizeTimestamps: true},
+	} {
+		archiver.SetOptions(opts)
+		if err := archiver.ArchiveFile("./test-fixtures/test-file.txt"); err == nil {
+			t.Errorf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestZipArchiver_NormalizeTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-normalize-timestamps")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file1.txt")
+	if err := ioutil.WriteFile(file, []byte("This is file 1"), 0644); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	var outputs [][]byte
+	for i, mtime := range []time.Time{time.Now(), time.Now().Add(-24 * time.Hour)} {
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatalf("could not change file times: %s", err)
+		}
+
+		zipfilepath := fmt.Sprintf("archive-normalize-timestamps-%d.zip", i)
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{NormalizeTimestamps: true})
+		if err := archiver.ArchiveDir(dir); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		for _, cf := range r.File {
+			if !cf.Modified.Equal(normalizedModTime) {
+				t.Errorf("mismatched modification time for %s, got %s, want %s", cf.Name, cf.Modified, normalizedModTime)
+			}
+		}
+		r.Close()
+
+		b, err := ioutil.ReadFile(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not read zip file: %s", err)
+		}
+		outputs = append(outputs, b)
+	}
+
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("expected identical output for files with different modification times")
+	}
+}
+
+func TestZipArchiver_CompressionLevel(t *testing.T) {
+	content := map[string][]byte{
+		"file1.txt": bytes.Repeat([]byte("This is file 1"), 100),
+		"file2.txt": bytes.Repeat([]byte("This is file 2"), 100),
+	}
+
+	for _, level := range []int{NoCompression, DefaultCompression, 1, 9} {
+		zipfilepath := fmt.Sprintf("archive-compression-level-%d.zip", level)
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{CompressionLevel: level})
+		if err := archiver.ArchiveMultiple(content); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		ensureContents(t, zipfilepath, content)
+
+		wantMethod := zip.Deflate
+		if level == NoCompression {
+			wantMethod = zip.Store
+		}
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		for _, cf := range r.File {
+			if cf.Method != wantMethod {
+				t.Errorf("mismatched method for %s at level %d, got %d, want %d", cf.Name, level, cf.Method, wantMethod)
+			}
+		}
+		r.Close()
+	}
+}
+
+func TestZipArchiver_Comment(t *testing.T) {
+	zipfilepath := "archive-comment.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{Comment: "build 1234"})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r, err := zip.OpenReader(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+	if r.Comment != "build 1234" {
+		t.Errorf("mismatched comment, got %q, want %q", r.Comment, "build 1234")
+	}
+}
+
+func TestZipArchiver_CommentTooLong(t *testing.T) {
+	archiver := NewZipArchiver("archive-comment-too-long.zip")
+	archiver.SetOptions(ArchiveOptions{Comment: strings.Repeat("x", 1<<16)})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err == nil {
+		t.Fatalf("expected error for comment longer than a zip file allows")
+	}
+}
+
+func TestZipArchiver_BaseArchive(t *testing.T) {
+	zipfilepath := "archive-base.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{BaseArchive: zipfilepath})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string][]byte{
+		"file1.txt":   []byte("This is file 1"),
+		"file2.txt":   []byte("This is file 2"),
+		"file3.txt":   []byte("This is file 3"),
+		"content.txt": []byte("This is some content"),
+	}
+	ensureContents(t, zipfilepath, want)
+
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{BaseArchive: zipfilepath})
+	err := archiver.ArchiveContent([]byte("This is new content"), "file1.txt")
+	if err == nil || !strings.Contains(err.Error(), "duplicate file path") {
+		t.Fatalf("expected duplicate file path error, got %v", err)
+	}
+	ensureContents(t, zipfilepath, want)
+}
+
+func TestZipArchiver_BaseArchiveZstd(t *testing.T) {
+	basefilepath := "archive-base-zstd.zip"
+	archiver := NewZipArchiver(basefilepath)
+	archiver.SetOptions(ArchiveOptions{Compression: CompressionZstd})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
+	zipfilepath := "archive-base-zstd-copy.zip"
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{BaseArchive: basefilepath, Compression: CompressionZstd})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 	ensureContents(t, zipfilepath, map[string][]byte{
-		"test-file.txt": []byte("This is test content"),
+		"file1.txt":   []byte("This is file 1"),
+		"file2.txt":   []byte("This is file 2"),
+		"file3.txt":   []byte("This is file 3"),
+		"content.txt": []byte("This is some content"),
+	})
+
+	// Base entries are copied as they are compressed, whatever the
+	// compression of the new archive.
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{BaseArchive: basefilepath})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r, err := openZip(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		want := zipZstd
+		if f.Name == "content.txt" {
+			want = zip.Deflate
+		}
+		if f.Method != want {
+			t.Errorf("expected %s to be compressed with method %d, got %d", f.Name, want, f.Method)
+		}
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"file1.txt":   []byte("This is file 1"),
+		"file2.txt":   []byte("This is file 2"),
+		"file3.txt":   []byte("This is file 3"),
+		"content.txt": []byte("This is some content"),
 	})
 }
 
-func TestZipArchiver_Dir(t *testing.T) {
-	zipfilepath := "archive-dir.zip"
-	archiver := NewZipArchiver(zipfilepath)
+func TestZipArchiver_DuplicatesOverwrite(t *testing.T) {
+	basefilepath := "archive-duplicates-base.zip"
+	archiver := NewZipArchiver(basefilepath)
 	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
+	zipfilepath := "archive-duplicates-overwrite.zip"
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{BaseArchive: basefilepath, Duplicates: DuplicatesOverwrite})
+	if err := archiver.ArchiveContent([]byte("This is new content"), "file2.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"file1.txt": []byte("This is file 1"),
+		"file2.txt": []byte("This is new content"),
+		"file3.txt": []byte("This is file 3"),
+	})
+	wantNames := []string{"file1.txt", "file3.txt", "file2.txt"}
+	if got := zipEntryNames(t, zipfilepath); !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("got entries %q, want %q", got, wantNames)
+	}
+	var gotNames []string
+	for _, entry := range archiver.Entries() {
+		gotNames = append(gotNames, entry.Name)
+	}
+	if !reflect.DeepEqual(gotNames, wantNames) {
+		t.Errorf("got manifest %q, want %q", gotNames, wantNames)
+	}
+
+	// Names that only match once sanitized keep the last original name.
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"./index.js": []byte("first"),
+		"index.js":   []byte("last"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 	ensureContents(t, zipfilepath, map[string][]byte{
 		"file1.txt": []byte("This is file 1"),
 		"file2.txt": []byte("This is file 2"),
 		"file3.txt": []byte("This is file 3"),
+		"index.js":  []byte("last"),
+	})
+
+	archiver.SetOptions(ArchiveOptions{Duplicates: "ignore"})
+	if err := archiver.ArchiveContent([]byte("content"), "content.txt"); err == nil {
+		t.Fatalf("expected error for invalid duplicate name policy")
+	}
+}
+
+func TestZipArchiver_CaseInsensitiveCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-case-check")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "a", "README.md"), "This is the readme")
+	writeTestFile(t, filepath.Join(dir, "b", "readme.MD"), "This is another readme")
+
+	zipfilepath := "archive-case-check.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{CaseInsensitiveCheck: CaseCheckError})
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"README.md": []byte("This is the readme"),
+		"readme.md": []byte("This is another readme"),
+	}); err == nil || !strings.Contains(err.Error(), "README.md and readme.md") {
+		t.Errorf("expected case error, got %v", err)
+	}
+
+	err = archiver.ArchiveDirsContext(context.Background(), []ArchiveDirSource{
+		{Path: filepath.Join(dir, "a")},
+		{Path: filepath.Join(dir, "b")},
+	}, ArchiveDirOptions{})
+	if err == nil || !strings.Contains(err.Error(), "differ only in case") {
+		t.Errorf("expected case error merging sources, got %v", err)
+	}
+
+	archiver.SetOptions(ArchiveOptions{CaseInsensitiveCheck: CaseCheckWarn})
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"README.md": []byte("This is the readme"),
+		"readme.md": []byte("This is another readme"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"README.md": []byte("This is the readme"),
+		"readme.md": []byte("This is another readme"),
+	})
+
+	archiver.SetOptions(ArchiveOptions{CaseInsensitiveCheck: "ignore"})
+	if err := archiver.ArchiveContent([]byte("content"), "content.txt"); err == nil {
+		t.Fatalf("expected error for invalid case insensitive check")
+	}
+}
+
+// TestZipArchiver_ZipCreator compares an archive written with
+// ZipCreatorInfoZipUnix to one written from the same files by Info-ZIP's
+// zip 3.0 with zip -X -0 -r on Unix, in UTC.
+func TestArchiveDirInto(t *testing.T) {
+	for _, options := range []ArchiveOptions{
+		{Prefix: "app"},
+		{Prefix: "app", ZipCreator: ZipCreatorInfoZipUnix},
+		{Prefix: "app", CompressionLevel: 9},
+	} {
+		zipfilepath := "archive-dir-into.zip"
+		f, err := os.Create(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not create archive: %s", err)
+		}
+		w := zip.NewWriter(f)
+		// The caller's own entries go around those of the directory.
+		if fw, err := w.Create("before.txt"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		} else {
+			fw.Write([]byte("before"))
+		}
+		entries, skipped, err := ArchiveDirInto(context.Background(), w, "./test-fixtures/test-dir", ArchiveDirOptions{Excludes: []string{"file3.txt"}}, options)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if fw, err := w.Create("after.txt"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		} else {
+			fw.Write([]byte("after"))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		f.Close()
+
+		if len(entries) != 2 || entries[0].Name != "app/file1.txt" || entries[1].Name != "app/file2.txt" {
+			t.Errorf("expected the entries written to be returned, got %+v", entries)
+		}
+		if len(skipped) != 1 || skipped[0].Name != "app/file3.txt" {
+			t.Errorf("expected the skipped files to be returned, got %+v", skipped)
+		}
+		ensureContents(t, zipfilepath, map[string][]byte{
+			"before.txt":    []byte("before"),
+			"app/file1.txt": []byte("This is file 1"),
+			"app/file2.txt": []byte("This is file 2"),
+			"after.txt":     []byte("after"),
+		})
+		os.Remove(zipfilepath)
+	}
+
+	w := zip.NewWriter(ioutil.Discard)
+	for _, options := range []ArchiveOptions{{Comment: "comment"}, {SortEntries: true}, {Verify: true}} {
+		if _, _, err := ArchiveDirInto(context.Background(), w, "./test-fixtures/test-dir", ArchiveDirOptions{}, options); err == nil {
+			t.Errorf("expected error for options %+v, which need the whole archive", options)
+		}
+	}
+}
+
+func TestZipArchiver_DataDescriptors(t *testing.T) {
+	dir := tempDir(t, "archive-data-descriptors")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "index.js"), strings.Repeat("index ", 100))
+	writeTestFile(t, filepath.Join(dir, "lib", "util.js"), "util")
+	want := map[string][]byte{
+		"index.js":    []byte(strings.Repeat("index ", 100)),
+		"lib/":        {},
+		"lib/util.js": []byte("util"),
+	}
+
+	cases := []struct {
+		options     ArchiveOptions
+		parallelism int
+		// descriptors is whether file entries are written with a data
+		// descriptor.
+		descriptors bool
+	}{
+		{ArchiveOptions{}, 0, true},
+		{ArchiveOptions{}, 2, false},
+		{ArchiveOptions{ZipCreator: ZipCreatorInfoZipUnix}, 0, false},
+		{ArchiveOptions{ZipDataDescriptors: true}, 0, true},
+		{ArchiveOptions{ZipDataDescriptors: true}, 2, true},
+		{ArchiveOptions{ZipDataDescriptors: true, ZipCreator: ZipCreatorInfoZipUnix}, 0, true},
+	}
+	for i, tc := range cases {
+		zipfilepath := "archive-data-descriptors.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(tc.options)
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DirEntries: DirEntriesAll, Parallelism: tc.parallelism}); err != nil {
+			t.Fatalf("case %d: unexpected error: %s", i, err)
+		}
+		b, err := ioutil.ReadFile(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not read zip file: %s", err)
+		}
+		// Either way the archive can be extracted as it is read, without
+		// its central directory.
+		got, descriptors := readZipStream(t, b)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("case %d: got streamed entries %q, want %q", i, got, want)
+		}
+		for name, descriptor := range descriptors {
+			if isDir := strings.HasSuffix(name, "/"); descriptor != (tc.descriptors && !isDir) {
+				t.Errorf("case %d: expected %s to have a data descriptor: %t, got %t", i, name, tc.descriptors && !isDir, descriptor)
+			}
+		}
+		ensureContents(t, zipfilepath, want)
+		os.Remove(zipfilepath)
+	}
+}
+
+// readZipStream reads the entries of the zip file b from their local headers
+// in order, as a streaming extractor does, without the central directory,
+// returning their content and whether each had a data descriptor.
+func readZipStream(t *testing.T, b []byte) (map[string][]byte, map[string]bool) {
+	t.Helper()
+	r := bytes.NewReader(b)
+	entries := map[string][]byte{}
+	descriptors := map[string]bool{}
+	for {
+		var sig uint32
+		if err := binary.Read(r, binary.LittleEndian, &sig); err != nil || sig != 0x04034b50 {
+			// The central directory follows the last entry.
+			return entries, descriptors
+		}
+		var h struct {
+			ReaderVersion, Flags, Method, ModifiedTime, ModifiedDate uint16
+			CRC32, CompressedSize, UncompressedSize                  uint32
+			NameLen, ExtraLen                                        uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+			t.Fatalf("could not read local header: %s", err)
+		}
+		name := make([]byte, h.NameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			t.Fatalf("could not read entry name: %s", err)
+		}
+		r.Seek(int64(h.ExtraLen), io.SeekCurrent)
+		descriptor := h.Flags&0x8 != 0
+		if descriptor && (h.CRC32 != 0 || h.CompressedSize != 0 || h.UncompressedSize != 0) {
+			t.Errorf("expected %s to have no checksum or sizes in its local header", name)
+		}
+
+		var content []byte
+		var err error
+		switch {
+		case h.Method == zip.Deflate:
+			content, err = ioutil.ReadAll(flate.NewReader(r))
+		case h.Method == zip.Store && !descriptor:
+			content = make([]byte, h.CompressedSize)
+			_, err = io.ReadFull(r, content)
+		default:
+			t.Fatalf("%s can't be streamed with method %d", name, h.Method)
+		}
+		if err != nil {
+			t.Fatalf("could not read %s: %s", name, err)
+		}
+		crc := h.CRC32
+		if descriptor {
+			var fields [4]uint32
+			if err := binary.Read(r, binary.LittleEndian, &fields); err != nil {
+				t.Fatalf("could not read data descriptor of %s: %s", name, err)
+			}
+			if fields[0] != 0x08074b50 {
+				t.Fatalf("expected the data descriptor of %s to have a signature", name)
+			}
+			crc = fields[1]
+			if int(fields[3]) != len(content) {
+				t.Errorf("expected the data descriptor of %s to have size %d, got %d", name, len(content), fields[3])
+			}
+		}
+		if crc != crc32.ChecksumIEEE(content) {
+			t.Errorf("expected %s to have CRC-32 %08x, got %08x", name, crc32.ChecksumIEEE(content), crc)
+		}
+		entries[string(name)] = content
+		descriptors[string(name)] = descriptor
+	}
+}
+
+func TestZipArchiver_ZipCreator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-zip-creator")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "data", "binary.bin"), "binary\x00\x01\x02\xff content")
+	// The modes of new files depend on the umask.
+	if err := os.Chmod(filepath.Join(dir, "data"), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, parallelism := range []int{0, 2} {
+		zipfilepath := "archive-zip-creator.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{
+			ZipCreator:       ZipCreatorInfoZipUnix,
+			CompressionLevel: NoCompression,
+			ModTime:          time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+		})
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{DirEntries: DirEntriesAll, Parallelism: parallelism}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		got, err := ioutil.ReadFile(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not read zip file: %s", err)
+		}
+		want, err := ioutil.ReadFile("./test-fixtures/zip-creator-info-zip-unix.zip")
+		if err != nil {
+			t.Fatalf("could not read golden file: %s", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("archive with parallelism %d differs from the golden file:\ngot  %x\nwant %x", parallelism, got, want)
+		}
+	}
+
+	zipfilepath := "archive-zip-creator-deflate.zip"
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{ZipCreator: ZipCreatorInfoZipUnix})
+	if err := archiver.ArchiveMultiple(map[string][]byte{
+		"content.txt": []byte("This is some content"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r, err := zip.OpenReader(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+	fh := r.File[0].FileHeader
+	if fh.CreatorVersion != ZipCreatorInfoZipUnix || fh.ReaderVersion != 20 || fh.Flags&0x8 != 0 || len(fh.Extra) != 0 {
+		t.Errorf("unexpected header: creator %#x, reader %d, flags %#x, extra %x", fh.CreatorVersion, fh.ReaderVersion, fh.Flags, fh.Extra)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"content.txt": []byte("This is some content"),
+	})
+
+	// Content that doesn't compress below zipSpoolSize is spooled to a
+	// temporary file until its header is written.
+	large := make([]byte, 2*zipSpoolSize)
+	rand.New(rand.NewSource(1)).Read(large)
+	zipfilepath = "archive-zip-creator-large.zip"
+	archiver = NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{ZipCreator: ZipCreatorInfoZipUnix})
+	if err := archiver.ArchiveContent(large, "large.bin"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"large.bin": large,
 	})
+
+	// The size limit stops the entry as it is written, rather than once
+	// it is complete.
+	src := strings.NewReader(strings.Repeat("This is some content", 1024*1024))
+	archiver = NewZipArchiver("archive-zip-creator-max-size.zip")
+	archiver.SetOptions(ArchiveOptions{ZipCreator: ZipCreatorInfoZipUnix, MaxSize: 1024})
+	err = archiver.ArchiveReader(src, "content.txt")
+	if err == nil || !strings.Contains(err.Error(), "maximum size of 1024 bytes") {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+	if read := src.Size() - int64(src.Len()); read > zipSpoolSize {
+		t.Errorf("expected the entry to stop once over the size limit, read %d bytes", read)
+	}
+}
+
+func TestZipArchiver_MaxSize(t *testing.T) {
+	archiver := NewZipArchiver("archive-max-size.zip")
+	archiver.SetOptions(ArchiveOptions{MaxSize: 42})
+	if err := archiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	archiver.SetOptions(ArchiveOptions{MaxSize: 20})
+	err := archiver.ArchiveDir("./test-fixtures/test-dir")
+	if err == nil || !strings.Contains(err.Error(), "maximum size of 20 bytes") || !strings.Contains(err.Error(), "file2.txt") {
+		t.Fatalf("expected size limit error for file2.txt, got %v", err)
+	}
+}
+
+func TestZipArchiver_CompressionZstd(t *testing.T) {
+	content := map[string][]byte{
+		"file1.txt": []byte(strings.Repeat("This is file 1\n", 100)),
+	}
+
+	for _, level := range []int{DefaultCompression, 1, 9} {
+		zipfilepath := fmt.Sprintf("archive-compression-zstd-%d.zip", level)
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{Compression: CompressionZstd, CompressionLevel: level})
+		if err := archiver.ArchiveMultiple(content); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		r.RegisterDecompressor(zipZstd, zstdDecompressor)
+		for _, f := range r.File {
+			if f.Method != zipZstd {
+				t.Errorf("expected %s to use method %d, got %d", f.Name, zipZstd, f.Method)
+			}
+			ensureContent(t, content, f)
+		}
+		r.Close()
+	}
+}
+
+func TestZipArchiver_MinCompressSize(t *testing.T) {
+	dir := tempDir(t, "archive-dir-min-compress-size")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "tiny.txt"), "tiny")
+	writeTestFile(t, filepath.Join(dir, "exact.txt"), "0123456789")
+	writeTestFile(t, filepath.Join(dir, "big.txt"), strings.Repeat("big", 100))
+
+	zipMethods := func(zipfilepath string) map[string]uint16 {
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		defer r.Close()
+		methods := map[string]uint16{}
+		for _, cf := range r.File {
+			methods[cf.Name] = cf.Method
+		}
+		return methods
+	}
+
+	zipfilepath := "archive-dir-min-compress-size.zip"
+	for _, parallelism := range []int{0, 2} {
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{MinCompressSize: 10})
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Parallelism: parallelism}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		want := map[string]uint16{"tiny.txt": zip.Store, "exact.txt": zip.Deflate, "big.txt": zip.Deflate}
+		if got := zipMethods(zipfilepath); !reflect.DeepEqual(got, want) {
+			t.Errorf("parallelism %d: got methods %v, want %v", parallelism, got, want)
+		}
+	}
+
+	archiver := NewZipArchiver(zipfilepath)
+	archiver.SetOptions(ArchiveOptions{MinCompressSize: 10})
+	if err := archiver.ArchiveContent([]byte("tiny"), "tiny.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := zipMethods(zipfilepath)["tiny.txt"]; got != zip.Store {
+		t.Errorf("expected small content to be stored, got method %d", got)
+	}
+	// The size of a reader isn't known until it has been read.
+	if err := archiver.ArchiveReader(strings.NewReader("tiny"), "tiny.txt"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := zipMethods(zipfilepath)["tiny.txt"]; got != zip.Deflate {
+		t.Errorf("expected a reader to be deflated, got method %d", got)
+	}
+}
+
+func TestZipArchiver_ExtensionCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-dir-extension-compression")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	content := map[string][]byte{
+		"app.js":    []byte(strings.Repeat("console.log('This is the app');\n", 100)),
+		"style.CSS": []byte(strings.Repeat("body { color: red; }\n", 100)),
+		"logo.png":  []byte(strings.Repeat("This is the logo\n", 100)),
+		"data.json": []byte(strings.Repeat(`{"data": true}`+"\n", 100)),
+		"notes.txt": []byte(strings.Repeat("These are notes\n", 100)),
+	}
+	for name, data := range content {
+		writeTestFile(t, filepath.Join(dir, name), string(data))
+	}
+
+	// Entries deflated at level 9 are as big as content deflated at level
+	// 9 by compress/flate.
+	var level9 bytes.Buffer
+	fw, _ := flate.NewWriter(&level9, 9)
+	fw.Write(content["app.js"])
+	fw.Close()
+
+	wantMethods := map[string]uint16{
+		"app.js":    zip.Deflate,
+		"style.CSS": zip.Deflate,
+		"logo.png":  zip.Store,
+		"data.json": zipZstd,
+		"notes.txt": zip.Deflate,
+	}
+	for _, tc := range []struct {
+		parallelism int
+		creator     uint16
+	}{{0, 0}, {2, 0}, {0, ZipCreatorInfoZipUnix}} {
+		zipfilepath := "archive-dir-extension-compression.zip"
+		archiver := NewZipArchiver(zipfilepath)
+		archiver.SetOptions(ArchiveOptions{
+			CompressionLevel: 1,
+			StoreExtensions:  []string{".js"},
+			ExtensionCompression: map[string]EntryCompression{
+				".js":   {Level: 9},
+				"css":   {Method: CompressionDeflate, Level: 9},
+				".png":  {Level: NoCompression},
+				".JSON": {Method: CompressionZstd},
+			},
+			ZipCreator: tc.creator,
+		})
+		if err := archiver.ArchiveDirWithOptions(dir, ArchiveDirOptions{Parallelism: tc.parallelism}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		r, err := zip.OpenReader(zipfilepath)
+		if err != nil {
+			t.Fatalf("could not open zip file: %s", err)
+		}
+		r.RegisterDecompressor(zipZstd, zstdDecompressor)
+		for _, f := range r.File {
+			if f.Method != wantMethods[f.Name] {
+				t.Errorf("parallelism %d, creator %#x: expected %s to use method %d, got %d", tc.parallelism, tc.creator, f.Name, wantMethods[f.Name], f.Method)
+			}
+			if f.Name == "app.js" && f.CompressedSize64 != uint64(level9.Len()) {
+				t.Errorf("parallelism %d, creator %#x: expected app.js to be deflated at level 9 to %d bytes, got %d", tc.parallelism, tc.creator, level9.Len(), f.CompressedSize64)
+			}
+			ensureContent(t, content, f)
+		}
+		r.Close()
+	}
+
+	archiver := NewZipArchiver("archive-extension-compression-invalid.zip")
+	for _, compression := range []map[string]EntryCompression{
+		{".js": {Method: "lzma"}},
+		{".js": {Level: 10}},
+		{".": {}},
+		{".js": {}, "JS": {Level: 9}},
+	} {
+		archiver.SetOptions(ArchiveOptions{ExtensionCompression: compression})
+		if err := archiver.ArchiveContent([]byte("This is some content"), "content.js"); err == nil {
+			t.Errorf("expected error for extension compression %v", compression)
+		}
+	}
+}
+
+func TestZipArchiver_CompressionInvalid(t *testing.T) {
+	archiver := NewZipArchiver("archive-compression-invalid.zip")
+	archiver.SetOptions(ArchiveOptions{Compression: "lzma"})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err == nil {
+		t.Fatalf("expected error for invalid compression method")
+	}
+}
+
+func TestZipArchiver_CompressionLevelInvalid(t *testing.T) {
+	archiver := NewZipArchiver("archive-compression-level-invalid.zip")
+	archiver.SetOptions(ArchiveOptions{CompressionLevel: 10})
+	if err := archiver.ArchiveContent([]byte("This is some content"), "content.txt"); err == nil {
+		t.Fatalf("expected error for invalid compression level")
+	}
 }
 
 func TestZipArchiver_Multiple(t *testing.T) {
@@ -61,12 +2377,110 @@ func TestZipArchiver_Multiple(t *testing.T) {
 
 }
 
-func ensureContents(t *testing.T, zipfilepath string, wants map[string][]byte) {
+func zipEntryNames(t *testing.T, zipfilepath string) []string {
+	r, err := zip.OpenReader(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func writeTestFile(t *testing.T, name string, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+}
+
+func TestZipArchiver_ExistingZip(t *testing.T) {
+	dir := tempDir(t, "archive-existing-zip")
+	defer os.RemoveAll(dir)
+	deps := filepath.Join(dir, "deps.zip")
+	lib := []byte(strings.Repeat("module.exports = {};\n", 100))
+	depsArchiver := NewZipArchiver(deps)
+	depsArchiver.SetOptions(ArchiveOptions{CompressionLevel: 9})
+	if err := depsArchiver.ArchiveMultiple(map[string][]byte{"lib/index.js": lib}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	zipfilepath := filepath.Join(dir, "app.zip")
+	archiver := NewZipArchiver(zipfilepath)
+	// The entries are copied compressed as they are, not at this level.
+	archiver.SetOptions(ArchiveOptions{CompressionLevel: NoCompression})
+	if err := archiver.Open(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.AddContent([]byte("app"), "app.js"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := archiver.ArchiveExistingZip(deps, "vendor"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err := archiver.ArchiveExistingZip(deps, "vendor")
+	if err == nil || !strings.Contains(err.Error(), "vendor/lib/index.js") {
+		t.Errorf("expected error for a duplicate entry, got %v", err)
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"app.js":              []byte("app"),
+		"vendor/lib/index.js": lib,
+	})
+
+	src, err := zip.OpenReader(deps)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer src.Close()
 	r, err := zip.OpenReader(zipfilepath)
 	if err != nil {
 		t.Fatalf("could not open zip file: %s", err)
 	}
 	defer r.Close()
+	if got, want := r.File[1].FileHeader, src.File[0].FileHeader; got.Method != want.Method || got.CompressedSize64 != want.CompressedSize64 || got.CRC32 != want.CRC32 {
+		t.Errorf("expected the entry to be copied without being compressed again, got method %d, %d bytes, want method %d, %d bytes", got.Method, got.CompressedSize64, want.Method, want.CompressedSize64)
+	}
+	if entries := archiver.Entries(); len(entries) != 2 || entries[1].Name != "vendor/lib/index.js" || entries[1].Size != int64(len(lib)) {
+		t.Errorf("unexpected entries %v", entries)
+	}
+}
+
+func TestZipArchiver_ExistingZipZstd(t *testing.T) {
+	dir := tempDir(t, "archive-existing-zip-zstd")
+	defer os.RemoveAll(dir)
+	deps := filepath.Join(dir, "deps.zip")
+	depsArchiver := NewZipArchiver(deps)
+	depsArchiver.SetOptions(ArchiveOptions{Compression: CompressionZstd})
+	if err := depsArchiver.ArchiveDir("./test-fixtures/test-dir"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	zipfilepath := filepath.Join(dir, "app.zip")
+	if err := NewZipArchiver(zipfilepath).ArchiveExistingZip(deps, "vendor"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ensureContents(t, zipfilepath, map[string][]byte{
+		"vendor/file1.txt": []byte("This is file 1"),
+		"vendor/file2.txt": []byte("This is file 2"),
+		"vendor/file3.txt": []byte("This is file 3"),
+	})
+}
+
+func ensureContents(t *testing.T, zipfilepath string, wants map[string][]byte) {
+	r, err := openZip(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
 
 	if len(r.File) != len(wants) {
 		t.Errorf("mismatched file count, got %d, want %d", len(r.File), len(wants))
@@ -76,6 +2490,25 @@ func ensureContents(t *testing.T, zipfilepath string, wants map[string][]byte) {
 	}
 }
 
+func ensureFileMode(t *testing.T, zipfilepath string, name string, want os.FileMode) {
+	r, err := zip.OpenReader(zipfilepath)
+	if err != nil {
+		t.Fatalf("could not open zip file: %s", err)
+	}
+	defer r.Close()
+
+	for _, cf := range r.File {
+		if cf.Name != name {
+			continue
+		}
+		if got := cf.Mode(); got != want {
+			t.Errorf("mismatched mode for %s, got %s, want %s", name, got, want)
+		}
+		return
+	}
+	t.Errorf("missing file in zip: %s", name)
+}
+
 func ensureContent(t *testing.T, wants map[string][]byte, got *zip.File) {
 	want, ok := wants[got.Name]
 	if !ok {
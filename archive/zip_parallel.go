@@ -0,0 +1,278 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// zipDefaultLevel is the level archive/zip deflates entries at unless
+// another compressor is registered.
+const zipDefaultLevel = 5
+
+// zipSpoolSize is how much of the compressed content of a queued entry is
+// held in memory before it is spooled to a temporary file.
+const zipSpoolSize = 1024 * 1024
+
+// zipJob is a file being read and compressed while other entries are
+// written, so that it can be stored as raw compressed data.
+type zipJob struct {
+	fh    *zip.FileHeader
+	entry *manifestEntry
+	data  spoolWriter
+	err   error
+	done  chan struct{}
+	// sized is set when the content was added to the archive's size limit
+	// as it was written, by createRawHeader.
+	sized bool
+	// skipped is the reason the file is skipped when it couldn't be read,
+	// as returned by skipReadError, with readErr the error reading it.
+	skipped string
+	readErr error
+	// finish, when set, finishes compressing an entry queued by
+	// createRawHeader once all of its content has been written.
+	finish func() error
+}
+
+// queueFile starts compressing the file at path in the background. At most
+// opts.Parallelism files are queued at once, so the oldest is written to the
+// archive first when there are already that many.
+func (a *ZipArchiver) queueFile(ctx context.Context, path string, fh *zip.FileHeader, opts ArchiveDirOptions) error {
+	for len(a.pending) >= opts.Parallelism {
+		if err := a.writeNextPending(); err != nil {
+			return err
+		}
+	}
+
+	job := &zipJob{fh: fh, entry: newManifestEntry(fh.Name, fh.Mode(), fh.Modified), done: make(chan struct{})}
+	a.pending = append(a.pending, job)
+	go func() {
+		defer close(job.done)
+		job.err = a.compressFile(ctx, path, job, opts)
+	}()
+	return nil
+}
+
+// compressFile reads the file at path into job, compressing it with the
+// method of job's header and filling in the checksum and sizes.
+func (a *ZipArchiver) compressFile(ctx context.Context, path string, job *zipJob, opts ArchiveDirOptions) error {
+	src, err := os.Open(path)
+	if err != nil {
+		if job.skipped = skipReadError(path, err, opts); job.skipped != "" {
+			job.readErr = err
+			return nil
+		}
+		return archiveError("reading file for archival", path, err)
+	}
+	defer src.Close()
+	r, size, err := a.options.transformReader(&contextReader{ctx: ctx, r: src}, int64(job.fh.UncompressedSize64), job.fh.Name)
+	if err != nil {
+		return err
+	}
+	// The method picked for the file's size on disk may not suit the size
+	// of its transformed content.
+	job.fh.Method = a.entryMethod(job.fh.Name, size)
+
+	var n int64
+	if job.fh.Method == zip.Store {
+		n, err = io.Copy(io.MultiWriter(&job.data, job.entry), r)
+	} else {
+		fw, ferr := a.compressor(&job.data, job.fh.Method, a.entryLevel(job.fh.Name))
+		if ferr != nil {
+			return ferr
+		}
+		n, err = io.Copy(io.MultiWriter(fw, job.entry), r)
+		if closeErr := fw.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return archiveError("compressing file for archival", path, err)
+	}
+
+	job.fh.CRC32 = job.entry.crc32.Sum32()
+	job.fh.UncompressedSize64 = uint64(n)
+	job.fh.CompressedSize64 = uint64(job.data.size)
+	return nil
+}
+
+// writeNextPending waits for the oldest queued file and writes it to the
+// archive.
+func (a *ZipArchiver) writeNextPending() error {
+	job := a.pending[0]
+	a.pending = a.pending[1:]
+	<-job.done
+	defer job.data.Close()
+	if job.err != nil {
+		return job.err
+	}
+	if job.skipped != "" {
+		a.skipped.addReadError(job.fh.Name, false, job.skipped, job.readErr)
+		return nil
+	}
+	if job.finish != nil {
+		if err := job.finish(); err != nil {
+			return err
+		}
+	}
+
+	fh := job.fh
+	if err := a.options.checkNameLength(fh.Name); err != nil {
+		return err
+	}
+	isDir := strings.HasSuffix(fh.Name, "/")
+	ok, err := a.names.add(strings.TrimSuffix(fh.Name, "/"), isDir)
+	if err != nil || !ok {
+		return err
+	}
+	if !job.sized {
+		if err := a.size.add(fh.Name, int64(fh.UncompressedSize64)); err != nil {
+			return err
+		}
+	}
+	if err := a.files.add(fh.Name, isDir); err != nil {
+		return err
+	}
+	f, err := a.createRaw(fh)
+	if err != nil {
+		return archiveError("creating file inside archive", fh.Name, err)
+	}
+	a.manifest = append(a.manifest, job.entry)
+	if !isDir {
+		a.progress.add(fh.Name)
+	}
+	_, err = job.data.WriteTo(f)
+	return err
+}
+
+// createRawHeader queues an entry whose content is compressed as it is
+// written, so that its header is written as given once the entry is
+// complete, for ZipCreator. The entry is written to the archive by the next
+// entry or when the archive is closed. Entries are compressed ahead of their
+// header, large ones into a temporary file, so that createRaw can write it
+// with their sizes, rather than archive/zip writing version 2.0, the system
+// picked by SetMode, an extended timestamp and a data descriptor. This
+// matches zip -X byte for byte for stored entries, except for the internal
+// attributes zip uses to mark text files, which archive/zip always writes as
+// zero. Deflated entries differ as zip deflates differently.
+func (a *ZipArchiver) createRawHeader(fh *zip.FileHeader) (io.Writer, error) {
+	job := &zipJob{fh: fh, entry: newManifestEntry(fh.Name, fh.Mode(), fh.Modified), done: make(chan struct{}), sized: true}
+	close(job.done)
+	if strings.HasSuffix(fh.Name, "/") {
+		fh.Method = zip.Store
+	}
+
+	var w io.Writer = &job.data
+	var fw io.WriteCloser
+	if fh.Method != zip.Store {
+		var err error
+		fw, err = a.compressor(&job.data, fh.Method, a.entryLevel(fh.Name))
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	}
+	job.finish = func() error {
+		if fw != nil {
+			if err := fw.Close(); err != nil {
+				return archiveError("compressing file for archival", fh.Name, err)
+			}
+		}
+		fh.CRC32 = job.entry.crc32.Sum32()
+		fh.UncompressedSize64 = uint64(job.entry.Size)
+		fh.CompressedSize64 = uint64(job.data.size)
+		return nil
+	}
+	a.pending = append(a.pending, job)
+	return &limitWriter{w: w, entry: job.entry, limit: &a.size}, nil
+}
+
+// zipReaderVersion returns the lowest "version needed to extract" for an
+// entry compressed with method, as Info-ZIP's zip writes it.
+func zipReaderVersion(method uint16) uint16 {
+	switch method {
+	case zip.Store:
+		return 10
+	case zipZstd:
+		return 63
+	}
+	return 20
+}
+
+// flushPending writes every queued file to the archive.
+func (a *ZipArchiver) flushPending() error {
+	for len(a.pending) > 0 {
+		if err := a.writeNextPending(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardPending waits for any queued files to finish without writing
+// them, after an error has stopped the archive.
+func (a *ZipArchiver) discardPending() {
+	for _, job := range a.pending {
+		<-job.done
+		job.data.Close()
+	}
+	a.pending = nil
+}
+
+// spoolWriter holds the compressed content of a queued entry, in memory up
+// to zipSpoolSize bytes and in a temporary file beyond that, so that large
+// files don't have to fit in memory.
+type spoolWriter struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if w.file == nil && w.buf.Len()+len(p) > zipSpoolSize {
+		f, err := ioutil.TempFile("", "terraform-provider-archive")
+		if err != nil {
+			return 0, fmt.Errorf("error buffering content for archival: %w", err)
+		}
+		w.file = f
+		if _, err := w.buf.WriteTo(f); err != nil {
+			return 0, fmt.Errorf("error buffering content for archival: %w", err)
+		}
+	}
+	var n int
+	var err error
+	if w.file != nil {
+		n, err = w.file.Write(p)
+	} else {
+		n, err = w.buf.Write(p)
+	}
+	w.size += int64(n)
+	return n, err
+}
+
+// WriteTo copies everything written to w to dst.
+func (w *spoolWriter) WriteTo(dst io.Writer) (int64, error) {
+	if w.file == nil {
+		return w.buf.WriteTo(dst)
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error reading buffered content: %w", err)
+	}
+	return io.Copy(dst, w.file)
+}
+
+// Close removes the temporary file, if any.
+func (w *spoolWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	w.file.Close()
+	err := os.Remove(w.file.Name())
+	w.file = nil
+	return err
+}
@@ -0,0 +1,631 @@
+package archive
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// zipSplitSignature starts the first volume of a split zip file.
+	zipSplitSignature = 0x08074b50
+
+	zipLocalHeaderSignature = 0x04034b50
+	zipRecordSignature      = 0x02014b50
+	zipEndSignature         = 0x06054b50
+	zip64EndSignature       = 0x06064b50
+	zip64LocatorSignature   = 0x07064b50
+
+	zipLocalHeaderLen = 30
+	zipRecordLen      = 46
+	zipEndLen         = 22
+	zip64EndLen       = 56
+	zip64LocatorLen   = 20
+
+	zipFlagEncrypted      = 0x1
+	zipFlagDataDescriptor = 0x8
+
+	// zip64ExtraID is the ID of the extra field holding the values that
+	// don't fit in an entry's central directory record.
+	zip64ExtraID = 0x0001
+)
+
+const (
+	// minZipSplitSize is the smallest volume a zip file is split into, as
+	// for zip -s, which leaves room for the headers of any entry.
+	minZipSplitSize = 64 * 1024
+
+	// maxZipSplitSize is the largest volume a zip file is split into, so
+	// that offsets within a volume always fit the central directory.
+	maxZipSplitSize = 1<<32 - 2
+
+	// maxZipVolumes is how many volumes the disk number of the central
+	// directory has room for.
+	maxZipVolumes = 0xffff
+)
+
+// splitZipFile splits the zip file at path into the volumes of a split zip
+// file, as zip -s writes them, of at most size bytes each, returning their
+// paths in order: path with the extension .z01, .z02 and so on, and path
+// itself last, which then holds only the last volume. The first volume starts
+// with the split signature, and each entry and central directory record is
+// located by the volume it starts in and its offset within that volume. Only
+// the content of an entry is split between volumes, never a header, and data
+// descriptors are merged into the local headers where they fit. An
+// archive that fits in a single volume is left as it is. Volumes left over
+// from splitting a bigger archive to the same path are removed.
+func splitZipFile(path string, size int64) (parts []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error splitting archive: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error splitting archive: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("error splitting archive: %s is not a regular file", path)
+	}
+
+	w := &zipVolumeWriter{path: path, size: size}
+	if fi.Size() > size {
+		if err := w.split(f, fi.Size()); err != nil {
+			w.remove()
+			return nil, fmt.Errorf("error splitting archive: %w", err)
+		}
+	}
+	// The last volume replaces the archive, which has to be closed before
+	// then on some platforms.
+	f.Close()
+	if parts, err = w.commit(path); err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for n := len(parts); ; n++ {
+		stale := zipVolumePath(base, n)
+		if err := os.Remove(stale); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return nil, fmt.Errorf("error removing archive volume %s: %w", stale, err)
+		}
+	}
+	return parts, nil
+}
+
+// zipVolumePath returns the path of volume n, counting from 1, of a split
+// zip file other than the last.
+func zipVolumePath(base string, n int) string {
+	return fmt.Sprintf("%s.z%02d", base, n)
+}
+
+// zipVolumeWriter writes the volumes of a split zip file, each to a temporary
+// file next to the archive at path, until they are committed.
+type zipVolumeWriter struct {
+	path string
+	size int64
+	// files are the temporary files of the volumes written, with n bytes
+	// in the last.
+	files []*os.File
+	n     int64
+}
+
+// split writes the zip file r, of size bytes, to volumes.
+func (w *zipVolumeWriter) split(r io.ReaderAt, size int64) error {
+	end, err := readZipEnd(r, size)
+	if err != nil {
+		return err
+	}
+	if end.disk != 0 || end.dirDisk != 0 {
+		return errors.New("archive is already split")
+	}
+	if end.dirOffset+end.dirSize > uint64(size) {
+		return errors.New("invalid central directory")
+	}
+	dir := make([]byte, end.dirSize)
+	if _, err := r.ReadAt(dir, int64(end.dirOffset)); err != nil {
+		return fmt.Errorf("could not read central directory: %w", err)
+	}
+	records, err := readZipRecords(dir, end.records)
+	if err != nil {
+		return err
+	}
+
+	// The entries are written in the order they are in the archive, each
+	// running up to the next, or to the central directory for the last.
+	byOffset := make([]*zipRecord, len(records))
+	copy(byOffset, records)
+	sort.SliceStable(byOffset, func(i, j int) bool { return byOffset[i].offset < byOffset[j].offset })
+	if err := w.record(le32(zipSplitSignature)); err != nil {
+		return err
+	}
+	if len(byOffset) > 0 && byOffset[0].offset > 0 {
+		if err := w.copy(io.NewSectionReader(r, 0, int64(byOffset[0].offset))); err != nil {
+			return err
+		}
+	}
+	for i, rec := range byOffset {
+		next := end.dirOffset
+		if i+1 < len(byOffset) {
+			next = byOffset[i+1].offset
+		}
+		if err := w.entry(r, rec, next); err != nil {
+			return err
+		}
+	}
+
+	disks := make([]uint32, len(records))
+	for i, rec := range records {
+		var offset int64
+		disks[i], offset = w.next(len(rec.b))
+		if i == 0 {
+			end.dirDisk, end.dirOffset = disks[i], uint64(offset)
+		}
+		if err := w.record(rec.b); err != nil {
+			return err
+		}
+	}
+	disk, offset := w.next(end.len())
+	if int(disk) >= maxZipVolumes {
+		return fmt.Errorf("archive needs more than %d volumes", maxZipVolumes)
+	}
+	if len(records) == 0 {
+		end.dirDisk, end.dirOffset = disk, uint64(offset)
+	}
+	end.disk, end.diskRecords = disk, 0
+	for _, d := range disks {
+		if d == disk {
+			end.diskRecords++
+		}
+	}
+	return w.record(end.bytes(uint64(offset)))
+}
+
+// entry writes the local header, content and data descriptor of the entry of
+// rec in r, which runs up to next, to volumes, and sets where it starts in
+// rec.
+func (w *zipVolumeWriter) entry(r io.ReaderAt, rec *zipRecord, next uint64) error {
+	header := make([]byte, zipLocalHeaderLen)
+	if _, err := r.ReadAt(header, int64(rec.offset)); err != nil {
+		return fmt.Errorf("could not read local header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(header) != zipLocalHeaderSignature {
+		return errors.New("invalid local header")
+	}
+	headerLen := uint64(zipLocalHeaderLen) + uint64(binary.LittleEndian.Uint16(header[26:])) + uint64(binary.LittleEndian.Uint16(header[28:]))
+	if rec.offset+headerLen+rec.compressedSize > next {
+		return errors.New("entries overlap")
+	}
+	header = make([]byte, headerLen)
+	if _, err := r.ReadAt(header, int64(rec.offset)); err != nil {
+		return fmt.Errorf("could not read local header: %w", err)
+	}
+	start := int64(rec.offset + headerLen)
+	descriptorLen := next - uint64(start) - rec.compressedSize
+
+	// As zip -s does, the CRC-32 and sizes of the data descriptor are moved
+	// into the local header, which recovering a split zip file relies on,
+	// unless they don't fit or are part of the encryption header.
+	if flags := binary.LittleEndian.Uint16(header[6:]); flags&zipFlagDataDescriptor != 0 && flags&zipFlagEncrypted == 0 && !rec.zip64Sizes {
+		flags &^= zipFlagDataDescriptor
+		binary.LittleEndian.PutUint16(header[6:], flags)
+		binary.LittleEndian.PutUint16(rec.b[8:], flags)
+		copy(header[14:26], rec.b[16:28])
+		descriptorLen = 0
+	}
+
+	disk, offset := w.next(len(header))
+	if int(disk) >= maxZipVolumes {
+		return fmt.Errorf("archive needs more than %d volumes", maxZipVolumes)
+	}
+	rec.setLocation(disk, uint64(offset))
+	if err := w.record(header); err != nil {
+		return err
+	}
+	if err := w.copy(io.NewSectionReader(r, start, int64(rec.compressedSize))); err != nil {
+		return err
+	}
+	// What is left is the data descriptor, if any.
+	descriptor := make([]byte, descriptorLen)
+	if len(descriptor) == 0 {
+		return nil
+	}
+	if _, err := r.ReadAt(descriptor, start+int64(rec.compressedSize)); err != nil {
+		return fmt.Errorf("could not read data descriptor: %w", err)
+	}
+	return w.record(descriptor)
+}
+
+// next returns the volume, counting from 0, and the offset within it that a
+// record of n bytes is written at.
+func (w *zipVolumeWriter) next(n int) (uint32, int64) {
+	if len(w.files) == 0 || w.n+int64(n) > w.size {
+		return uint32(len(w.files)), 0
+	}
+	return uint32(len(w.files) - 1), w.n
+}
+
+// record writes b, which can't be split between volumes, starting a new
+// volume when it doesn't fit in the current one.
+func (w *zipVolumeWriter) record(b []byte) error {
+	if int64(len(b)) > w.size {
+		return fmt.Errorf("header of %d bytes doesn't fit in a volume", len(b))
+	}
+	if len(w.files) == 0 || w.n+int64(len(b)) > w.size {
+		if err := w.create(); err != nil {
+			return err
+		}
+	}
+	return w.write(b)
+}
+
+// copy writes what is read from r to volumes, starting a new volume whenever
+// the current one is full.
+func (w *zipVolumeWriter) copy(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for b := buf[:n]; len(b) > 0; {
+			if len(w.files) == 0 || w.n == w.size {
+				if err := w.create(); err != nil {
+					return err
+				}
+			}
+			chunk := b
+			if int64(len(chunk)) > w.size-w.n {
+				chunk = chunk[:w.size-w.n]
+			}
+			if err := w.write(chunk); err != nil {
+				return err
+			}
+			b = b[len(chunk):]
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write writes b to the current volume.
+func (w *zipVolumeWriter) write(b []byte) error {
+	f := w.files[len(w.files)-1]
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("error writing archive volume: %w", err)
+	}
+	w.n += int64(len(b))
+	return nil
+}
+
+// create starts a new volume.
+func (w *zipVolumeWriter) create() error {
+	if len(w.files) > 0 {
+		if err := w.files[len(w.files)-1].Close(); err != nil {
+			return fmt.Errorf("error writing archive volume: %w", err)
+		}
+	}
+	f, err := createArchiveFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.files = append(w.files, f)
+	w.n = 0
+	return nil
+}
+
+// commit moves the volumes written to their paths, with the last at path,
+// and returns their paths. When no volumes were written, the archive at path
+// is the only one.
+func (w *zipVolumeWriter) commit(path string) ([]string, error) {
+	if len(w.files) == 0 {
+		return []string{path}, nil
+	}
+	if err := w.files[len(w.files)-1].Close(); err != nil {
+		w.remove()
+		return nil, fmt.Errorf("error writing archive volume: %w", err)
+	}
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	parts := make([]string, len(w.files))
+	for i, f := range w.files {
+		parts[i] = zipVolumePath(base, i+1)
+		if i == len(w.files)-1 {
+			parts[i] = path
+		}
+		if err := commitArchiveFile(f.Name(), parts[i], nil); err != nil {
+			w.files = w.files[i+1:]
+			w.remove()
+			return nil, fmt.Errorf("error writing archive volume %s: %w", parts[i], err)
+		}
+	}
+	return parts, nil
+}
+
+// remove removes the temporary files of the volumes written.
+func (w *zipVolumeWriter) remove() {
+	for _, f := range w.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// zipEnd is the end of a zip file: its end of central directory record, with
+// the values of its zip64 end of central directory record when it has one.
+type zipEnd struct {
+	// disk is the volume the end is in, and dirDisk the one the central
+	// directory starts in, at dirOffset within it.
+	disk, dirDisk uint32
+	// records is how many central directory records there are, with
+	// diskRecords of them in the last volume.
+	records, diskRecords uint64
+	dirSize, dirOffset   uint64
+	comment              []byte
+
+	zip64 bool
+	// zip64Versions are the versions made by and needed to extract of the
+	// zip64 record, and zip64Data its extensible data.
+	zip64Versions [4]byte
+	zip64Data     []byte
+}
+
+// readZipEnd reads the end of the zip file r of size bytes, or of the last
+// volume of a split zip file.
+func readZipEnd(r io.ReaderAt, size int64) (*zipEnd, error) {
+	// The end of central directory record is followed only by its comment,
+	// of at most 65535 bytes.
+	n := int64(zipEndLen + 0xffff)
+	if n > size {
+		n = size
+	}
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, size-n); err != nil {
+		return nil, fmt.Errorf("could not read end of central directory: %w", err)
+	}
+	at := -1
+	for i := len(b) - zipEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(b[i:]) == zipEndSignature && i+zipEndLen+int(binary.LittleEndian.Uint16(b[i+20:])) == len(b) {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		return nil, errors.New("no end of central directory")
+	}
+	e := b[at:]
+	end := &zipEnd{
+		disk:        uint32(binary.LittleEndian.Uint16(e[4:])),
+		dirDisk:     uint32(binary.LittleEndian.Uint16(e[6:])),
+		diskRecords: uint64(binary.LittleEndian.Uint16(e[8:])),
+		records:     uint64(binary.LittleEndian.Uint16(e[10:])),
+		dirSize:     uint64(binary.LittleEndian.Uint32(e[12:])),
+		dirOffset:   uint64(binary.LittleEndian.Uint32(e[16:])),
+		comment:     append([]byte(nil), e[zipEndLen:]...),
+	}
+
+	endOffset := size - n + int64(at)
+	if endOffset < zip64LocatorLen {
+		return end, nil
+	}
+	locator := make([]byte, zip64LocatorLen)
+	if _, err := r.ReadAt(locator, endOffset-zip64LocatorLen); err != nil {
+		return nil, fmt.Errorf("could not read zip64 end of central directory locator: %w", err)
+	}
+	if binary.LittleEndian.Uint32(locator) != zip64LocatorSignature {
+		return end, nil
+	}
+	offset := binary.LittleEndian.Uint64(locator[8:])
+	if offset > uint64(endOffset) {
+		return nil, errors.New("invalid zip64 end of central directory locator")
+	}
+	e = make([]byte, uint64(endOffset-zip64LocatorLen)-offset)
+	if _, err := r.ReadAt(e, int64(offset)); err != nil {
+		return nil, fmt.Errorf("could not read zip64 end of central directory: %w", err)
+	}
+	if len(e) < zip64EndLen || binary.LittleEndian.Uint32(e) != zip64EndSignature {
+		return nil, errors.New("invalid zip64 end of central directory")
+	}
+	end.zip64 = true
+	copy(end.zip64Versions[:], e[12:16])
+	end.disk = binary.LittleEndian.Uint32(e[16:])
+	end.dirDisk = binary.LittleEndian.Uint32(e[20:])
+	end.diskRecords = binary.LittleEndian.Uint64(e[24:])
+	end.records = binary.LittleEndian.Uint64(e[32:])
+	end.dirSize = binary.LittleEndian.Uint64(e[40:])
+	end.dirOffset = binary.LittleEndian.Uint64(e[48:])
+	end.zip64Data = append([]byte(nil), e[zip64EndLen:]...)
+	return end, nil
+}
+
+// len returns the length of the end once it is written.
+func (end *zipEnd) len() int {
+	n := zipEndLen + len(end.comment)
+	if end.zip64 {
+		n += zip64EndLen + len(end.zip64Data) + zip64LocatorLen
+	}
+	return n
+}
+
+// bytes returns the end as it is written at offset in its volume.
+func (end *zipEnd) bytes(offset uint64) []byte {
+	var b []byte
+	if end.zip64 {
+		b = append(b, le32(zip64EndSignature)...)
+		b = append(b, le64(uint64(zip64EndLen-12+len(end.zip64Data)))...)
+		b = append(b, end.zip64Versions[:]...)
+		b = append(b, le32(end.disk)...)
+		b = append(b, le32(end.dirDisk)...)
+		b = append(b, le64(end.diskRecords)...)
+		b = append(b, le64(end.records)...)
+		b = append(b, le64(end.dirSize)...)
+		b = append(b, le64(end.dirOffset)...)
+		b = append(b, end.zip64Data...)
+		b = append(b, le32(zip64LocatorSignature)...)
+		b = append(b, le32(end.disk)...)
+		b = append(b, le64(offset)...)
+		b = append(b, le32(end.disk+1)...)
+	}
+	// The zip64 record holds the values that don't fit the end of central
+	// directory record, which then has the maximum value instead.
+	b = append(b, le32(zipEndSignature)...)
+	b = append(b, le16(uint16(end.disk))...)
+	b = append(b, le16(uint16(end.dirDisk))...)
+	b = append(b, le16(uint16(clampUint64(end.diskRecords, 0xffff)))...)
+	b = append(b, le16(uint16(clampUint64(end.records, 0xffff)))...)
+	b = append(b, le32(uint32(clampUint64(end.dirSize, 0xffffffff)))...)
+	b = append(b, le32(uint32(clampUint64(end.dirOffset, 0xffffffff)))...)
+	b = append(b, le16(uint16(len(end.comment)))...)
+	return append(b, end.comment...)
+}
+
+// zipRecord is a central directory record.
+type zipRecord struct {
+	b []byte
+	// offset is where the local header of the entry starts, and
+	// compressedSize is the size of its content.
+	offset, compressedSize uint64
+	// zip64Sizes is set when the sizes of the entry are in the zip64
+	// extra field.
+	zip64Sizes bool
+	// diskAt and offsetAt are where the volume and offset of the local
+	// header are in b, with their sizes, which are bigger when they are in
+	// the zip64 extra field.
+	diskAt, diskLen     int
+	offsetAt, offsetLen int
+}
+
+// readZipRecords reads the n central directory records in dir.
+func readZipRecords(dir []byte, n uint64) ([]*zipRecord, error) {
+	var records []*zipRecord
+	for uint64(len(records)) < n {
+		if len(dir) < zipRecordLen || binary.LittleEndian.Uint32(dir) != zipRecordSignature {
+			return nil, errors.New("invalid central directory record")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(dir[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(dir[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(dir[32:]))
+		recordLen := zipRecordLen + nameLen + extraLen + commentLen
+		if len(dir) < recordLen {
+			return nil, errors.New("invalid central directory record")
+		}
+		rec := &zipRecord{
+			b:              dir[:recordLen],
+			offset:         uint64(binary.LittleEndian.Uint32(dir[42:])),
+			compressedSize: uint64(binary.LittleEndian.Uint32(dir[20:])),
+			zip64Sizes:     binary.LittleEndian.Uint32(dir[20:]) == 0xffffffff || binary.LittleEndian.Uint32(dir[24:]) == 0xffffffff,
+			diskAt:         34,
+			diskLen:        2,
+			offsetAt:       42,
+			offsetLen:      4,
+		}
+		if err := rec.readZip64(zipRecordLen+nameLen, extraLen); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+		dir = dir[recordLen:]
+	}
+	return records, nil
+}
+
+// readZip64 reads the values of the zip64 extra field of rec, if any, from its
+// extra fields of n bytes at i.
+func (rec *zipRecord) readZip64(i, n int) error {
+	for end := i + n; i+4 <= end; {
+		id := binary.LittleEndian.Uint16(rec.b[i:])
+		size := int(binary.LittleEndian.Uint16(rec.b[i+2:]))
+		i += 4
+		if i+size > end {
+			return errors.New("invalid extra field")
+		}
+		if id != zip64ExtraID {
+			i += size
+			continue
+		}
+		// The values are there in this order only when they don't fit
+		// the record itself.
+		field := i
+		next := func(n int) (int, bool) {
+			if field+n > i+size {
+				return 0, false
+			}
+			field += n
+			return field - n, true
+		}
+		var ok bool
+		if binary.LittleEndian.Uint32(rec.b[24:]) == 0xffffffff {
+			if _, ok = next(8); !ok {
+				return errors.New("invalid zip64 extra field")
+			}
+		}
+		if binary.LittleEndian.Uint32(rec.b[20:]) == 0xffffffff {
+			at, ok := next(8)
+			if !ok {
+				return errors.New("invalid zip64 extra field")
+			}
+			rec.compressedSize = binary.LittleEndian.Uint64(rec.b[at:])
+		}
+		if binary.LittleEndian.Uint32(rec.b[42:]) == 0xffffffff {
+			if rec.offsetAt, ok = next(8); !ok {
+				return errors.New("invalid zip64 extra field")
+			}
+			rec.offset = binary.LittleEndian.Uint64(rec.b[rec.offsetAt:])
+			rec.offsetLen = 8
+		}
+		if binary.LittleEndian.Uint16(rec.b[34:]) == 0xffff {
+			if rec.diskAt, ok = next(4); !ok {
+				return errors.New("invalid zip64 extra field")
+			}
+			rec.diskLen = 4
+		}
+		return nil
+	}
+	return nil
+}
+
+// setLocation sets the volume and the offset within it of the local header
+// of rec.
+func (rec *zipRecord) setLocation(disk uint32, offset uint64) {
+	if rec.diskLen == 2 {
+		binary.LittleEndian.PutUint16(rec.b[rec.diskAt:], uint16(disk))
+	} else {
+		binary.LittleEndian.PutUint32(rec.b[rec.diskAt:], disk)
+	}
+	if rec.offsetLen == 4 {
+		binary.LittleEndian.PutUint32(rec.b[rec.offsetAt:], uint32(offset))
+	} else {
+		binary.LittleEndian.PutUint64(rec.b[rec.offsetAt:], offset)
+	}
+}
+
+// clampUint64 returns v, or max when v is bigger.
+func clampUint64(v, max uint64) uint64 {
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
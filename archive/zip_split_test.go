@@ -0,0 +1,242 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitZipFile(t *testing.T) {
+	dir := tempDir(t, "archive-split-zip")
+	defer os.RemoveAll(dir)
+
+	// The random content doesn't compress, so it is split between volumes.
+	content := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.bin", "b.txt", "c.bin"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if name == "b.txt" {
+			w.Write([]byte("small"))
+		} else {
+			w.Write(content)
+		}
+	}
+	zw.SetComment("split")
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	path := filepath.Join(dir, "out.zip")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write archive: %s", err)
+	}
+	parts, err := splitZipFile(path, minZipSplitSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := buf.Len()/minZipSplitSize + 1; len(parts) < n {
+		t.Fatalf("expected at least %d volumes for a %d byte archive, got %v", n, buf.Len(), parts)
+	}
+	for i, part := range parts {
+		want := filepath.Join(dir, fmt.Sprintf("out.z%02d", i+1))
+		if i == len(parts)-1 {
+			want = path
+		}
+		if part != want {
+			t.Errorf("got volume %s, want %s", part, want)
+		}
+		if fi, err := os.Stat(part); err != nil || fi.Size() > minZipSplitSize {
+			t.Errorf("expected volume %s of at most %d bytes: %v", part, minZipSplitSize, err)
+		}
+	}
+	ensureSameZipEntries(t, joinZipVolumes(t, parts), buf.Bytes())
+
+	// An archive that fits in a volume is left as it is, and the volumes
+	// left over are removed.
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write archive: %s", err)
+	}
+	if parts, err := splitZipFile(path, int64(buf.Len())); err != nil || len(parts) != 1 || parts[0] != path {
+		t.Fatalf("expected the archive as the only volume, got %v: %v", parts, err)
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(b, buf.Bytes()) {
+		t.Errorf("expected the archive to be left as it is: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.z01")); !os.IsNotExist(err) {
+		t.Errorf("expected the volumes left over to be removed: %v", err)
+	}
+}
+
+func TestSplitZipFile_Zip64(t *testing.T) {
+	dir := tempDir(t, "archive-split-zip64")
+	defer os.RemoveAll(dir)
+
+	// More entries than the end of central directory record can count
+	// need the zip64 one.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < 0x10000; i++ {
+		if _, err := zw.Create(fmt.Sprintf("%05d", i)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	path := filepath.Join(dir, "out.zip")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write archive: %s", err)
+	}
+	parts, err := splitZipFile(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("expected the archive to be split, got %v", parts)
+	}
+	ensureSameZipEntries(t, joinZipVolumes(t, parts), buf.Bytes())
+}
+
+func TestSplitZipFile_HeaderTooBig(t *testing.T) {
+	dir := tempDir(t, "archive-split-zip-header")
+	defer os.RemoveAll(dir)
+
+	// A comment filling the end of central directory record can't be in
+	// a volume of the smallest size with the rest of it.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("a.bin")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	content := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	w.Write(content)
+	zw.SetComment(string(bytes.Repeat([]byte("x"), 0xffff)))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	path := filepath.Join(dir, "out.zip")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write archive: %s", err)
+	}
+	if _, err := splitZipFile(path, minZipSplitSize); err == nil {
+		t.Fatalf("expected error for a header bigger than a volume")
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(b, buf.Bytes()) {
+		t.Errorf("expected the archive to be left as it is: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("expected no volumes to be left, got %v", files)
+	}
+}
+
+// ensureSameZipEntries checks that the zip file joined from volumes has the
+// entries of the archive it was split from, with the same content, and has
+// no data descriptors.
+func ensureSameZipEntries(t *testing.T, joined, archive []byte) {
+	zr, err := zip.NewReader(bytes.NewReader(joined), int64(len(joined)))
+	if err != nil {
+		t.Fatalf("could not read the joined volumes: %s", err)
+	}
+	want, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err)
+	}
+	if len(zr.File) != len(want.File) || zr.Comment != want.Comment {
+		t.Fatalf("expected %d entries and comment %q, got %d and %q", len(want.File), want.Comment, len(zr.File), zr.Comment)
+	}
+	for i, f := range zr.File {
+		if f.Name != want.File[i].Name || f.CRC32 != want.File[i].CRC32 {
+			t.Fatalf("expected entry %s, got %s", want.File[i].Name, f.Name)
+		}
+		if f.Flags&zipFlagDataDescriptor != 0 {
+			t.Errorf("expected entry %s to have no data descriptor", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("could not open entry %s: %s", f.Name, err)
+		}
+		// Reading the content to the end checks its CRC-32.
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("could not read entry %s: %s", f.Name, err)
+		}
+	}
+}
+
+// joinZipVolumes joins the volumes of a split zip file into the zip file they
+// were split from, as zip -s 0 does, checking the split signature and where
+// each volume says the central directory and its end are.
+func joinZipVolumes(t *testing.T, parts []string) []byte {
+	var joined, last []byte
+	// starts are where each volume starts in the joined archive; offsets
+	// in the first one count the split signature.
+	starts := make([]uint64, len(parts))
+	for i, part := range parts {
+		b, err := ioutil.ReadFile(part)
+		if err != nil {
+			t.Fatalf("could not read volume: %s", err)
+		}
+		last = b
+		if i == 0 {
+			if len(b) < 4 || binary.LittleEndian.Uint32(b) != zipSplitSignature {
+				t.Fatalf("expected volume %s to start with the split signature", part)
+			}
+			b = b[4:]
+		}
+		starts[i] = uint64(len(joined))
+		if i == 0 {
+			starts[i] -= 4
+		}
+		joined = append(joined, b...)
+	}
+
+	// The end is all in the last volume, where the zip64 one is located.
+	end, err := readZipEnd(bytes.NewReader(last), int64(len(last)))
+	if err != nil {
+		t.Fatalf("could not read end of central directory: %s", err)
+	}
+	if int(end.disk) != len(parts)-1 {
+		t.Fatalf("expected the end of central directory in volume %d, got %d", len(parts)-1, end.disk)
+	}
+	dirOffset := starts[end.dirDisk] + end.dirOffset
+	records, err := readZipRecords(joined[dirOffset:dirOffset+end.dirSize], end.records)
+	if err != nil {
+		t.Fatalf("could not read central directory: %s", err)
+	}
+	var diskRecords uint64
+	at := dirOffset
+	for _, rec := range records {
+		if at >= starts[end.disk] {
+			diskRecords++
+		}
+		at += uint64(len(rec.b))
+		disk := uint32(binary.LittleEndian.Uint16(rec.b[rec.diskAt:]))
+		if rec.diskLen == 4 {
+			disk = binary.LittleEndian.Uint32(rec.b[rec.diskAt:])
+		}
+		rec.setLocation(0, starts[disk]+rec.offset)
+	}
+	if end.diskRecords != diskRecords {
+		t.Errorf("expected %d central directory records in the last volume, got %d", diskRecords, end.diskRecords)
+	}
+
+	end.disk, end.dirDisk = 0, 0
+	end.diskRecords, end.dirOffset = end.records, dirOffset
+	return append(joined[:dirOffset+end.dirSize], end.bytes(dirOffset+end.dirSize)...)
+}